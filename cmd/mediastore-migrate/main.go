@@ -0,0 +1,73 @@
+// Command mediastore-migrate copies the objects of a media store to
+// another, e.g., from a MinIO bucket to a GCS bucket.
+//
+// The configurations of both stores are loaded from the environment, with
+// the prefixes provided by the flags. For example, with the default
+// prefixes:
+//
+//	SOURCE_STORE_SERVICE=minio
+//	SOURCE_MINIO_BUCKET_NAME=...
+//	DESTINATION_STORE_SERVICE=gcs
+//	DESTINATION_GCS_BUCKET_NAME=...
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/timemore/foundation/logger"
+	mediastore "github.com/timemore/foundation/media/store"
+	_ "github.com/timemore/foundation/media/store/gcs"
+	_ "github.com/timemore/foundation/media/store/local"
+	_ "github.com/timemore/foundation/media/store/minio"
+	_ "github.com/timemore/foundation/media/store/replicated"
+	_ "github.com/timemore/foundation/media/store/s3"
+)
+
+var log = logger.NewPkgLogger()
+
+func main() {
+	sourceEnvPrefix := flag.String("source-env-prefix", "SOURCE_", "prefix of the environment variables of the source store")
+	destinationEnvPrefix := flag.String("destination-env-prefix", "DESTINATION_", "prefix of the environment variables of the destination store")
+	prefix := flag.String("prefix", "", "migrate only the objects whose key starts with the prefix")
+	checkpointFile := flag.String("checkpoint", "mediastore-migrate.checkpoint", "file to record the progress, the migration resumes from it")
+	dryRun := flag.Bool("dry-run", false, "list the objects which would be copied without copying them")
+	overwrite := flag.Bool("overwrite", false, "copy the objects which already exist at the destination")
+	flag.Parse()
+
+	sourceConfig, err := mediastore.ParseConfigFromEnv(*sourceEnvPrefix)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Source config loading")
+	}
+	destinationConfig, err := mediastore.ParseConfigFromEnv(*destinationEnvPrefix)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Destination config loading")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	result, err := mediastore.Migrate(ctx, sourceConfig, destinationConfig, mediastore.MigrateOptions{
+		Prefix:         *prefix,
+		CheckpointFile: *checkpointFile,
+		DryRun:         *dryRun,
+		Overwrite:      *overwrite,
+		OnObject: func(info mediastore.ObjectInfo, copied bool) {
+			if copied {
+				log.Info().Str("key", info.Key).Int64("size", info.Size).Bool("dry_run", *dryRun).Msg("Copied")
+			} else {
+				log.Debug().Str("key", info.Key).Msg("Skipped, exists at the destination")
+			}
+		},
+	})
+	if result != nil {
+		log.Info().Int("copied", result.Copied).Int("skipped", result.Skipped).
+			Int64("bytes", result.Bytes).Bool("dry_run", *dryRun).Msg("Migration summary")
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("Migration")
+	}
+}
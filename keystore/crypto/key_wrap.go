@@ -0,0 +1,108 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+
+	"github.com/timemore/foundation/errors"
+)
+
+var ErrKeyUnwrap = errors.New("key could not be unwrapped")
+
+// KeyEncryptionKey wraps the keys used to encrypt data, so that the data
+// keys could be stored along with the data they encrypt.
+type KeyEncryptionKey interface {
+	// ID identifies the key. It's stored along with the wrapped keys to
+	// find the key which unwraps them after the key has been rotated.
+	ID() string
+	WrapKey(dataKey []byte) ([]byte, error)
+	UnwrapKey(wrappedKey []byte) ([]byte, error)
+}
+
+// NewAESKeyEncryptionKey returns a key encryption key which wraps with
+// AES-GCM. The key must be 16, 24 or 32 bytes long.
+func NewAESKeyEncryptionKey(id string, key []byte) (KeyEncryptionKey, error) {
+	if id == "" {
+		return nil, errors.ArgMsg("id", "empty")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap("cipher.NewGCM", err)
+	}
+	return &aesKeyEncryptionKey{id: id, aead: aead}, nil
+}
+
+type aesKeyEncryptionKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+var _ KeyEncryptionKey = &aesKeyEncryptionKey{}
+
+func (k *aesKeyEncryptionKey) ID() string { return k.id }
+
+// WrapKey returns the random nonce followed by the sealed key.
+func (k *aesKeyEncryptionKey) WrapKey(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize(), k.aead.NonceSize()+len(dataKey)+k.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap("generate nonce", err)
+	}
+	return k.aead.Seal(nonce, nonce, dataKey, []byte(k.id)), nil
+}
+
+func (k *aesKeyEncryptionKey) UnwrapKey(wrappedKey []byte) ([]byte, error) {
+	if len(wrappedKey) < k.aead.NonceSize() {
+		return nil, ErrKeyUnwrap
+	}
+	nonce, sealed := wrappedKey[:k.aead.NonceSize()], wrappedKey[k.aead.NonceSize():]
+	dataKey, err := k.aead.Open(nil, nonce, sealed, []byte(k.id))
+	if err != nil {
+		return nil, ErrKeyUnwrap
+	}
+	return dataKey, nil
+}
+
+// NewRSAKeyEncryptionKey returns a key encryption key which wraps with
+// RSA-OAEP and SHA-256. The key could be parsed with
+// ParseRSAPrivateKeyFromPEM.
+func NewRSAKeyEncryptionKey(id string, key *rsa.PrivateKey) (KeyEncryptionKey, error) {
+	if id == "" {
+		return nil, errors.ArgMsg("id", "empty")
+	}
+	if key == nil {
+		return nil, ErrInvalidKey
+	}
+	return &rsaKeyEncryptionKey{id: id, key: key}, nil
+}
+
+type rsaKeyEncryptionKey struct {
+	id  string
+	key *rsa.PrivateKey
+}
+
+var _ KeyEncryptionKey = &rsaKeyEncryptionKey{}
+
+func (k *rsaKeyEncryptionKey) ID() string { return k.id }
+
+func (k *rsaKeyEncryptionKey) WrapKey(dataKey []byte) ([]byte, error) {
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &k.key.PublicKey, dataKey, []byte(k.id))
+	if err != nil {
+		return nil, errors.Wrap("rsa.EncryptOAEP", err)
+	}
+	return wrappedKey, nil
+}
+
+func (k *rsaKeyEncryptionKey) UnwrapKey(wrappedKey []byte) ([]byte, error) {
+	dataKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, k.key, wrappedKey, []byte(k.id))
+	if err != nil {
+		return nil, ErrKeyUnwrap
+	}
+	return dataKey, nil
+}
@@ -0,0 +1,180 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/timemore/foundation/errors"
+)
+
+// AdaptLegacyService wraps a Service so that it could be used where a
+// ServiceV2 is required. The legacy service is not able to observe the
+// context once a call has started, the context is only checked before
+// delegating the call.
+func AdaptLegacyService(svc Service) ServiceV2 {
+	if svc == nil {
+		return nil
+	}
+	if v, ok := svc.(*legacyService); ok {
+		return v.svc
+	}
+	return &legacyServiceAdapter{svc: svc}
+}
+
+type legacyServiceAdapter struct {
+	svc Service
+}
+
+var _ ServiceV2 = &legacyServiceAdapter{}
+
+// PutObject of the legacy service is not able to store the attributes,
+// the options are ignored.
+func (a *legacyServiceAdapter) PutObject(
+	ctx context.Context,
+	objectKey string,
+	content io.Reader,
+	opts PutObjectOptions,
+) (*UploadInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.svc.PutObject(objectKey, content)
+}
+
+func (a *legacyServiceAdapter) GetObject(
+	ctx context.Context,
+	objectKey string,
+) (*ObjectReader, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	buf, err := a.svc.GetObject(objectKey)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectReader{
+		ReadCloser: io.NopCloser(buf),
+		Info: ObjectInfo{
+			Key:  objectKey,
+			Size: int64(buf.Len()),
+		},
+	}, nil
+}
+
+// GetObjectRange of the legacy service downloads the whole object, only
+// the range is returned.
+func (a *legacyServiceAdapter) GetObjectRange(
+	ctx context.Context,
+	objectKey string,
+	offset, length int64,
+) (*ObjectReader, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	buf, err := a.svc.GetObject(objectKey)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(buf.Len())
+	length, err = ResolveRange(size, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectReader{
+		ReadCloser: io.NopCloser(bytes.NewReader(buf.Bytes()[offset : offset+length])),
+		Info: ObjectInfo{
+			Key:  objectKey,
+			Size: size,
+		},
+	}, nil
+}
+
+// GetPublicObject of the legacy service is not able to apply the options,
+// they are ignored.
+func (a *legacyServiceAdapter) GetPublicObject(
+	ctx context.Context,
+	objectKey string,
+	opts PublicURLOptions,
+) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return a.svc.GetPublicObject(objectKey)
+}
+
+func (a *legacyServiceAdapter) ListObjects(
+	ctx context.Context,
+	prefix string,
+	pageToken string,
+	limit int,
+) (*ObjectList, error) {
+	return nil, errors.ErrUnimplemented
+}
+
+func (a *legacyServiceAdapter) DeleteObject(ctx context.Context, objectKey string) error {
+	return errors.ErrUnimplemented
+}
+
+func (a *legacyServiceAdapter) StatObject(ctx context.Context, objectKey string) (*ObjectInfo, error) {
+	return nil, errors.ErrUnimplemented
+}
+
+// LegacyService wraps a ServiceV2 so that it could be used by the code
+// which still expects a Service. All the calls are made with
+// context.Background and downloaded objects are buffered in memory.
+func LegacyService(svc ServiceV2) Service {
+	if svc == nil {
+		return nil
+	}
+	if v, ok := svc.(*legacyServiceAdapter); ok {
+		return v.svc
+	}
+	return &legacyService{svc: svc}
+}
+
+type legacyService struct {
+	svc ServiceV2
+}
+
+var _ Service = &legacyService{}
+
+func (s *legacyService) PutObject(objectKey string, content io.Reader) (*UploadInfo, error) {
+	return s.svc.PutObject(context.Background(), objectKey, content, PutObjectOptions{})
+}
+
+func (s *legacyService) GetObject(objectKey string) (*bytes.Buffer, error) {
+	stream, err := s.svc.GetObject(context.Background(), objectKey)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	buf := new(bytes.Buffer)
+	if _, err = buf.ReadFrom(stream); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (s *legacyService) GetPublicObject(objectKey string) (string, error) {
+	return s.svc.GetPublicObject(context.Background(), objectKey, PublicURLOptions{})
+}
+
+// ContextReader returns a reader which stops reading from r once ctx is
+// done. This is useful for backends which copy the content themselves.
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"path"
+	"strings"
+
+	"github.com/timemore/foundation/errors"
+)
+
+// BasePath is a key prefix within a bucket under which a service keeps
+// its objects. Service implementations use it to translate between the
+// keys their callers use and the keys of the objects in the bucket.
+type BasePath string
+
+// ObjectKey resolves a key relative to the base path into the key of
+// the object in the bucket. The keys which resolve outside of the base
+// path, e.g., "../other/key", are rejected with an argument error.
+func (basePath BasePath) ObjectKey(key string) (string, error) {
+	objectKey := basePath.join(key)
+	root := basePath.join("")
+	if objectKey == ".." || strings.HasPrefix(objectKey, "../") ||
+		(root != "" && objectKey != root && !strings.HasPrefix(objectKey, root+"/")) {
+		return "", errors.ArgMsg("objectKey", "outside of the base path")
+	}
+	return objectKey, nil
+}
+
+// PrefixKey is like ObjectKey but keeps the trailing slash of prefix so
+// that it could be used to list objects in a "directory".
+func (basePath BasePath) PrefixKey(prefix string) (string, error) {
+	prefixKey, err := basePath.ObjectKey(prefix)
+	if err != nil {
+		return "", errors.ArgMsg("prefix", "outside of the base path")
+	}
+	if basePath.isRoot() {
+		return prefix, nil
+	}
+	if prefix == "" || strings.HasSuffix(prefix, "/") {
+		return prefixKey + "/", nil
+	}
+	return prefixKey, nil
+}
+
+// RelativeKey is the inverse of ObjectKey.
+func (basePath BasePath) RelativeKey(objectKey string) string {
+	if basePath.isRoot() {
+		return objectKey
+	}
+	return strings.TrimPrefix(objectKey, basePath.join("")+"/")
+}
+
+func (basePath BasePath) join(key string) string {
+	if basePath != "" {
+		key = path.Join(string(basePath), key)
+	}
+	key = path.Clean(key)
+	if key == "." {
+		return ""
+	}
+	return strings.TrimPrefix(key, "/")
+}
+
+func (basePath BasePath) isRoot() bool {
+	return basePath.join("") == ""
+}
@@ -0,0 +1,64 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+func TestBasePath(t *testing.T) {
+	testCases := []struct {
+		name      string
+		basePath  mediastore.BasePath
+		key       string
+		objectKey string
+		prefixKey string
+		escapes   bool
+	}{
+		{name: "root", key: "a/b", objectKey: "a/b", prefixKey: "a/b"},
+		{name: "root directory", key: "a/", objectKey: "a", prefixKey: "a/"},
+		{name: "base", basePath: "/base/", key: "a/b", objectKey: "base/a/b", prefixKey: "base/a/b"},
+		{name: "base directory", basePath: "base", key: "a/", objectKey: "base/a", prefixKey: "base/a/"},
+		{name: "base itself", basePath: "base", key: "", objectKey: "base", prefixKey: "base/"},
+		{name: "dot segments within", basePath: "base", key: "a/../b", objectKey: "base/b", prefixKey: "base/b"},
+		{name: "rooted key", basePath: "base", key: "/a", objectKey: "base/a", prefixKey: "base/a"},
+		{name: "dots in a name", basePath: "base", key: "..b", objectKey: "base/..b", prefixKey: "base/..b"},
+		{name: "parent", basePath: "base", key: "..", escapes: true},
+		{name: "sibling", basePath: "base", key: "../other/x", escapes: true},
+		{name: "sibling through a directory", basePath: "base", key: "a/../../other/x", escapes: true},
+		{name: "rooted sibling", basePath: "base", key: "/../other/x", escapes: true},
+		{name: "sibling with the same prefix", basePath: "base", key: "../base2/x", escapes: true},
+		{name: "sibling of the root", key: "../x", escapes: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			objectKey, err := tc.basePath.ObjectKey(tc.key)
+			prefixKey, prefixErr := tc.basePath.PrefixKey(tc.key)
+			if tc.escapes {
+				var argErr errors.ArgumentError
+				if !errors.As(err, &argErr) || argErr.ArgumentName() != "objectKey" {
+					t.Errorf("ObjectKey: got %q, %v, want an argument error", objectKey, err)
+				}
+				if !errors.As(prefixErr, &argErr) || argErr.ArgumentName() != "prefix" {
+					t.Errorf("PrefixKey: got %q, %v, want an argument error", prefixKey, prefixErr)
+				}
+				return
+			}
+			if err != nil || prefixErr != nil {
+				t.Fatal(err, prefixErr)
+			}
+			if objectKey != tc.objectKey {
+				t.Errorf("ObjectKey: got %q, want %q", objectKey, tc.objectKey)
+			}
+			if prefixKey != tc.prefixKey {
+				t.Errorf("PrefixKey: got %q, want %q", prefixKey, tc.prefixKey)
+			}
+			if tc.key != "" {
+				if relKey := tc.basePath.RelativeKey(objectKey); relKey != objectKey[len(objectKey)-len(relKey):] {
+					t.Errorf("RelativeKey: got %q", relKey)
+				}
+			}
+		})
+	}
+}
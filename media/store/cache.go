@@ -0,0 +1,561 @@
+package store
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+)
+
+// CacheConfig configures the read-through cache of the downloads. The
+// cache is disabled if both MaxMemoryBytes and DiskDirectory are empty.
+type CacheConfig struct {
+	// MaxMemoryBytes is the total size of the objects kept in memory.
+	MaxMemoryBytes int64 `env:"MAX_MEMORY_BYTES" yaml:"max_memory_bytes" json:"max_memory_bytes"`
+
+	// DiskDirectory is the directory of the on-disk tier, which keeps
+	// the objects evicted from memory, and those too large for it. The
+	// files are kept in its subdirectory named by CacheDiskSubdirectory,
+	// which is owned by the cache: whatever a previous process left in it
+	// is removed when the service is created.
+	DiskDirectory string `env:"DISK_DIRECTORY" yaml:"disk_directory" json:"disk_directory"`
+	// MaxDiskBytes is the total size of the objects kept on disk.
+	MaxDiskBytes int64 `env:"MAX_DISK_BYTES" yaml:"max_disk_bytes" json:"max_disk_bytes"`
+
+	// MaxObjectBytes is the size of the largest object which could be
+	// cached. Larger objects are streamed from the storage.
+	// CacheMaxObjectBytesDefault is used if it's not positive.
+	MaxObjectBytes int64 `env:"MAX_OBJECT_BYTES" yaml:"max_object_bytes" json:"max_object_bytes"`
+
+	// TTL is how long a cached object is served without checking
+	// its ETag against the storage. If it's zero, the ETag is checked
+	// on every download.
+	TTL time.Duration `env:"TTL" yaml:"ttl" json:"ttl"`
+}
+
+// Enabled returns true if the config enables any tier of the cache.
+func (cfg CacheConfig) Enabled() bool {
+	return cfg.MaxMemoryBytes > 0 || cfg.DiskDirectory != ""
+}
+
+const CacheMaxObjectBytesDefault = 1024 * 1024
+
+// CacheDiskSubdirectory is the subdirectory of CacheConfig.DiskDirectory
+// where the files of the on-disk tier are kept.
+const CacheDiskSubdirectory = "mediastore-cache"
+
+// cacheFileSuffix is the suffix of the files of the on-disk tier.
+const cacheFileSuffix = ".cache"
+
+// NewCachingService wraps the service with a read-through cache of
+// GetObject. The cached objects are identified by their key and ETag, and
+// the writes made through the returned service invalidate them.
+func NewCachingService(svc ServiceV2, config CacheConfig) (ServiceV2, error) {
+	if svc == nil {
+		return nil, errors.ArgMsg("svc", "missing")
+	}
+	if config.MaxMemoryBytes < 0 {
+		return nil, errors.ArgMsg("config.MaxMemoryBytes", "negative")
+	}
+	if config.TTL < 0 {
+		return nil, errors.ArgMsg("config.TTL", "negative")
+	}
+	if config.DiskDirectory != "" && config.MaxDiskBytes <= 0 {
+		return nil, errors.ArgMsg("config.MaxDiskBytes", "required by config.DiskDirectory")
+	}
+	maxObjectBytes := config.MaxObjectBytes
+	if maxObjectBytes <= 0 {
+		maxObjectBytes = CacheMaxObjectBytesDefault
+	}
+
+	var diskDirectory string
+	if config.DiskDirectory != "" {
+		diskDirectory = filepath.Join(config.DiskDirectory, CacheDiskSubdirectory)
+		// The index of the on-disk tier is not persisted, the files left
+		// by a previous process are unknown to it.
+		if err := os.RemoveAll(diskDirectory); err != nil {
+			return nil, errors.Wrap("remove stale cache files", err)
+		}
+		if err := os.MkdirAll(diskDirectory, 0755); err != nil {
+			return nil, errors.Wrap("create cache directory", err)
+		}
+	}
+
+	c := &cachingService{
+		ServiceV2:      svc,
+		ttl:            config.TTL,
+		maxObjectBytes: maxObjectBytes,
+		diskDirectory:  diskDirectory,
+		fills:          map[string]*cacheFill{},
+	}
+	c.memory = newLRUCache(config.MaxMemoryBytes, nil)
+	c.disk = newLRUCache(config.MaxDiskBytes, func(obj *cachedObject) {
+		_ = os.Remove(obj.fileName)
+	})
+	return c, nil
+}
+
+// cachingService embeds the service so that the calls which are not
+// cached are forwarded as they are.
+type cachingService struct {
+	ServiceV2
+
+	ttl            time.Duration
+	maxObjectBytes int64
+	diskDirectory  string
+
+	mu     sync.Mutex
+	memory *lruCache
+	disk   *lruCache
+	fills  map[string]*cacheFill
+}
+
+// cacheFill tracks the downloads of an object which are in progress to
+// fill the cache. The generation is incremented by the invalidations of
+// the object, the downloads started before are not cached.
+type cacheFill struct {
+	downloads  int
+	generation uint64
+}
+
+var (
+	_ ServiceV2         = &cachingService{}
+	_ Copier            = &cachingService{}
+	_ Presigner         = &cachingService{}
+	_ MultipartUploader = &cachingService{}
+	_ HealthChecker     = &cachingService{}
+)
+
+// cachedObject is an object kept by a tier. The memory tier keeps the
+// content in data, the on-disk tier keeps it in the file fileName, whose
+// content is checked against sum before it's promoted to memory.
+type cachedObject struct {
+	info     ObjectInfo
+	expires  time.Time
+	data     []byte
+	fileName string
+	sum      [sha256.Size]byte
+}
+
+func (c *cachingService) GetObject(ctx context.Context, objectKey string) (*ObjectReader, error) {
+	cached := c.lookup(objectKey)
+	if cached != nil && time.Now().After(cached.expires) {
+		info, err := c.ServiceV2.StatObject(ctx, objectKey)
+		if err != nil {
+			if errors.Is(err, ErrObjectNotFound) {
+				c.invalidate(objectKey)
+			}
+			return nil, err
+		}
+		if info.ETag != "" && info.ETag == cached.info.ETag {
+			c.touch(objectKey, time.Now().Add(c.ttl))
+		} else {
+			c.invalidate(objectKey)
+			cached = nil
+		}
+	}
+	if cached != nil {
+		if obj := c.open(objectKey, cached); obj != nil {
+			return obj, nil
+		}
+	}
+
+	generation := c.beginFill(objectKey)
+	defer c.endFill(objectKey)
+	obj, err := c.ServiceV2.GetObject(ctx, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Info.ETag == "" || obj.Info.Size > c.maxObjectBytes {
+		return obj, nil
+	}
+
+	// The size in the info might be unknown, the read is bounded
+	// nonetheless. The objects larger than expected are not cached.
+	data, err := io.ReadAll(io.LimitReader(obj, c.maxObjectBytes+1))
+	if err != nil {
+		_ = obj.Close()
+		return nil, errors.Wrap("read object", err)
+	}
+	if int64(len(data)) > c.maxObjectBytes {
+		obj.ReadCloser = readCloser{io.MultiReader(bytes.NewReader(data), obj.ReadCloser), obj.ReadCloser}
+		return obj, nil
+	}
+	_ = obj.Close()
+	c.store(objectKey, generation, obj.Info, data)
+
+	return &ObjectReader{
+		ReadCloser: io.NopCloser(bytes.NewReader(data)),
+		Info:       cloneObjectInfo(obj.Info),
+	}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// lookup returns a copy of the object from the memory tier or, if it's
+// not there, from the on-disk tier.
+func (c *cachingService) lookup(objectKey string) *cachedObject {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	obj := c.memory.get(objectKey)
+	if obj == nil {
+		obj = c.disk.get(objectKey)
+	}
+	if obj == nil {
+		return nil
+	}
+	cached := *obj
+	return &cached
+}
+
+func (c *cachingService) touch(objectKey string, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if obj := c.memory.get(objectKey); obj != nil {
+		obj.expires = expires
+	}
+	if obj := c.disk.get(objectKey); obj != nil {
+		obj.expires = expires
+	}
+}
+
+func (c *cachingService) invalidate(objectKeys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, objectKey := range objectKeys {
+		c.memory.remove(objectKey)
+		c.disk.remove(objectKey)
+		if fill := c.fills[objectKey]; fill != nil {
+			fill.generation++
+		}
+	}
+}
+
+// beginFill registers a download of the object, which might fill the
+// cache, and returns the generation to pass to store.
+func (c *cachingService) beginFill(objectKey string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fill := c.fills[objectKey]
+	if fill == nil {
+		fill = &cacheFill{}
+		c.fills[objectKey] = fill
+	}
+	fill.downloads++
+	return fill.generation
+}
+
+func (c *cachingService) endFill(objectKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if fill := c.fills[objectKey]; fill != nil {
+		if fill.downloads--; fill.downloads == 0 {
+			delete(c.fills, objectKey)
+		}
+	}
+}
+
+// isCurrent returns true if the object was not invalidated since the
+// download of the generation began. The caller must hold mu.
+func (c *cachingService) isCurrent(objectKey string, generation uint64) bool {
+	fill := c.fills[objectKey]
+	return fill != nil && fill.generation == generation
+}
+
+// open returns a reader of the cached content. The content of the
+// on-disk tier is promoted to the memory tier if it fits and it's still
+// the content which was stored. It returns nil if the file of the on-disk
+// tier is gone or it was modified.
+func (c *cachingService) open(objectKey string, cached *cachedObject) *ObjectReader {
+	if cached.fileName == "" {
+		return &ObjectReader{
+			ReadCloser: io.NopCloser(bytes.NewReader(cached.data)),
+			Info:       cloneObjectInfo(cached.info),
+		}
+	}
+
+	if c.memory.fits(cached.info.Size) {
+		data, err := os.ReadFile(cached.fileName)
+		if err != nil {
+			return nil
+		}
+		if int64(len(data)) != cached.info.Size || sha256.Sum256(data) != cached.sum {
+			c.discardFile(objectKey, cached)
+			return nil
+		}
+		c.mu.Lock()
+		// The entry might have been invalidated, or replaced by another
+		// version, while the file was read.
+		if current := c.disk.get(objectKey); current != nil && current.fileName == cached.fileName &&
+			current.info.ETag == cached.info.ETag {
+			c.memory.put(objectKey, cached.info.Size, &cachedObject{
+				info: cached.info, expires: cached.expires, data: data,
+			})
+		}
+		c.mu.Unlock()
+		return &ObjectReader{
+			ReadCloser: io.NopCloser(bytes.NewReader(data)),
+			Info:       cloneObjectInfo(cached.info),
+		}
+	}
+
+	// The file could be removed once it's opened, the content stays
+	// readable until it's closed.
+	f, err := os.Open(cached.fileName)
+	if err != nil {
+		return nil
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() != cached.info.Size {
+		_ = f.Close()
+		c.discardFile(objectKey, cached)
+		return nil
+	}
+	return &ObjectReader{ReadCloser: f, Info: cloneObjectInfo(cached.info)}
+}
+
+// discardFile removes the entry of the on-disk tier, along with its file,
+// if it's still the cached one.
+func (c *cachingService) discardFile(objectKey string, cached *cachedObject) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if current := c.disk.get(objectKey); current != nil && current.fileName == cached.fileName {
+		c.disk.remove(objectKey)
+	}
+}
+
+// store keeps the object in the memory tier and in the on-disk tier,
+// where it stays after it's evicted from memory. The object is not stored
+// if it was invalidated since the download of the generation began, as
+// the content might be older than the write which invalidated it.
+func (c *cachingService) store(objectKey string, generation uint64, info ObjectInfo, data []byte) {
+	size := int64(len(data))
+	expires := time.Now().Add(c.ttl)
+	info = cloneObjectInfo(info)
+	info.Size = size
+
+	if c.memory.fits(size) {
+		c.mu.Lock()
+		if c.isCurrent(objectKey, generation) {
+			c.memory.put(objectKey, size, &cachedObject{info: info, expires: expires, data: data})
+		}
+		c.mu.Unlock()
+	}
+	if c.diskDirectory == "" || !c.disk.fits(size) {
+		return
+	}
+
+	// The concurrent misses of an object write the same file, each
+	// through its own temporary file.
+	fileName := c.diskFileName(objectKey, info.ETag)
+	tempFile, err := os.CreateTemp(c.diskDirectory, filepath.Base(fileName)+".tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = tempFile.Write(data)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), fileName)
+	}
+	if err != nil {
+		_ = os.Remove(tempFile.Name())
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.isCurrent(objectKey, generation) {
+		// The file is not referenced by the entry which replaced it, if
+		// any, as it's named after another ETag.
+		if current := c.disk.get(objectKey); current == nil || current.fileName != fileName {
+			_ = os.Remove(fileName)
+		}
+		return
+	}
+	c.disk.put(objectKey, size, &cachedObject{
+		info: info, expires: expires, fileName: fileName, sum: sha256.Sum256(data),
+	})
+}
+
+// diskFileName derives the name of the file from the key and the ETag so
+// that a newer version of the object never overwrites a file being read.
+func (c *cachingService) diskFileName(objectKey, etag string) string {
+	sum := sha256.Sum256([]byte(objectKey + "\x00" + etag))
+	return filepath.Join(c.diskDirectory, hex.EncodeToString(sum[:])+cacheFileSuffix)
+}
+
+func (c *cachingService) PutObject(
+	ctx context.Context,
+	objectKey string,
+	content io.Reader,
+	opts PutObjectOptions,
+) (*UploadInfo, error) {
+	defer c.invalidate(objectKey)
+	return c.ServiceV2.PutObject(ctx, objectKey, content, opts)
+}
+
+func (c *cachingService) DeleteObject(ctx context.Context, objectKey string) error {
+	defer c.invalidate(objectKey)
+	return c.ServiceV2.DeleteObject(ctx, objectKey)
+}
+
+func (c *cachingService) CopyObject(ctx context.Context, srcKey, dstKey string) error {
+	defer c.invalidate(dstKey)
+	return CopyObject(ctx, c.ServiceV2, srcKey, dstKey)
+}
+
+func (c *cachingService) MoveObject(ctx context.Context, srcKey, dstKey string) error {
+	defer c.invalidate(srcKey, dstKey)
+	return MoveObject(ctx, c.ServiceV2, srcKey, dstKey)
+}
+
+func (c *cachingService) PresignPutObject(
+	ctx context.Context,
+	objectKey string,
+	opts PresignPutOptions,
+) (*PresignedRequest, error) {
+	return PresignPutObject(ctx, c.ServiceV2, objectKey, opts)
+}
+
+func (c *cachingService) InitiateUpload(ctx context.Context, objectKey string, opts PutObjectOptions) (string, error) {
+	uploader, err := GetMultipartUploader(c.ServiceV2)
+	if err != nil {
+		return "", err
+	}
+	return uploader.InitiateUpload(ctx, objectKey, opts)
+}
+
+func (c *cachingService) UploadPart(
+	ctx context.Context,
+	objectKey, uploadID string,
+	partNumber int,
+	content io.Reader,
+	size int64,
+) (*UploadPart, error) {
+	uploader, err := GetMultipartUploader(c.ServiceV2)
+	if err != nil {
+		return nil, err
+	}
+	return uploader.UploadPart(ctx, objectKey, uploadID, partNumber, content, size)
+}
+
+func (c *cachingService) ListUploadParts(ctx context.Context, objectKey, uploadID string) ([]UploadPart, error) {
+	uploader, err := GetMultipartUploader(c.ServiceV2)
+	if err != nil {
+		return nil, err
+	}
+	return uploader.ListUploadParts(ctx, objectKey, uploadID)
+}
+
+func (c *cachingService) CompleteUpload(ctx context.Context, objectKey, uploadID string) (*UploadInfo, error) {
+	uploader, err := GetMultipartUploader(c.ServiceV2)
+	if err != nil {
+		return nil, err
+	}
+	defer c.invalidate(objectKey)
+	return uploader.CompleteUpload(ctx, objectKey, uploadID)
+}
+
+func (c *cachingService) AbortUpload(ctx context.Context, objectKey, uploadID string) error {
+	uploader, err := GetMultipartUploader(c.ServiceV2)
+	if err != nil {
+		return err
+	}
+	return uploader.AbortUpload(ctx, objectKey, uploadID)
+}
+
+func (c *cachingService) ListUploads(ctx context.Context, prefix string) ([]UploadSession, error) {
+	uploader, err := GetMultipartUploader(c.ServiceV2)
+	if err != nil {
+		return nil, err
+	}
+	return uploader.ListUploads(ctx, prefix)
+}
+
+func (c *cachingService) HealthCheck(ctx context.Context) error {
+	return HealthCheck(ctx, c.ServiceV2)
+}
+
+func cloneObjectInfo(info ObjectInfo) ObjectInfo {
+	info.Metadata = NormalizeMetadata(info.Metadata)
+	return info
+}
+
+// lruCache keeps the objects up to a total size, evicting the least
+// recently used ones. It's not safe for concurrent use.
+type lruCache struct {
+	maxSize int64
+	size    int64
+	order   *list.List
+	items   map[string]*list.Element
+	onEvict func(*cachedObject)
+}
+
+type lruItem struct {
+	key  string
+	size int64
+	obj  *cachedObject
+}
+
+func newLRUCache(maxSize int64, onEvict func(*cachedObject)) *lruCache {
+	return &lruCache{
+		maxSize: maxSize,
+		order:   list.New(),
+		items:   map[string]*list.Element{},
+		onEvict: onEvict,
+	}
+}
+
+func (lru *lruCache) fits(size int64) bool {
+	return lru.maxSize > 0 && size <= lru.maxSize
+}
+
+func (lru *lruCache) get(key string) *cachedObject {
+	elem, ok := lru.items[key]
+	if !ok {
+		return nil
+	}
+	lru.order.MoveToFront(elem)
+	return elem.Value.(*lruItem).obj
+}
+
+// put replaces the object of the key. The replaced object is not evicted
+// if it shares the file of obj, e.g., when the same version of the object
+// is stored again.
+func (lru *lruCache) put(key string, size int64, obj *cachedObject) {
+	if elem, ok := lru.items[key]; ok {
+		replaced := elem.Value.(*lruItem).obj
+		lru.removeElement(elem, replaced.fileName == "" || replaced.fileName != obj.fileName)
+	}
+	lru.items[key] = lru.order.PushFront(&lruItem{key: key, size: size, obj: obj})
+	lru.size += size
+	for lru.size > lru.maxSize {
+		lru.remove(lru.order.Back().Value.(*lruItem).key)
+	}
+}
+
+func (lru *lruCache) remove(key string) {
+	if elem, ok := lru.items[key]; ok {
+		lru.removeElement(elem, true)
+	}
+}
+
+func (lru *lruCache) removeElement(elem *list.Element, evict bool) {
+	item := lru.order.Remove(elem).(*lruItem)
+	delete(lru.items, item.key)
+	lru.size -= item.size
+	if evict && lru.onEvict != nil {
+		lru.onEvict(item.obj)
+	}
+}
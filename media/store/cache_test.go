@@ -0,0 +1,318 @@
+package store_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+var errUnavailable = errors.Msg("unavailable")
+
+func TestCachingService(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config mediastore.CacheConfig
+		// content is the content of the object, which is cached unless
+		// it's larger than MaxObjectBytes.
+		content string
+		cached  bool
+	}{
+		{
+			name:    "memory",
+			config:  mediastore.CacheConfig{MaxMemoryBytes: 1024, TTL: time.Hour},
+			content: "content",
+			cached:  true,
+		},
+		{
+			name:    "disk",
+			config:  mediastore.CacheConfig{MaxDiskBytes: 1024, TTL: time.Hour},
+			content: "content",
+			cached:  true,
+		},
+		{
+			name:    "larger than memory",
+			config:  mediastore.CacheConfig{MaxMemoryBytes: 4, MaxDiskBytes: 1024, TTL: time.Hour},
+			content: "content",
+			cached:  true,
+		},
+		{
+			name:    "larger than the objects",
+			config:  mediastore.CacheConfig{MaxMemoryBytes: 1024, MaxObjectBytes: 4, TTL: time.Hour},
+			content: "content",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.config.MaxDiskBytes > 0 {
+				tc.config.DiskDirectory = t.TempDir()
+			}
+			backend := newMemoryService(t)
+			svc, err := mediastore.NewCachingService(backend, tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			putObject(t, backend, "key", tc.content)
+			if got := readObject(t, svc, "key"); got != tc.content {
+				t.Fatalf("got %q, want %q", got, tc.content)
+			}
+
+			backend.InjectFailure(mediastore.OperationGetObject, errUnavailable)
+			obj, err := svc.GetObject(context.Background(), "key")
+			if !tc.cached {
+				if !errors.Is(err, errUnavailable) {
+					t.Fatalf("got %v, want the object not to be cached", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(obj)
+			obj.Close()
+			if string(b) != tc.content {
+				t.Errorf("cached: got %q, want %q", b, tc.content)
+			}
+		})
+	}
+}
+
+func TestCachingServiceInvalidation(t *testing.T) {
+	testCases := []struct {
+		name   string
+		update func(t *testing.T, backend, svc mediastore.ServiceV2)
+		want   string
+	}{
+		{
+			name: "put through the cache",
+			update: func(t *testing.T, backend, svc mediastore.ServiceV2) {
+				putObject(t, svc, "key", "updated")
+			},
+			want: "updated",
+		},
+		{
+			name: "copied over",
+			update: func(t *testing.T, backend, svc mediastore.ServiceV2) {
+				putObject(t, backend, "other", "copied")
+				if err := mediastore.CopyObject(context.Background(), svc, "other", "key"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: "copied",
+		},
+		{
+			// Without a TTL, the ETag is checked on every download.
+			name: "put behind the cache",
+			update: func(t *testing.T, backend, svc mediastore.ServiceV2) {
+				putObject(t, backend, "key", "behind")
+			},
+			want: "behind",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := newMemoryService(t)
+			svc, err := mediastore.NewCachingService(backend, mediastore.CacheConfig{
+				MaxMemoryBytes: 1024,
+				DiskDirectory:  t.TempDir(),
+				MaxDiskBytes:   1024,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			putObject(t, backend, "key", "original")
+			readObject(t, svc, "key")
+
+			tc.update(t, backend, svc)
+			if got := readObject(t, svc, "key"); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	t.Run("deleted", func(t *testing.T) {
+		backend := newMemoryService(t)
+		svc, err := mediastore.NewCachingService(backend, mediastore.CacheConfig{MaxMemoryBytes: 1024, TTL: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		putObject(t, backend, "key", "original")
+		readObject(t, svc, "key")
+		if err = svc.DeleteObject(context.Background(), "key"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = svc.GetObject(context.Background(), "key"); !errors.Is(err, mediastore.ErrObjectNotFound) {
+			t.Errorf("got %v, want ErrObjectNotFound", err)
+		}
+	})
+}
+
+// barrierService holds the downloads until n of them are in flight.
+type barrierService struct {
+	mediastore.ServiceV2
+	wg *sync.WaitGroup
+}
+
+func (s barrierService) GetObject(ctx context.Context, objectKey string) (*mediastore.ObjectReader, error) {
+	s.wg.Done()
+	s.wg.Wait()
+	return s.ServiceV2.GetObject(ctx, objectKey)
+}
+
+// The concurrent misses of an object store the same file, which must
+// still be there once they are done.
+func TestCachingServiceConcurrentMisses(t *testing.T) {
+	backend := newMemoryService(t)
+	putObject(t, backend, "key", "content")
+	dir := t.TempDir()
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	svc, err := mediastore.NewCachingService(barrierService{backend, wg},
+		mediastore.CacheConfig{DiskDirectory: dir, MaxDiskBytes: 1024, TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var readers sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			obj, err := svc.GetObject(context.Background(), "key")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_, _ = io.Copy(io.Discard, obj)
+			obj.Close()
+		}()
+	}
+	readers.Wait()
+
+	files, _ := filepath.Glob(filepath.Join(dir, mediastore.CacheDiskSubdirectory, "*"))
+	if len(files) != 1 || !strings.HasSuffix(files[0], ".cache") {
+		t.Fatalf("cache files: got %v, want one", files)
+	}
+	backend.InjectFailure(mediastore.OperationGetObject, errUnavailable)
+	wg.Add(1)
+	if got := readObject(t, svc, "key"); got != "content" {
+		t.Errorf("got %q, want the cached content", got)
+	}
+}
+
+func TestCachingServiceRemovesStaleFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, mediastore.CacheDiskSubdirectory), 0755); err != nil {
+		t.Fatal(err)
+	}
+	staleFile := filepath.Join(dir, mediastore.CacheDiskSubdirectory, "stale.cache")
+	otherFile := filepath.Join(dir, "other.cache")
+	for _, fileName := range []string{staleFile, otherFile} {
+		if err := os.WriteFile(fileName, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := mediastore.NewCachingService(newMemoryService(t),
+		mediastore.CacheConfig{DiskDirectory: dir, MaxDiskBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(staleFile); !os.IsNotExist(err) {
+		t.Errorf("stale file: %v", err)
+	}
+	if _, err = os.Stat(otherFile); err != nil {
+		t.Errorf("other file: %v", err)
+	}
+}
+
+// pausingService holds the first download, once its content is fetched,
+// until resume is closed.
+type pausingService struct {
+	mediastore.ServiceV2
+	once    sync.Once
+	fetched chan struct{}
+	resume  chan struct{}
+}
+
+func (s *pausingService) GetObject(ctx context.Context, objectKey string) (*mediastore.ObjectReader, error) {
+	obj, err := s.ServiceV2.GetObject(ctx, objectKey)
+	s.once.Do(func() {
+		close(s.fetched)
+		<-s.resume
+	})
+	return obj, err
+}
+
+// A download which began before a write must not fill the cache with the
+// content it fetched.
+func TestCachingServiceFillRacingWrite(t *testing.T) {
+	backend := newMemoryService(t)
+	putObject(t, backend, "key", "original")
+	paused := &pausingService{ServiceV2: backend, fetched: make(chan struct{}), resume: make(chan struct{})}
+	svc, err := mediastore.NewCachingService(paused, mediastore.CacheConfig{
+		MaxMemoryBytes: 1024,
+		DiskDirectory:  t.TempDir(),
+		MaxDiskBytes:   1024,
+		TTL:            time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan string)
+	go func() {
+		done <- readObject(t, svc, "key")
+	}()
+	<-paused.fetched
+	putObject(t, svc, "key", "updated")
+	close(paused.resume)
+	if got := <-done; got != "original" {
+		t.Fatalf("racing download: got %q", got)
+	}
+
+	if got := readObject(t, svc, "key"); got != "updated" {
+		t.Errorf("got %q, want %q", got, "updated")
+	}
+}
+
+// The files of the on-disk tier which were modified are not served, nor
+// promoted to memory.
+func TestCachingServiceModifiedFile(t *testing.T) {
+	backend := newMemoryService(t)
+	dir := t.TempDir()
+	svc, err := mediastore.NewCachingService(backend, mediastore.CacheConfig{
+		MaxMemoryBytes: 16,
+		DiskDirectory:  dir,
+		MaxDiskBytes:   1024,
+		TTL:            time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putObject(t, backend, "key", "content")
+	readObject(t, svc, "key")
+	// The other object evicts the first one from memory.
+	putObject(t, backend, "other", "0123456789")
+	readObject(t, svc, "other")
+
+	files, _ := filepath.Glob(filepath.Join(dir, mediastore.CacheDiskSubdirectory, "*.cache"))
+	for _, fileName := range files {
+		if fi, err := os.Stat(fileName); err == nil && fi.Size() == int64(len("content")) {
+			if err = os.WriteFile(fileName, []byte("CONTENT"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if got := readObject(t, svc, "key"); got != "content" {
+			t.Errorf("read %d: got %q, want %q", i, got, "content")
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package store
 
 import (
+	"time"
+
 	"github.com/rez-go/stev"
 )
 
@@ -10,7 +12,39 @@ type Config struct {
 
 	Modules map[string]any `env:",map,squash" yaml:",inline,omitempty"`
 
+	// ImagesBaseURL is the URL where the services which serve the
+	// objects themselves, e.g., the local module, are reachable. See
+	// PublicBaseURLSetter.
 	ImagesBaseURL string `env:"IMAGES_BASE_URL" yaml:"images_base_url" json:"images_base_url"`
+
+	// PublicURLExpiry is how long the URLs of Store.GetPublicURL stay
+	// valid when the caller doesn't provide an expiry. If it's zero, the
+	// default of the backend applies: 24 hours for minio, 15 minutes for
+	// s3 and local, and gcs returns the MediaLink of the object, which
+	// doesn't expire, unless response overrides are requested.
+	PublicURLExpiry time.Duration `env:"PUBLIC_URL_EXPIRY" yaml:"public_url_expiry" json:"public_url_expiry"`
+
+	// KeyLayout selects how the keys of the media objects are built by
+	// Store.Upload.
+	KeyLayout KeyLayoutConfig `env:"KEY_LAYOUT" yaml:"key_layout" json:"key_layout"`
+
+	// UploadPolicy restricts the content uploaded with each media type.
+	UploadPolicy UploadPolicyConfig `env:"UPLOAD_POLICY" yaml:"upload_policy" json:"upload_policy"`
+
+	// Resilience configures the retries and the circuit breaker of the
+	// calls to the storage.
+	Resilience ResilienceConfig `env:"RESILIENCE" yaml:"resilience" json:"resilience"`
+
+	// Cache configures the read-through cache of the downloads.
+	Cache CacheConfig `env:"CACHE" yaml:"cache" json:"cache"`
+
+	// Instrumentation configures the metrics and the logs of the calls to
+	// the storage.
+	Instrumentation InstrumentationConfig `env:"INSTRUMENTATION" yaml:"instrumentation" json:"instrumentation"`
+
+	// Lifecycle configures the expiration and the retention of the
+	// objects.
+	Lifecycle LifecycleConfig `env:"LIFECYCLE" yaml:"lifecycle" json:"lifecycle"`
 }
 
 // ParseConfigFromEnv populate the configuration by looking up the environment variables.
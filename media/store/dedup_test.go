@@ -0,0 +1,117 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/timemore/foundation/media"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+func TestUploadDeduplicatedMatchesContentName(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content []byte
+	}{
+		{"empty", nil},
+		{"small", []byte("content")},
+		{"larger than the buffer", bytes.Repeat([]byte("0123456789"), 300*1024)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mediaStore := newTestStore(t, mediastore.Config{NameGenerationKey: "test-key"}, newMemoryService(t))
+
+			info, duplicate, err := mediaStore.UploadDeduplicated(context.Background(), "media/",
+				bytes.NewReader(tc.content), media.MediaType_MEDIA_TYPE_UNSPECIFIED, mediastore.PutObjectOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if duplicate {
+				t.Error("first upload reported as a duplicate")
+			}
+			name, err := mediaStore.ContentName(bytes.NewReader(tc.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "media/" + name; info.Key != want {
+				t.Errorf("got %q, want %q", info.Key, want)
+			}
+			if legacy := mediaStore.GenerateName(bytes.NewReader(tc.content)); name == legacy {
+				t.Errorf("ContentName is the same as GenerateName: %q", name)
+			}
+		})
+	}
+}
+
+// The names from GenerateName must not change, objects are stored under
+// them.
+func TestGenerateName(t *testing.T) {
+	mediaStore := newTestStore(t, mediastore.Config{NameGenerationKey: "test-key"}, newMemoryService(t))
+	testCases := []struct {
+		content string
+		want    string
+	}{
+		{"", "257f34acf964d64f26a99e860a005a9fK74657374N0"},
+		{"content", "5cb1bfbcf0e3a6ea5ee01b9d97d357dbK74657374N7"},
+	}
+	for _, tc := range testCases {
+		if got := mediaStore.GenerateName(strings.NewReader(tc.content)); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.content, got, tc.want)
+		}
+	}
+}
+
+func TestUploadDeduplicated(t *testing.T) {
+	svc := newMemoryService(t)
+	mediaStore := newTestStore(t, mediastore.Config{}, svc)
+	upload := func(content string) (*mediastore.UploadInfo, bool) {
+		t.Helper()
+		info, duplicate, err := mediaStore.UploadDeduplicated(context.Background(), "",
+			strings.NewReader(content), media.MediaType_MEDIA_TYPE_UNSPECIFIED, mediastore.PutObjectOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info, duplicate
+	}
+
+	first, _ := upload("content")
+	second, duplicate := upload("content")
+	if !duplicate || second.Key != first.Key {
+		t.Errorf("got %q, duplicate %v, want %q as a duplicate", second.Key, duplicate, first.Key)
+	}
+	other, duplicate := upload("other content")
+	if duplicate || other.Key == first.Key {
+		t.Errorf("different content: got %q, duplicate %v", other.Key, duplicate)
+	}
+
+	// The content stored under a name from ContentName by Upload is
+	// recognized as well.
+	name, err := mediaStore.ContentName(strings.NewReader("uploaded"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mediaStore.UploadContext(context.Background(), name, strings.NewReader("uploaded"),
+		media.MediaType_MEDIA_TYPE_UNSPECIFIED, mediastore.PutObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, duplicate := upload("uploaded"); !duplicate || info.Key != name {
+		t.Errorf("got %q, duplicate %v, want %q as a duplicate", info.Key, duplicate, name)
+	}
+
+	// The temporary objects are gone.
+	keys := objectKeys(t, svc, "")
+	if want := []string{first.Key, other.Key, name}; len(keys) != len(want) {
+		t.Errorf("got %v, want %v", keys, want)
+	}
+	for i := range keys {
+		if keys[i] != first.Key && keys[i] != other.Key && keys[i] != name {
+			t.Errorf("unexpected object %q", keys[i])
+		}
+	}
+	if got := readObject(t, svc, first.Key); got != "content" {
+		t.Errorf("got %q", got)
+	}
+}
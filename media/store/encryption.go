@@ -0,0 +1,509 @@
+package store
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"strings"
+
+	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/keystore/crypto"
+)
+
+var (
+	// ErrDecryptionFailed is returned, usually wrapped, when the content
+	// of an encrypted object has been altered or truncated.
+	ErrDecryptionFailed = errors.Msg("decryption failed")
+
+	// ErrEncryptionKeyNotFound is returned, wrapped, when an object has
+	// been encrypted with a key encryption key which is not known.
+	ErrEncryptionKeyNotFound = errors.Msg("encryption key not found")
+
+	// ErrObjectNotEncrypted is returned, wrapped, when an object has no
+	// encryption metadata and EncryptionConfig.AllowPlaintext is not set.
+	ErrObjectNotEncrypted = errors.Msg("object not encrypted")
+)
+
+// The metadata stored along with an encrypted object.
+const (
+	EncryptionAlgorithmMetadata = "encryption-algorithm"
+	EncryptionKeyIDMetadata     = "encryption-key-id"
+	EncryptionKeyMetadata       = "encryption-key"
+)
+
+// EncryptionAlgorithmAESGCMStream is the only supported algorithm. The
+// content is split into segments of encryptionSegmentSize bytes which are
+// sealed with AES-256-GCM. The nonce of a segment is its index and a flag
+// set on the last segment so that the reordering and the truncation of
+// the segments are detected. The key of the object is the additional data
+// of the segments, and it's wrapped along with the data key, so that the
+// content could not be moved to another key.
+const EncryptionAlgorithmAESGCMStream = "AES256-GCM-STREAM-64K"
+
+const (
+	encryptionSegmentSize   = 64 * 1024
+	encryptionTagSize       = 16
+	encryptionSealedSize    = encryptionSegmentSize + encryptionTagSize
+	encryptionDataKeyLength = 32
+)
+
+// EncryptionConfig configures NewEncryptingService.
+type EncryptionConfig struct {
+	// KEK wraps the data keys of the objects which are stored.
+	KEK crypto.KeyEncryptionKey
+
+	// PreviousKEKs are only used to unwrap the data keys of the objects
+	// which have been encrypted before KEK was rotated.
+	PreviousKEKs []crypto.KeyEncryptionKey
+
+	// AllowPlaintext allows reading the objects without encryption
+	// metadata, e.g., those stored before the encryption was enabled, as
+	// they are stored. Anyone able to write to the storage could then have
+	// their content served as authentic, so it should only be set while
+	// the existing objects are encrypted. Otherwise, reading such an
+	// object fails with ErrObjectNotEncrypted.
+	AllowPlaintext bool
+}
+
+// NewEncryptingService wraps the service so that the content of the
+// objects is encrypted before it's stored and decrypted when it's read.
+// Each object is encrypted with its own data key, which is wrapped by
+// config.KEK and stored in the metadata of the object.
+//
+// As the storage only holds the ciphertext, the public URLs, the presigned
+// uploads and the upload sessions are not supported, and the sizes
+// returned by ListObjects are the sizes of the ciphertext. The copies are
+// made by downloading and uploading the objects, which are bound to their
+// key.
+func NewEncryptingService(svc ServiceV2, config EncryptionConfig) (ServiceV2, error) {
+	if svc == nil {
+		return nil, errors.ArgMsg("svc", "missing")
+	}
+	if config.KEK == nil {
+		return nil, errors.ArgMsg("config.KEK", "missing")
+	}
+	keks := map[string]crypto.KeyEncryptionKey{config.KEK.ID(): config.KEK}
+	for _, k := range config.PreviousKEKs {
+		if k == nil {
+			return nil, errors.ArgMsg("config.PreviousKEKs", "contains nil")
+		}
+		if _, dup := keks[k.ID()]; dup {
+			return nil, errors.ArgMsg("config.PreviousKEKs", "duplicate ID "+k.ID())
+		}
+		keks[k.ID()] = k
+	}
+	return &encryptingService{
+		ServiceV2:      svc,
+		kek:            config.KEK,
+		keks:           keks,
+		allowPlaintext: config.AllowPlaintext,
+	}, nil
+}
+
+// encryptingService embeds the service so that the calls which don't
+// involve the content, e.g., DeleteObject, are forwarded as they are. It's
+// not a Copier, CopyObject and MoveObject fall back to downloading and
+// uploading through it so that the copies are encrypted for their key.
+type encryptingService struct {
+	ServiceV2
+
+	kek            crypto.KeyEncryptionKey
+	keks           map[string]crypto.KeyEncryptionKey
+	allowPlaintext bool
+}
+
+var (
+	_ ServiceV2     = &encryptingService{}
+	_ HealthChecker = &encryptingService{}
+)
+
+func (s *encryptingService) PutObject(
+	ctx context.Context,
+	targetKey string,
+	contentSource io.Reader,
+	opts PutObjectOptions,
+) (*UploadInfo, error) {
+	dataKey := make([]byte, encryptionDataKeyLength)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, errors.Wrap("generate data key", err)
+	}
+	aead, err := newEncryptionAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := s.kek.WrapKey(boundDataKey(dataKey, targetKey))
+	if err != nil {
+		return nil, errors.Wrap("wrap data key", err)
+	}
+
+	metadata := make(map[string]string, len(opts.Metadata)+3)
+	for k, v := range NormalizeMetadata(opts.Metadata) {
+		metadata[k] = v
+	}
+	metadata[EncryptionAlgorithmMetadata] = EncryptionAlgorithmAESGCMStream
+	metadata[EncryptionKeyIDMetadata] = s.kek.ID()
+	metadata[EncryptionKeyMetadata] = base64.StdEncoding.EncodeToString(wrappedKey)
+	opts.Metadata = metadata
+
+	encrypter := &encryptingReader{
+		src:  contentSource,
+		aead: aead,
+		aad:  []byte(targetKey),
+		buf:  make([]byte, encryptionSegmentSize+1),
+	}
+	uploadInfo, err := s.ServiceV2.PutObject(ctx, targetKey, encrypter, opts)
+	if err != nil {
+		return nil, err
+	}
+	uploadInfo.Size = int(encrypter.plaintextSize)
+	return uploadInfo, nil
+}
+
+func (s *encryptingService) GetObject(ctx context.Context, sourceKey string) (*ObjectReader, error) {
+	object, err := s.ServiceV2.GetObject(ctx, sourceKey)
+	if err != nil {
+		return nil, err
+	}
+	if !isEncryptedObject(object.Info) {
+		if s.allowPlaintext {
+			return object, nil
+		}
+		object.Close()
+		return nil, errors.Wrap(sourceKey, ErrObjectNotEncrypted)
+	}
+
+	info := object.Info
+	aead, err := s.openDataKey(sourceKey, info)
+	if err != nil {
+		object.Close()
+		return nil, errors.Wrap(sourceKey, err)
+	}
+	segmentCount, plaintextSize, ok := encryptedSegments(info.Size)
+	if !ok {
+		object.Close()
+		return nil, errors.Wrap(sourceKey, ErrDecryptionFailed)
+	}
+	return &ObjectReader{
+		ReadCloser: &decryptingReader{
+			src:         object.ReadCloser,
+			aead:        aead,
+			aad:         []byte(sourceKey),
+			lastSegment: segmentCount - 1,
+			endSegment:  segmentCount,
+			buf:         make([]byte, encryptionSealedSize),
+		},
+		Info: plaintextInfo(info, plaintextSize),
+	}, nil
+}
+
+// GetObjectRange only reads and decrypts the segments which contain the
+// range.
+func (s *encryptingService) GetObjectRange(
+	ctx context.Context,
+	sourceKey string,
+	offset, length int64,
+) (*ObjectReader, error) {
+	info, err := s.ServiceV2.StatObject(ctx, sourceKey)
+	if err != nil {
+		return nil, err
+	}
+	if !isEncryptedObject(*info) {
+		if s.allowPlaintext {
+			return s.ServiceV2.GetObjectRange(ctx, sourceKey, offset, length)
+		}
+		return nil, errors.Wrap(sourceKey, ErrObjectNotEncrypted)
+	}
+
+	aead, err := s.openDataKey(sourceKey, *info)
+	if err != nil {
+		return nil, errors.Wrap(sourceKey, err)
+	}
+	segmentCount, plaintextSize, ok := encryptedSegments(info.Size)
+	if !ok {
+		return nil, errors.Wrap(sourceKey, ErrDecryptionFailed)
+	}
+	length, err = ResolveRange(plaintextSize, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return &ObjectReader{
+			ReadCloser: io.NopCloser(strings.NewReader("")),
+			Info:       plaintextInfo(*info, plaintextSize),
+		}, nil
+	}
+
+	startSegment := offset / encryptionSegmentSize
+	endSegment := (offset+length-1)/encryptionSegmentSize + 1
+	sealedOffset := startSegment * encryptionSealedSize
+	sealedLength := endSegment*encryptionSealedSize - sealedOffset
+	if sealedOffset+sealedLength > info.Size {
+		sealedLength = info.Size - sealedOffset
+	}
+	object, err := s.ServiceV2.GetObjectRange(ctx, sourceKey, sealedOffset, sealedLength)
+	if err != nil {
+		return nil, err
+	}
+	// The data key of another version of the object would not open the
+	// segments, but the error is clearer this way.
+	if object.Info.ETag != "" && info.ETag != "" && object.Info.ETag != info.ETag {
+		object.Close()
+		return nil, errors.Wrap(sourceKey, errors.Msg("object changed while reading"))
+	}
+
+	decrypter := &decryptingReader{
+		src:         object.ReadCloser,
+		aead:        aead,
+		aad:         []byte(sourceKey),
+		segment:     startSegment,
+		lastSegment: segmentCount - 1,
+		endSegment:  endSegment,
+		buf:         make([]byte, encryptionSealedSize),
+	}
+	if _, err = io.CopyN(io.Discard, decrypter, offset-startSegment*encryptionSegmentSize); err != nil {
+		decrypter.Close()
+		return nil, errors.Wrap(sourceKey, err)
+	}
+	return &ObjectReader{
+		ReadCloser: LimitReadCloser(decrypter, length),
+		Info:       plaintextInfo(*info, plaintextSize),
+	}, nil
+}
+
+func (s *encryptingService) StatObject(ctx context.Context, sourceKey string) (*ObjectInfo, error) {
+	info, err := s.ServiceV2.StatObject(ctx, sourceKey)
+	if err != nil {
+		return nil, err
+	}
+	if !isEncryptedObject(*info) {
+		if s.allowPlaintext {
+			return info, nil
+		}
+		return nil, errors.Wrap(sourceKey, ErrObjectNotEncrypted)
+	}
+	_, plaintextSize, ok := encryptedSegments(info.Size)
+	if !ok {
+		return nil, errors.Wrap(sourceKey, ErrDecryptionFailed)
+	}
+	plaintext := plaintextInfo(*info, plaintextSize)
+	return &plaintext, nil
+}
+
+// GetPublicObject is not supported, the URL would serve the ciphertext.
+func (s *encryptingService) GetPublicObject(context.Context, string, PublicURLOptions) (string, error) {
+	return "", errors.ErrUnimplemented
+}
+
+func (s *encryptingService) HealthCheck(ctx context.Context) error {
+	return HealthCheck(ctx, s.ServiceV2)
+}
+
+// boundDataKey returns the data key followed by the digest of the key of
+// the object, which is what's wrapped.
+func boundDataKey(dataKey []byte, objectKey string) []byte {
+	digest := sha256.Sum256([]byte(objectKey))
+	return append(append(make([]byte, 0, len(dataKey)+len(digest)), dataKey...), digest[:]...)
+}
+
+// openDataKey unwraps the data key of the object, which must have been
+// wrapped for the key of the object.
+func (s *encryptingService) openDataKey(objectKey string, info ObjectInfo) (cipher.AEAD, error) {
+	if algorithm := info.Metadata[EncryptionAlgorithmMetadata]; algorithm != EncryptionAlgorithmAESGCMStream {
+		return nil, errors.Msg("unsupported encryption algorithm " + algorithm)
+	}
+	keyID := info.Metadata[EncryptionKeyIDMetadata]
+	kek := s.keks[keyID]
+	if kek == nil {
+		return nil, errors.Wrap(keyID, ErrEncryptionKeyNotFound)
+	}
+	wrappedKey, err := base64.StdEncoding.DecodeString(info.Metadata[EncryptionKeyMetadata])
+	if err != nil {
+		return nil, errors.Wrap("decode data key", err)
+	}
+	boundKey, err := kek.UnwrapKey(wrappedKey)
+	if err != nil {
+		return nil, errors.Wrap("unwrap data key", err)
+	}
+	expected := boundDataKey(make([]byte, encryptionDataKeyLength), objectKey)
+	if len(boundKey) != len(expected) ||
+		subtle.ConstantTimeCompare(boundKey[encryptionDataKeyLength:], expected[encryptionDataKeyLength:]) != 1 {
+		return nil, errors.Wrap("data key bound to another object", ErrDecryptionFailed)
+	}
+	return newEncryptionAEAD(boundKey[:encryptionDataKeyLength])
+}
+
+func newEncryptionAEAD(dataKey []byte) (cipher.AEAD, error) {
+	if len(dataKey) != encryptionDataKeyLength {
+		return nil, errors.Msg("data key length invalid")
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, errors.Wrap("aes.NewCipher", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap("cipher.NewGCM", err)
+	}
+	return aead, nil
+}
+
+func isEncryptedObject(info ObjectInfo) bool {
+	return info.Metadata[EncryptionKeyMetadata] != ""
+}
+
+// plaintextInfo returns the info without the encryption metadata.
+func plaintextInfo(info ObjectInfo, plaintextSize int64) ObjectInfo {
+	info.Size = plaintextSize
+	metadata := make(map[string]string, len(info.Metadata))
+	for k, v := range info.Metadata {
+		switch k {
+		case EncryptionAlgorithmMetadata, EncryptionKeyIDMetadata, EncryptionKeyMetadata:
+		default:
+			metadata[k] = v
+		}
+	}
+	info.Metadata = NormalizeMetadata(metadata)
+	return info
+}
+
+// encryptedSegments returns the number of segments and the size of the
+// plaintext of a ciphertext of sealedSize bytes. There's always at least
+// one segment, the last segment of an empty plaintext is empty.
+func encryptedSegments(sealedSize int64) (segmentCount, plaintextSize int64, ok bool) {
+	if sealedSize < encryptionTagSize {
+		return 0, 0, false
+	}
+	segmentCount = (sealedSize + encryptionSealedSize - 1) / encryptionSealedSize
+	if sealedSize-(segmentCount-1)*encryptionSealedSize < encryptionTagSize {
+		return 0, 0, false
+	}
+	return segmentCount, sealedSize - segmentCount*encryptionTagSize, true
+}
+
+func encryptionNonce(aead cipher.AEAD, segment int64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, uint64(segment))
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptingReader reads the ciphertext of src. It reads one byte ahead
+// of each segment to know whether it's the last one.
+type encryptingReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	aad     []byte
+	segment int64
+	buf     []byte
+	// buffered is the number of bytes read ahead in buf.
+	buffered  int
+	sealedBuf []byte
+	sealed    []byte
+	done      bool
+
+	plaintextSize int64
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.sealed) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.sealSegment(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.sealed)
+	r.sealed = r.sealed[n:]
+	return n, nil
+}
+
+func (r *encryptingReader) sealSegment() error {
+	n, err := io.ReadFull(r.src, r.buf[r.buffered:])
+	n += r.buffered
+	last := false
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	default:
+		return err
+	}
+
+	plaintext := r.buf[:n]
+	if !last {
+		plaintext = r.buf[:encryptionSegmentSize]
+	}
+	r.sealedBuf = r.aead.Seal(r.sealedBuf[:0], encryptionNonce(r.aead, r.segment, last), plaintext, r.aad)
+	r.sealed = r.sealedBuf
+	r.plaintextSize += int64(len(plaintext))
+	r.segment++
+	if last {
+		r.done = true
+		return nil
+	}
+	r.buf[0] = r.buf[encryptionSegmentSize]
+	r.buffered = 1
+	return nil
+}
+
+// decryptingReader reads the plaintext of the segments from segment up
+// to, but excluding, endSegment.
+type decryptingReader struct {
+	src         io.ReadCloser
+	aead        cipher.AEAD
+	aad         []byte
+	segment     int64
+	lastSegment int64
+	endSegment  int64
+	buf         []byte
+	plaintext   []byte
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.plaintext) == 0 {
+		if r.segment >= r.endSegment {
+			return 0, io.EOF
+		}
+		if err := r.openSegment(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
+}
+
+func (r *decryptingReader) openSegment() error {
+	last := r.segment == r.lastSegment
+	n, err := io.ReadFull(r.src, r.buf)
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		// Only the last segment could be shorter.
+		if !last {
+			return ErrDecryptionFailed
+		}
+	default:
+		return err
+	}
+	plaintext, err := r.aead.Open(r.buf[:0], encryptionNonce(r.aead, r.segment, last), r.buf[:n], r.aad)
+	if err != nil {
+		return ErrDecryptionFailed
+	}
+	r.plaintext = plaintext
+	r.segment++
+	return nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.src.Close()
+}
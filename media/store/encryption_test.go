@@ -0,0 +1,313 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"testing"
+
+	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/keystore/crypto"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+const encryptionSegmentSize = 64 * 1024
+
+func newTestKEK(t *testing.T, id string) crypto.KeyEncryptionKey {
+	t.Helper()
+	kek, err := crypto.NewAESKeyEncryptionKey(id, bytes.Repeat([]byte(id[:1]), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kek
+}
+
+func newEncryptingService(t *testing.T, backend mediastore.ServiceV2, kek crypto.KeyEncryptionKey, previousKEKs ...crypto.KeyEncryptionKey) mediastore.ServiceV2 {
+	t.Helper()
+	svc, err := mediastore.NewEncryptingService(backend, mediastore.EncryptionConfig{KEK: kek, PreviousKEKs: previousKEKs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc
+}
+
+// testContent returns content which differs at every offset so that the
+// misplaced bytes are noticed.
+func testContent(size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i * 7 / 3)
+	}
+	return b
+}
+
+func TestEncryptingServiceRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, 100, encryptionSegmentSize - 1, encryptionSegmentSize, encryptionSegmentSize + 1,
+		3*encryptionSegmentSize + 5}
+	for _, size := range sizes {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			backend := newMemoryService(t)
+			svc := newEncryptingService(t, backend, newTestKEK(t, "k1"))
+			content := testContent(size)
+
+			info, err := svc.PutObject(context.Background(), "key", bytes.NewReader(content),
+				mediastore.PutObjectOptions{Metadata: map[string]string{"origin": "test"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size != size {
+				t.Errorf("upload size: got %d, want %d", info.Size, size)
+			}
+			stored := readObject(t, backend, "key")
+			if size > 0 && bytes.Contains([]byte(stored), content[:size/2+1]) {
+				t.Error("content stored in plaintext")
+			}
+
+			obj, err := svc.GetObject(context.Background(), "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(obj)
+			obj.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("content differs, got %d bytes", len(got))
+			}
+			if obj.Info.Size != int64(size) {
+				t.Errorf("size: got %d, want %d", obj.Info.Size, size)
+			}
+			if len(obj.Info.Metadata) != 1 || obj.Info.Metadata["origin"] != "test" {
+				t.Errorf("metadata: got %v", obj.Info.Metadata)
+			}
+
+			stat, err := svc.StatObject(context.Background(), "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stat.Size != int64(size) {
+				t.Errorf("stat size: got %d, want %d", stat.Size, size)
+			}
+		})
+	}
+}
+
+func TestEncryptingServiceRange(t *testing.T) {
+	content := testContent(3*encryptionSegmentSize + 5)
+	svc := newEncryptingService(t, newMemoryService(t), newTestKEK(t, "k1"))
+	_, err := svc.PutObject(context.Background(), "key", bytes.NewReader(content), mediastore.PutObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name           string
+		offset, length int64
+	}{
+		{"head", 0, 10},
+		{"within a segment", 100, 1000},
+		{"across a boundary", encryptionSegmentSize - 10, 20},
+		{"across segments", 10, 2*encryptionSegmentSize + 10},
+		{"last segment", 3 * encryptionSegmentSize, -1},
+		{"last byte", int64(len(content)) - 1, 1},
+		{"clamped", 2 * encryptionSegmentSize, 10 * encryptionSegmentSize},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			obj, err := svc.GetObjectRange(context.Background(), "key", tc.offset, tc.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(obj)
+			obj.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			end := int64(len(content))
+			if tc.length >= 0 && tc.offset+tc.length < end {
+				end = tc.offset + tc.length
+			}
+			if !bytes.Equal(got, content[tc.offset:end]) {
+				t.Errorf("got %d bytes, want %d bytes at %d", len(got), end-tc.offset, tc.offset)
+			}
+		})
+	}
+
+	_, err = svc.GetObjectRange(context.Background(), "key", int64(len(content)), -1)
+	if !errors.Is(err, mediastore.ErrRangeNotSatisfiable) {
+		t.Errorf("beyond the end: got %v, want ErrRangeNotSatisfiable", err)
+	}
+}
+
+func TestEncryptingServiceKeyRotation(t *testing.T) {
+	backend := newMemoryService(t)
+	k1, k2 := newTestKEK(t, "k1"), newTestKEK(t, "k2")
+	_, err := newEncryptingService(t, backend, k1).PutObject(context.Background(), "old",
+		bytes.NewReader([]byte("old content")), mediastore.PutObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := newEncryptingService(t, backend, k2, k1)
+	putObject(t, rotated, "new", "new content")
+	for key, want := range map[string]string{"old": "old content", "new": "new content"} {
+		if got := readObject(t, rotated, key); got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+
+	if _, err = newEncryptingService(t, backend, k2).GetObject(context.Background(), "old"); !errors.Is(err, mediastore.ErrEncryptionKeyNotFound) {
+		t.Errorf("without the previous key: got %v, want ErrEncryptionKeyNotFound", err)
+	}
+}
+
+func TestEncryptingServiceTampering(t *testing.T) {
+	content := testContent(2*encryptionSegmentSize + 100)
+	testCases := []struct {
+		name   string
+		tamper func(sealed []byte) []byte
+	}{
+		{"byte flipped", func(sealed []byte) []byte {
+			sealed[encryptionSegmentSize+20] ^= 1
+			return sealed
+		}},
+		{"truncated in a segment", func(sealed []byte) []byte {
+			return sealed[:len(sealed)-10]
+		}},
+		{"last segment dropped", func(sealed []byte) []byte {
+			return sealed[:2*(encryptionSegmentSize+16)]
+		}},
+		{"segments swapped", func(sealed []byte) []byte {
+			segmentSize := encryptionSegmentSize + 16
+			swapped := append([]byte(nil), sealed[segmentSize:2*segmentSize]...)
+			swapped = append(swapped, sealed[:segmentSize]...)
+			return append(swapped, sealed[2*segmentSize:]...)
+		}},
+		{"moved to another key", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			backend := newMemoryService(t)
+			svc := newEncryptingService(t, backend, newTestKEK(t, "k1"))
+			if _, err := svc.PutObject(ctx, "key", bytes.NewReader(content), mediastore.PutObjectOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			stored, err := backend.GetObject(ctx, "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sealed, _ := io.ReadAll(stored)
+			stored.Close()
+			// The ciphertext is stored along with its metadata, as a
+			// server-side copy would do.
+			key := "other"
+			if tc.tamper != nil {
+				key, sealed = "key", tc.tamper(sealed)
+			}
+			_, err = backend.PutObject(ctx, key, bytes.NewReader(sealed),
+				mediastore.PutObjectOptions{Metadata: stored.Info.Metadata})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			obj, err := svc.GetObject(ctx, key)
+			if err == nil {
+				_, err = io.ReadAll(obj)
+				obj.Close()
+			}
+			if !errors.Is(err, mediastore.ErrDecryptionFailed) {
+				t.Errorf("got %v, want ErrDecryptionFailed", err)
+			}
+		})
+	}
+}
+
+func TestEncryptingServicePlaintext(t *testing.T) {
+	backend := newMemoryService(t)
+	putObject(t, backend, "plain", "plain content")
+	ctx := context.Background()
+
+	svc := newEncryptingService(t, backend, newTestKEK(t, "k1"))
+	testCases := []struct {
+		name string
+		call func(svc mediastore.ServiceV2) error
+	}{
+		{"get", func(svc mediastore.ServiceV2) error {
+			obj, err := svc.GetObject(ctx, "plain")
+			if err == nil {
+				obj.Close()
+			}
+			return err
+		}},
+		{"get range", func(svc mediastore.ServiceV2) error {
+			obj, err := svc.GetObjectRange(ctx, "plain", 0, 5)
+			if err == nil {
+				obj.Close()
+			}
+			return err
+		}},
+		{"stat", func(svc mediastore.ServiceV2) error {
+			_, err := svc.StatObject(ctx, "plain")
+			return err
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.call(svc); !errors.Is(err, mediastore.ErrObjectNotEncrypted) {
+				t.Errorf("got %v, want ErrObjectNotEncrypted", err)
+			}
+		})
+	}
+
+	legacy, err := mediastore.NewEncryptingService(backend, mediastore.EncryptionConfig{
+		KEK:            newTestKEK(t, "k1"),
+		AllowPlaintext: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, legacy, "plain"); got != "plain content" {
+		t.Errorf("allowed: got %q", got)
+	}
+}
+
+// The copies are encrypted for their own key, the server-side copies of
+// the backend would not be readable.
+func TestEncryptingServiceCopy(t *testing.T) {
+	ctx := context.Background()
+	backend := newMemoryService(t)
+	svc := newEncryptingService(t, backend, newTestKEK(t, "k1"))
+	content := testContent(encryptionSegmentSize + 10)
+	_, err := svc.PutObject(ctx, "key", bytes.NewReader(content), mediastore.PutObjectOptions{
+		ContentType: "application/pdf",
+		Metadata:    map[string]string{"origin": "test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = mediastore.CopyObject(ctx, svc, "key", "copy"); err != nil {
+		t.Fatal(err)
+	}
+	if err = mediastore.MoveObject(ctx, svc, "copy", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key", "moved"} {
+		if got := readObject(t, svc, key); got != string(content) {
+			t.Errorf("%s: got %d bytes, want %d", key, len(got), len(content))
+		}
+	}
+	info, err := svc.StatObject(ctx, "moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentType != "application/pdf" || len(info.Metadata) != 1 || info.Metadata["origin"] != "test" {
+		t.Errorf("attributes: got %q, %v", info.ContentType, info.Metadata)
+	}
+	if _, err = svc.StatObject(ctx, "copy"); !errors.Is(err, mediastore.ErrObjectNotFound) {
+		t.Errorf("moved: got %v, want ErrObjectNotFound", err)
+	}
+}
@@ -1,23 +1,25 @@
 package gcs
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
-	"path"
-	"strings"
+	"strconv"
 	"time"
 
 	gcs "cloud.google.com/go/storage"
 	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/logger"
 	mediastore "github.com/timemore/foundation/media/store"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"gopkg.in/yaml.v3"
 )
 
+var log = logger.NewPkgLogger()
+
 type Config struct {
 	BucketName      string `env:"BUCKET_NAME" yaml:"bucket_name" json:"bucket_name"`
 	ProjectID       string `env:"PROJECT_ID" yaml:"project_id" json:"project_id"`
@@ -32,7 +34,7 @@ func init() {
 	mediastore.RegisterModule(
 		ServiceName,
 		mediastore.Module{
-			NewService: NewService,
+			NewServiceV2: NewServiceV2,
 			ServiceConfigSkeleton: func() mediastore.ServiceConfig {
 				cfg := ConfigSkeleton()
 				return &cfg
@@ -46,7 +48,18 @@ func ConfigSkeleton() Config {
 	}
 }
 
+// NewService creates the service behind the legacy Service interface.
+//
+// Deprecated: use NewServiceV2.
 func NewService(config mediastore.ServiceConfig) (mediastore.Service, error) {
+	svc, err := NewServiceV2(config)
+	if err != nil {
+		return nil, err
+	}
+	return mediastore.LegacyService(svc), nil
+}
+
+func NewServiceV2(config mediastore.ServiceConfig) (mediastore.ServiceV2, error) {
 	ctx := context.Background()
 	if config == nil {
 		return nil, errors.ArgMsg("config", "missing")
@@ -107,18 +120,20 @@ func NewService(config mediastore.ServiceConfig) (mediastore.Service, error) {
 	}
 
 	return &Service{
-		bucketName: bucketName,
-		projectID:  conf.ProjectID,
-		gcsClient:  client,
-		basePath:   conf.Basepath,
+		bucketName:      bucketName,
+		projectID:       conf.ProjectID,
+		gcsClient:       client,
+		basePath:        mediastore.BasePath(conf.Basepath),
+		bucketOperation: conf.BucketOperation,
 	}, nil
 }
 
 type Service struct {
-	bucketName string
-	projectID  string
-	gcsClient  *gcs.Client
-	basePath   string
+	bucketName      string
+	projectID       string
+	gcsClient       *gcs.Client
+	basePath        mediastore.BasePath
+	bucketOperation bool
 }
 
 type UploadInfo struct {
@@ -126,17 +141,25 @@ type UploadInfo struct {
 	Key    string
 }
 
-func (s *Service) PutObject(targetKey string, contentSource io.Reader) (uploadInfo *mediastore.UploadInfo, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*50)
-	defer cancel()
-	if s.basePath != "" {
-		targetKey = path.Join(s.basePath, targetKey)
+func (s *Service) PutObject(
+	ctx context.Context,
+	targetKey string,
+	contentSource io.Reader,
+	opts mediastore.PutObjectOptions,
+) (uploadInfo *mediastore.UploadInfo, err error) {
+	objectKey, err := s.basePath.ObjectKey(targetKey)
+	if err != nil {
+		return nil, err
 	}
-
-	targetKey = path.Clean(targetKey)
-	targetKey = strings.TrimPrefix(targetKey, "/")
-	// Upload an object with storage.Writer.
-	wc := s.gcsClient.Bucket(s.bucketName).Object(targetKey).NewWriter(ctx)
+	// Upload an object with storage.Writer. Cancelling the context
+	// aborts the upload without committing the partial content.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wc := s.gcsClient.Bucket(s.bucketName).Object(objectKey).NewWriter(ctx)
+	wc.ContentType = opts.ContentType
+	wc.CacheControl = opts.CacheControl
+	wc.ContentDisposition = opts.ContentDisposition
+	wc.Metadata = mediastore.NormalizeMetadata(opts.Metadata)
 	if _, err = io.Copy(wc, contentSource); err != nil {
 		return nil, errors.Wrap("copy file io.Copy", err)
 	}
@@ -144,42 +167,365 @@ func (s *Service) PutObject(targetKey string, contentSource io.Reader) (uploadIn
 		return nil, errors.Wrap("writer.Close", err)
 	}
 
+	attrs := wc.Attrs()
 	return &mediastore.UploadInfo{
-		Bucket: s.bucketName,
-		Key:    targetKey,
+		Bucket:       s.bucketName,
+		Key:          s.basePath.RelativeKey(objectKey),
+		ETag:         attrs.Etag,
+		LastModified: attrs.Updated,
+		Size:         int(attrs.Size),
 	}, nil
 }
 
-func (s *Service) GetPublicObject(sourceKey string) (targetURl string, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*50)
-	defer cancel()
+// GetPublicObject returns the MediaLink of the object, which doesn't
+// expire, if neither an expiry nor response overrides are requested.
+// Otherwise it creates a V4 signed URL for downloading the object, valid
+// for PresignExpiryDefault if opts.Expiry is not positive. The signing
+// credentials are taken from the credential file used by the client.
+func (s *Service) GetPublicObject(
+	ctx context.Context,
+	sourceKey string,
+	opts mediastore.PublicURLOptions,
+) (targetURl string, err error) {
+	objectKey, err := s.basePath.ObjectKey(sourceKey)
+	if err != nil {
+		return "", err
+	}
+	query := opts.ResponseQuery()
+	if opts.Expiry <= 0 && len(query) == 0 {
+		attrs, err := s.gcsClient.Bucket(s.bucketName).Object(objectKey).Attrs(ctx)
+		if err != nil {
+			return "", errors.Wrap(fmt.Sprintf("Object(%q).Attrs", sourceKey), translateError(err))
+		}
+		return attrs.MediaLink, nil
+	}
 
-	obj := s.gcsClient.Bucket(s.bucketName).Object(sourceKey)
+	expiry := opts.Expiry
+	if expiry <= 0 {
+		expiry = mediastore.PresignExpiryDefault
+	}
+	signedURL, err := s.gcsClient.Bucket(s.bucketName).SignedURL(objectKey, &gcs.SignedURLOptions{
+		Scheme:          gcs.SigningSchemeV4,
+		Method:          http.MethodGet,
+		Expires:         time.Now().Add(expiry),
+		QueryParameters: query,
+	})
+	if err != nil {
+		return "", errors.Wrap("sign URL", err)
+	}
+
+	return signedURL, nil
+}
+
+func (s *Service) GetObject(ctx context.Context, sourceKey string) (object *mediastore.ObjectReader, err error) {
+	// The reader doesn't provide all the attributes, get them first and
+	// then read the same generation of the object.
+	obj, err := s.object(sourceKey)
+	if err != nil {
+		return nil, err
+	}
 	attrs, err := obj.Attrs(ctx)
 	if err != nil {
-		return "", errors.Wrap(fmt.Sprintf("Object(%q).Attrs", sourceKey), err)
+		return nil, errors.Wrap(fmt.Sprintf("Object(%q).Attrs", sourceKey), translateError(err))
+	}
+	rc, err := obj.Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		return nil, errors.Wrap(fmt.Sprintf("Object(%q).NewReader", sourceKey), translateError(err))
 	}
 
-	return attrs.MediaLink, nil
+	return &mediastore.ObjectReader{
+		ReadCloser: rc,
+		Info:       objectInfo(sourceKey, attrs),
+	}, nil
 }
 
-func (s *Service) GetObject(sourceKey string) (stream *bytes.Buffer, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*50)
-	defer cancel()
+func (s *Service) GetObjectRange(
+	ctx context.Context,
+	sourceKey string,
+	offset, length int64,
+) (object *mediastore.ObjectReader, err error) {
+	obj, err := s.object(sourceKey)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return nil, errors.Wrap(fmt.Sprintf("Object(%q).Attrs", sourceKey), translateError(err))
+	}
+	length, err = mediastore.ResolveRange(attrs.Size, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := obj.Generation(attrs.Generation).NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, errors.Wrap(fmt.Sprintf("Object(%q).NewRangeReader", sourceKey), translateError(err))
+	}
 
-	rc, err := s.gcsClient.Bucket(s.bucketName).Object(sourceKey).NewReader(ctx)
+	return &mediastore.ObjectReader{
+		ReadCloser: rc,
+		Info:       objectInfo(sourceKey, attrs),
+	}, nil
+}
+
+func (s *Service) ListObjects(
+	ctx context.Context,
+	prefix string,
+	pageToken string,
+	limit int,
+) (*mediastore.ObjectList, error) {
+	if limit <= 0 {
+		limit = mediastore.ListObjectsLimitDefault
+	}
+
+	prefixKey, err := s.basePath.PrefixKey(prefix)
 	if err != nil {
-		return nil, errors.Wrap(fmt.Sprintf("Object(%q).NewReader", sourceKey), err)
+		return nil, err
+	}
+	query := &gcs.Query{Prefix: prefixKey}
+	if err := query.SetAttrSelection([]string{"Name", "Size", "Etag", "Updated"}); err != nil {
+		return nil, errors.Wrap("query.SetAttrSelection", err)
 	}
-	defer rc.Close()
+	it := s.gcsClient.Bucket(s.bucketName).Objects(ctx, query)
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(rc)
+	var attrsList []*gcs.ObjectAttrs
+	nextPageToken, err := iterator.NewPager(it, limit, pageToken).NextPage(&attrsList)
+	if err != nil {
+		return nil, errors.Wrap("list objects", err)
+	}
 
-	return buf, nil
+	objects := make([]mediastore.ObjectInfo, 0, len(attrsList))
+	for _, attrs := range attrsList {
+		key := s.basePath.RelativeKey(attrs.Name)
+		// The objects of the upload sessions are not part of the store.
+		if isUploadKey(key) {
+			continue
+		}
+		objects = append(objects, mediastore.ObjectInfo{
+			Key:          key,
+			Size:         attrs.Size,
+			ETag:         attrs.Etag,
+			LastModified: attrs.Updated,
+		})
+	}
+
+	return &mediastore.ObjectList{
+		Objects:       objects,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+func (s *Service) DeleteObject(ctx context.Context, sourceKey string) error {
+	obj, err := s.object(sourceKey)
+	if err != nil {
+		return err
+	}
+	err = obj.Delete(ctx)
+	if err != nil && !errors.Is(err, gcs.ErrObjectNotExist) {
+		return errors.Wrap(fmt.Sprintf("Object(%q).Delete", sourceKey), err)
+	}
+	return nil
 }
 
-var _ mediastore.Service = &Service{}
+func (s *Service) StatObject(ctx context.Context, sourceKey string) (*mediastore.ObjectInfo, error) {
+	obj, err := s.object(sourceKey)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return nil, errors.Wrap(fmt.Sprintf("Object(%q).Attrs", sourceKey), translateError(err))
+	}
+
+	info := objectInfo(sourceKey, attrs)
+	return &info, nil
+}
+
+// object returns the handle of the object whose key is relative to the
+// base path.
+func (s *Service) object(key string) (*gcs.ObjectHandle, error) {
+	objectKey, err := s.basePath.ObjectKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.gcsClient.Bucket(s.bucketName).Object(objectKey), nil
+}
+
+func objectInfo(objectKey string, attrs *gcs.ObjectAttrs) mediastore.ObjectInfo {
+	return mediastore.ObjectInfo{
+		Key:                objectKey,
+		Size:               attrs.Size,
+		ContentType:        attrs.ContentType,
+		CacheControl:       attrs.CacheControl,
+		ContentDisposition: attrs.ContentDisposition,
+		ETag:               attrs.Etag,
+		LastModified:       attrs.Updated,
+		Metadata:           mediastore.NormalizeMetadata(attrs.Metadata),
+	}
+}
+
+// PresignPutObject creates a V4 signed URL for uploading the object with
+// a PUT request. The signing credentials are taken from the credential
+// file used by the client.
+func (s *Service) PresignPutObject(
+	ctx context.Context,
+	targetKey string,
+	opts mediastore.PresignPutOptions,
+) (*mediastore.PresignedRequest, error) {
+	expiry := opts.Expiry
+	if expiry <= 0 {
+		expiry = mediastore.PresignExpiryDefault
+	}
+	expires := time.Now().Add(expiry)
+
+	header := http.Header{}
+	signOpts := &gcs.SignedURLOptions{
+		Scheme:  gcs.SigningSchemeV4,
+		Method:  http.MethodPut,
+		Expires: expires,
+	}
+	if opts.ContentType != "" {
+		signOpts.ContentType = opts.ContentType
+		header.Set("Content-Type", opts.ContentType)
+	}
+	if opts.MaxSize > 0 {
+		lengthRange := "0," + strconv.FormatInt(opts.MaxSize, 10)
+		signOpts.Headers = []string{"x-goog-content-length-range:" + lengthRange}
+		header.Set("X-Goog-Content-Length-Range", lengthRange)
+	}
+
+	objectKey, err := s.basePath.ObjectKey(targetKey)
+	if err != nil {
+		return nil, err
+	}
+	signedURL, err := s.gcsClient.Bucket(s.bucketName).SignedURL(objectKey, signOpts)
+	if err != nil {
+		return nil, errors.Wrap("sign URL", err)
+	}
+
+	return &mediastore.PresignedRequest{
+		Method:  http.MethodPut,
+		URL:     signedURL,
+		Header:  header,
+		Expires: expires,
+	}, nil
+}
+
+func (s *Service) CopyObject(ctx context.Context, srcKey, dstKey string) error {
+	src, err := s.object(srcKey)
+	if err != nil {
+		return err
+	}
+	dst, err := s.object(dstKey)
+	if err != nil {
+		return err
+	}
+	// The copier keeps the attributes of the source object.
+	if _, err := dst.CopierFrom(src).Run(ctx); err != nil {
+		return errors.Wrap(fmt.Sprintf("Object(%q).CopierFrom(%q)", dstKey, srcKey), translateError(err))
+	}
+	return nil
+}
+
+// MoveObject copies the object and then deletes the source, GCS doesn't
+// provide a rename.
+func (s *Service) MoveObject(ctx context.Context, srcKey, dstKey string) error {
+	if err := s.CopyObject(ctx, srcKey, dstKey); err != nil {
+		return err
+	}
+	return s.DeleteObject(ctx, srcKey)
+}
+
+// HealthCheck checks that the bucket is reachable with the credentials
+// and that the objects could be written.
+func (s *Service) HealthCheck(ctx context.Context) error {
+	if _, err := s.gcsClient.Bucket(s.bucketName).Attrs(ctx); err != nil {
+		return errors.Wrap("bucket attrs", err)
+	}
+	return mediastore.CheckWritable(ctx, s)
+}
+
+// SetLifecycle replaces the lifecycle configuration of the bucket with
+// the expirations and the transitions of the rules. The bucket is left as
+// it is if BucketOperation is not enabled.
+func (s *Service) SetLifecycle(ctx context.Context, config mediastore.LifecycleConfig) error {
+	if !s.bucketOperation {
+		log.Warn().Str("bucket", s.bucketName).
+			Msg("Bucket operation disabled, the lifecycle rules must be configured on the bucket")
+		return nil
+	}
+
+	var rules []gcs.LifecycleRule
+	for _, rule := range config.Rules {
+		var matchesPrefix []string
+		prefix, err := s.basePath.PrefixKey(rule.Prefix)
+		if err != nil {
+			return errors.Wrap("rule prefix", err)
+		}
+		if prefix != "" {
+			matchesPrefix = []string{prefix}
+		}
+		if rule.ExpirationDays > 0 {
+			rules = append(rules, gcs.LifecycleRule{
+				Action: gcs.LifecycleAction{Type: gcs.DeleteAction},
+				Condition: gcs.LifecycleCondition{
+					AgeInDays:     int64(rule.ExpirationDays),
+					MatchesPrefix: matchesPrefix,
+				},
+			})
+		}
+		for _, transition := range rule.Transitions {
+			rules = append(rules, gcs.LifecycleRule{
+				Action: gcs.LifecycleAction{
+					Type:         gcs.SetStorageClassAction,
+					StorageClass: transition.StorageClass,
+				},
+				Condition: gcs.LifecycleCondition{
+					AllObjects:    transition.Days == 0,
+					AgeInDays:     int64(transition.Days),
+					MatchesPrefix: matchesPrefix,
+				},
+			})
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	_, err := s.gcsClient.Bucket(s.bucketName).Update(ctx, gcs.BucketAttrsToUpdate{
+		Lifecycle: &gcs.Lifecycle{Rules: rules},
+	})
+	if err != nil {
+		return errors.Wrap("update bucket lifecycle", err)
+	}
+	return nil
+}
+
+var _ mediastore.ServiceV2 = &Service{}
+var _ mediastore.Copier = &Service{}
+var _ mediastore.Presigner = &Service{}
+var _ mediastore.MultipartUploader = &Service{}
+var _ mediastore.HealthChecker = &Service{}
+var _ mediastore.LifecycleConfigurer = &Service{}
+
+// ClassifyError relies on the client library, which retries the
+// transient errors itself, to tell the retryable errors apart.
+func (s *Service) ClassifyError(err error) mediastore.ErrorClass {
+	if gcs.ShouldRetry(err) {
+		return mediastore.ErrorClassRetryable
+	}
+	return mediastore.ErrorClassUnknown
+}
+
+var _ mediastore.ErrorClassifier = &Service{}
+
+// translateError maps the errors of the client library into the errors
+// defined by mediastore.
+func translateError(err error) error {
+	if errors.Is(err, gcs.ErrObjectNotExist) {
+		return mediastore.ErrObjectNotFound
+	}
+	return err
+}
 
 func (conf *Config) IsAvailableCredentials() (bool, error) {
 	if conf.CredentialFile == "" {
@@ -1 +1,251 @@
 package gcs
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gcs "cloud.google.com/go/storage"
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+	"google.golang.org/api/option"
+)
+
+func TestBasePathEscape(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNotImplemented)
+	}))
+	defer srv.Close()
+	client, err := gcs.NewClient(context.Background(),
+		option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	s := &Service{bucketName: "bucket", gcsClient: client, basePath: "tenant"}
+	ctx := context.Background()
+
+	testCases := []struct {
+		name string
+		call func() error
+	}{
+		{"put", func() error {
+			_, err := s.PutObject(ctx, "../other/x", strings.NewReader("x"), mediastore.PutObjectOptions{})
+			return err
+		}},
+		{"get", func() error {
+			_, err := s.GetObject(ctx, "../other/x")
+			return err
+		}},
+		{"get range", func() error {
+			_, err := s.GetObjectRange(ctx, "a/../../other/x", 0, 1)
+			return err
+		}},
+		{"public URL", func() error {
+			_, err := s.GetPublicObject(ctx, "../other/x", mediastore.PublicURLOptions{})
+			return err
+		}},
+		{"list", func() error {
+			_, err := s.ListObjects(ctx, "../other/", "", 10)
+			return err
+		}},
+		{"delete", func() error { return s.DeleteObject(ctx, "../other/x") }},
+		{"stat", func() error {
+			_, err := s.StatObject(ctx, "..")
+			return err
+		}},
+		{"presign", func() error {
+			_, err := s.PresignPutObject(ctx, "../other/x", mediastore.PresignPutOptions{})
+			return err
+		}},
+		{"copy from", func() error { return s.CopyObject(ctx, "../other/x", "x") }},
+		{"copy to", func() error { return s.CopyObject(ctx, "x", "../other/x") }},
+		{"initiate upload", func() error {
+			_, err := s.InitiateUpload(ctx, "../other/x", mediastore.PutObjectOptions{})
+			return err
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var argErr errors.ArgumentError
+			if err := tc.call(); !errors.As(err, &argErr) {
+				t.Errorf("got %v, want an argument error", err)
+			}
+		})
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("%d requests sent to the backend", n)
+	}
+}
+
+// newFakeService creates a service whose client sends its requests to
+// handler, with the credentials of a service account which are able to
+// sign URLs.
+func newFakeService(t *testing.T, handler http.Handler) *Service {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"access_token":"token","token_type":"Bearer","expires_in":3600}`)
+	})
+	mux.Handle("/", handler)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	credentials, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "media@project.iam.gserviceaccount.com",
+		"private_key_id": "key",
+		"private_key":    string(keyPEM),
+		"token_uri":      srv.URL + "/token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := gcs.NewClient(context.Background(),
+		option.WithEndpoint(srv.URL), option.WithCredentialsJSON(credentials))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return &Service{bucketName: "bucket", gcsClient: client}
+}
+
+func TestGetPublicObject(t *testing.T) {
+	var attrsRequests int32
+	s := newFakeService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attrsRequests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"bucket":"bucket","name":"key","mediaLink":"https://media.example/key"}`)
+	}))
+
+	testCases := []struct {
+		name      string
+		opts      mediastore.PublicURLOptions
+		mediaLink bool
+		expires   time.Duration
+		query     map[string]string
+	}{
+		{name: "default", mediaLink: true},
+		{name: "expiry", opts: mediastore.PublicURLOptions{Expiry: time.Hour}, expires: time.Hour},
+		{name: "response overrides", opts: mediastore.PublicURLOptions{ContentType: "text/plain"},
+			expires: mediastore.PresignExpiryDefault, query: map[string]string{"response-content-type": "text/plain"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(&attrsRequests, 0)
+			publicURL, err := s.GetPublicObject(context.Background(), "key", tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.mediaLink {
+				if publicURL != "https://media.example/key" {
+					t.Errorf("got %q, want the media link", publicURL)
+				}
+				return
+			}
+			if n := atomic.LoadInt32(&attrsRequests); n != 0 {
+				t.Errorf("%d requests for a signed URL", n)
+			}
+			u, err := url.Parse(publicURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query := u.Query()
+			// The expiry is rounded down to the second of the signing time.
+			seconds, _ := strconv.ParseInt(query.Get("X-Goog-Expires"), 10, 64)
+			if got := time.Duration(seconds) * time.Second; got > tc.expires || got < tc.expires-time.Second {
+				t.Errorf("expires: got %v, want %v", got, tc.expires)
+			}
+			for name, value := range tc.query {
+				if got := query.Get(name); got != value {
+					t.Errorf("%s: got %q, want %q", name, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestObjectAttributes(t *testing.T) {
+	var uploaded map[string]any
+	s := newFakeService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPost {
+			// The first part of the multipart upload is the resource of
+			// the object.
+			_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			part, err := multipart.NewReader(r.Body, params["boundary"]).NextPart()
+			if err == nil {
+				err = json.NewDecoder(part).Decode(&uploaded)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		_, _ = io.WriteString(w, `{"bucket":"bucket","name":"key","size":"7","contentType":"text/csv",`+
+			`"cacheControl":"no-cache","contentDisposition":"inline","etag":"etag",`+
+			`"updated":"2023-04-05T10:00:00Z","metadata":{"owner":"acme"}}`)
+	}))
+	ctx := context.Background()
+
+	_, err := s.PutObject(ctx, "key", strings.NewReader("content"), mediastore.PutObjectOptions{
+		ContentType:        "text/csv",
+		CacheControl:       "no-cache",
+		ContentDisposition: "inline",
+		Metadata:           map[string]string{"Owner": "acme"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range map[string]any{
+		"contentType":        "text/csv",
+		"cacheControl":       "no-cache",
+		"contentDisposition": "inline",
+		"metadata":           map[string]any{"owner": "acme"},
+	} {
+		if got := uploaded[name]; !reflect.DeepEqual(got, value) {
+			t.Errorf("uploaded %s: got %v, want %v", name, got, value)
+		}
+	}
+
+	info, err := s.StatObject(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mediastore.ObjectInfo{
+		Key:                "key",
+		Size:               7,
+		ContentType:        "text/csv",
+		CacheControl:       "no-cache",
+		ContentDisposition: "inline",
+		ETag:               "etag",
+		LastModified:       time.Date(2023, 4, 5, 10, 0, 0, 0, time.UTC),
+		Metadata:           map[string]string{"owner": "acme"},
+	}
+	if !reflect.DeepEqual(*info, want) {
+		t.Errorf("stat: got %+v, want %+v", *info, want)
+	}
+}
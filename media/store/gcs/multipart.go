@@ -0,0 +1,346 @@
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	gcs "cloud.google.com/go/storage"
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+	"google.golang.org/api/iterator"
+)
+
+// The upload sessions are kept as objects under uploadsPrefix: a session
+// object, which holds the attributes of the object to create, and an
+// object for each part. Completing the upload composes the parts into the
+// object. Unlike a GCS resumable upload, which only accepts the content in
+// order, the parts could be uploaded in any order and concurrently.
+const uploadsPrefix = ".uploads/"
+
+const (
+	uploadSessionName    = "session"
+	uploadPartNamePrefix = "part-"
+	uploadKeyMetadata    = "upload-key"
+
+	// composeSourcesMax is the number of objects GCS composes at once.
+	composeSourcesMax = 32
+)
+
+type uploadSession struct {
+	ContentType        string            `json:"content_type,omitempty"`
+	CacheControl       string            `json:"cache_control,omitempty"`
+	ContentDisposition string            `json:"content_disposition,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+// uploadObject returns the handle of an object of the upload. The upload
+// IDs are checked with IsUploadID, so the key is within the base path.
+func (s *Service) uploadObject(uploadID, name string) *gcs.ObjectHandle {
+	objectKey, _ := s.basePath.ObjectKey(uploadsPrefix + uploadID + "/" + name)
+	return s.gcsClient.Bucket(s.bucketName).Object(objectKey)
+}
+
+// uploadsPrefixKey is like uploadObject but returns the prefix of the keys
+// of the objects of the upload, or of all the uploads if uploadID is
+// empty.
+func (s *Service) uploadsPrefixKey(uploadID string) string {
+	if uploadID != "" {
+		uploadID += "/"
+	}
+	prefixKey, _ := s.basePath.PrefixKey(uploadsPrefix + uploadID)
+	return prefixKey
+}
+
+func uploadPartName(partNumber int) string {
+	return fmt.Sprintf("%s%05d", uploadPartNamePrefix, partNumber)
+}
+
+func isUploadKey(key string) bool {
+	return strings.HasPrefix(key, uploadsPrefix)
+}
+
+func (s *Service) InitiateUpload(
+	ctx context.Context,
+	targetKey string,
+	opts mediastore.PutObjectOptions,
+) (string, error) {
+	if _, err := s.basePath.ObjectKey(targetKey); err != nil {
+		return "", err
+	}
+	uploadID, err := mediastore.NewUploadID()
+	if err != nil {
+		return "", errors.Wrap("generate upload ID", err)
+	}
+	b, err := json.Marshal(uploadSession{
+		ContentType:        opts.ContentType,
+		CacheControl:       opts.CacheControl,
+		ContentDisposition: opts.ContentDisposition,
+		Metadata:           mediastore.NormalizeMetadata(opts.Metadata),
+	})
+	if err != nil {
+		return "", errors.Wrap("encode session", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wc := s.uploadObject(uploadID, uploadSessionName).NewWriter(ctx)
+	wc.ContentType = "application/json"
+	wc.Metadata = map[string]string{uploadKeyMetadata: targetKey}
+	if _, err = wc.Write(b); err != nil {
+		return "", errors.Wrap("write session", err)
+	}
+	if err = wc.Close(); err != nil {
+		return "", errors.Wrap("writer.Close", err)
+	}
+	return uploadID, nil
+}
+
+// readUploadSession returns the session of the upload, checking that it's
+// the session of the object.
+func (s *Service) readUploadSession(ctx context.Context, targetKey, uploadID string) (*uploadSession, error) {
+	if !mediastore.IsUploadID(uploadID) {
+		return nil, errors.Wrap(uploadID, mediastore.ErrUploadNotFound)
+	}
+	rc, err := s.uploadObject(uploadID, uploadSessionName).NewReader(ctx)
+	if err != nil {
+		if errors.Is(err, gcs.ErrObjectNotExist) {
+			return nil, errors.Wrap(uploadID, mediastore.ErrUploadNotFound)
+		}
+		return nil, errors.Wrap("read session", err)
+	}
+	defer rc.Close()
+
+	attrs, err := s.uploadObject(uploadID, uploadSessionName).Generation(rc.Attrs.Generation).Attrs(ctx)
+	if err != nil {
+		return nil, errors.Wrap("session attrs", translateError(err))
+	}
+	if attrs.Metadata[uploadKeyMetadata] != targetKey {
+		return nil, errors.Wrap(uploadID, mediastore.ErrUploadNotFound)
+	}
+	var session uploadSession
+	if err = json.NewDecoder(rc).Decode(&session); err != nil {
+		return nil, errors.Wrap("decode session", err)
+	}
+	return &session, nil
+}
+
+func (s *Service) UploadPart(
+	ctx context.Context,
+	targetKey, uploadID string,
+	partNumber int,
+	contentSource io.Reader,
+	size int64,
+) (*mediastore.UploadPart, error) {
+	if _, err := s.readUploadSession(ctx, targetKey, uploadID); err != nil {
+		return nil, err
+	}
+
+	// Cancelling the context aborts the upload without committing the
+	// partial content.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wc := s.uploadObject(uploadID, uploadPartName(partNumber)).NewWriter(ctx)
+	written, err := io.Copy(wc, contentSource)
+	if err != nil {
+		return nil, errors.Wrap("copy part io.Copy", err)
+	}
+	if size >= 0 && written != size {
+		return nil, errors.ArgMsg("size", "does not match the content")
+	}
+	if err = wc.Close(); err != nil {
+		return nil, errors.Wrap("writer.Close", err)
+	}
+
+	attrs := wc.Attrs()
+	return &mediastore.UploadPart{
+		PartNumber:   partNumber,
+		Size:         attrs.Size,
+		ETag:         attrs.Etag,
+		LastModified: attrs.Updated,
+	}, nil
+}
+
+func (s *Service) ListUploadParts(ctx context.Context, targetKey, uploadID string) ([]mediastore.UploadPart, error) {
+	if _, err := s.readUploadSession(ctx, targetKey, uploadID); err != nil {
+		return nil, err
+	}
+	return s.listUploadParts(ctx, uploadID)
+}
+
+func (s *Service) listUploadParts(ctx context.Context, uploadID string) ([]mediastore.UploadPart, error) {
+	namePrefix := s.uploadsPrefixKey(uploadID) + uploadPartNamePrefix
+	query := &gcs.Query{Prefix: namePrefix}
+	if err := query.SetAttrSelection([]string{"Name", "Size", "Etag", "Updated"}); err != nil {
+		return nil, errors.Wrap("query.SetAttrSelection", err)
+	}
+	it := s.gcsClient.Bucket(s.bucketName).Objects(ctx, query)
+
+	var parts []mediastore.UploadPart
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap("list parts", err)
+		}
+		partNumber, err := strconv.Atoi(strings.TrimPrefix(attrs.Name, namePrefix))
+		if err != nil {
+			continue
+		}
+		parts = append(parts, mediastore.UploadPart{
+			PartNumber:   partNumber,
+			Size:         attrs.Size,
+			ETag:         attrs.Etag,
+			LastModified: attrs.Updated,
+		})
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	return parts, nil
+}
+
+// CompleteUpload composes the parts into the object. As GCS composes up to
+// 32 objects at once, the parts of larger uploads are composed into
+// intermediate objects first.
+func (s *Service) CompleteUpload(ctx context.Context, targetKey, uploadID string) (*mediastore.UploadInfo, error) {
+	session, err := s.readUploadSession(ctx, targetKey, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := s.listUploadParts(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		return nil, errors.ArgMsg("uploadID", "no parts uploaded")
+	}
+
+	sources := make([]*gcs.ObjectHandle, 0, len(parts))
+	for _, part := range parts {
+		sources = append(sources, s.uploadObject(uploadID, uploadPartName(part.PartNumber)))
+	}
+	for level := 0; len(sources) > composeSourcesMax; level++ {
+		var composed []*gcs.ObjectHandle
+		for i := 0; i < len(sources); i += composeSourcesMax {
+			end := i + composeSourcesMax
+			if end > len(sources) {
+				end = len(sources)
+			}
+			dst := s.uploadObject(uploadID, fmt.Sprintf("compose-%d-%05d", level, i/composeSourcesMax))
+			if _, err = dst.ComposerFrom(sources[i:end]...).Run(ctx); err != nil {
+				return nil, errors.Wrap("compose parts", err)
+			}
+			composed = append(composed, dst)
+		}
+		sources = composed
+	}
+
+	target, err := s.object(targetKey)
+	if err != nil {
+		return nil, err
+	}
+	composer := target.ComposerFrom(sources...)
+	composer.ContentType = session.ContentType
+	composer.CacheControl = session.CacheControl
+	composer.ContentDisposition = session.ContentDisposition
+	composer.Metadata = session.Metadata
+	attrs, err := composer.Run(ctx)
+	if err != nil {
+		return nil, errors.Wrap("compose object", err)
+	}
+
+	if err = s.deleteUpload(ctx, uploadID); err != nil {
+		return nil, err
+	}
+	return &mediastore.UploadInfo{
+		Bucket:       s.bucketName,
+		Key:          targetKey,
+		ETag:         attrs.Etag,
+		LastModified: attrs.Updated,
+		Size:         int(attrs.Size),
+		UploadID:     uploadID,
+	}, nil
+}
+
+func (s *Service) AbortUpload(ctx context.Context, targetKey, uploadID string) error {
+	if _, err := s.readUploadSession(ctx, targetKey, uploadID); err != nil {
+		return err
+	}
+	return s.deleteUpload(ctx, uploadID)
+}
+
+// deleteUpload deletes all the objects of the upload, the session object
+// last so that the session could be aborted again if this fails.
+func (s *Service) deleteUpload(ctx context.Context, uploadID string) error {
+	query := &gcs.Query{Prefix: s.uploadsPrefixKey(uploadID)}
+	if err := query.SetAttrSelection([]string{"Name"}); err != nil {
+		return errors.Wrap("query.SetAttrSelection", err)
+	}
+	bucket := s.gcsClient.Bucket(s.bucketName)
+	sessionName := s.uploadObject(uploadID, uploadSessionName).ObjectName()
+	it := bucket.Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return errors.Wrap("list upload objects", err)
+		}
+		if attrs.Name == sessionName {
+			continue
+		}
+		if err = bucket.Object(attrs.Name).Delete(ctx); err != nil && !errors.Is(err, gcs.ErrObjectNotExist) {
+			return errors.Wrap("delete upload object", err)
+		}
+	}
+	err := bucket.Object(sessionName).Delete(ctx)
+	if err != nil && !errors.Is(err, gcs.ErrObjectNotExist) {
+		return errors.Wrap("delete upload session", err)
+	}
+	return nil
+}
+
+func (s *Service) ListUploads(ctx context.Context, prefix string) ([]mediastore.UploadSession, error) {
+	query := &gcs.Query{Prefix: s.uploadsPrefixKey("")}
+	if err := query.SetAttrSelection([]string{"Name", "Metadata", "Created"}); err != nil {
+		return nil, errors.Wrap("query.SetAttrSelection", err)
+	}
+	it := s.gcsClient.Bucket(s.bucketName).Objects(ctx, query)
+
+	var sessions []mediastore.UploadSession
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap("list uploads", err)
+		}
+		relName := strings.TrimPrefix(s.basePath.RelativeKey(attrs.Name), uploadsPrefix)
+		uploadID, name, _ := strings.Cut(relName, "/")
+		key := attrs.Metadata[uploadKeyMetadata]
+		if name != uploadSessionName || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		sessions = append(sessions, mediastore.UploadSession{
+			Key:       key,
+			UploadID:  uploadID,
+			Initiated: attrs.Created,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Key != sessions[j].Key {
+			return sessions[i].Key < sessions[j].Key
+		}
+		return sessions[i].Initiated.Before(sessions[j].Initiated)
+	})
+	return sessions, nil
+}
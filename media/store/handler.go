@@ -0,0 +1,129 @@
+package store
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/timemore/foundation/errors"
+)
+
+// Handler returns an http.Handler which serves the objects for GET and
+// HEAD requests, with support for range requests and for the conditional
+// requests based on the ETag and the modification time of the objects.
+// The handler expects the object key as the request path, it should be
+// mounted with http.StripPrefix.
+func (mediaStore *Store) Handler() http.Handler {
+	return http.HandlerFunc(mediaStore.serveHTTP)
+}
+
+func (mediaStore *Store) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodHead)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	objectKey := strings.TrimPrefix(r.URL.Path, "/")
+	if objectKey == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	info, err := mediaStore.Stat(r.Context(), objectKey)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	header := w.Header()
+	if info.ETag != "" {
+		header.Set("ETag", `"`+info.ETag+`"`)
+	}
+	// Prevent http.ServeContent from reading the content to sniff it.
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header.Set("Content-Type", contentType)
+	if info.CacheControl != "" {
+		header.Set("Cache-Control", info.CacheControl)
+	}
+	if info.ContentDisposition != "" {
+		header.Set("Content-Disposition", info.ContentDisposition)
+	}
+
+	content := &objectRangeReader{
+		ctx:        r.Context(),
+		mediaStore: mediaStore,
+		objectKey:  objectKey,
+		size:       info.Size,
+	}
+	defer content.Close()
+
+	// ServeContent evaluates the Range, If-Range, If-None-Match,
+	// If-Modified-Since, If-Match and If-Unmodified-Since headers.
+	http.ServeContent(w, r, "", info.LastModified, content)
+}
+
+// objectRangeReader is an io.ReadSeeker of an object. The content is
+// downloaded from the position of the first Read after a Seek, so that
+// only the requested ranges are transferred.
+type objectRangeReader struct {
+	ctx        context.Context
+	mediaStore *Store
+	objectKey  string
+	size       int64
+
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *objectRangeReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		obj, err := r.mediaStore.DownloadRange(r.ctx, r.objectKey, r.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.body = obj.ReadCloser
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *objectRangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.ArgMsg("whence", "invalid")
+	}
+	if offset < 0 {
+		return 0, errors.ArgMsg("offset", "negative")
+	}
+	if offset != r.offset {
+		_ = r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *objectRangeReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
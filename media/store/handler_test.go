@@ -0,0 +1,166 @@
+package store_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+	"github.com/timemore/foundation/media/store/local"
+)
+
+func newLocalService(t *testing.T) mediastore.ServiceV2 {
+	t.Helper()
+	svc, err := local.NewServiceV2(&local.Config{DirectoryPath: t.TempDir(), SigningKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc
+}
+
+func TestDownloadRange(t *testing.T) {
+	backends := map[string]func(t *testing.T) mediastore.ServiceV2{
+		"memory": func(t *testing.T) mediastore.ServiceV2 { return newMemoryService(t) },
+		"local":  newLocalService,
+	}
+	testCases := []struct {
+		name    string
+		offset  int64
+		length  int64
+		want    string
+		wantErr error
+	}{
+		{name: "whole", offset: 0, length: -1, want: "0123456789"},
+		{name: "head", offset: 0, length: 4, want: "0123"},
+		{name: "middle", offset: 3, length: 4, want: "3456"},
+		{name: "open-ended", offset: 7, length: -1, want: "789"},
+		{name: "clamped", offset: 7, length: 100, want: "789"},
+		{name: "last byte", offset: 9, length: 1, want: "9"},
+		{name: "at the end", offset: 10, length: -1, wantErr: mediastore.ErrRangeNotSatisfiable},
+		{name: "beyond the end", offset: 20, length: 1, wantErr: mediastore.ErrRangeNotSatisfiable},
+	}
+	for backendName, newService := range backends {
+		svc := newService(t)
+		putObject(t, svc, "key", "0123456789")
+		mediaStore := newTestStore(t, mediastore.Config{}, svc)
+		for _, tc := range testCases {
+			t.Run(backendName+"/"+tc.name, func(t *testing.T) {
+				obj, err := mediaStore.DownloadRange(context.Background(), "key", tc.offset, tc.length)
+				if tc.wantErr != nil {
+					if !errors.Is(err, tc.wantErr) {
+						t.Fatalf("got %v, want %v", err, tc.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer obj.Close()
+				b, _ := io.ReadAll(obj)
+				if string(b) != tc.want {
+					t.Errorf("got %q, want %q", b, tc.want)
+				}
+				if obj.Info.Size != 10 {
+					t.Errorf("size: got %d, want the size of the object", obj.Info.Size)
+				}
+			})
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	svc := newMemoryService(t)
+	putObject(t, svc, "key", "0123456789")
+	info, err := svc.StatObject(context.Background(), "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := `"` + info.ETag + `"`
+	handler := newTestStore(t, mediastore.Config{}, svc).Handler()
+
+	testCases := []struct {
+		name    string
+		method  string
+		path    string
+		header  map[string]string
+		status  int
+		body    string
+		headers map[string]string
+	}{
+		{
+			name: "whole", method: http.MethodGet, path: "/key", status: http.StatusOK, body: "0123456789",
+			headers: map[string]string{"ETag": etag, "Accept-Ranges": "bytes"},
+		},
+		{name: "head", method: http.MethodHead, path: "/key", status: http.StatusOK},
+		{
+			name: "range", method: http.MethodGet, path: "/key",
+			header: map[string]string{"Range": "bytes=2-5"},
+			status: http.StatusPartialContent, body: "2345",
+			headers: map[string]string{"Content-Range": "bytes 2-5/10"},
+		},
+		{
+			name: "suffix range", method: http.MethodGet, path: "/key",
+			header: map[string]string{"Range": "bytes=-3"},
+			status: http.StatusPartialContent, body: "789",
+		},
+		{
+			name: "unsatisfiable range", method: http.MethodGet, path: "/key",
+			header: map[string]string{"Range": "bytes=20-"},
+			status: http.StatusRequestedRangeNotSatisfiable,
+		},
+		{
+			name: "if-none-match", method: http.MethodGet, path: "/key",
+			header: map[string]string{"If-None-Match": etag},
+			status: http.StatusNotModified,
+		},
+		{
+			name: "if-none-match changed", method: http.MethodGet, path: "/key",
+			header: map[string]string{"If-None-Match": `"other"`},
+			status: http.StatusOK, body: "0123456789",
+		},
+		{
+			name: "if-modified-since", method: http.MethodGet, path: "/key",
+			header: map[string]string{"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)},
+			status: http.StatusNotModified,
+		},
+		{
+			name: "if-match failed", method: http.MethodGet, path: "/key",
+			header: map[string]string{"If-Match": `"other"`},
+			status: http.StatusPreconditionFailed,
+		},
+		{
+			name: "if-range changed", method: http.MethodGet, path: "/key",
+			header: map[string]string{"Range": "bytes=2-5", "If-Range": `"other"`},
+			status: http.StatusOK, body: "0123456789",
+		},
+		{name: "not found", method: http.MethodGet, path: "/missing", status: http.StatusNotFound},
+		{name: "no key", method: http.MethodGet, path: "/", status: http.StatusNotFound},
+		{name: "method not allowed", method: http.MethodPost, path: "/key", status: http.StatusMethodNotAllowed},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			for name, value := range tc.header {
+				req.Header.Set(name, value)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tc.status {
+				t.Fatalf("status: got %d, want %d", rec.Code, tc.status)
+			}
+			if tc.body != "" && rec.Body.String() != tc.body {
+				t.Errorf("body: got %q, want %q", rec.Body.String(), tc.body)
+			}
+			for name, value := range tc.headers {
+				if got := rec.Header().Get(name); got != value {
+					t.Errorf("%s: got %q, want %q", name, got, value)
+				}
+			}
+		})
+	}
+}
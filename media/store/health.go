@@ -0,0 +1,187 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/timemore/foundation/app"
+	"github.com/timemore/foundation/errors"
+)
+
+// HealthCheckProbePrefix is the prefix of the keys of the objects written
+// by CheckWritable.
+const HealthCheckProbePrefix = ".health/"
+
+// CheckWritable writes a small object, reads its information back and
+// deletes it. The services use it in their HealthCheck after they have
+// checked the bucket. The key of the object is random so that the
+// instances sharing a bucket don't interfere. The probes which could not
+// be deleted are logged with their key, they are left in the storage.
+func CheckWritable(ctx context.Context, svc ServiceV2) error {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return errors.Wrap("generate probe key", err)
+	}
+	probeKey := HealthCheckProbePrefix + hex.EncodeToString(suffix)
+
+	const probeContent = "ok"
+	_, err := svc.PutObject(ctx, probeKey, strings.NewReader(probeContent), PutObjectOptions{
+		ContentType: "text/plain",
+	})
+	if err != nil {
+		return errors.Wrap("write probe", err)
+	}
+	info, err := svc.StatObject(ctx, probeKey)
+	if err != nil {
+		deleteProbe(svc, probeKey)
+		return errors.Wrap("stat probe", err)
+	}
+	if info.Size != int64(len(probeContent)) {
+		deleteProbe(svc, probeKey)
+		return errors.Msg("probe size mismatch")
+	}
+	if err = svc.DeleteObject(ctx, probeKey); err != nil {
+		log.Warn().Err(err).Str("key", probeKey).Msg("Unable to delete the health check probe")
+		return errors.Wrap("delete probe", err)
+	}
+	return nil
+}
+
+// deleteProbe deletes the probe of a failed check. The context of the
+// check might be the cause of the failure, e.g., it timed out, so the
+// probe is deleted with its own.
+func deleteProbe(svc ServiceV2, probeKey string) {
+	ctx, cancel := context.WithTimeout(context.Background(), HealthCheckTimeoutDefault)
+	defer cancel()
+	if err := svc.DeleteObject(ctx, probeKey); err != nil {
+		log.Warn().Err(err).Str("key", probeKey).Msg("Unable to delete the health check probe")
+	}
+}
+
+// HealthCheck checks that the storage is usable, e.g., that the
+// credentials are still valid. The returned error wraps
+// errors.ErrUnimplemented if the service is not able to check.
+func (mediaStore *Store) HealthCheck(ctx context.Context) error {
+	if err := HealthCheck(ctx, mediaStore.serviceClient); err != nil {
+		return errors.Wrap("health check", err)
+	}
+	return nil
+}
+
+const (
+	HealthCheckIntervalDefault = 30 * time.Second
+	HealthCheckTimeoutDefault  = 10 * time.Second
+)
+
+// HealthServer checks the store periodically so that its health is
+// reported along with the servers of the app, e.g., by
+// App.IsAllServersAcceptingClients. Add it with App.AddServer.
+type HealthServer struct {
+	mediaStore *Store
+	name       string
+	interval   time.Duration
+	timeout    time.Duration
+
+	mu      sync.RWMutex
+	lastErr error
+	checked bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+var _ app.ServiceServer = &HealthServer{}
+
+// NewHealthServer creates a HealthServer for the store.
+// HealthCheckIntervalDefault is used if interval is not positive. The store
+// is reported unhealthy until the first check succeeds. A service which is
+// not able to check is considered healthy.
+func NewHealthServer(mediaStore *Store, name string, interval time.Duration) (*HealthServer, error) {
+	if mediaStore == nil {
+		return nil, errors.ArgMsg("mediaStore", "missing")
+	}
+	if name == "" {
+		name = "Media store"
+	}
+	if interval <= 0 {
+		interval = HealthCheckIntervalDefault
+	}
+	timeout := HealthCheckTimeoutDefault
+	if timeout > interval {
+		timeout = interval
+	}
+	return &HealthServer{
+		mediaStore: mediaStore,
+		name:       name,
+		interval:   interval,
+		timeout:    timeout,
+		stop:       make(chan struct{}),
+	}, nil
+}
+
+func (srv *HealthServer) ServerName() string { return srv.name }
+
+// Serve checks the store at every interval until Shutdown is called.
+func (srv *HealthServer) Serve() error {
+	ticker := time.NewTicker(srv.interval)
+	defer ticker.Stop()
+	for {
+		srv.Check()
+		select {
+		case <-srv.stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (srv *HealthServer) Shutdown(ctx context.Context) error {
+	srv.stopOnce.Do(func() { close(srv.stop) })
+	return nil
+}
+
+// Check checks the store now and returns the result, which is also
+// reported by IsHealthy until the next check.
+func (srv *HealthServer) Check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), srv.timeout)
+	defer cancel()
+	err := srv.mediaStore.HealthCheck(ctx)
+	if errors.Is(err, errors.ErrUnimplemented) {
+		err = nil
+	}
+
+	srv.mu.Lock()
+	wasHealthy := srv.checked && srv.lastErr == nil
+	srv.lastErr = err
+	srv.checked = true
+	srv.mu.Unlock()
+
+	if err != nil {
+		log.Error().Err(err).Str("server", srv.name).Msg("Media store unhealthy")
+	} else if !wasHealthy {
+		log.Info().Str("server", srv.name).Msg("Media store healthy")
+	}
+	return err
+}
+
+// LastError returns the error of the last check. It returns nil if the
+// store has not been checked yet.
+func (srv *HealthServer) LastError() error {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	return srv.lastErr
+}
+
+func (srv *HealthServer) IsAcceptingClients() bool {
+	return srv.IsHealthy()
+}
+
+func (srv *HealthServer) IsHealthy() bool {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	return srv.checked && srv.lastErr == nil
+}
@@ -0,0 +1,131 @@
+package store_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+func TestCheckWritable(t *testing.T) {
+	testCases := []struct {
+		name string
+		op   mediastore.Operation
+		// probeLeft tells whether the probe is left in the storage.
+		probeLeft bool
+	}{
+		{name: "writable"},
+		{name: "put failure", op: mediastore.OperationPutObject},
+		{name: "stat failure", op: mediastore.OperationStatObject},
+		{name: "delete failure", op: mediastore.OperationDeleteObject, probeLeft: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := newMemoryService(t)
+			if tc.op != "" {
+				svc.InjectFailure(tc.op, errUnavailable)
+			}
+
+			err := mediastore.CheckWritable(context.Background(), svc)
+			if tc.op == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.op != "" && !errors.Is(err, errUnavailable) {
+				t.Fatalf("got %v, want the injected failure", err)
+			}
+			svc.ClearFailures()
+			probes := objectKeys(t, svc, mediastore.HealthCheckProbePrefix)
+			if tc.probeLeft {
+				if len(probes) != 1 || !strings.HasPrefix(probes[0], mediastore.HealthCheckProbePrefix) {
+					t.Errorf("probes: got %v, want one", probes)
+				}
+			} else if len(probes) != 0 {
+				t.Errorf("probes left: %v", probes)
+			}
+		})
+	}
+}
+
+// uncheckedService hides the HealthChecker of the service.
+type uncheckedService struct {
+	mediastore.ServiceV2
+}
+
+func TestHealthServer(t *testing.T) {
+	svc := newMemoryService(t)
+	srv, err := mediastore.NewHealthServer(newTestStore(t, mediastore.Config{}, svc), "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.IsHealthy() || srv.IsAcceptingClients() {
+		t.Error("healthy before the first check")
+	}
+
+	if err = srv.Check(); err != nil || !srv.IsHealthy() {
+		t.Fatalf("check: %v, healthy: %v", err, srv.IsHealthy())
+	}
+	svc.InjectFailure(mediastore.OperationHealthCheck, errUnavailable)
+	if err = srv.Check(); !errors.Is(err, errUnavailable) {
+		t.Fatalf("got %v, want the injected failure", err)
+	}
+	if srv.IsHealthy() || !errors.Is(srv.LastError(), errUnavailable) {
+		t.Errorf("healthy: %v, last error: %v", srv.IsHealthy(), srv.LastError())
+	}
+	svc.ClearFailures()
+	if err = srv.Check(); err != nil || !srv.IsHealthy() || srv.LastError() != nil {
+		t.Errorf("recovered: %v, healthy: %v", err, srv.IsHealthy())
+	}
+
+	// A service which is not able to check is healthy.
+	unchecked, err := mediastore.NewHealthServer(newTestStore(t, mediastore.Config{}, uncheckedService{svc}), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = unchecked.Check(); err != nil || !unchecked.IsHealthy() {
+		t.Errorf("unchecked: %v, healthy: %v", err, unchecked.IsHealthy())
+	}
+}
+
+func TestHealthServerServe(t *testing.T) {
+	svc := newMemoryService(t)
+	srv, err := mediastore.NewHealthServer(newTestStore(t, mediastore.Config{}, svc), "media", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.ServerName() != "media" {
+		t.Errorf("name: got %q", srv.ServerName())
+	}
+	svc.InjectFailure(mediastore.OperationHealthCheck, errUnavailable)
+
+	done := make(chan error)
+	go func() { done <- srv.Serve() }()
+	for deadline := time.Now().Add(5 * time.Second); srv.LastError() == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("not checked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// The checks go on until the shutdown.
+	svc.ClearFailures()
+	for deadline := time.Now().Add(5 * time.Second); !srv.IsHealthy(); {
+		if time.Now().After(deadline) {
+			t.Fatal("not checked again")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err = srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+}
@@ -0,0 +1,554 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+)
+
+// InstrumentationConfig configures the measurements of the calls to the
+// storage.
+type InstrumentationConfig struct {
+	// Enabled records the calls into DefaultMetrics and logs them. The
+	// successful calls are logged at the debug level.
+	Enabled bool `env:"ENABLED" yaml:"enabled" json:"enabled"`
+}
+
+// MetricsLatencyBucketsDefault are the upper bounds, in seconds, of the
+// buckets of the latency histograms.
+var MetricsLatencyBucketsDefault = []float64{
+	.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60,
+}
+
+// DefaultMetrics is the Metrics the stores created by New record into
+// when Config.Instrumentation is enabled.
+var DefaultMetrics = NewMetrics(nil)
+
+// The results of the calls, as labelled in the metrics.
+const (
+	metricsResultOK       = "ok"
+	metricsResultNotFound = "not_found"
+	metricsResultError    = "error"
+)
+
+// Metrics collects the counters, the byte totals and the latency
+// histograms of the calls, by backend and by operation. It could be shared
+// by several services, which are told apart by their backend name.
+type Metrics struct {
+	buckets []float64
+
+	mu         sync.Mutex
+	operations map[metricsKey]*operationMetrics
+}
+
+type metricsKey struct {
+	backend   string
+	operation Operation
+}
+
+type operationMetrics struct {
+	results         map[string]uint64
+	uploadedBytes   uint64
+	downloadedBytes uint64
+	// bucketCounts are not cumulative, they are summed up when written.
+	bucketCounts []uint64
+	durationSum  float64
+	count        uint64
+}
+
+// NewMetrics creates a Metrics with the latency buckets, in seconds.
+// MetricsLatencyBucketsDefault is used if buckets is empty.
+func NewMetrics(buckets []float64) *Metrics {
+	if len(buckets) == 0 {
+		buckets = MetricsLatencyBucketsDefault
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &Metrics{
+		buckets:    buckets,
+		operations: map[metricsKey]*operationMetrics{},
+	}
+}
+
+// operation returns the metrics of the operation. The caller must hold
+// the lock.
+func (m *Metrics) operation(backend string, op Operation) *operationMetrics {
+	key := metricsKey{backend: backend, operation: op}
+	opMetrics := m.operations[key]
+	if opMetrics == nil {
+		opMetrics = &operationMetrics{
+			results:      map[string]uint64{},
+			bucketCounts: make([]uint64, len(m.buckets)+1),
+		}
+		m.operations[key] = opMetrics
+	}
+	return opMetrics
+}
+
+func (m *Metrics) observe(backend string, op Operation, result string, duration time.Duration) {
+	seconds := duration.Seconds()
+	bucket := sort.SearchFloat64s(m.buckets, seconds)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	opMetrics := m.operation(backend, op)
+	opMetrics.results[result]++
+	opMetrics.bucketCounts[bucket]++
+	opMetrics.durationSum += seconds
+	opMetrics.count++
+}
+
+func (m *Metrics) addBytes(backend string, op Operation, uploaded, downloaded int64) {
+	if uploaded <= 0 && downloaded <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	opMetrics := m.operation(backend, op)
+	if uploaded > 0 {
+		opMetrics.uploadedBytes += uint64(uploaded)
+	}
+	if downloaded > 0 {
+		opMetrics.downloadedBytes += uint64(downloaded)
+	}
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	m.mu.Lock()
+	keys := make([]metricsKey, 0, len(m.operations))
+	snapshot := make(map[metricsKey]operationMetrics, len(m.operations))
+	for key, opMetrics := range m.operations {
+		keys = append(keys, key)
+		copied := *opMetrics
+		copied.results = make(map[string]uint64, len(opMetrics.results))
+		for result, n := range opMetrics.results {
+			copied.results[result] = n
+		}
+		copied.bucketCounts = append([]uint64(nil), opMetrics.bucketCounts...)
+		snapshot[key] = copied
+	}
+	m.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].backend != keys[j].backend {
+			return keys[i].backend < keys[j].backend
+		}
+		return keys[i].operation < keys[j].operation
+	})
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("# HELP mediastore_operations_total Number of calls to the storage by result.\n")
+	bw.WriteString("# TYPE mediastore_operations_total counter\n")
+	for _, key := range keys {
+		results := snapshot[key].results
+		names := make([]string, 0, len(results))
+		for result := range results {
+			names = append(names, result)
+		}
+		sort.Strings(names)
+		for _, result := range names {
+			writeMetric(bw, "mediastore_operations_total", key, `,result="`+result+`"`,
+				strconv.FormatUint(results[result], 10))
+		}
+	}
+
+	bw.WriteString("# HELP mediastore_uploaded_bytes_total Number of bytes sent to the storage.\n")
+	bw.WriteString("# TYPE mediastore_uploaded_bytes_total counter\n")
+	for _, key := range keys {
+		if n := snapshot[key].uploadedBytes; n > 0 {
+			writeMetric(bw, "mediastore_uploaded_bytes_total", key, "", strconv.FormatUint(n, 10))
+		}
+	}
+	bw.WriteString("# HELP mediastore_downloaded_bytes_total Number of bytes received from the storage.\n")
+	bw.WriteString("# TYPE mediastore_downloaded_bytes_total counter\n")
+	for _, key := range keys {
+		if n := snapshot[key].downloadedBytes; n > 0 {
+			writeMetric(bw, "mediastore_downloaded_bytes_total", key, "", strconv.FormatUint(n, 10))
+		}
+	}
+
+	bw.WriteString("# HELP mediastore_operation_duration_seconds Latency of the calls to the storage, up to the first byte of the downloads.\n")
+	bw.WriteString("# TYPE mediastore_operation_duration_seconds histogram\n")
+	for _, key := range keys {
+		opMetrics := snapshot[key]
+		var cumulative uint64
+		for i, upperBound := range m.buckets {
+			cumulative += opMetrics.bucketCounts[i]
+			writeMetric(bw, "mediastore_operation_duration_seconds_bucket", key,
+				`,le="`+strconv.FormatFloat(upperBound, 'g', -1, 64)+`"`,
+				strconv.FormatUint(cumulative, 10))
+		}
+		writeMetric(bw, "mediastore_operation_duration_seconds_bucket", key, `,le="+Inf"`,
+			strconv.FormatUint(opMetrics.count, 10))
+		writeMetric(bw, "mediastore_operation_duration_seconds_sum", key, "",
+			strconv.FormatFloat(opMetrics.durationSum, 'g', -1, 64))
+		writeMetric(bw, "mediastore_operation_duration_seconds_count", key, "",
+			strconv.FormatUint(opMetrics.count, 10))
+	}
+	return bw.Flush()
+}
+
+func writeMetric(w *bufio.Writer, name string, key metricsKey, extraLabels, value string) {
+	w.WriteString(name)
+	w.WriteString(`{backend="`)
+	w.WriteString(escapeLabelValue(key.backend))
+	w.WriteString(`",operation="`)
+	w.WriteString(escapeLabelValue(key.operation.String()))
+	w.WriteString(`"`)
+	w.WriteString(extraLabels)
+	w.WriteString("} ")
+	w.WriteString(value)
+	w.WriteString("\n")
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
+
+// Handler returns a handler which serves the metrics in the Prometheus
+// text format.
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := m.WritePrometheus(w); err != nil {
+			log.Error().Err(err).Msg("Writing media store metrics")
+		}
+	})
+}
+
+// NewInstrumentedService wraps the service so that its calls are recorded
+// into metrics, labelled with backend, and logged along with the key, the
+// size of the content and the duration. The duration of a download only
+// covers the call, i.e., the time to the first byte, not the reading of
+// the stream. Its bytes are counted as the stream is read and recorded
+// once it's closed.
+func NewInstrumentedService(svc ServiceV2, backend string, metrics *Metrics) (ServiceV2, error) {
+	if svc == nil {
+		return nil, errors.ArgMsg("svc", "missing")
+	}
+	if backend == "" {
+		return nil, errors.ArgMsg("backend", "empty")
+	}
+	if metrics == nil {
+		return nil, errors.ArgMsg("metrics", "missing")
+	}
+	return &instrumentedService{
+		svc:     svc,
+		backend: backend,
+		metrics: metrics,
+	}, nil
+}
+
+type instrumentedService struct {
+	svc     ServiceV2
+	backend string
+	metrics *Metrics
+}
+
+var (
+	_ ServiceV2         = &instrumentedService{}
+	_ Copier            = &instrumentedService{}
+	_ Presigner         = &instrumentedService{}
+	_ MultipartUploader = &instrumentedService{}
+	_ HealthChecker     = &instrumentedService{}
+)
+
+// observe records and logs the call which started at start. The size is
+// negative if it's not known.
+func (s *instrumentedService) observe(op Operation, key string, start time.Time, size int64, err error) {
+	duration := time.Since(start)
+	result := metricsResultOK
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrObjectNotFound), errors.Is(err, ErrUploadNotFound):
+		result = metricsResultNotFound
+	default:
+		result = metricsResultError
+	}
+	s.metrics.observe(s.backend, op, result, duration)
+
+	var event = log.Debug()
+	if result == metricsResultError {
+		event = log.Warn().Err(err)
+	}
+	if !event.Enabled() {
+		return
+	}
+	event = event.Str("backend", s.backend).Str("operation", op.String()).Dur("duration", duration)
+	if key != "" {
+		event = event.Str("key", key)
+	}
+	if size >= 0 {
+		event = event.Int64("size", size)
+	}
+	event.Msg("Media store " + op.String() + " " + result)
+}
+
+func (s *instrumentedService) PutObject(
+	ctx context.Context,
+	objectKey string,
+	content io.Reader,
+	opts PutObjectOptions,
+) (*UploadInfo, error) {
+	start := time.Now()
+	// The seekable content is passed as it is as the services rely on
+	// seeking, e.g., to retry.
+	var size int64 = -1
+	counter := &byteCounter{}
+	if seeker, ok := content.(io.Seeker); ok {
+		size = seekableSize(seeker)
+	} else {
+		content = io.TeeReader(content, counter)
+	}
+	info, err := s.svc.PutObject(ctx, objectKey, content, opts)
+	if size < 0 {
+		size = counter.n
+	}
+	if err == nil {
+		s.metrics.addBytes(s.backend, OperationPutObject, size, 0)
+	}
+	s.observe(OperationPutObject, objectKey, start, size, err)
+	return info, err
+}
+
+// seekableSize returns the number of bytes from the current position to
+// the end, or -1 if it could not be determined.
+func seekableSize(seeker io.Seeker) int64 {
+	current, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return -1
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return -1
+	}
+	if _, err = seeker.Seek(current, io.SeekStart); err != nil {
+		return -1
+	}
+	return end - current
+}
+
+func (s *instrumentedService) GetObject(ctx context.Context, objectKey string) (*ObjectReader, error) {
+	start := time.Now()
+	object, err := s.svc.GetObject(ctx, objectKey)
+	if err != nil {
+		s.observe(OperationGetObject, objectKey, start, -1, err)
+		return nil, err
+	}
+	s.observe(OperationGetObject, objectKey, start, object.Info.Size, nil)
+	object.ReadCloser = s.countDownload(OperationGetObject, object.ReadCloser)
+	return object, nil
+}
+
+func (s *instrumentedService) GetObjectRange(
+	ctx context.Context,
+	objectKey string,
+	offset, length int64,
+) (*ObjectReader, error) {
+	start := time.Now()
+	object, err := s.svc.GetObjectRange(ctx, objectKey, offset, length)
+	if err != nil {
+		s.observe(OperationGetObjectRange, objectKey, start, -1, err)
+		return nil, err
+	}
+	// The requested length could be negative or exceed the object, the
+	// size is the one of the range which is returned.
+	size, err := ResolveRange(object.Info.Size, offset, length)
+	if err != nil {
+		size = -1
+	}
+	s.observe(OperationGetObjectRange, objectKey, start, size, nil)
+	object.ReadCloser = s.countDownload(OperationGetObjectRange, object.ReadCloser)
+	return object, nil
+}
+
+func (s *instrumentedService) GetPublicObject(
+	ctx context.Context,
+	objectKey string,
+	opts PublicURLOptions,
+) (string, error) {
+	start := time.Now()
+	publicURL, err := s.svc.GetPublicObject(ctx, objectKey, opts)
+	s.observe(OperationGetPublicObject, objectKey, start, -1, err)
+	return publicURL, err
+}
+
+func (s *instrumentedService) ListObjects(
+	ctx context.Context,
+	prefix string,
+	pageToken string,
+	limit int,
+) (*ObjectList, error) {
+	start := time.Now()
+	list, err := s.svc.ListObjects(ctx, prefix, pageToken, limit)
+	s.observe(OperationListObjects, prefix, start, -1, err)
+	return list, err
+}
+
+func (s *instrumentedService) DeleteObject(ctx context.Context, objectKey string) error {
+	start := time.Now()
+	err := s.svc.DeleteObject(ctx, objectKey)
+	s.observe(OperationDeleteObject, objectKey, start, -1, err)
+	return err
+}
+
+func (s *instrumentedService) StatObject(ctx context.Context, objectKey string) (*ObjectInfo, error) {
+	start := time.Now()
+	info, err := s.svc.StatObject(ctx, objectKey)
+	size := int64(-1)
+	if err == nil {
+		size = info.Size
+	}
+	s.observe(OperationStatObject, objectKey, start, size, err)
+	return info, err
+}
+
+func (s *instrumentedService) PresignPutObject(
+	ctx context.Context,
+	objectKey string,
+	opts PresignPutOptions,
+) (*PresignedRequest, error) {
+	start := time.Now()
+	req, err := PresignPutObject(ctx, s.svc, objectKey, opts)
+	s.observe(OperationPresignPutObject, objectKey, start, -1, err)
+	return req, err
+}
+
+func (s *instrumentedService) CopyObject(ctx context.Context, srcKey, dstKey string) error {
+	start := time.Now()
+	err := CopyObject(ctx, s.svc, srcKey, dstKey)
+	s.observe(OperationCopyObject, srcKey+" -> "+dstKey, start, -1, err)
+	return err
+}
+
+func (s *instrumentedService) MoveObject(ctx context.Context, srcKey, dstKey string) error {
+	start := time.Now()
+	err := MoveObject(ctx, s.svc, srcKey, dstKey)
+	s.observe(OperationMoveObject, srcKey+" -> "+dstKey, start, -1, err)
+	return err
+}
+
+func (s *instrumentedService) InitiateUpload(ctx context.Context, objectKey string, opts PutObjectOptions) (string, error) {
+	uploader, err := GetMultipartUploader(s.svc)
+	if err != nil {
+		return "", err
+	}
+	start := time.Now()
+	uploadID, err := uploader.InitiateUpload(ctx, objectKey, opts)
+	s.observe(OperationInitiateUpload, objectKey, start, -1, err)
+	return uploadID, err
+}
+
+func (s *instrumentedService) UploadPart(
+	ctx context.Context,
+	objectKey, uploadID string,
+	partNumber int,
+	content io.Reader,
+	size int64,
+) (*UploadPart, error) {
+	uploader, err := GetMultipartUploader(s.svc)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	// The services check whether the content is seekable, which counting
+	// it would hide, so the size is taken from the result instead.
+	part, err := uploader.UploadPart(ctx, objectKey, uploadID, partNumber, content, size)
+	if err == nil {
+		size = part.Size
+		s.metrics.addBytes(s.backend, OperationUploadPart, size, 0)
+	}
+	s.observe(OperationUploadPart, objectKey, start, size, err)
+	return part, err
+}
+
+func (s *instrumentedService) ListUploadParts(ctx context.Context, objectKey, uploadID string) ([]UploadPart, error) {
+	uploader, err := GetMultipartUploader(s.svc)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	parts, err := uploader.ListUploadParts(ctx, objectKey, uploadID)
+	s.observe(OperationListUploadParts, objectKey, start, -1, err)
+	return parts, err
+}
+
+func (s *instrumentedService) CompleteUpload(ctx context.Context, objectKey, uploadID string) (*UploadInfo, error) {
+	uploader, err := GetMultipartUploader(s.svc)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	info, err := uploader.CompleteUpload(ctx, objectKey, uploadID)
+	size := int64(-1)
+	if err == nil {
+		size = int64(info.Size)
+	}
+	s.observe(OperationCompleteUpload, objectKey, start, size, err)
+	return info, err
+}
+
+func (s *instrumentedService) AbortUpload(ctx context.Context, objectKey, uploadID string) error {
+	uploader, err := GetMultipartUploader(s.svc)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = uploader.AbortUpload(ctx, objectKey, uploadID)
+	s.observe(OperationAbortUpload, objectKey, start, -1, err)
+	return err
+}
+
+func (s *instrumentedService) ListUploads(ctx context.Context, prefix string) ([]UploadSession, error) {
+	uploader, err := GetMultipartUploader(s.svc)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	sessions, err := uploader.ListUploads(ctx, prefix)
+	s.observe(OperationListUploads, prefix, start, -1, err)
+	return sessions, err
+}
+
+func (s *instrumentedService) HealthCheck(ctx context.Context) error {
+	start := time.Now()
+	err := HealthCheck(ctx, s.svc)
+	s.observe(OperationHealthCheck, "", start, -1, err)
+	return err
+}
+
+// countDownload adds the bytes read from the stream to the metrics once
+// it's closed.
+func (s *instrumentedService) countDownload(op Operation, stream io.ReadCloser) io.ReadCloser {
+	return &countingReadCloser{ReadCloser: stream, onClose: func(n int64) {
+		s.metrics.addBytes(s.backend, op, 0, n)
+	}}
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	n         int64
+	onClose   func(n int64)
+	closeOnce sync.Once
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *countingReadCloser) Close() error {
+	r.closeOnce.Do(func() { r.onClose(r.n) })
+	return r.ReadCloser.Close()
+}
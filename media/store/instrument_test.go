@@ -0,0 +1,204 @@
+package store_test
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+func newInstrumentedService(
+	t *testing.T,
+	backend mediastore.ServiceV2,
+	name string,
+	metrics *mediastore.Metrics,
+) mediastore.ServiceV2 {
+	t.Helper()
+	svc, err := mediastore.NewInstrumentedService(backend, name, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc
+}
+
+// metricsSumPattern matches the sums of the durations, which vary from a
+// run to another.
+var metricsSumPattern = regexp.MustCompile(`(?m)^(mediastore_operation_duration_seconds_sum\{.*\}) (.+)$`)
+
+const instrumentedMetricsGolden = `# HELP mediastore_operations_total Number of calls to the storage by result.
+# TYPE mediastore_operations_total counter
+mediastore_operations_total{backend="back\"end\\\n",operation="StatObject",result="not_found"} 1
+mediastore_operations_total{backend="memory",operation="DeleteObject",result="ok"} 1
+mediastore_operations_total{backend="memory",operation="GetObject",result="not_found"} 1
+mediastore_operations_total{backend="memory",operation="GetObject",result="ok"} 1
+mediastore_operations_total{backend="memory",operation="PutObject",result="ok"} 2
+mediastore_operations_total{backend="memory",operation="StatObject",result="error"} 1
+# HELP mediastore_uploaded_bytes_total Number of bytes sent to the storage.
+# TYPE mediastore_uploaded_bytes_total counter
+mediastore_uploaded_bytes_total{backend="memory",operation="PutObject"} 13
+# HELP mediastore_downloaded_bytes_total Number of bytes received from the storage.
+# TYPE mediastore_downloaded_bytes_total counter
+mediastore_downloaded_bytes_total{backend="memory",operation="GetObject"} 4
+# HELP mediastore_operation_duration_seconds Latency of the calls to the storage, up to the first byte of the downloads.
+# TYPE mediastore_operation_duration_seconds histogram
+mediastore_operation_duration_seconds_bucket{backend="back\"end\\\n",operation="StatObject",le="0.05"} 1
+mediastore_operation_duration_seconds_bucket{backend="back\"end\\\n",operation="StatObject",le="10"} 1
+mediastore_operation_duration_seconds_bucket{backend="back\"end\\\n",operation="StatObject",le="+Inf"} 1
+mediastore_operation_duration_seconds_sum{backend="back\"end\\\n",operation="StatObject"} SUM
+mediastore_operation_duration_seconds_count{backend="back\"end\\\n",operation="StatObject"} 1
+mediastore_operation_duration_seconds_bucket{backend="memory",operation="DeleteObject",le="0.05"} 0
+mediastore_operation_duration_seconds_bucket{backend="memory",operation="DeleteObject",le="10"} 1
+mediastore_operation_duration_seconds_bucket{backend="memory",operation="DeleteObject",le="+Inf"} 1
+mediastore_operation_duration_seconds_sum{backend="memory",operation="DeleteObject"} SUM
+mediastore_operation_duration_seconds_count{backend="memory",operation="DeleteObject"} 1
+mediastore_operation_duration_seconds_bucket{backend="memory",operation="GetObject",le="0.05"} 2
+mediastore_operation_duration_seconds_bucket{backend="memory",operation="GetObject",le="10"} 2
+mediastore_operation_duration_seconds_bucket{backend="memory",operation="GetObject",le="+Inf"} 2
+mediastore_operation_duration_seconds_sum{backend="memory",operation="GetObject"} SUM
+mediastore_operation_duration_seconds_count{backend="memory",operation="GetObject"} 2
+mediastore_operation_duration_seconds_bucket{backend="memory",operation="PutObject",le="0.05"} 2
+mediastore_operation_duration_seconds_bucket{backend="memory",operation="PutObject",le="10"} 2
+mediastore_operation_duration_seconds_bucket{backend="memory",operation="PutObject",le="+Inf"} 2
+mediastore_operation_duration_seconds_sum{backend="memory",operation="PutObject"} SUM
+mediastore_operation_duration_seconds_count{backend="memory",operation="PutObject"} 2
+mediastore_operation_duration_seconds_bucket{backend="memory",operation="StatObject",le="0.05"} 1
+mediastore_operation_duration_seconds_bucket{backend="memory",operation="StatObject",le="10"} 1
+mediastore_operation_duration_seconds_bucket{backend="memory",operation="StatObject",le="+Inf"} 1
+mediastore_operation_duration_seconds_sum{backend="memory",operation="StatObject"} SUM
+mediastore_operation_duration_seconds_count{backend="memory",operation="StatObject"} 1
+`
+
+func TestMetricsWritePrometheus(t *testing.T) {
+	ctx := context.Background()
+	// The buckets are sorted.
+	metrics := mediastore.NewMetrics([]float64{10, 0.05})
+	backend := newMemoryService(t)
+	svc := newInstrumentedService(t, backend, "memory", metrics)
+
+	putObject(t, svc, "key", "content")
+	_, err := svc.PutObject(ctx, "stream", io.MultiReader(strings.NewReader("strea"), strings.NewReader("m")),
+		mediastore.PutObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The bytes are counted as they are read, up to the close.
+	obj, err := svc.GetObject(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(obj, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	obj.Close()
+	if _, err = svc.GetObject(ctx, "missing"); !errors.Is(err, mediastore.ErrObjectNotFound) {
+		t.Fatalf("missing: got %v, want ErrObjectNotFound", err)
+	}
+	backend.InjectFailure(mediastore.OperationStatObject, errUnavailable)
+	if _, err = svc.StatObject(ctx, "key"); err == nil {
+		t.Fatal("stat: got no error")
+	}
+	backend.ClearFailures()
+	backend.SetLatency(60 * time.Millisecond)
+	if err = svc.DeleteObject(ctx, "stream"); err != nil {
+		t.Fatal(err)
+	}
+	backend.SetLatency(0)
+	escaped := newInstrumentedService(t, backend, `back"end\`+"\n", metrics)
+	if _, err = escaped.StatObject(ctx, "missing"); !errors.Is(err, mediastore.ErrObjectNotFound) {
+		t.Fatalf("escaped: got %v, want ErrObjectNotFound", err)
+	}
+
+	var out strings.Builder
+	if err = metrics.WritePrometheus(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, match := range metricsSumPattern.FindAllStringSubmatch(out.String(), -1) {
+		sum, err := strconv.ParseFloat(match[2], 64)
+		if err != nil || sum < 0 {
+			t.Errorf("%s: got %q", match[1], match[2])
+		}
+		if strings.Contains(match[1], "DeleteObject") && sum < 0.06 {
+			t.Errorf("%s: got %v, want the latency", match[1], sum)
+		}
+	}
+	if got := metricsSumPattern.ReplaceAllString(out.String(), "$1 SUM"); got != instrumentedMetricsGolden {
+		t.Errorf("got:\n%s\nwant:\n%s", got, instrumentedMetricsGolden)
+	}
+}
+
+// The latency of a download is the time to the first byte, the reading of
+// the stream isn't measured.
+func TestInstrumentedServiceDownloadLatency(t *testing.T) {
+	metrics := mediastore.NewMetrics([]float64{0.05})
+	backend := newMemoryService(t)
+	svc := newInstrumentedService(t, backend, "memory", metrics)
+	putObject(t, backend, "key", "content")
+
+	obj, err := svc.GetObject(context.Background(), "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err = io.ReadAll(obj); err != nil {
+		t.Fatal(err)
+	}
+	obj.Close()
+	// A second close doesn't count the bytes again.
+	obj.Close()
+
+	var out strings.Builder
+	if err = metrics.WritePrometheus(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`mediastore_downloaded_bytes_total{backend="memory",operation="GetObject"} 7`,
+		`mediastore_operation_duration_seconds_bucket{backend="memory",operation="GetObject",le="0.05"} 1`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	metrics := mediastore.NewMetrics(nil)
+	putObject(t, newInstrumentedService(t, newMemoryService(t), "memory", metrics), "key", "content")
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if got := rec.Header().Get("Content-Type"); got != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("content type: got %q", got)
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		`mediastore_operations_total{backend="memory",operation="PutObject",result="ok"} 1`,
+		`mediastore_operation_duration_seconds_bucket{backend="memory",operation="PutObject",le="+Inf"} 1`,
+		`mediastore_operation_duration_seconds_bucket{backend="memory",operation="PutObject",le="60"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+}
+
+func TestNewInstrumentedServiceInvalid(t *testing.T) {
+	metrics := mediastore.NewMetrics(nil)
+	backend := newMemoryService(t)
+	for name, call := range map[string]func() (mediastore.ServiceV2, error){
+		"svc":     func() (mediastore.ServiceV2, error) { return mediastore.NewInstrumentedService(nil, "memory", metrics) },
+		"backend": func() (mediastore.ServiceV2, error) { return mediastore.NewInstrumentedService(backend, "", metrics) },
+		"metrics": func() (mediastore.ServiceV2, error) { return mediastore.NewInstrumentedService(backend, "memory", nil) },
+	} {
+		var argErr errors.ArgumentError
+		if _, err := call(); !errors.As(err, &argErr) {
+			t.Errorf("%s: got %v, want an argument error", name, err)
+		}
+	}
+}
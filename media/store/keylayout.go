@@ -0,0 +1,429 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/media"
+)
+
+// ErrKeyLayoutMismatch is returned, wrapped, by KeyLayout.ParseObjectKey
+// when the key was not built by the layout.
+var ErrKeyLayoutMismatch = errors.Msg("key does not match the layout")
+
+// KeyParams are the attributes of a media object from which a KeyLayout
+// builds the key of the object.
+type KeyParams struct {
+	MediaType media.MediaType
+	// Name is the name of the media, e.g., generated by
+	// Store.ContentName. It must not contain a slash nor start with a
+	// dot.
+	Name   string
+	Tenant string
+	// Time is the time the media was uploaded. It's in UTC.
+	Time time.Time
+}
+
+// KeyLayout builds the keys of the media objects from their attributes so
+// that the objects are laid out the same way in every backend.
+type KeyLayout interface {
+	// ObjectKey returns the key of the object described by params.
+	ObjectKey(params KeyParams) (string, error)
+
+	// ParseObjectKey is the inverse of ObjectKey. The attributes which
+	// are not part of the key are left empty. The returned error wraps
+	// ErrKeyLayoutMismatch if the key was not built by the layout.
+	ParseObjectKey(objectKey string) (KeyParams, error)
+
+	// ListPrefix returns the prefix shared by the keys of the objects of
+	// the media type, or of all the media types if it's unspecified. Only
+	// MediaType and Tenant of params are used.
+	ListPrefix(params KeyParams) (string, error)
+}
+
+// DirectoryKeyLayout lays the objects out as <dir>/<name>, where dir is
+// the DirectoryName of the media type.
+type DirectoryKeyLayout struct{}
+
+var _ KeyLayout = DirectoryKeyLayout{}
+
+func (DirectoryKeyLayout) ObjectKey(params KeyParams) (string, error) {
+	dir, err := mediaDirectoryName(params.MediaType)
+	if err != nil {
+		return "", err
+	}
+	if err = checkKeySegment("Name", params.Name); err != nil {
+		return "", err
+	}
+	return dir + "/" + params.Name, nil
+}
+
+func (DirectoryKeyLayout) ParseObjectKey(objectKey string) (KeyParams, error) {
+	segments, mediaType, err := parseMediaKey(objectKey, 2)
+	if err != nil {
+		return KeyParams{}, err
+	}
+	return KeyParams{MediaType: mediaType, Name: segments[1]}, nil
+}
+
+func (DirectoryKeyLayout) ListPrefix(params KeyParams) (string, error) {
+	return mediaListPrefix(params.MediaType)
+}
+
+// HashedKeyLayout lays the objects out as <dir>/<name[0:n]>/<name>, where
+// n is PrefixLength, so that the objects with generated names are spread
+// evenly.
+type HashedKeyLayout struct {
+	PrefixLength int
+}
+
+var _ KeyLayout = HashedKeyLayout{}
+
+func (layout HashedKeyLayout) ObjectKey(params KeyParams) (string, error) {
+	dir, err := mediaDirectoryName(params.MediaType)
+	if err != nil {
+		return "", err
+	}
+	if err = checkKeySegment("Name", params.Name); err != nil {
+		return "", err
+	}
+	if len(params.Name) < layout.prefixLength() {
+		return "", errors.ArgMsg("Name", "too short")
+	}
+	return dir + "/" + params.Name[:layout.prefixLength()] + "/" + params.Name, nil
+}
+
+func (layout HashedKeyLayout) ParseObjectKey(objectKey string) (KeyParams, error) {
+	segments, mediaType, err := parseMediaKey(objectKey, 3)
+	if err != nil {
+		return KeyParams{}, err
+	}
+	name := segments[2]
+	if len(name) < layout.prefixLength() || segments[1] != name[:layout.prefixLength()] {
+		return KeyParams{}, errors.Wrap(objectKey, ErrKeyLayoutMismatch)
+	}
+	return KeyParams{MediaType: mediaType, Name: name}, nil
+}
+
+func (HashedKeyLayout) ListPrefix(params KeyParams) (string, error) {
+	return mediaListPrefix(params.MediaType)
+}
+
+func (layout HashedKeyLayout) prefixLength() int {
+	if layout.PrefixLength <= 0 {
+		return 2
+	}
+	return layout.PrefixLength
+}
+
+// DatedKeyLayout lays the objects out as <dir>/<yyyy>/<mm>/<dd>/<name> by
+// the upload date, so that the objects could be listed, or expired by a
+// lifecycle rule, by date.
+type DatedKeyLayout struct{}
+
+var _ KeyLayout = DatedKeyLayout{}
+
+const datedKeyLayoutFormat = "2006/01/02"
+
+func (DatedKeyLayout) ObjectKey(params KeyParams) (string, error) {
+	dir, err := mediaDirectoryName(params.MediaType)
+	if err != nil {
+		return "", err
+	}
+	if err = checkKeySegment("Name", params.Name); err != nil {
+		return "", err
+	}
+	if params.Time.IsZero() {
+		return "", errors.ArgMsg("Time", "zero")
+	}
+	return dir + "/" + params.Time.UTC().Format(datedKeyLayoutFormat) + "/" + params.Name, nil
+}
+
+func (DatedKeyLayout) ParseObjectKey(objectKey string) (KeyParams, error) {
+	segments, mediaType, err := parseMediaKey(objectKey, 5)
+	if err != nil {
+		return KeyParams{}, err
+	}
+	t, err := time.Parse(datedKeyLayoutFormat, strings.Join(segments[1:4], "/"))
+	if err != nil {
+		return KeyParams{}, errors.Wrap(objectKey, ErrKeyLayoutMismatch)
+	}
+	return KeyParams{MediaType: mediaType, Name: segments[4], Time: t}, nil
+}
+
+func (DatedKeyLayout) ListPrefix(params KeyParams) (string, error) {
+	return mediaListPrefix(params.MediaType)
+}
+
+// TenantKeyLayout prefixes the keys of another layout with the tenant, as
+// <tenant>/<key>. The tenant is required.
+type TenantKeyLayout struct {
+	Layout KeyLayout
+}
+
+var _ KeyLayout = TenantKeyLayout{}
+
+func (layout TenantKeyLayout) ObjectKey(params KeyParams) (string, error) {
+	if err := checkKeySegment("Tenant", params.Tenant); err != nil {
+		return "", err
+	}
+	key, err := layout.Layout.ObjectKey(params)
+	if err != nil {
+		return "", err
+	}
+	return params.Tenant + "/" + key, nil
+}
+
+func (layout TenantKeyLayout) ParseObjectKey(objectKey string) (KeyParams, error) {
+	tenant, key, ok := strings.Cut(objectKey, "/")
+	if !ok || checkKeySegment("Tenant", tenant) != nil {
+		return KeyParams{}, errors.Wrap(objectKey, ErrKeyLayoutMismatch)
+	}
+	params, err := layout.Layout.ParseObjectKey(key)
+	if err != nil {
+		return KeyParams{}, err
+	}
+	params.Tenant = tenant
+	return params, nil
+}
+
+func (layout TenantKeyLayout) ListPrefix(params KeyParams) (string, error) {
+	if err := checkKeySegment("Tenant", params.Tenant); err != nil {
+		return "", err
+	}
+	prefix, err := layout.Layout.ListPrefix(params)
+	if err != nil {
+		return "", err
+	}
+	return params.Tenant + "/" + prefix, nil
+}
+
+// KeyLayoutConfig selects the KeyLayout of the Store.
+type KeyLayoutConfig struct {
+	// Name is the name of a layout registered with RegisterKeyLayout,
+	// e.g., "directory", "hashed" or "dated". The keys are used as they
+	// are if it's empty.
+	Name string `env:"NAME" yaml:"name" json:"name"`
+
+	// TenantPrefix prefixes the keys with the tenant of the context. See
+	// ContextWithTenant.
+	TenantPrefix bool `env:"TENANT_PREFIX" yaml:"tenant_prefix" json:"tenant_prefix"`
+}
+
+// KeyLayout returns the layout selected by the config. It returns nil if
+// no layout is selected.
+func (cfg KeyLayoutConfig) KeyLayout() (KeyLayout, error) {
+	if cfg.Name == "" {
+		if cfg.TenantPrefix {
+			return nil, errors.ArgMsg("Name", "empty")
+		}
+		return nil, nil
+	}
+	keyLayoutsMu.RLock()
+	layout, ok := keyLayouts[cfg.Name]
+	keyLayoutsMu.RUnlock()
+	if !ok {
+		return nil, errors.ArgMsg("Name", cfg.Name+" not registered")
+	}
+	if cfg.TenantPrefix {
+		layout = TenantKeyLayout{Layout: layout}
+	}
+	return layout, nil
+}
+
+var (
+	keyLayouts = map[string]KeyLayout{
+		"directory": DirectoryKeyLayout{},
+		"hashed":    HashedKeyLayout{},
+		"dated":     DatedKeyLayout{},
+	}
+	keyLayoutsMu sync.RWMutex
+)
+
+// RegisterKeyLayout makes the layout selectable by KeyLayoutConfig.Name.
+func RegisterKeyLayout(name string, layout KeyLayout) {
+	if name == "" {
+		panic("name is empty")
+	}
+	if layout == nil {
+		panic("layout is nil")
+	}
+	keyLayoutsMu.Lock()
+	defer keyLayoutsMu.Unlock()
+	if _, dup := keyLayouts[name]; dup {
+		panic("called twice for " + name)
+	}
+	keyLayouts[name] = layout
+}
+
+// KeyLayoutNames returns the names of the registered layouts.
+func KeyLayoutNames() []string {
+	keyLayoutsMu.RLock()
+	defer keyLayoutsMu.RUnlock()
+	names := make([]string, 0, len(keyLayouts))
+	for name := range keyLayouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type tenantContextKey struct{}
+
+// ContextWithTenant returns a context which carries the tenant of the
+// calls made with it.
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant carried by the context. It returns
+// an empty string if there's none.
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantContextKey{}).(string)
+	return tenant
+}
+
+// checkKeySegment checks that the value could be used as a single segment
+// of a key. The segments starting with a dot are reserved for the objects
+// of the store itself, e.g., the temporary objects of UploadDeduplicated.
+func checkKeySegment(argName, value string) error {
+	switch {
+	case value == "":
+		return errors.ArgMsg(argName, "empty")
+	case strings.HasPrefix(value, "."):
+		return errors.ArgMsg(argName, "starts with a dot")
+	case strings.Contains(value, "/"):
+		return errors.ArgMsg(argName, "contains a slash")
+	}
+	return nil
+}
+
+func mediaDirectoryName(mediaType media.MediaType) (string, error) {
+	typeInfo := media.GetMediaTypeInfo(mediaType)
+	if typeInfo == nil {
+		return "", errors.ArgMsg("MediaType", mediaType.String()+" unsupported")
+	}
+	return typeInfo.DirectoryName(), nil
+}
+
+func mediaListPrefix(mediaType media.MediaType) (string, error) {
+	if mediaType == media.MediaType_MEDIA_TYPE_UNSPECIFIED {
+		return "", nil
+	}
+	dir, err := mediaDirectoryName(mediaType)
+	if err != nil {
+		return "", err
+	}
+	return dir + "/", nil
+}
+
+// parseMediaKey splits the key into its segments, of which there must be
+// n, and resolves the media type from the first one.
+func parseMediaKey(objectKey string, n int) ([]string, media.MediaType, error) {
+	segments := strings.Split(objectKey, "/")
+	if len(segments) != n {
+		return nil, 0, errors.Wrap(objectKey, ErrKeyLayoutMismatch)
+	}
+	for _, segment := range segments {
+		if checkKeySegment("", segment) != nil {
+			return nil, 0, errors.Wrap(objectKey, ErrKeyLayoutMismatch)
+		}
+	}
+	for value := range media.MediaType_name {
+		mediaType := media.MediaType(value)
+		if typeInfo := media.GetMediaTypeInfo(mediaType); typeInfo != nil && typeInfo.DirectoryName() == segments[0] {
+			return segments, mediaType, nil
+		}
+	}
+	return nil, 0, errors.Wrap(objectKey, ErrKeyLayoutMismatch)
+}
+
+// MediaKey returns the key of the object which Upload stores as the media
+// named mediaName. If the store has no key layout, mediaName is the key.
+// The tenant is the one of the context, see ContextWithTenant, and the
+// upload time is now.
+func (mediaStore *Store) MediaKey(
+	ctx context.Context,
+	mediaName string,
+	mediaType media.MediaType,
+) (string, error) {
+	if mediaStore.keyLayout == nil {
+		return mediaName, nil
+	}
+	objectKey, err := mediaStore.keyLayout.ObjectKey(KeyParams{
+		MediaType: mediaType,
+		Name:      mediaName,
+		Tenant:    TenantFromContext(ctx),
+		Time:      time.Now().UTC(),
+	})
+	if err != nil {
+		return "", errors.ArgWrap("mediaName", "key layout", err)
+	}
+	return objectKey, nil
+}
+
+// ParseMediaKey returns the attributes of the media from the key of its
+// object. The returned error wraps ErrKeyLayoutMismatch if the key was not
+// built by the key layout of the store.
+func (mediaStore *Store) ParseMediaKey(objectKey string) (KeyParams, error) {
+	if mediaStore.keyLayout == nil {
+		return KeyParams{}, errors.Wrap("no key layout", ErrKeyLayoutMismatch)
+	}
+	return mediaStore.keyLayout.ParseObjectKey(objectKey)
+}
+
+// MediaObject is an object listed by ListMedia along with the attributes
+// parsed from its key.
+type MediaObject struct {
+	ObjectInfo
+	Params KeyParams
+}
+
+// MediaList is a page of media returned by ListMedia.
+type MediaList struct {
+	Objects []MediaObject
+
+	// NextPageToken is used to retrieve the next page. It's empty
+	// when there are no more objects to list.
+	NextPageToken string
+}
+
+// ListMedia returns a page of the media of the media type, or of all the
+// media types if it's unspecified, of the tenant of the context. The objects
+// whose key was not built by the key layout of the store are skipped, so a
+// page could have less than limit objects while there are more to list.
+func (mediaStore *Store) ListMedia(
+	ctx context.Context,
+	mediaType media.MediaType,
+	pageToken string,
+	limit int,
+) (*MediaList, error) {
+	if mediaStore.keyLayout == nil {
+		return nil, errors.Wrap("no key layout", ErrKeyLayoutMismatch)
+	}
+	prefix, err := mediaStore.keyLayout.ListPrefix(KeyParams{
+		MediaType: mediaType,
+		Tenant:    TenantFromContext(ctx),
+	})
+	if err != nil {
+		return nil, errors.Wrap("key layout", err)
+	}
+	list, err := mediaStore.ListObjects(ctx, prefix, pageToken, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &MediaList{NextPageToken: list.NextPageToken}
+	for _, info := range list.Objects {
+		params, err := mediaStore.keyLayout.ParseObjectKey(info.Key)
+		if err != nil {
+			continue
+		}
+		result.Objects = append(result.Objects, MediaObject{ObjectInfo: info, Params: params})
+	}
+	return result, nil
+}
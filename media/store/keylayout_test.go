@@ -0,0 +1,215 @@
+package store_test
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/media"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+func TestKeyLayouts(t *testing.T) {
+	// The dated keys only keep the date of the upload time.
+	uploadTime := time.Date(2023, 4, 5, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name    string
+		layout  mediastore.KeyLayout
+		params  mediastore.KeyParams
+		key     string
+		argName string
+	}{
+		{name: "directory", layout: mediastore.DirectoryKeyLayout{},
+			params: mediastore.KeyParams{MediaType: media.MediaType_IMAGE, Name: "abcdef"},
+			key:    "images/abcdef"},
+		{name: "hashed", layout: mediastore.HashedKeyLayout{},
+			params: mediastore.KeyParams{MediaType: media.MediaType_FILE, Name: "abcdef"},
+			key:    "files/ab/abcdef"},
+		{name: "hashed with prefix length", layout: mediastore.HashedKeyLayout{PrefixLength: 3},
+			params: mediastore.KeyParams{MediaType: media.MediaType_FILE, Name: "abcdef"},
+			key:    "files/abc/abcdef"},
+		{name: "dated", layout: mediastore.DatedKeyLayout{},
+			params: mediastore.KeyParams{MediaType: media.MediaType_IMAGE, Name: "abcdef", Time: uploadTime},
+			key:    "images/2023/04/05/abcdef"},
+		{name: "tenant", layout: mediastore.TenantKeyLayout{Layout: mediastore.DirectoryKeyLayout{}},
+			params: mediastore.KeyParams{MediaType: media.MediaType_IMAGE, Name: "abcdef", Tenant: "acme"},
+			key:    "acme/images/abcdef"},
+		{name: "unspecified media type", layout: mediastore.DirectoryKeyLayout{},
+			params:  mediastore.KeyParams{Name: "abcdef"},
+			argName: "MediaType"},
+		{name: "name with a slash", layout: mediastore.DirectoryKeyLayout{},
+			params:  mediastore.KeyParams{MediaType: media.MediaType_IMAGE, Name: "a/b"},
+			argName: "Name"},
+		{name: "name with a dot", layout: mediastore.DirectoryKeyLayout{},
+			params:  mediastore.KeyParams{MediaType: media.MediaType_IMAGE, Name: ".tmp"},
+			argName: "Name"},
+		{name: "name too short", layout: mediastore.HashedKeyLayout{},
+			params:  mediastore.KeyParams{MediaType: media.MediaType_IMAGE, Name: "a"},
+			argName: "Name"},
+		{name: "no time", layout: mediastore.DatedKeyLayout{},
+			params:  mediastore.KeyParams{MediaType: media.MediaType_IMAGE, Name: "abcdef"},
+			argName: "Time"},
+		{name: "no tenant", layout: mediastore.TenantKeyLayout{Layout: mediastore.DirectoryKeyLayout{}},
+			params:  mediastore.KeyParams{MediaType: media.MediaType_IMAGE, Name: "abcdef"},
+			argName: "Tenant"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := tc.layout.ObjectKey(tc.params)
+			if tc.argName != "" {
+				var argErr errors.ArgumentError
+				if !errors.As(err, &argErr) || argErr.ArgumentName() != tc.argName {
+					t.Fatalf("got %v, want an argument error of %s", err, tc.argName)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key != tc.key {
+				t.Fatalf("key: got %q, want %q", key, tc.key)
+			}
+			params, err := tc.layout.ParseObjectKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if params != tc.params {
+				t.Errorf("parsed: got %+v, want %+v", params, tc.params)
+			}
+		})
+	}
+}
+
+func TestParseObjectKeyMismatch(t *testing.T) {
+	testCases := []struct {
+		name   string
+		layout mediastore.KeyLayout
+		key    string
+	}{
+		{"directory too deep", mediastore.DirectoryKeyLayout{}, "images/a/b"},
+		{"unknown directory", mediastore.DirectoryKeyLayout{}, "videos/abcdef"},
+		{"hidden segment", mediastore.DirectoryKeyLayout{}, "images/.tmp"},
+		{"hashed prefix mismatch", mediastore.HashedKeyLayout{}, "images/xy/abcdef"},
+		{"dated invalid date", mediastore.DatedKeyLayout{}, "images/2023/13/05/abcdef"},
+		{"tenant missing", mediastore.TenantKeyLayout{Layout: mediastore.DirectoryKeyLayout{}}, "images/abcdef"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := tc.layout.ParseObjectKey(tc.key); !errors.Is(err, mediastore.ErrKeyLayoutMismatch) {
+				t.Errorf("got %v, want ErrKeyLayoutMismatch", err)
+			}
+		})
+	}
+}
+
+func TestKeyLayoutConfig(t *testing.T) {
+	testCases := []struct {
+		name    string
+		config  mediastore.KeyLayoutConfig
+		layout  mediastore.KeyLayout
+		argName string
+	}{
+		{name: "none"},
+		{name: "hashed", config: mediastore.KeyLayoutConfig{Name: "hashed"}, layout: mediastore.HashedKeyLayout{}},
+		{name: "tenant prefix", config: mediastore.KeyLayoutConfig{Name: "dated", TenantPrefix: true},
+			layout: mediastore.TenantKeyLayout{Layout: mediastore.DatedKeyLayout{}}},
+		{name: "tenant prefix without layout", config: mediastore.KeyLayoutConfig{TenantPrefix: true}, argName: "Name"},
+		{name: "not registered", config: mediastore.KeyLayoutConfig{Name: "unknown"}, argName: "Name"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			layout, err := tc.config.KeyLayout()
+			if tc.argName != "" {
+				var argErr errors.ArgumentError
+				if !errors.As(err, &argErr) || argErr.ArgumentName() != tc.argName {
+					t.Fatalf("got %v, want an argument error of %s", err, tc.argName)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if layout != tc.layout {
+				t.Errorf("got %#v, want %#v", layout, tc.layout)
+			}
+		})
+	}
+}
+
+func TestUploadWithKeyLayout(t *testing.T) {
+	svc := newMemoryService(t)
+	mediaStore := newTestStore(t, mediastore.Config{
+		KeyLayout: mediastore.KeyLayoutConfig{Name: "hashed", TenantPrefix: true},
+	}, svc)
+	ctx := mediastore.ContextWithTenant(context.Background(), "acme")
+
+	info, err := mediaStore.UploadContext(ctx, "abcdef", strings.NewReader("content"), media.MediaType_FILE,
+		mediastore.PutObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Key != "acme/files/ab/abcdef" {
+		t.Errorf("key: got %q", info.Key)
+	}
+	_, err = mediaStore.UploadContext(context.Background(), "abcdef", strings.NewReader("content"), media.MediaType_FILE,
+		mediastore.PutObjectOptions{})
+	var argErr errors.ArgumentError
+	if !errors.As(err, &argErr) || argErr.ArgumentName() != "mediaName" {
+		t.Errorf("without tenant: got %v, want an argument error of mediaName", err)
+	}
+
+	// UploadObject uses the key as it is.
+	info, err = mediaStore.UploadObject(ctx, "acme/other", strings.NewReader("content"), media.MediaType_FILE,
+		mediastore.PutObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Key != "acme/other" {
+		t.Errorf("raw key: got %q", info.Key)
+	}
+
+	// The objects whose key was not built by the layout, or which belong
+	// to another tenant, are not listed.
+	putObject(t, svc, "other/files/ab/abcdef", "content")
+	list, err := mediaStore.ListMedia(ctx, media.MediaType_MEDIA_TYPE_UNSPECIFIED, "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Objects) != 1 || list.Objects[0].Key != "acme/files/ab/abcdef" ||
+		list.Objects[0].Params.Name != "abcdef" || list.Objects[0].Params.Tenant != "acme" {
+		t.Errorf("listed: got %+v", list.Objects)
+	}
+}
+
+func TestMigrateObjectsKeepsKeys(t *testing.T) {
+	srcSvc, dstSvc := newMemoryService(t), newMemoryService(t)
+	keys := []string{"files/ab/abcdef", "legacy/name"}
+	for _, key := range keys {
+		putObject(t, srcSvc, key, key)
+	}
+	// The layout of the destination must not be applied to the keys of
+	// the objects which are copied.
+	destination := newTestStore(t, mediastore.Config{KeyLayout: mediastore.KeyLayoutConfig{Name: "hashed"}}, dstSvc)
+
+	result, err := mediastore.MigrateObjects(context.Background(), newTestStore(t, mediastore.Config{}, srcSvc),
+		destination, mediastore.MigrateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Copied != len(keys) {
+		t.Errorf("copied: got %d, want %d", result.Copied, len(keys))
+	}
+	got := objectKeys(t, dstSvc, "")
+	sort.Strings(got)
+	if strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Errorf("keys: got %v, want %v", got, keys)
+	}
+	for _, key := range keys {
+		if content := readObject(t, dstSvc, key); content != key {
+			t.Errorf("%s: got %q", key, content)
+		}
+	}
+}
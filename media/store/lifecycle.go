@@ -0,0 +1,260 @@
+package store
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/logger"
+)
+
+var log = logger.NewPkgLogger()
+
+// ErrObjectRetained is returned, wrapped, when an object could not be
+// deleted because it's still within the retention period of a lifecycle
+// rule.
+var ErrObjectRetained = errors.Msg("object retained")
+
+// LifecycleConfig configures the expiration and the retention of the
+// objects. The rules could only be provided with YAML or JSON.
+type LifecycleConfig struct {
+	Rules []LifecycleRule `env:"-" yaml:"rules" json:"rules"`
+
+	// SweepInterval is how often the services which apply the rules
+	// themselves, e.g., the local module, look for the expired objects.
+	// LifecycleSweepIntervalDefault is used if it's not positive.
+	SweepInterval time.Duration `env:"SWEEP_INTERVAL" yaml:"sweep_interval" json:"sweep_interval"`
+}
+
+const LifecycleSweepIntervalDefault = time.Hour
+
+// LifecycleRule applies to the objects whose key starts with Prefix. The
+// age of an object is measured from its last modification.
+type LifecycleRule struct {
+	// ID identifies the rule in the bucket lifecycle configuration. It's
+	// derived from the position of the rule if it's empty.
+	ID     string `yaml:"id" json:"id"`
+	Prefix string `yaml:"prefix" json:"prefix"`
+
+	// ExpirationDays is the age at which the objects are deleted. The
+	// objects don't expire if it's zero.
+	ExpirationDays int `yaml:"expiration_days" json:"expiration_days"`
+
+	// Transitions move the objects to other storage classes as they
+	// age. They are only supported by the services with storage classes.
+	Transitions []LifecycleTransition `yaml:"transitions" json:"transitions"`
+
+	// RetentionDays is the age before which the objects could not be
+	// deleted, or moved, through the Store. It does not protect the
+	// objects from the other clients of the storage.
+	RetentionDays int `yaml:"retention_days" json:"retention_days"`
+}
+
+type LifecycleTransition struct {
+	Days         int    `yaml:"days" json:"days"`
+	StorageClass string `yaml:"storage_class" json:"storage_class"`
+}
+
+// RuleID returns the ID of the rule, which is at index in the config.
+func (rule LifecycleRule) RuleID(index int) string {
+	if rule.ID != "" {
+		return rule.ID
+	}
+	return "mediastore-" + strconv.Itoa(index)
+}
+
+// Validate checks the rules.
+func (cfg LifecycleConfig) Validate() error {
+	for i, rule := range cfg.Rules {
+		argName := "Rules[" + strconv.Itoa(i) + "]"
+		if rule.ExpirationDays < 0 || rule.RetentionDays < 0 {
+			return errors.ArgMsg(argName, "days negative")
+		}
+		if rule.ExpirationDays == 0 && rule.RetentionDays == 0 && len(rule.Transitions) == 0 {
+			return errors.ArgMsg(argName, "no action")
+		}
+		if rule.ExpirationDays != 0 && rule.ExpirationDays < rule.RetentionDays {
+			return errors.ArgMsg(argName, "expires before the end of the retention")
+		}
+		for _, transition := range rule.Transitions {
+			if transition.Days < 0 {
+				return errors.ArgMsg(argName+".Transitions", "days negative")
+			}
+			if transition.StorageClass == "" {
+				return errors.ArgMsg(argName+".Transitions", "storage class empty")
+			}
+		}
+	}
+	return nil
+}
+
+// LifecycleConfigurer is implemented by the services which apply the
+// lifecycle rules, either by configuring the bucket or by sweeping the
+// objects themselves. Store.New provides Config.Lifecycle to them.
+type LifecycleConfigurer interface {
+	SetLifecycle(ctx context.Context, config LifecycleConfig) error
+}
+
+// retainedUntil returns the time until which the object is retained by
+// the rules.
+func retainedUntil(rules []LifecycleRule, info ObjectInfo) time.Time {
+	var until time.Time
+	for _, rule := range rules {
+		if rule.RetentionDays == 0 || !strings.HasPrefix(info.Key, rule.Prefix) {
+			continue
+		}
+		if t := info.LastModified.AddDate(0, 0, rule.RetentionDays); t.After(until) {
+			until = t
+		}
+	}
+	return until
+}
+
+// checkRetention returns an error if the object could not be deleted yet.
+func (mediaStore *Store) checkRetention(ctx context.Context, objectKey string) error {
+	rules := mediaStore.config.Lifecycle.Rules
+	retained := false
+	for _, rule := range rules {
+		if rule.RetentionDays > 0 && strings.HasPrefix(objectKey, rule.Prefix) {
+			retained = true
+			break
+		}
+	}
+	if !retained {
+		return nil
+	}
+
+	info, err := mediaStore.serviceClient.StatObject(ctx, objectKey)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil
+		}
+		return errors.Wrap("stat object", err)
+	}
+	if until := retainedUntil(rules, *info); time.Now().Before(until) {
+		return errors.Wrap(objectKey+" until "+until.UTC().Format(time.RFC3339), ErrObjectRetained)
+	}
+	return nil
+}
+
+// LifecycleSweeper applies the expiration of the lifecycle rules by
+// listing and deleting the objects periodically. It's used by the services
+// which don't have a native lifecycle. Transitions are not applied.
+type LifecycleSweeper struct {
+	svc      ServiceV2
+	rules    []LifecycleRule
+	interval time.Duration
+	now      func() time.Time
+
+	started  atomic.Bool
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewLifecycleSweeper creates a sweeper of the objects of the service.
+// Call Start to run it in the background.
+func NewLifecycleSweeper(svc ServiceV2, config LifecycleConfig) (*LifecycleSweeper, error) {
+	if svc == nil {
+		return nil, errors.ArgMsg("svc", "missing")
+	}
+	if err := config.Validate(); err != nil {
+		return nil, errors.ArgWrap("config", "invalid", err)
+	}
+	interval := config.SweepInterval
+	if interval <= 0 {
+		interval = LifecycleSweepIntervalDefault
+	}
+	return &LifecycleSweeper{
+		svc:      svc,
+		rules:    config.Rules,
+		interval: interval,
+		now:      time.Now,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Start sweeps immediately and then at every interval until Stop is
+// called. The errors are logged.
+func (sweeper *LifecycleSweeper) Start() {
+	if !sweeper.started.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer close(sweeper.done)
+		ticker := time.NewTicker(sweeper.interval)
+		defer ticker.Stop()
+		for {
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				select {
+				case <-sweeper.stop:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			deleted, err := sweeper.Sweep(ctx)
+			cancel()
+			if err != nil && !errors.Is(err, context.Canceled) {
+				log.Error().Err(err).Msg("Lifecycle sweep failed")
+			} else if deleted > 0 {
+				log.Info().Int("deleted", deleted).Msg("Lifecycle sweep deleted expired objects")
+			}
+
+			select {
+			case <-sweeper.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops the sweeper started by Start and waits for it.
+func (sweeper *LifecycleSweeper) Stop() {
+	sweeper.stopOnce.Do(func() { close(sweeper.stop) })
+	if sweeper.started.Load() {
+		<-sweeper.done
+	}
+}
+
+// Sweep deletes the expired objects once. It returns the number of the
+// deleted objects.
+func (sweeper *LifecycleSweeper) Sweep(ctx context.Context) (deleted int, err error) {
+	now := sweeper.now()
+	for _, rule := range sweeper.rules {
+		if rule.ExpirationDays == 0 {
+			continue
+		}
+		var pageToken string
+		for {
+			list, err := sweeper.svc.ListObjects(ctx, rule.Prefix, pageToken, ListObjectsLimitDefault)
+			if err != nil {
+				return deleted, errors.Wrap("listing objects", err)
+			}
+			for _, info := range list.Objects {
+				if !now.After(info.LastModified.AddDate(0, 0, rule.ExpirationDays)) {
+					continue
+				}
+				// Another rule may retain the object longer.
+				if now.Before(retainedUntil(sweeper.rules, info)) {
+					continue
+				}
+				if err = sweeper.svc.DeleteObject(ctx, info.Key); err != nil {
+					return deleted, errors.Wrap(info.Key, err)
+				}
+				deleted++
+			}
+			if list.NextPageToken == "" {
+				break
+			}
+			pageToken = list.NextPageToken
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,170 @@
+package store_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+	"github.com/timemore/foundation/media/store/local"
+)
+
+// newAgedLocalService creates a local service with the objects, whose
+// modification time is set to their age in days.
+func newAgedLocalService(t *testing.T, ages map[string]int) mediastore.ServiceV2 {
+	t.Helper()
+	dir := t.TempDir()
+	svc, err := local.NewServiceV2(&local.Config{DirectoryPath: dir, SigningKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, days := range ages {
+		putObject(t, svc, key, key)
+		modTime := time.Now().AddDate(0, 0, -days)
+		if err = os.Chtimes(filepath.Join(dir, filepath.FromSlash(key)), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return svc
+}
+
+func TestLifecycleConfigValidate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		rule    mediastore.LifecycleRule
+		argName string
+	}{
+		{name: "expiration", rule: mediastore.LifecycleRule{ExpirationDays: 30}},
+		{name: "retention", rule: mediastore.LifecycleRule{RetentionDays: 30}},
+		{name: "expiration after retention", rule: mediastore.LifecycleRule{ExpirationDays: 30, RetentionDays: 30}},
+		{name: "transition", rule: mediastore.LifecycleRule{
+			Transitions: []mediastore.LifecycleTransition{{Days: 30, StorageClass: "GLACIER"}},
+		}},
+		{name: "no action", rule: mediastore.LifecycleRule{Prefix: "tmp/"}, argName: "Rules[0]"},
+		{name: "negative", rule: mediastore.LifecycleRule{ExpirationDays: -1}, argName: "Rules[0]"},
+		{name: "expiration before retention", rule: mediastore.LifecycleRule{ExpirationDays: 10, RetentionDays: 30},
+			argName: "Rules[0]"},
+		{name: "transition without storage class", rule: mediastore.LifecycleRule{
+			Transitions: []mediastore.LifecycleTransition{{Days: 30}},
+		}, argName: "Rules[0].Transitions"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := mediastore.LifecycleConfig{Rules: []mediastore.LifecycleRule{tc.rule}}.Validate()
+			if tc.argName == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var argErr errors.ArgumentError
+			if !errors.As(err, &argErr) || argErr.ArgumentName() != tc.argName {
+				t.Fatalf("got %v, want an argument error of %s", err, tc.argName)
+			}
+		})
+	}
+}
+
+func TestRetention(t *testing.T) {
+	svc := newAgedLocalService(t, map[string]int{
+		"retained/recent": 1,
+		"retained/old":    40,
+		"other/recent":    1,
+	})
+	mediaStore := newTestStore(t, mediastore.Config{
+		Lifecycle: mediastore.LifecycleConfig{Rules: []mediastore.LifecycleRule{
+			{Prefix: "retained/", RetentionDays: 30},
+		}},
+	}, svc)
+	ctx := context.Background()
+
+	testCases := []struct {
+		name     string
+		call     func(key string) error
+		key      string
+		retained bool
+	}{
+		{name: "delete retained", call: func(key string) error { return mediaStore.Delete(ctx, key) },
+			key: "retained/recent", retained: true},
+		{name: "move retained", call: func(key string) error { return mediaStore.Move(ctx, key, "moved") },
+			key: "retained/recent", retained: true},
+		{name: "delete after the retention", call: func(key string) error { return mediaStore.Delete(ctx, key) },
+			key: "retained/old"},
+		{name: "delete another prefix", call: func(key string) error { return mediaStore.Delete(ctx, key) },
+			key: "other/recent"},
+		{name: "delete missing", call: func(key string) error { return mediaStore.Delete(ctx, key) },
+			key: "retained/missing"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.call(tc.key)
+			if tc.retained {
+				if !errors.Is(err, mediastore.ErrObjectRetained) {
+					t.Fatalf("got %v, want ErrObjectRetained", err)
+				}
+				if exists, _ := mediaStore.Exists(ctx, tc.key); !exists {
+					t.Error("retained object removed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exists, _ := mediaStore.Exists(ctx, tc.key); exists {
+				t.Error("object not removed")
+			}
+		})
+	}
+}
+
+func TestLifecycleSweeper(t *testing.T) {
+	svc := newAgedLocalService(t, map[string]int{
+		"tmp/old":          40,
+		"tmp/recent":       1,
+		"tmp/retained/old": 40,
+		"keep/old":         400,
+	})
+	sweeper, err := mediastore.NewLifecycleSweeper(svc, mediastore.LifecycleConfig{Rules: []mediastore.LifecycleRule{
+		{Prefix: "tmp/", ExpirationDays: 30},
+		{Prefix: "tmp/retained/", ExpirationDays: 90, RetentionDays: 60},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := sweeper.Sweep(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Errorf("deleted: got %d, want 1", deleted)
+	}
+	keys := objectKeys(t, svc, "")
+	sort.Strings(keys)
+	if want := "keep/old,tmp/recent,tmp/retained/old"; strings.Join(keys, ",") != want {
+		t.Errorf("got %v, want %s", keys, want)
+	}
+
+	// The sweeper started by the module removes the expired objects in the
+	// background.
+	svc = newAgedLocalService(t, map[string]int{"tmp/old": 40})
+	configurer := svc.(mediastore.LifecycleConfigurer)
+	err = configurer.SetLifecycle(context.Background(), mediastore.LifecycleConfig{
+		Rules: []mediastore.LifecycleRule{{Prefix: "tmp/", ExpirationDays: 30}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(objectKeys(t, svc, "")) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expired object not swept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,164 @@
+package local
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+// The files whose name starts with these prefixes are kept by the service
+// for its own use, they are not objects.
+const (
+	tempFilePrefix     = ".upload-"
+	metadataFilePrefix = ".meta."
+)
+
+func isInternalFile(name string) bool {
+	return strings.HasPrefix(name, tempFilePrefix) ||
+		strings.HasPrefix(name, metadataFilePrefix)
+}
+
+// isReservedKey returns true if the file of the key would be one of the
+// files of the service, i.e., a file whose name has an internal prefix or
+// a file of the directory of the upload sessions.
+func isReservedKey(objectKey string) bool {
+	segments := strings.Split(strings.TrimPrefix(path.Clean("/"+objectKey), "/"), "/")
+	return isInternalFile(segments[len(segments)-1]) || segments[0] == uploadsDirName
+}
+
+// fileAttributes are the attributes of an object which the file system
+// is not able to keep. They are stored as JSON in a file next to the
+// object file.
+type fileAttributes struct {
+	ContentType        string            `json:"content_type,omitempty"`
+	CacheControl       string            `json:"cache_control,omitempty"`
+	ContentDisposition string            `json:"content_disposition,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+func (attrs fileAttributes) isEmpty() bool {
+	return attrs.ContentType == "" && attrs.CacheControl == "" &&
+		attrs.ContentDisposition == "" && len(attrs.Metadata) == 0
+}
+
+func metadataFileName(fileName string) string {
+	return filepath.Join(filepath.Dir(fileName), metadataFilePrefix+filepath.Base(fileName)+".json")
+}
+
+// writeFileAtomic writes the content into a temporary file first so that
+// a failed write doesn't leave a partial file or destroy the existing one.
+func writeFileAtomic(fileName string, content io.Reader) (written int64, err error) {
+	if err = os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return 0, errors.Wrap("create directory", err)
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(fileName), tempFilePrefix+"*")
+	if err != nil {
+		return 0, errors.Wrap("create file", err)
+	}
+	defer func() {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+	}()
+
+	written, err = io.Copy(tempFile, content)
+	if err != nil {
+		return 0, errors.Wrap("write content", err)
+	}
+	if err = tempFile.Chmod(0644); err != nil {
+		return 0, errors.Wrap("chmod file", err)
+	}
+	if err = tempFile.Close(); err != nil {
+		return 0, errors.Wrap("close file", err)
+	}
+	if err = os.Rename(tempFile.Name(), fileName); err != nil {
+		return 0, errors.Wrap("rename file", err)
+	}
+	return written, nil
+}
+
+func writeAttributes(fileName string, attrs fileAttributes) error {
+	if attrs.isEmpty() {
+		err := os.Remove(metadataFileName(fileName))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap("remove metadata file", err)
+		}
+		return nil
+	}
+
+	b, err := json.Marshal(attrs)
+	if err != nil {
+		return errors.Wrap("encode metadata", err)
+	}
+	_, err = writeFileAtomic(metadataFileName(fileName), bytes.NewReader(b))
+	return err
+}
+
+func readAttributes(fileName string) (attrs fileAttributes, err error) {
+	b, err := os.ReadFile(metadataFileName(fileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fileAttributes{}, nil
+		}
+		return fileAttributes{}, errors.Wrap("read metadata file", err)
+	}
+	if err = json.Unmarshal(b, &attrs); err != nil {
+		return fileAttributes{}, errors.Wrap("decode metadata", err)
+	}
+	return attrs, nil
+}
+
+// fileObjectInfo builds the information of the object from the opened
+// file and its attributes. If the content type was not provided when the
+// object was stored, it's detected from the head of the file, in which
+// case the file is rewound.
+func fileObjectInfo(objectKey string, f *os.File) (*mediastore.ObjectInfo, error) {
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrap("stat file", err)
+	}
+	if fileInfo.IsDir() {
+		return nil, errors.Wrap(objectKey, mediastore.ErrObjectNotFound)
+	}
+	attrs, err := readAttributes(f.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := attrs.ContentType
+	if contentType == "" {
+		contentType, _, err = mediastore.SniffContentType(f)
+		if err != nil {
+			return nil, errors.Wrap("read file", err)
+		}
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return nil, errors.Wrap("seek file", err)
+		}
+	}
+
+	return &mediastore.ObjectInfo{
+		Key:                objectKey,
+		Size:               fileInfo.Size(),
+		ContentType:        contentType,
+		CacheControl:       attrs.CacheControl,
+		ContentDisposition: attrs.ContentDisposition,
+		ETag:               fileETag(fileInfo),
+		LastModified:       fileInfo.ModTime().UTC(),
+		Metadata:           attrs.Metadata,
+	}, nil
+}
+
+// fileETag derives a weak entity tag from the modification time and the
+// size of the file.
+func fileETag(fileInfo fs.FileInfo) string {
+	return strconv.FormatInt(fileInfo.ModTime().UnixNano(), 16) + "-" +
+		strconv.FormatInt(fileInfo.Size(), 16)
+}
@@ -0,0 +1,235 @@
+package local
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+// The query parameters of the signed URLs.
+const (
+	signatureParam   = "signature"
+	expiresParam     = "expires"
+	contentTypeParam = "content-type"
+	maxSizeParam     = "max-size"
+)
+
+var (
+	errSignatureInvalid = errors.Msg("signature invalid")
+	errSignatureExpired = errors.Msg("signature expired")
+)
+
+// PresignPutObject creates a URL, signed with HMAC-SHA256, which is
+// accepted by the Handler for uploading the object with a PUT request.
+func (s *Service) PresignPutObject(
+	ctx context.Context,
+	targetKey string,
+	opts mediastore.PresignPutOptions,
+) (*mediastore.PresignedRequest, error) {
+	if s.directoryPath == "" {
+		return nil, errors.ArgMsg("config.DirectoryPath", "empty")
+	}
+	if s.baseURL == nil {
+		return nil, errors.ArgMsg("config.BaseURL", "empty")
+	}
+	if _, err := s.filePath("targetKey", targetKey); err != nil {
+		return nil, err
+	}
+	expiry := opts.Expiry
+	if expiry <= 0 {
+		expiry = mediastore.PresignExpiryDefault
+	}
+	expires := time.Now().Add(expiry)
+
+	header := http.Header{}
+	params := url.Values{}
+	params.Set(expiresParam, strconv.FormatInt(expires.Unix(), 10))
+	if opts.ContentType != "" {
+		params.Set(contentTypeParam, opts.ContentType)
+		header.Set("Content-Type", opts.ContentType)
+	}
+	if opts.MaxSize > 0 {
+		params.Set(maxSizeParam, strconv.FormatInt(opts.MaxSize, 10))
+	}
+
+	return &mediastore.PresignedRequest{
+		Method:  http.MethodPut,
+		URL:     s.signedURL(http.MethodPut, targetKey, params),
+		Header:  header,
+		Expires: expires,
+	}, nil
+}
+
+// signedURL returns the URL of the object with the params and their
+// signature in the query. The key is signed the way the Handler receives
+// it, i.e., as the cleaned path of the URL.
+func (s *Service) signedURL(method, objectKey string, params url.Values) string {
+	objectKey = strings.TrimPrefix(path.Clean("/"+objectKey), "/")
+	params.Set(signatureParam, s.sign(method, objectKey, params))
+	u := *s.baseURL
+	u.Path = path.Join("/", u.Path, objectKey)
+	u.RawPath = ""
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+// sign computes the signature of the method, the object key and the
+// params, excluding the signature param itself.
+func (s *Service) sign(method, objectKey string, params url.Values) string {
+	signed := url.Values{}
+	for k, v := range params {
+		if k != signatureParam {
+			signed[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, s.signingKey)
+	mac.Write([]byte(method + "\n" + objectKey + "\n" + signed.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyRequest checks that the request was made to a signed URL which
+// has not expired, and returns the key of the requested object. The
+// method is the one the URL was signed for.
+func (s *Service) verifyRequest(r *http.Request, method string) (objectKey string, params url.Values, err error) {
+	objectKey = strings.TrimPrefix(r.URL.Path, "/")
+	if objectKey == "" || path.Clean("/"+objectKey) != "/"+objectKey {
+		return "", nil, errSignatureInvalid
+	}
+
+	params = r.URL.Query()
+	signature, err := hex.DecodeString(params.Get(signatureParam))
+	if err != nil {
+		return "", nil, errSignatureInvalid
+	}
+	expected, _ := hex.DecodeString(s.sign(method, objectKey, params))
+	if !hmac.Equal(signature, expected) {
+		return "", nil, errSignatureInvalid
+	}
+
+	expires, err := strconv.ParseInt(params.Get(expiresParam), 10, 64)
+	if err != nil {
+		return "", nil, errSignatureInvalid
+	}
+	if time.Now().Unix() > expires {
+		return "", nil, errSignatureExpired
+	}
+
+	return objectKey, params, nil
+}
+
+// Handler returns an http.Handler which serves the URLs signed by the
+// service. The handler expects the object key as the request path, it
+// should be mounted at the path of the configured BaseURL with
+// http.StripPrefix.
+func (s *Service) Handler() http.Handler {
+	return http.HandlerFunc(s.serveHTTP)
+}
+
+func (s *Service) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.serveGet(w, r)
+	case http.MethodPut:
+		s.servePut(w, r)
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodHead+", "+http.MethodPut)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// serveGet serves the object of a URL created by GetPublicObject. HEAD
+// requests are accepted with the URLs signed for GET.
+func (s *Service) serveGet(w http.ResponseWriter, r *http.Request) {
+	objectKey, params, err := s.verifyRequest(r, http.MethodGet)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	obj, err := s.GetObject(r.Context(), objectKey)
+	if err != nil {
+		if errors.Is(err, mediastore.ErrObjectNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer obj.Close()
+
+	header := w.Header()
+	header.Set("ETag", `"`+obj.Info.ETag+`"`)
+	header.Set("Content-Type", obj.Info.ContentType)
+	if contentType := params.Get("response-content-type"); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	if obj.Info.ContentDisposition != "" {
+		header.Set("Content-Disposition", obj.Info.ContentDisposition)
+	}
+	if contentDisposition := params.Get("response-content-disposition"); contentDisposition != "" {
+		header.Set("Content-Disposition", contentDisposition)
+	}
+	if obj.Info.CacheControl != "" {
+		header.Set("Cache-Control", obj.Info.CacheControl)
+	}
+
+	// The reader of the object is the file, which allows ServeContent
+	// to serve ranges.
+	http.ServeContent(w, r, "", obj.Info.LastModified, obj.ReadCloser.(io.ReadSeeker))
+}
+
+func (s *Service) servePut(w http.ResponseWriter, r *http.Request) {
+	objectKey, params, err := s.verifyRequest(r, http.MethodPut)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if contentType := params.Get(contentTypeParam); contentType != "" &&
+		r.Header.Get("Content-Type") != contentType {
+		http.Error(w, "content type not allowed", http.StatusForbidden)
+		return
+	}
+
+	body := r.Body
+	if maxSizeStr := params.Get(maxSizeParam); maxSizeStr != "" {
+		maxSize, _ := strconv.ParseInt(maxSizeStr, 10, 64)
+		if r.ContentLength > maxSize {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		body = http.MaxBytesReader(w, r.Body, maxSize)
+	}
+
+	opts := mediastore.PutObjectOptions{
+		ContentType:        r.Header.Get("Content-Type"),
+		CacheControl:       r.Header.Get("Cache-Control"),
+		ContentDisposition: r.Header.Get("Content-Disposition"),
+	}
+	if _, err = s.PutObject(r.Context(), objectKey, body, opts); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		var argErr errors.ArgumentError
+		if errors.As(err, &argErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,286 @@
+package local
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+func newSigningTestService(t *testing.T) (*Service, http.Handler) {
+	t.Helper()
+	svc, err := NewServiceV2(&Config{
+		DirectoryPath: t.TempDir(),
+		BaseURL:       "http://example.com/media",
+		SigningKey:    "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc.(*Service), http.StripPrefix("/media", svc.(*Service).Handler())
+}
+
+func serve(handler http.Handler, method, target string, body string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestSignedGet(t *testing.T) {
+	svc, handler := newSigningTestService(t)
+	putObject(t, svc, "dir/key", "content")
+	publicURL, err := svc.GetPublicObject(context.Background(), "dir/key", mediastore.PublicURLOptions{
+		ContentType: "text/plain",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := svc.signedURL(http.MethodGet, "dir/key", url.Values{
+		expiresParam: {strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)},
+	})
+
+	tamper := func(fn func(u *url.URL)) string {
+		u, _ := url.Parse(publicURL)
+		fn(u)
+		return u.String()
+	}
+	testCases := []struct {
+		name   string
+		method string
+		url    string
+		status int
+		body   string
+	}{
+		{name: "signed", method: http.MethodGet, url: publicURL, status: http.StatusOK, body: "content"},
+		{name: "head", method: http.MethodHead, url: publicURL, status: http.StatusOK},
+		{name: "expired", method: http.MethodGet, url: expired, status: http.StatusForbidden},
+		{name: "other key", method: http.MethodGet, status: http.StatusForbidden,
+			url: tamper(func(u *url.URL) { u.Path = "/media/dir/other" })},
+		{name: "escaping key", method: http.MethodGet, status: http.StatusForbidden,
+			url: tamper(func(u *url.URL) { u.Path = "/media/dir/../dir/key" })},
+		{name: "signature modified", method: http.MethodGet, status: http.StatusForbidden,
+			url: tamper(func(u *url.URL) {
+				q := u.Query()
+				q.Set(signatureParam, strings.Repeat("0", 64))
+				u.RawQuery = q.Encode()
+			})},
+		{name: "param modified", method: http.MethodGet, status: http.StatusForbidden,
+			url: tamper(func(u *url.URL) {
+				q := u.Query()
+				q.Set("response-content-type", "text/html")
+				u.RawQuery = q.Encode()
+			})},
+		{name: "signed for another method", method: http.MethodPut, url: publicURL, status: http.StatusForbidden},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := serve(handler, tc.method, tc.url, "", nil)
+			if rec.Code != tc.status {
+				t.Fatalf("status: got %d, want %d", rec.Code, tc.status)
+			}
+			if tc.body != "" && rec.Body.String() != tc.body {
+				t.Errorf("body: got %q, want %q", rec.Body.String(), tc.body)
+			}
+			if tc.status == http.StatusOK && rec.Header().Get("Content-Type") != "text/plain" {
+				t.Errorf("content type: got %q", rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestSignedGetNonCanonicalKey(t *testing.T) {
+	svc, handler := newSigningTestService(t)
+	putObject(t, svc, "dir/key", "content")
+	for _, key := range []string{"dir//key", "./dir/key", "dir/sub/../key", "/dir/key"} {
+		t.Run(key, func(t *testing.T) {
+			publicURL, err := svc.GetPublicObject(context.Background(), key, mediastore.PublicURLOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := serve(handler, http.MethodGet, publicURL, "", nil)
+			if rec.Code != http.StatusOK || rec.Body.String() != "content" {
+				t.Errorf("got %d %q, want the content", rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestSignedPut(t *testing.T) {
+	svc, handler := newSigningTestService(t)
+	presign := func(opts mediastore.PresignPutOptions) string {
+		req, err := svc.PresignPutObject(context.Background(), "uploaded", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req.URL
+	}
+
+	testCases := []struct {
+		name   string
+		url    string
+		header map[string]string
+		body   string
+		status int
+	}{
+		{name: "signed", url: presign(mediastore.PresignPutOptions{}), body: "content", status: http.StatusOK},
+		{
+			name:   "content type",
+			url:    presign(mediastore.PresignPutOptions{ContentType: "image/png"}),
+			header: map[string]string{"Content-Type": "image/png"},
+			body:   "content",
+			status: http.StatusOK,
+		},
+		{
+			name:   "content type not allowed",
+			url:    presign(mediastore.PresignPutOptions{ContentType: "image/png"}),
+			header: map[string]string{"Content-Type": "text/html"},
+			body:   "content",
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "at the maximum size",
+			url:    presign(mediastore.PresignPutOptions{MaxSize: 7}),
+			body:   "content",
+			status: http.StatusOK,
+		},
+		{
+			name:   "too large",
+			url:    presign(mediastore.PresignPutOptions{MaxSize: 4}),
+			body:   "content",
+			status: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := serve(handler, http.MethodPut, tc.url, tc.body, tc.header)
+			if rec.Code != tc.status {
+				t.Fatalf("status: got %d, want %d: %s", rec.Code, tc.status, rec.Body.String())
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			obj, err := svc.StatObject(context.Background(), "uploaded")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if obj.Size != int64(len(tc.body)) {
+				t.Errorf("size: got %d, want %d", obj.Size, len(tc.body))
+			}
+		})
+	}
+}
+
+func TestPresignPutSignature(t *testing.T) {
+	svc, handler := newSigningTestService(t)
+	ctx := context.Background()
+	before := time.Now()
+	req, err := svc.PresignPutObject(ctx, "dir/./uploaded", mediastore.PresignPutOptions{
+		ContentType: "image/png",
+		MaxSize:     100,
+		Expiry:      time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != http.MethodPut || req.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("request: got %+v", req)
+	}
+	if req.Expires.Before(before.Add(time.Minute)) || req.Expires.After(time.Now().Add(time.Minute)) {
+		t.Errorf("expires: got %v", req.Expires)
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/media/dir/uploaded" {
+		t.Errorf("path: got %q", u.Path)
+	}
+	query := u.Query()
+	if query.Get(contentTypeParam) != "image/png" || query.Get(maxSizeParam) != "100" {
+		t.Errorf("query: got %v", query)
+	}
+	if expires, _ := strconv.ParseInt(query.Get(expiresParam), 10, 64); expires != req.Expires.Unix() {
+		t.Errorf("expires param: got %d, want %d", expires, req.Expires.Unix())
+	}
+
+	tamper := func(fn func(u *url.URL, q url.Values)) string {
+		u, _ := url.Parse(req.URL)
+		q := u.Query()
+		fn(u, q)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	header := map[string]string{"Content-Type": "image/png"}
+	testCases := []struct {
+		name   string
+		url    string
+		status int
+	}{
+		{"other key", tamper(func(u *url.URL, q url.Values) { u.Path = "/media/dir/other" }), http.StatusForbidden},
+		{"max size raised", tamper(func(u *url.URL, q url.Values) { q.Set(maxSizeParam, "1000") }), http.StatusForbidden},
+		{"max size removed", tamper(func(u *url.URL, q url.Values) { q.Del(maxSizeParam) }), http.StatusForbidden},
+		{"content type removed", tamper(func(u *url.URL, q url.Values) { q.Del(contentTypeParam) }), http.StatusForbidden},
+		{"expiry extended", tamper(func(u *url.URL, q url.Values) {
+			q.Set(expiresParam, strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		}), http.StatusForbidden},
+		{"signature removed", tamper(func(u *url.URL, q url.Values) { q.Del(signatureParam) }), http.StatusForbidden},
+		{"signed", req.URL, http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := serve(handler, http.MethodPut, tc.url, "content", header)
+			if rec.Code != tc.status {
+				t.Fatalf("status: got %d, want %d: %s", rec.Code, tc.status, rec.Body.String())
+			}
+		})
+	}
+	if _, err = svc.StatObject(ctx, "dir/other"); !errors.Is(err, mediastore.ErrObjectNotFound) {
+		t.Errorf("tampered upload stored: %v", err)
+	}
+	info, err := svc.StatObject(ctx, "dir/uploaded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentType != "image/png" || info.Size != int64(len("content")) {
+		t.Errorf("uploaded: got %+v", info)
+	}
+
+	// A URL signed by another key is rejected.
+	other, err := NewServiceV2(&Config{DirectoryPath: t.TempDir(), BaseURL: "http://example.com/media", SigningKey: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherReq, err := other.(*Service).PresignPutObject(ctx, "dir/uploaded", mediastore.PresignPutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(handler, http.MethodPut, otherReq.URL, "content", nil); rec.Code != http.StatusForbidden {
+		t.Errorf("signed by another key: got %d", rec.Code)
+	}
+
+	var argErr errors.ArgumentError
+	for _, key := range []string{"../outside", "dir/.meta.uploaded"} {
+		if _, err = svc.PresignPutObject(ctx, key, mediastore.PresignPutOptions{}); !errors.As(err, &argErr) {
+			t.Errorf("%s: got %v, want an argument error", key, err)
+		}
+	}
+	noBaseURL, err := NewServiceV2(&Config{DirectoryPath: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = noBaseURL.(*Service).PresignPutObject(ctx, "key", mediastore.PresignPutOptions{}); !errors.As(err, &argErr) ||
+		argErr.ArgumentName() != "config.BaseURL" {
+		t.Errorf("without base URL: got %v, want an argument error of config.BaseURL", err)
+	}
+}
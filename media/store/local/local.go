@@ -2,9 +2,19 @@ package local
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/timemore/foundation/errors"
 	mediastore "github.com/timemore/foundation/media/store"
@@ -12,7 +22,19 @@ import (
 )
 
 type Config struct {
+	// DirectoryPath is the directory where the objects are stored. If it's
+	// empty, the content is not stored: PutObject returns the content in
+	// the UploadInfo and the service behaves as if it holds no object.
 	DirectoryPath string `env:"FOLDER_PATH" yaml:"folder_path" json:"folder_path"`
+
+	// BaseURL is the URL where the Handler of the service is mounted. It's
+	// used to construct the signed URLs.
+	BaseURL string `env:"BASE_URL" yaml:"base_url" json:"base_url"`
+
+	// SigningKey is the key used to sign the URLs. If it's empty, a random
+	// key is generated and the signed URLs are only valid for the
+	// lifetime of the process.
+	SigningKey string `env:"SIGNING_KEY" yaml:"signing_key" json:"signing_key"`
 }
 
 const ServiceName = "local"
@@ -21,7 +43,7 @@ func init() {
 	mediastore.RegisterModule(
 		ServiceName,
 		mediastore.Module{
-			NewService: NewService,
+			NewServiceV2: NewServiceV2,
 			ServiceConfigSkeleton: func() mediastore.ServiceConfig {
 				cfg := ConfigSkeleton()
 				return &cfg
@@ -29,7 +51,18 @@ func init() {
 		})
 }
 
+// NewService creates the service behind the legacy Service interface.
+//
+// Deprecated: use NewServiceV2.
 func NewService(config mediastore.ServiceConfig) (mediastore.Service, error) {
+	svc, err := NewServiceV2(config)
+	if err != nil {
+		return nil, err
+	}
+	return mediastore.LegacyService(svc), nil
+}
+
+func NewServiceV2(config mediastore.ServiceConfig) (mediastore.ServiceV2, error) {
 	if config == nil {
 		return nil, errors.ArgMsg("config", "missing")
 	}
@@ -45,89 +78,412 @@ func NewService(config mediastore.ServiceConfig) (mediastore.Service, error) {
 		conf = &cfg
 	}
 
+	var baseURL *url.URL
+	if conf.BaseURL != "" {
+		u, err := url.Parse(conf.BaseURL)
+		if err != nil {
+			return nil, errors.ArgWrap("config.BaseURL", "parse", err)
+		}
+		baseURL = u
+	}
+
+	signingKey := []byte(conf.SigningKey)
+	if len(signingKey) == 0 {
+		signingKey = make([]byte, 32)
+		if _, err := rand.Read(signingKey); err != nil {
+			return nil, errors.Wrap("generate signing key", err)
+		}
+	}
+
 	return &Service{
 		directoryPath: conf.DirectoryPath,
+		baseURL:       baseURL,
+		signingKey:    signingKey,
 	}, nil
 }
 
 type Service struct {
 	directoryPath string
-}
+	baseURL       *url.URL
+	signingKey    []byte
 
-func (s *Service) PutObject(objectKey string, contentSource io.Reader) (uploadInfo *mediastore.UploadInfo, err error) {
-	if s.directoryPath != "" {
-		targetName := filepath.Join(s.directoryPath, objectKey)
-		targetFile, err := os.Create(targetName)
-		if err != nil {
-			return nil, errors.Wrap("create file", err)
-		}
-		defer func() {
-			_ = targetFile.Close()
-		}()
+	sweeperMu sync.Mutex
+	sweeper   *mediastore.LifecycleSweeper
+}
 
-		_, err = io.Copy(targetFile, contentSource)
+func (s *Service) PutObject(
+	ctx context.Context,
+	objectKey string,
+	contentSource io.Reader,
+	opts mediastore.PutObjectOptions,
+) (uploadInfo *mediastore.UploadInfo, err error) {
+	contentSource = mediastore.ContextReader(ctx, contentSource)
+	if s.directoryPath == "" {
+		stream := &bytes.Buffer{}
+		dataSize, err := stream.ReadFrom(contentSource)
 		if err != nil {
-			return nil, errors.Wrap("write content", err)
+			return nil, errors.Wrap("read content", err)
 		}
+		return &mediastore.UploadInfo{
+			Key:    objectKey,
+			Output: stream,
+			Size:   int(dataSize),
+		}, nil
 	}
-	stream := &bytes.Buffer{}
-	buf := make([]byte, 1*1024*1024)
-	dataSize := 0
-	for {
-		n, err := contentSource.Read(buf)
-		if err != nil && err != io.EOF {
-			panic(err)
-		}
-		dataSize += n
 
-		_, _ = stream.Write(buf)
-		if err == io.EOF || n == 0 {
-			break
-		}
+	targetName, err := s.filePath("objectKey", objectKey)
+	if err != nil {
+		return nil, err
+	}
+	dataSize, err := writeFileAtomic(targetName, contentSource)
+	if err != nil {
+		return nil, err
+	}
+	err = writeAttributes(targetName, fileAttributes{
+		ContentType:        opts.ContentType,
+		CacheControl:       opts.CacheControl,
+		ContentDisposition: opts.ContentDisposition,
+		Metadata:           mediastore.NormalizeMetadata(opts.Metadata),
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return &mediastore.UploadInfo{
 		Bucket: s.directoryPath,
 		Key:    objectKey,
-		Output: stream,
-		Size:   dataSize,
+		Size:   int(dataSize),
 	}, nil
 }
 
-func (s *Service) GetPublicObject(sourceKey string) (targetURL string, err error) {
-	// TODO: final URL! ask the HTTP server to provide this.
-	return
+// GetPublicObject creates a URL, signed the same way as the URLs created
+// by PresignPutObject, which is served by the Handler.
+func (s *Service) GetPublicObject(
+	ctx context.Context,
+	sourceKey string,
+	opts mediastore.PublicURLOptions,
+) (targetURL string, err error) {
+	if s.baseURL == nil {
+		return "", errors.ArgMsg("config.BaseURL", "empty")
+	}
+	if _, err = s.filePath("sourceKey", sourceKey); err != nil {
+		return "", err
+	}
+	expiry := opts.Expiry
+	if expiry <= 0 {
+		expiry = mediastore.PresignExpiryDefault
+	}
+
+	params := opts.ResponseQuery()
+	params.Set(expiresParam, strconv.FormatInt(time.Now().Add(expiry).Unix(), 10))
+	return s.signedURL(http.MethodGet, sourceKey, params), nil
 }
 
-func (s *Service) GetObject(sourceKey string) (stream *bytes.Buffer, err error) {
-	sourceFile := filepath.Join(s.directoryPath, sourceKey)
-	if _, err := os.Stat(sourceFile); os.IsNotExist(err) {
-		return nil, errors.EntMsg(sourceFile, err.Error())
+// SetPublicBaseURL sets the URL where the Handler is mounted if it's not
+// provided by Config.BaseURL.
+func (s *Service) SetPublicBaseURL(baseURL string) error {
+	if s.baseURL != nil || baseURL == "" {
+		return nil
 	}
-	f, err := os.Open(sourceFile)
+	u, err := url.Parse(baseURL)
 	if err != nil {
-		return nil, errors.Wrap("open file", err)
+		return errors.ArgWrap("baseURL", "parse", err)
+	}
+	s.baseURL = u
+	return nil
+}
+
+// SetLifecycle starts a sweeper which deletes the expired objects in the
+// background, replacing the sweeper of a previous call. The transitions
+// are ignored.
+func (s *Service) SetLifecycle(ctx context.Context, config mediastore.LifecycleConfig) error {
+	sweeper, err := mediastore.NewLifecycleSweeper(s, config)
+	if err != nil {
+		return err
+	}
+	s.sweeperMu.Lock()
+	defer s.sweeperMu.Unlock()
+	if s.sweeper != nil {
+		s.sweeper.Stop()
+	}
+	s.sweeper = sweeper
+	sweeper.Start()
+	return nil
+}
+
+func (s *Service) GetObject(ctx context.Context, sourceKey string) (object *mediastore.ObjectReader, err error) {
+	f, err := s.openFile(ctx, sourceKey)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fileObjectInfo(sourceKey, f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return &mediastore.ObjectReader{ReadCloser: f, Info: *info}, nil
+}
+
+func (s *Service) GetObjectRange(
+	ctx context.Context,
+	sourceKey string,
+	offset, length int64,
+) (object *mediastore.ObjectReader, err error) {
+	obj, err := s.GetObject(ctx, sourceKey)
+	if err != nil {
+		return nil, err
+	}
+	f := obj.ReadCloser.(*os.File)
+	length, err = mediastore.ResolveRange(obj.Info.Size, offset, length)
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	obj.ReadCloser = mediastore.LimitReadCloser(f, length)
+	return obj, nil
+}
+
+// ListObjects walks the directory for the files whose key starts with
+// prefix. The page token is the key of the last object of the previous page.
+func (s *Service) ListObjects(
+	ctx context.Context,
+	prefix string,
+	pageToken string,
+	limit int,
+) (*mediastore.ObjectList, error) {
+	if limit <= 0 {
+		limit = mediastore.ListObjectsLimitDefault
+	}
+	result := &mediastore.ObjectList{}
+	if s.directoryPath == "" {
+		return result, nil
+	}
+
+	if _, err := s.resolvePath("prefix", prefix); err != nil {
+		return nil, err
+	}
+	// Only walk the deepest directory which could contain the prefix.
+	walkRoot := s.directoryPath
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		var err error
+		if walkRoot, err = s.resolvePath("prefix", prefix[:i]); err != nil {
+			return nil, err
+		}
+	}
+
+	var objects []mediastore.ObjectInfo
+	err := filepath.WalkDir(walkRoot, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && filePath == walkRoot {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if filePath == filepath.Join(s.directoryPath, uploadsDirName) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isInternalFile(d.Name()) {
+			return nil
+		}
+		relPath, err := filepath.Rel(s.directoryPath, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relPath)
+		if !strings.HasPrefix(key, prefix) || key <= pageToken {
+			return nil
+		}
+		fileInfo, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, mediastore.ObjectInfo{
+			Key:          key,
+			Size:         fileInfo.Size(),
+			ETag:         fileETag(fileInfo),
+			LastModified: fileInfo.ModTime().UTC(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap("walk directory", err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	if len(objects) > limit {
+		objects = objects[:limit]
+		result.NextPageToken = objects[limit-1].Key
+	}
+	result.Objects = objects
+
+	return result, nil
+}
+
+func (s *Service) DeleteObject(ctx context.Context, sourceKey string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.directoryPath == "" {
+		return nil
+	}
+	sourceFile, err := s.filePath("sourceKey", sourceKey)
+	if err != nil {
+		return err
 	}
+	err = os.Remove(sourceFile)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap("remove file", err)
+	}
+	err = os.Remove(metadataFileName(sourceFile))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap("remove metadata file", err)
+	}
+	return nil
+}
+
+func (s *Service) StatObject(ctx context.Context, sourceKey string) (*mediastore.ObjectInfo, error) {
+	f, err := s.openFile(ctx, sourceKey)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return fileObjectInfo(sourceKey, f)
+}
 
-	buf := make([]byte, 1*1024*1024)
-	dataSize := 0
-	for {
-		n, err := f.Read(buf)
-		if err != nil && err != io.EOF {
-			panic(err)
+func (s *Service) CopyObject(ctx context.Context, srcKey, dstKey string) error {
+	f, err := s.openFile(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	attrs, err := readAttributes(f.Name())
+	if err != nil {
+		return err
+	}
+	dstFile, err := s.filePath("dstKey", dstKey)
+	if err != nil {
+		return err
+	}
+	if _, err = writeFileAtomic(dstFile, mediastore.ContextReader(ctx, f)); err != nil {
+		return err
+	}
+	return writeAttributes(dstFile, attrs)
+}
+
+// MoveObject renames the file, and its attributes file, which is atomic
+// within a file system.
+func (s *Service) MoveObject(ctx context.Context, srcKey, dstKey string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.directoryPath == "" {
+		return errors.Wrap(srcKey, mediastore.ErrObjectNotFound)
+	}
+	srcFile, err := s.filePath("srcKey", srcKey)
+	if err != nil {
+		return err
+	}
+	dstFile, err := s.filePath("dstKey", dstKey)
+	if err != nil {
+		return err
+	}
+	if fileInfo, err := os.Stat(srcFile); err != nil || fileInfo.IsDir() {
+		if err == nil || os.IsNotExist(err) {
+			return errors.Wrap(srcKey, mediastore.ErrObjectNotFound)
 		}
-		dataSize += n
+		return errors.Wrap("stat file", err)
+	}
+	attrs, err := readAttributes(srcFile)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(dstFile), 0755); err != nil {
+		return errors.Wrap("create directory", err)
+	}
+	if err = os.Rename(srcFile, dstFile); err != nil {
+		return errors.Wrap("rename file", err)
+	}
+	if err = writeAttributes(dstFile, attrs); err != nil {
+		return err
+	}
+	return writeAttributes(srcFile, fileAttributes{})
+}
 
-		_, _ = stream.Write(buf)
-		if err == io.EOF || n == 0 {
-			break
+func (s *Service) openFile(ctx context.Context, objectKey string) (*os.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if s.directoryPath == "" {
+		return nil, errors.Wrap(objectKey, mediastore.ErrObjectNotFound)
+	}
+	fileName, err := s.filePath("objectKey", objectKey)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Wrap(objectKey, mediastore.ErrObjectNotFound)
 		}
+		return nil, errors.Wrap("open file", err)
 	}
+	return f, nil
+}
 
-	return
+// filePath returns the path of the file of the object. The keys which
+// would resolve outside of the directory, e.g., with "..", or to a file
+// kept by the service for its own use are rejected.
+func (s *Service) filePath(argName, objectKey string) (string, error) {
+	fileName, err := s.resolvePath(argName, objectKey)
+	if err != nil {
+		return "", err
+	}
+	if isReservedKey(objectKey) {
+		return "", errors.ArgMsg(argName, "reserved name")
+	}
+	return fileName, nil
+}
+
+// resolvePath is like filePath but accepts any name within the directory,
+// e.g., to resolve a prefix.
+func (s *Service) resolvePath(argName, objectKey string) (string, error) {
+	fileName := filepath.Join(s.directoryPath, filepath.FromSlash(objectKey))
+	relPath, err := filepath.Rel(s.directoryPath, fileName)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", errors.ArgMsg(argName, "outside of the directory")
+	}
+	return fileName, nil
+}
+
+// HealthCheck checks that the objects could be written to the directory.
+func (s *Service) HealthCheck(ctx context.Context) error {
+	if s.directoryPath == "" {
+		return nil
+	}
+	return mediastore.CheckWritable(ctx, s)
 }
 
-var _ mediastore.Service = &Service{}
+var _ mediastore.ServiceV2 = &Service{}
+var _ mediastore.Copier = &Service{}
+var _ mediastore.Presigner = &Service{}
+var _ mediastore.MultipartUploader = &Service{}
+var _ mediastore.HealthChecker = &Service{}
+var _ mediastore.PublicBaseURLSetter = &Service{}
+var _ mediastore.LifecycleConfigurer = &Service{}
 
 func ConfigSkeleton() Config { return Config{} }
 
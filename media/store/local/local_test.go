@@ -1 +1,341 @@
 package local
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+func newTestService(t *testing.T) (*Service, string) {
+	t.Helper()
+	root := t.TempDir()
+	dir := filepath.Join(root, "store")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	svc, err := NewServiceV2(&Config{DirectoryPath: dir, SigningKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc.(*Service), root
+}
+
+func putObject(t *testing.T, svc mediastore.ServiceV2, key, content string) {
+	t.Helper()
+	_, err := svc.PutObject(context.Background(), key, strings.NewReader(content), mediastore.PutObjectOptions{})
+	if err != nil {
+		t.Fatalf("PutObject(%q): %v", key, err)
+	}
+}
+
+func TestListObjects(t *testing.T) {
+	svc, _ := newTestService(t)
+	for _, key := range []string{"a/1", "a/2", "a/3", "b/1", "top"} {
+		putObject(t, svc, key, key)
+	}
+
+	testCases := []struct {
+		name      string
+		prefix    string
+		pageToken string
+		limit     int
+		keys      []string
+		nextToken string
+	}{
+		{name: "all", keys: []string{"a/1", "a/2", "a/3", "b/1", "top"}},
+		{name: "directory", prefix: "a/", keys: []string{"a/1", "a/2", "a/3"}},
+		{name: "partial name", prefix: "t", keys: []string{"top"}},
+		{name: "first page", prefix: "a/", limit: 2, keys: []string{"a/1", "a/2"}, nextToken: "a/2"},
+		{name: "next page", prefix: "a/", pageToken: "a/2", limit: 2, keys: []string{"a/3"}},
+		{name: "missing directory", prefix: "c/", keys: nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			list, err := svc.ListObjects(context.Background(), tc.prefix, tc.pageToken, tc.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for _, obj := range list.Objects {
+				keys = append(keys, obj.Key)
+			}
+			if strings.Join(keys, ",") != strings.Join(tc.keys, ",") {
+				t.Errorf("keys: got %v, want %v", keys, tc.keys)
+			}
+			if list.NextPageToken != tc.nextToken {
+				t.Errorf("next page token: got %q, want %q", list.NextPageToken, tc.nextToken)
+			}
+		})
+	}
+}
+
+func TestKeysOutsideOfTheDirectory(t *testing.T) {
+	svc, root := newTestService(t)
+	putObject(t, svc, "inside", "inside")
+	if err := os.WriteFile(filepath.Join(root, "outside"), []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	testCases := []struct {
+		name    string
+		argName string
+		call    func() error
+	}{
+		{"ListObjects", "prefix", func() error {
+			_, err := svc.ListObjects(ctx, "../", "", 0)
+			return err
+		}},
+		{"ListObjects nested", "prefix", func() error {
+			_, err := svc.ListObjects(ctx, "a/../../", "", 0)
+			return err
+		}},
+		{"GetObject", "objectKey", func() error {
+			_, err := svc.GetObject(ctx, "../outside")
+			return err
+		}},
+		{"StatObject", "objectKey", func() error {
+			_, err := svc.StatObject(ctx, "../outside")
+			return err
+		}},
+		{"PutObject", "objectKey", func() error {
+			_, err := svc.PutObject(ctx, "../written", strings.NewReader("x"), mediastore.PutObjectOptions{})
+			return err
+		}},
+		{"DeleteObject", "sourceKey", func() error {
+			return svc.DeleteObject(ctx, "../outside")
+		}},
+		{"CopyObject source", "objectKey", func() error {
+			return svc.CopyObject(ctx, "../outside", "copied")
+		}},
+		{"CopyObject destination", "dstKey", func() error {
+			return svc.CopyObject(ctx, "inside", "../copied")
+		}},
+		{"MoveObject source", "srcKey", func() error {
+			return svc.MoveObject(ctx, "../outside", "moved")
+		}},
+		{"MoveObject destination", "dstKey", func() error {
+			return svc.MoveObject(ctx, "inside", "../moved")
+		}},
+		{"InitiateUpload", "objectKey", func() error {
+			_, err := svc.InitiateUpload(ctx, "../uploaded", mediastore.PutObjectOptions{})
+			return err
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.call()
+			var argErr errors.ArgumentError
+			if !errors.As(err, &argErr) || argErr.ArgumentName() != tc.argName {
+				t.Fatalf("got %v, want an argument error of %s", err, tc.argName)
+			}
+		})
+	}
+
+	for _, name := range []string{"outside", "written", "copied", "moved", "uploaded"} {
+		_, err := os.Stat(filepath.Join(root, name))
+		if name == "outside" && err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if name != "outside" && !os.IsNotExist(err) {
+			t.Errorf("%s: created outside of the directory", name)
+		}
+	}
+	obj, err := svc.GetObject(ctx, "inside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	if b, _ := io.ReadAll(obj); string(b) != "inside" {
+		t.Errorf("inside: got %q", b)
+	}
+}
+
+func TestEmptyDirectoryPath(t *testing.T) {
+	svc, err := NewServiceV2(&Config{BaseURL: "http://example.com/media"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The files of the working directory must not be reached.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+	if err = os.WriteFile("key", []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	info, err := svc.PutObject(ctx, "other", strings.NewReader("discarded"), mediastore.PutObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Output == nil || info.Output.String() != "discarded" {
+		t.Errorf("output: got %v", info.Output)
+	}
+	list, err := svc.ListObjects(ctx, "", "", 0)
+	if err != nil || len(list.Objects) != 0 {
+		t.Errorf("listed: got %+v, %v", list, err)
+	}
+	if err = svc.DeleteObject(ctx, "key"); err != nil {
+		t.Errorf("DeleteObject: %v", err)
+	}
+
+	testCases := []struct {
+		name    string
+		wantErr error
+		call    func() error
+	}{
+		{"GetObject", mediastore.ErrObjectNotFound, func() error {
+			_, err := svc.GetObject(ctx, "key")
+			return err
+		}},
+		{"GetObjectRange", mediastore.ErrObjectNotFound, func() error {
+			_, err := svc.GetObjectRange(ctx, "key", 0, 1)
+			return err
+		}},
+		{"StatObject", mediastore.ErrObjectNotFound, func() error {
+			_, err := svc.StatObject(ctx, "key")
+			return err
+		}},
+		{"CopyObject", mediastore.ErrObjectNotFound, func() error {
+			return svc.(*Service).CopyObject(ctx, "key", "copied")
+		}},
+		{"MoveObject", mediastore.ErrObjectNotFound, func() error {
+			return svc.(*Service).MoveObject(ctx, "key", "moved")
+		}},
+		{"UploadPart", mediastore.ErrUploadNotFound, func() error {
+			uploadID, _ := mediastore.NewUploadID()
+			_, err := svc.(*Service).UploadPart(ctx, "key", uploadID, 1, strings.NewReader("x"), 1)
+			return err
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.call(); !errors.Is(err, tc.wantErr) {
+				t.Errorf("got %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+	var argErr errors.ArgumentError
+	if _, err = svc.(*Service).InitiateUpload(ctx, "key", mediastore.PutObjectOptions{}); !errors.As(err, &argErr) {
+		t.Errorf("InitiateUpload: got %v, want an argument error", err)
+	}
+	if _, err = svc.(*Service).PresignPutObject(ctx, "key", mediastore.PresignPutOptions{}); !errors.As(err, &argErr) {
+		t.Errorf("PresignPutObject: got %v, want an argument error", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "key" {
+		t.Errorf("working directory modified: %v", entries)
+	}
+}
+
+func TestReservedKeys(t *testing.T) {
+	svc, _ := newTestService(t)
+	putObject(t, svc, "dir/key", "content")
+	ctx := context.Background()
+	for _, key := range []string{"dir/.meta.key", ".meta.key", "dir/.upload-123", ".uploads/id/session.json", "./.uploads/x"} {
+		t.Run(key, func(t *testing.T) {
+			var argErr errors.ArgumentError
+			_, err := svc.PutObject(ctx, key, strings.NewReader("{}"), mediastore.PutObjectOptions{})
+			if !errors.As(err, &argErr) {
+				t.Errorf("PutObject: got %v, want an argument error", err)
+			}
+			if _, err = svc.GetObject(ctx, key); !errors.As(err, &argErr) {
+				t.Errorf("GetObject: got %v, want an argument error", err)
+			}
+			if err = svc.DeleteObject(ctx, key); !errors.As(err, &argErr) {
+				t.Errorf("DeleteObject: got %v, want an argument error", err)
+			}
+		})
+	}
+	// The names which only contain the prefixes are objects.
+	for _, key := range []string{"dir/x.meta.key", "uploads/key", "dir/.uploads"} {
+		putObject(t, svc, key, "content")
+	}
+
+	info, err := svc.StatObject(ctx, "dir/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len("content")) {
+		t.Errorf("object modified: %+v", info)
+	}
+}
+
+func TestObjectAttributes(t *testing.T) {
+	svc, root := newTestService(t)
+	ctx := context.Background()
+	opts := mediastore.PutObjectOptions{
+		ContentType:        "text/csv",
+		CacheControl:       "no-cache",
+		ContentDisposition: "inline",
+		Metadata:           map[string]string{"Owner": "acme"},
+	}
+	if _, err := svc.PutObject(ctx, "dir/key", strings.NewReader("a,b"), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// The attributes are kept by the files, not by the service.
+	reopened, err := NewServiceV2(&Config{DirectoryPath: filepath.Join(root, "store")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(op string, info mediastore.ObjectInfo) {
+		t.Helper()
+		if info.ContentType != opts.ContentType || info.CacheControl != opts.CacheControl ||
+			info.ContentDisposition != opts.ContentDisposition || info.Metadata["owner"] != "acme" ||
+			info.Size != 3 {
+			t.Errorf("%s: got %+v", op, info)
+		}
+	}
+	stat, err := reopened.StatObject(ctx, "dir/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("stat", *stat)
+	obj, err := reopened.GetObject(ctx, "dir/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("get", obj.Info)
+	obj.Close()
+
+	// The attribute files are not objects.
+	list, err := reopened.ListObjects(ctx, "dir/", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Objects) != 1 || list.Objects[0].Key != "dir/key" {
+		t.Errorf("listed: got %+v", list.Objects)
+	}
+
+	// Without attributes, the attribute file is removed and the content
+	// type is detected.
+	putObject(t, reopened, "dir/key", "%PDF-1.7\n")
+	stat, err = reopened.StatObject(ctx, "dir/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.ContentType != "application/pdf" || stat.CacheControl != "" || stat.Metadata != nil {
+		t.Errorf("overwritten: got %+v", stat)
+	}
+	if _, err = os.Stat(metadataFileName(filepath.Join(root, "store", "dir", "key"))); !os.IsNotExist(err) {
+		t.Errorf("attribute file: got %v, want removed", err)
+	}
+}
@@ -0,0 +1,334 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+// uploadsDirName is the directory, at the root of the storage directory,
+// which contains a directory of chunks for each upload session.
+const uploadsDirName = ".uploads"
+
+const (
+	uploadSessionFileName = "session.json"
+	uploadPartFilePrefix  = "part-"
+)
+
+// uploadSession is stored as JSON in the directory of the session.
+type uploadSession struct {
+	Key                string            `json:"key"`
+	Initiated          time.Time         `json:"initiated"`
+	ContentType        string            `json:"content_type,omitempty"`
+	CacheControl       string            `json:"cache_control,omitempty"`
+	ContentDisposition string            `json:"content_disposition,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+func (s *Service) uploadDir(uploadID string) string {
+	return filepath.Join(s.directoryPath, uploadsDirName, uploadID)
+}
+
+func uploadPartFileName(partNumber int) string {
+	return fmt.Sprintf("%s%05d", uploadPartFilePrefix, partNumber)
+}
+
+func (s *Service) InitiateUpload(
+	ctx context.Context,
+	objectKey string,
+	opts mediastore.PutObjectOptions,
+) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if s.directoryPath == "" {
+		return "", errors.ArgMsg("config.DirectoryPath", "empty")
+	}
+	if _, err := s.filePath("objectKey", objectKey); err != nil {
+		return "", err
+	}
+	uploadID, err := mediastore.NewUploadID()
+	if err != nil {
+		return "", errors.Wrap("generate upload ID", err)
+	}
+
+	b, err := json.Marshal(uploadSession{
+		Key:                objectKey,
+		Initiated:          time.Now().UTC(),
+		ContentType:        opts.ContentType,
+		CacheControl:       opts.CacheControl,
+		ContentDisposition: opts.ContentDisposition,
+		Metadata:           mediastore.NormalizeMetadata(opts.Metadata),
+	})
+	if err != nil {
+		return "", errors.Wrap("encode session", err)
+	}
+	sessionFile := filepath.Join(s.uploadDir(uploadID), uploadSessionFileName)
+	if _, err = writeFileAtomic(sessionFile, bytes.NewReader(b)); err != nil {
+		return "", err
+	}
+	return uploadID, nil
+}
+
+// readUploadSession returns the session of the upload. The upload ID is
+// checked before it's used as a path.
+func (s *Service) readUploadSession(objectKey, uploadID string) (*uploadSession, error) {
+	if s.directoryPath == "" || !mediastore.IsUploadID(uploadID) {
+		return nil, errors.Wrap(uploadID, mediastore.ErrUploadNotFound)
+	}
+	b, err := os.ReadFile(filepath.Join(s.uploadDir(uploadID), uploadSessionFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Wrap(uploadID, mediastore.ErrUploadNotFound)
+		}
+		return nil, errors.Wrap("read session file", err)
+	}
+	var session uploadSession
+	if err = json.Unmarshal(b, &session); err != nil {
+		return nil, errors.Wrap("decode session file", err)
+	}
+	if session.Key != objectKey {
+		return nil, errors.Wrap(uploadID, mediastore.ErrUploadNotFound)
+	}
+	return &session, nil
+}
+
+func (s *Service) UploadPart(
+	ctx context.Context,
+	objectKey, uploadID string,
+	partNumber int,
+	contentSource io.Reader,
+	size int64,
+) (*mediastore.UploadPart, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := s.readUploadSession(objectKey, uploadID); err != nil {
+		return nil, err
+	}
+
+	partFile := filepath.Join(s.uploadDir(uploadID), uploadPartFileName(partNumber))
+	written, err := writeFileAtomic(partFile, mediastore.ContextReader(ctx, contentSource))
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 && written != size {
+		_ = os.Remove(partFile)
+		return nil, errors.ArgMsg("size", "does not match the content")
+	}
+	fileInfo, err := os.Stat(partFile)
+	if err != nil {
+		return nil, errors.Wrap("stat part file", err)
+	}
+	part := uploadPartInfo(partNumber, fileInfo)
+	return &part, nil
+}
+
+func uploadPartInfo(partNumber int, fileInfo os.FileInfo) mediastore.UploadPart {
+	return mediastore.UploadPart{
+		PartNumber:   partNumber,
+		Size:         fileInfo.Size(),
+		ETag:         fileETag(fileInfo),
+		LastModified: fileInfo.ModTime().UTC(),
+	}
+}
+
+func (s *Service) ListUploadParts(ctx context.Context, objectKey, uploadID string) ([]mediastore.UploadPart, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := s.readUploadSession(objectKey, uploadID); err != nil {
+		return nil, err
+	}
+	return s.listUploadParts(uploadID)
+}
+
+func (s *Service) listUploadParts(uploadID string) ([]mediastore.UploadPart, error) {
+	entries, err := os.ReadDir(s.uploadDir(uploadID))
+	if err != nil {
+		return nil, errors.Wrap("read upload directory", err)
+	}
+	var parts []mediastore.UploadPart
+	for _, entry := range entries {
+		partNumber, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), uploadPartFilePrefix))
+		if !strings.HasPrefix(entry.Name(), uploadPartFilePrefix) || err != nil {
+			continue
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return nil, errors.Wrap("stat part file", err)
+		}
+		parts = append(parts, uploadPartInfo(partNumber, fileInfo))
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	return parts, nil
+}
+
+// CompleteUpload concatenates the chunks into the object file, which is
+// replaced atomically.
+func (s *Service) CompleteUpload(ctx context.Context, objectKey, uploadID string) (*mediastore.UploadInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	session, err := s.readUploadSession(objectKey, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := s.listUploadParts(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		return nil, errors.ArgMsg("uploadID", "no parts uploaded")
+	}
+
+	partFiles := make([]string, 0, len(parts))
+	for _, part := range parts {
+		partFiles = append(partFiles, filepath.Join(s.uploadDir(uploadID), uploadPartFileName(part.PartNumber)))
+	}
+	content := &filesReader{fileNames: partFiles}
+	defer content.Close()
+
+	targetName, err := s.filePath("objectKey", objectKey)
+	if err != nil {
+		return nil, err
+	}
+	dataSize, err := writeFileAtomic(targetName, mediastore.ContextReader(ctx, content))
+	if err != nil {
+		return nil, err
+	}
+	err = writeAttributes(targetName, fileAttributes{
+		ContentType:        session.ContentType,
+		CacheControl:       session.CacheControl,
+		ContentDisposition: session.ContentDisposition,
+		Metadata:           session.Metadata,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = os.RemoveAll(s.uploadDir(uploadID)); err != nil {
+		return nil, errors.Wrap("remove upload directory", err)
+	}
+
+	return &mediastore.UploadInfo{
+		Bucket:   s.directoryPath,
+		Key:      objectKey,
+		Size:     int(dataSize),
+		UploadID: uploadID,
+	}, nil
+}
+
+func (s *Service) AbortUpload(ctx context.Context, objectKey, uploadID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := s.readUploadSession(objectKey, uploadID); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(s.uploadDir(uploadID)); err != nil {
+		return errors.Wrap("remove upload directory", err)
+	}
+	return nil
+}
+
+func (s *Service) ListUploads(ctx context.Context, prefix string) ([]mediastore.UploadSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if s.directoryPath == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(filepath.Join(s.directoryPath, uploadsDirName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap("read uploads directory", err)
+	}
+
+	var sessions []mediastore.UploadSession
+	for _, entry := range entries {
+		uploadID := entry.Name()
+		if !entry.IsDir() || !mediastore.IsUploadID(uploadID) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(s.uploadDir(uploadID), uploadSessionFileName))
+		if err != nil {
+			// The session is being completed or aborted.
+			continue
+		}
+		var session uploadSession
+		if err = json.Unmarshal(b, &session); err != nil {
+			continue
+		}
+		if strings.HasPrefix(session.Key, prefix) {
+			sessions = append(sessions, mediastore.UploadSession{
+				Key:       session.Key,
+				UploadID:  uploadID,
+				Initiated: session.Initiated,
+			})
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Key != sessions[j].Key {
+			return sessions[i].Key < sessions[j].Key
+		}
+		return sessions[i].Initiated.Before(sessions[j].Initiated)
+	})
+	return sessions, nil
+}
+
+// filesReader reads the files one after the other, only one file is open
+// at a time.
+type filesReader struct {
+	fileNames []string
+	current   *os.File
+}
+
+func (r *filesReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.fileNames) == 0 {
+				return 0, io.EOF
+			}
+			f, err := os.Open(r.fileNames[0])
+			if err != nil {
+				return 0, errors.Wrap("open part file", err)
+			}
+			r.current = f
+			r.fileNames = r.fileNames[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			_ = r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *filesReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
@@ -0,0 +1,431 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/media"
+	mediastore "github.com/timemore/foundation/media/store"
+	"gopkg.in/yaml.v3"
+)
+
+// Config for the in-memory storage. The objects are lost when the process
+// terminates, this module is intended for tests and local development.
+type Config struct {
+	// Latency is added to every call to simulate a remote storage.
+	Latency time.Duration `env:"LATENCY" yaml:"latency" json:"latency"`
+}
+
+const ServiceName = "memory"
+
+func init() {
+	mediastore.RegisterModule(
+		ServiceName,
+		mediastore.Module{
+			NewServiceV2: NewServiceV2,
+			ServiceConfigSkeleton: func() mediastore.ServiceConfig {
+				cfg := ConfigSkeleton()
+				return &cfg
+			},
+		})
+}
+
+func ConfigSkeleton() Config { return Config{} }
+
+// NewService creates the service behind the legacy Service interface.
+//
+// Deprecated: use NewServiceV2.
+func NewService(config mediastore.ServiceConfig) (mediastore.Service, error) {
+	svc, err := NewServiceV2(config)
+	if err != nil {
+		return nil, err
+	}
+	return mediastore.LegacyService(svc), nil
+}
+
+func NewServiceV2(config mediastore.ServiceConfig) (mediastore.ServiceV2, error) {
+	if config == nil {
+		return nil, errors.ArgMsg("config", "missing")
+	}
+
+	conf, ok := config.(*Config)
+	if !ok {
+		b, _ := yaml.Marshal(config)
+		var cfg Config
+		err := yaml.Unmarshal(b, &cfg)
+		if err != nil {
+			return nil, errors.ArgMsg("config", "type invalid")
+		}
+		conf = &cfg
+	}
+
+	return &Service{
+		objects:  map[string]*object{},
+		uploads:  map[string]*upload{},
+		latency:  conf.Latency,
+		failures: map[mediastore.Operation]error{},
+	}, nil
+}
+
+// Service keeps the objects in a map. It's safe for concurrent use.
+type Service struct {
+	mu       sync.RWMutex
+	objects  map[string]*object
+	uploads  map[string]*upload
+	latency  time.Duration
+	failures map[mediastore.Operation]error
+
+	sweeperMu sync.Mutex
+	sweeper   *mediastore.LifecycleSweeper
+}
+
+type object struct {
+	data []byte
+	info mediastore.ObjectInfo
+}
+
+// objectInfo returns a copy of the information which the caller is free
+// to modify.
+func (obj *object) objectInfo() mediastore.ObjectInfo {
+	info := obj.info
+	info.Metadata = mediastore.NormalizeMetadata(obj.info.Metadata)
+	return info
+}
+
+var _ mediastore.ServiceV2 = &Service{}
+var _ mediastore.Copier = &Service{}
+var _ mediastore.Presigner = &Service{}
+var _ mediastore.MultipartUploader = &Service{}
+var _ mediastore.HealthChecker = &Service{}
+var _ mediastore.LifecycleConfigurer = &Service{}
+
+// InjectFailure makes every following call of the operation fail with
+// err. Pass a nil err to remove the failure.
+func (s *Service) InjectFailure(op mediastore.Operation, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		delete(s.failures, op)
+		return
+	}
+	s.failures[op] = err
+}
+
+// ClearFailures removes all the injected failures.
+func (s *Service) ClearFailures() {
+	s.mu.Lock()
+	s.failures = map[mediastore.Operation]error{}
+	s.mu.Unlock()
+}
+
+// SetLatency sets the delay added to every call.
+func (s *Service) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	s.latency = latency
+	s.mu.Unlock()
+}
+
+// Reset removes all the objects and the upload sessions.
+func (s *Service) Reset() {
+	s.mu.Lock()
+	s.objects = map[string]*object{}
+	s.uploads = map[string]*upload{}
+	s.mu.Unlock()
+}
+
+// begin simulates the latency and returns the failure injected for the
+// operation, if any.
+func (s *Service) begin(ctx context.Context, op mediastore.Operation) error {
+	s.mu.RLock()
+	latency := s.latency
+	failure := s.failures[op]
+	s.mu.RUnlock()
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return failure
+}
+
+func (s *Service) PutObject(
+	ctx context.Context,
+	objectKey string,
+	contentSource io.Reader,
+	opts mediastore.PutObjectOptions,
+) (*mediastore.UploadInfo, error) {
+	if err := s.begin(ctx, mediastore.OperationPutObject); err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := buf.ReadFrom(mediastore.ContextReader(ctx, contentSource)); err != nil {
+		return nil, errors.Wrap("read content", err)
+	}
+	data := buf.Bytes()
+	if opts.ContentType == "" {
+		opts.ContentType = media.DetectType(data)
+	}
+	obj := newObject(objectKey, data, opts)
+
+	s.mu.Lock()
+	s.objects[objectKey] = obj
+	s.mu.Unlock()
+
+	return obj.uploadInfo(), nil
+}
+
+func newObject(objectKey string, data []byte, opts mediastore.PutObjectOptions) *object {
+	sum := md5.Sum(data)
+	return &object{
+		data: data,
+		info: mediastore.ObjectInfo{
+			Key:                objectKey,
+			Size:               int64(len(data)),
+			ContentType:        opts.ContentType,
+			CacheControl:       opts.CacheControl,
+			ContentDisposition: opts.ContentDisposition,
+			ETag:               hex.EncodeToString(sum[:]),
+			LastModified:       time.Now().UTC(),
+			Metadata:           mediastore.NormalizeMetadata(opts.Metadata),
+		},
+	}
+}
+
+func (obj *object) uploadInfo() *mediastore.UploadInfo {
+	return &mediastore.UploadInfo{
+		Bucket:       ServiceName,
+		Key:          obj.info.Key,
+		ETag:         obj.info.ETag,
+		LastModified: obj.info.LastModified,
+		Size:         len(obj.data),
+	}
+}
+
+func (s *Service) GetObject(ctx context.Context, objectKey string) (*mediastore.ObjectReader, error) {
+	if err := s.begin(ctx, mediastore.OperationGetObject); err != nil {
+		return nil, err
+	}
+	obj, err := s.lookup(objectKey)
+	if err != nil {
+		return nil, err
+	}
+	return &mediastore.ObjectReader{
+		ReadCloser: io.NopCloser(bytes.NewReader(obj.data)),
+		Info:       obj.objectInfo(),
+	}, nil
+}
+
+func (s *Service) GetObjectRange(
+	ctx context.Context,
+	objectKey string,
+	offset, length int64,
+) (*mediastore.ObjectReader, error) {
+	if err := s.begin(ctx, mediastore.OperationGetObjectRange); err != nil {
+		return nil, err
+	}
+	obj, err := s.lookup(objectKey)
+	if err != nil {
+		return nil, err
+	}
+	length, err = mediastore.ResolveRange(int64(len(obj.data)), offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return &mediastore.ObjectReader{
+		ReadCloser: io.NopCloser(bytes.NewReader(obj.data[offset : offset+length])),
+		Info:       obj.objectInfo(),
+	}, nil
+}
+
+// GetPublicObject returns a memory URL which carries the options in its
+// query, the same way the backends which sign their URLs do.
+func (s *Service) GetPublicObject(
+	ctx context.Context,
+	objectKey string,
+	opts mediastore.PublicURLOptions,
+) (string, error) {
+	if err := s.begin(ctx, mediastore.OperationGetPublicObject); err != nil {
+		return "", err
+	}
+	if _, err := s.lookup(objectKey); err != nil {
+		return "", err
+	}
+	u := url.URL{
+		Scheme:   ServiceName,
+		Path:     "/" + objectKey,
+		RawQuery: opts.ResponseQuery().Encode(),
+	}
+	return u.String(), nil
+}
+
+// ListObjects lists the objects ordered by key. The page token is the key
+// of the last object of the previous page.
+func (s *Service) ListObjects(
+	ctx context.Context,
+	prefix string,
+	pageToken string,
+	limit int,
+) (*mediastore.ObjectList, error) {
+	if err := s.begin(ctx, mediastore.OperationListObjects); err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = mediastore.ListObjectsLimitDefault
+	}
+
+	s.mu.RLock()
+	var objects []mediastore.ObjectInfo
+	for key, obj := range s.objects {
+		if strings.HasPrefix(key, prefix) && key > pageToken {
+			info := obj.info
+			info.Metadata = nil
+			objects = append(objects, info)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	result := &mediastore.ObjectList{}
+	if len(objects) > limit {
+		objects = objects[:limit]
+		result.NextPageToken = objects[limit-1].Key
+	}
+	result.Objects = objects
+
+	return result, nil
+}
+
+func (s *Service) DeleteObject(ctx context.Context, objectKey string) error {
+	if err := s.begin(ctx, mediastore.OperationDeleteObject); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.objects, objectKey)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Service) StatObject(ctx context.Context, objectKey string) (*mediastore.ObjectInfo, error) {
+	if err := s.begin(ctx, mediastore.OperationStatObject); err != nil {
+		return nil, err
+	}
+	obj, err := s.lookup(objectKey)
+	if err != nil {
+		return nil, err
+	}
+	info := obj.objectInfo()
+	return &info, nil
+}
+
+// PresignPutObject returns a request to a memory URL, which could not be
+// requested but allows exercising the code which presigns uploads.
+func (s *Service) PresignPutObject(
+	ctx context.Context,
+	objectKey string,
+	opts mediastore.PresignPutOptions,
+) (*mediastore.PresignedRequest, error) {
+	if err := s.begin(ctx, mediastore.OperationPresignPutObject); err != nil {
+		return nil, err
+	}
+	expiry := opts.Expiry
+	if expiry <= 0 {
+		expiry = mediastore.PresignExpiryDefault
+	}
+
+	header := http.Header{}
+	if opts.ContentType != "" {
+		header.Set("Content-Type", opts.ContentType)
+	}
+	u := url.URL{Scheme: ServiceName, Path: "/" + objectKey}
+	return &mediastore.PresignedRequest{
+		Method:  http.MethodPut,
+		URL:     u.String(),
+		Header:  header,
+		Expires: time.Now().Add(expiry),
+	}, nil
+}
+
+func (s *Service) CopyObject(ctx context.Context, srcKey, dstKey string) error {
+	if err := s.begin(ctx, mediastore.OperationCopyObject); err != nil {
+		return err
+	}
+	return s.copyObject(srcKey, dstKey, false)
+}
+
+func (s *Service) MoveObject(ctx context.Context, srcKey, dstKey string) error {
+	if err := s.begin(ctx, mediastore.OperationMoveObject); err != nil {
+		return err
+	}
+	return s.copyObject(srcKey, dstKey, true)
+}
+
+func (s *Service) copyObject(srcKey, dstKey string, removeSource bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src, ok := s.objects[srcKey]
+	if !ok {
+		return errors.Wrap(srcKey, mediastore.ErrObjectNotFound)
+	}
+	// The content is never modified once stored, it's safe to share.
+	dst := &object{data: src.data, info: src.objectInfo()}
+	dst.info.Key = dstKey
+	dst.info.LastModified = time.Now().UTC()
+	s.objects[dstKey] = dst
+	if removeSource {
+		delete(s.objects, srcKey)
+	}
+	return nil
+}
+
+func (s *Service) HealthCheck(ctx context.Context) error {
+	return s.begin(ctx, mediastore.OperationHealthCheck)
+}
+
+// SetLifecycle starts a sweeper which deletes the expired objects in the
+// background, replacing the sweeper of a previous call. The transitions
+// are ignored.
+func (s *Service) SetLifecycle(ctx context.Context, config mediastore.LifecycleConfig) error {
+	sweeper, err := mediastore.NewLifecycleSweeper(s, config)
+	if err != nil {
+		return err
+	}
+	s.sweeperMu.Lock()
+	defer s.sweeperMu.Unlock()
+	if s.sweeper != nil {
+		s.sweeper.Stop()
+	}
+	s.sweeper = sweeper
+	sweeper.Start()
+	return nil
+}
+
+func (s *Service) lookup(objectKey string) (*object, error) {
+	s.mu.RLock()
+	obj, ok := s.objects[objectKey]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, errors.Wrap(objectKey, mediastore.ErrObjectNotFound)
+	}
+	return obj, nil
+}
@@ -0,0 +1,169 @@
+package memory
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+var errInjected = errors.Msg("injected")
+
+func newTestService(t *testing.T, config *Config) *Service {
+	t.Helper()
+	svc, err := NewServiceV2(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc.(*Service)
+}
+
+func TestInjectFailure(t *testing.T) {
+	svc := newTestService(t, &Config{})
+	ctx := context.Background()
+	if _, err := svc.PutObject(ctx, "key", strings.NewReader("content"), mediastore.PutObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		op   mediastore.Operation
+		call func() error
+	}{
+		{mediastore.OperationPutObject, func() error {
+			_, err := svc.PutObject(ctx, "key", strings.NewReader("other"), mediastore.PutObjectOptions{})
+			return err
+		}},
+		{mediastore.OperationGetObject, func() error {
+			_, err := svc.GetObject(ctx, "key")
+			return err
+		}},
+		{mediastore.OperationGetObjectRange, func() error {
+			_, err := svc.GetObjectRange(ctx, "key", 0, 1)
+			return err
+		}},
+		{mediastore.OperationGetPublicObject, func() error {
+			_, err := svc.GetPublicObject(ctx, "key", mediastore.PublicURLOptions{})
+			return err
+		}},
+		{mediastore.OperationListObjects, func() error {
+			_, err := svc.ListObjects(ctx, "", "", 0)
+			return err
+		}},
+		{mediastore.OperationStatObject, func() error {
+			_, err := svc.StatObject(ctx, "key")
+			return err
+		}},
+		{mediastore.OperationPresignPutObject, func() error {
+			_, err := svc.PresignPutObject(ctx, "key", mediastore.PresignPutOptions{})
+			return err
+		}},
+		{mediastore.OperationCopyObject, func() error { return svc.CopyObject(ctx, "key", "copy") }},
+		{mediastore.OperationInitiateUpload, func() error {
+			_, err := svc.InitiateUpload(ctx, "key", mediastore.PutObjectOptions{})
+			return err
+		}},
+		{mediastore.OperationListUploads, func() error {
+			_, err := svc.ListUploads(ctx, "")
+			return err
+		}},
+		{mediastore.OperationHealthCheck, func() error { return svc.HealthCheck(ctx) }},
+		{mediastore.OperationDeleteObject, func() error { return svc.DeleteObject(ctx, "key") }},
+	}
+	for _, tc := range testCases {
+		t.Run(string(tc.op), func(t *testing.T) {
+			svc.InjectFailure(tc.op, errInjected)
+			// The failure persists until it's removed.
+			for i := 0; i < 2; i++ {
+				if err := tc.call(); !errors.Is(err, errInjected) {
+					t.Fatalf("call %d: got %v, want the injected failure", i+1, err)
+				}
+			}
+			svc.InjectFailure(tc.op, nil)
+			if err := tc.call(); err != nil {
+				t.Errorf("after the removal: %v", err)
+			}
+		})
+	}
+
+	// The failure of an operation doesn't affect the others, and the
+	// objects are not modified by a failed call.
+	svc.InjectFailure(mediastore.OperationPutObject, errInjected)
+	if _, err := svc.PutObject(ctx, "key", strings.NewReader("failed"), mediastore.PutObjectOptions{}); err == nil {
+		t.Fatal("no failure")
+	}
+	if _, err := svc.StatObject(ctx, "key"); !errors.Is(err, mediastore.ErrObjectNotFound) {
+		t.Errorf("got %v, want ErrObjectNotFound", err)
+	}
+	svc.ClearFailures()
+	if _, err := svc.PutObject(ctx, "key", strings.NewReader("content"), mediastore.PutObjectOptions{}); err != nil {
+		t.Errorf("after ClearFailures: %v", err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	const latency = 20 * time.Millisecond
+	svc := newTestService(t, &Config{Latency: latency})
+
+	start := time.Now()
+	if _, err := svc.PutObject(context.Background(), "key", strings.NewReader("content"),
+		mediastore.PutObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Errorf("elapsed %v, want at least %v", elapsed, latency)
+	}
+
+	// The context ends the wait.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	svc.SetLatency(time.Hour)
+	if _, err := svc.GetObject(ctx, "key"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want DeadlineExceeded", err)
+	}
+
+	// The latency applies before the injected failure.
+	svc.SetLatency(latency)
+	svc.InjectFailure(mediastore.OperationGetObject, errInjected)
+	start = time.Now()
+	if _, err := svc.GetObject(context.Background(), "key"); !errors.Is(err, errInjected) {
+		t.Errorf("got %v, want the injected failure", err)
+	}
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Errorf("failure after %v, want at least %v", elapsed, latency)
+	}
+
+	svc.SetLatency(0)
+	svc.ClearFailures()
+	obj, err := svc.GetObject(context.Background(), "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	if b, _ := io.ReadAll(obj); string(b) != "content" {
+		t.Errorf("content: got %q", b)
+	}
+}
+
+func TestNewService(t *testing.T) {
+	svc, err := NewService(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = svc.PutObject("key", strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := svc.GetObject("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "content" {
+		t.Errorf("content: got %q", buf.String())
+	}
+	if _, err = NewService(nil); err == nil {
+		t.Error("no error without config")
+	}
+}
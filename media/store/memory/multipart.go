@@ -0,0 +1,195 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/media"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+type upload struct {
+	key       string
+	opts      mediastore.PutObjectOptions
+	initiated time.Time
+	parts     map[int]*uploadPart
+}
+
+type uploadPart struct {
+	data []byte
+	info mediastore.UploadPart
+}
+
+func (s *Service) InitiateUpload(
+	ctx context.Context,
+	objectKey string,
+	opts mediastore.PutObjectOptions,
+) (string, error) {
+	if err := s.begin(ctx, mediastore.OperationInitiateUpload); err != nil {
+		return "", err
+	}
+	uploadID, err := mediastore.NewUploadID()
+	if err != nil {
+		return "", errors.Wrap("generate upload ID", err)
+	}
+	opts.Metadata = mediastore.NormalizeMetadata(opts.Metadata)
+
+	s.mu.Lock()
+	s.uploads[uploadID] = &upload{
+		key:       objectKey,
+		opts:      opts,
+		initiated: time.Now().UTC(),
+		parts:     map[int]*uploadPart{},
+	}
+	s.mu.Unlock()
+	return uploadID, nil
+}
+
+func (s *Service) UploadPart(
+	ctx context.Context,
+	objectKey, uploadID string,
+	partNumber int,
+	contentSource io.Reader,
+	size int64,
+) (*mediastore.UploadPart, error) {
+	if err := s.begin(ctx, mediastore.OperationUploadPart); err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if _, err := buf.ReadFrom(mediastore.ContextReader(ctx, contentSource)); err != nil {
+		return nil, errors.Wrap("read content", err)
+	}
+	if size >= 0 && int64(buf.Len()) != size {
+		return nil, errors.ArgMsg("size", "does not match the content")
+	}
+	sum := md5.Sum(buf.Bytes())
+	part := &uploadPart{
+		data: buf.Bytes(),
+		info: mediastore.UploadPart{
+			PartNumber:   partNumber,
+			Size:         int64(buf.Len()),
+			ETag:         hex.EncodeToString(sum[:]),
+			LastModified: time.Now().UTC(),
+		},
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, err := s.lookupUpload(objectKey, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	u.parts[partNumber] = part
+	info := part.info
+	return &info, nil
+}
+
+func (s *Service) ListUploadParts(ctx context.Context, objectKey, uploadID string) ([]mediastore.UploadPart, error) {
+	if err := s.begin(ctx, mediastore.OperationListUploadParts); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, err := s.lookupUpload(objectKey, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	return u.sortedParts(), nil
+}
+
+func (s *Service) CompleteUpload(ctx context.Context, objectKey, uploadID string) (*mediastore.UploadInfo, error) {
+	if err := s.begin(ctx, mediastore.OperationCompleteUpload); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, err := s.lookupUpload(objectKey, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.parts) == 0 {
+		return nil, errors.ArgMsg("uploadID", "no parts uploaded")
+	}
+
+	buf := &bytes.Buffer{}
+	for _, part := range u.sortedParts() {
+		buf.Write(u.parts[part.PartNumber].data)
+	}
+	opts := u.opts
+	if opts.ContentType == "" {
+		opts.ContentType = media.DetectType(buf.Bytes())
+	}
+	obj := newObject(objectKey, buf.Bytes(), opts)
+	s.objects[objectKey] = obj
+	delete(s.uploads, uploadID)
+
+	uploadInfo := obj.uploadInfo()
+	uploadInfo.UploadID = uploadID
+	return uploadInfo, nil
+}
+
+func (s *Service) AbortUpload(ctx context.Context, objectKey, uploadID string) error {
+	if err := s.begin(ctx, mediastore.OperationAbortUpload); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.lookupUpload(objectKey, uploadID); err != nil {
+		return err
+	}
+	delete(s.uploads, uploadID)
+	return nil
+}
+
+func (s *Service) ListUploads(ctx context.Context, prefix string) ([]mediastore.UploadSession, error) {
+	if err := s.begin(ctx, mediastore.OperationListUploads); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	var sessions []mediastore.UploadSession
+	for uploadID, u := range s.uploads {
+		if strings.HasPrefix(u.key, prefix) {
+			sessions = append(sessions, mediastore.UploadSession{
+				Key:       u.key,
+				UploadID:  uploadID,
+				Initiated: u.initiated,
+			})
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Key != sessions[j].Key {
+			return sessions[i].Key < sessions[j].Key
+		}
+		return sessions[i].Initiated.Before(sessions[j].Initiated)
+	})
+	return sessions, nil
+}
+
+// lookupUpload must be called with the lock held.
+func (s *Service) lookupUpload(objectKey, uploadID string) (*upload, error) {
+	u, ok := s.uploads[uploadID]
+	if !ok || u.key != objectKey {
+		return nil, errors.Wrap(uploadID, mediastore.ErrUploadNotFound)
+	}
+	return u, nil
+}
+
+func (u *upload) sortedParts() []mediastore.UploadPart {
+	parts := make([]mediastore.UploadPart, 0, len(u.parts))
+	for _, part := range u.parts {
+		parts = append(parts, part.info)
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	return parts
+}
@@ -0,0 +1,275 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/media"
+)
+
+// ErrChecksumMismatch is returned, wrapped, by the migration when the
+// content read back from the destination differs from the source.
+var ErrChecksumMismatch = errors.Msg("checksum mismatch")
+
+// MigrateOptions controls the copy of the objects between two stores.
+type MigrateOptions struct {
+	// Prefix limits the migration to the objects whose key starts with
+	// the prefix.
+	Prefix string
+
+	// CheckpointFile is the path of the file where the progress is
+	// recorded. If the file exists when the migration starts, the
+	// migration resumes after the last object recorded in it. The file
+	// is removed once the migration completes. No checkpoint is kept if
+	// it's empty.
+	CheckpointFile string
+
+	// DryRun lists the objects which would be copied without copying
+	// them nor writing the checkpoint.
+	DryRun bool
+
+	// Overwrite copies the objects which already exist at the
+	// destination. By default, an object is skipped if there's an object
+	// with the same key and the same content at the destination. The
+	// contents are compared by their ETags if they are equal, otherwise
+	// by their checksums, which reads both objects.
+	Overwrite bool
+
+	// OnObject, if provided, is called after each object is processed.
+	// copied is false if the object was skipped.
+	OnObject func(info ObjectInfo, copied bool)
+}
+
+// MigrateResult summarizes a migration.
+type MigrateResult struct {
+	Copied  int
+	Skipped int
+	// Bytes is the total size of the objects copied, or which would be
+	// copied on a dry run.
+	Bytes int64
+}
+
+// Migrate copies the objects from the store configured by source to the
+// store configured by destination. See MigrateObjects. The lifecycle of
+// the source is not applied, the migration only reads the source.
+func Migrate(ctx context.Context, source, destination Config, opts MigrateOptions) (*MigrateResult, error) {
+	source.Lifecycle = LifecycleConfig{}
+	srcStore, err := New(source)
+	if err != nil {
+		return nil, errors.ArgWrap("source", "store initialization failed", err)
+	}
+	dstStore, err := New(destination)
+	if err != nil {
+		return nil, errors.ArgWrap("destination", "store initialization failed", err)
+	}
+	return MigrateObjects(ctx, srcStore, dstStore, opts)
+}
+
+// MigrateObjects copies every object of the source, along with its
+// attributes, to the destination under the same key. The content of each
+// object is read back from the destination and its checksum is compared
+// with the checksum of the source content.
+func MigrateObjects(ctx context.Context, source, destination *Store, opts MigrateOptions) (*MigrateResult, error) {
+	if source == nil {
+		return nil, errors.ArgMsg("source", "missing")
+	}
+	if destination == nil {
+		return nil, errors.ArgMsg("destination", "missing")
+	}
+
+	checkpoint := migrateCheckpoint{Prefix: opts.Prefix}
+	if opts.CheckpointFile != "" {
+		loaded, err := readMigrateCheckpoint(opts.CheckpointFile)
+		if err != nil {
+			return nil, err
+		}
+		if loaded != nil {
+			if loaded.Prefix != opts.Prefix {
+				return nil, errors.ArgMsg("opts.Prefix", "does not match the checkpoint prefix "+loaded.Prefix)
+			}
+			checkpoint = *loaded
+		}
+	}
+
+	result := &MigrateResult{}
+	pageToken := checkpoint.PageToken
+	for {
+		list, err := source.ListObjects(ctx, opts.Prefix, pageToken, ListObjectsLimitDefault)
+		if err != nil {
+			return result, errors.Wrap("listing objects", err)
+		}
+		for _, info := range list.Objects {
+			// The listing of a resumed page includes the objects which
+			// have been copied before the interruption.
+			if checkpoint.LastKey != "" && info.Key <= checkpoint.LastKey {
+				continue
+			}
+
+			copied, err := migrateObject(ctx, source, destination, info, opts)
+			if err != nil {
+				return result, errors.Wrap(info.Key, err)
+			}
+			if copied {
+				result.Copied++
+				result.Bytes += info.Size
+			} else {
+				result.Skipped++
+			}
+			if opts.OnObject != nil {
+				opts.OnObject(info, copied)
+			}
+
+			if opts.CheckpointFile != "" && !opts.DryRun {
+				checkpoint.PageToken = pageToken
+				checkpoint.LastKey = info.Key
+				if err = writeMigrateCheckpoint(opts.CheckpointFile, checkpoint); err != nil {
+					return result, err
+				}
+			}
+		}
+		if list.NextPageToken == "" {
+			break
+		}
+		pageToken = list.NextPageToken
+	}
+
+	if opts.CheckpointFile != "" && !opts.DryRun {
+		err := os.Remove(opts.CheckpointFile)
+		if err != nil && !os.IsNotExist(err) {
+			return result, errors.Wrap("remove checkpoint file", err)
+		}
+	}
+
+	return result, nil
+}
+
+// migrateObject copies the object unless it already exists at the
+// destination. It returns false if the object was skipped.
+func migrateObject(
+	ctx context.Context,
+	source, destination *Store,
+	info ObjectInfo,
+	opts MigrateOptions,
+) (copied bool, err error) {
+	if !opts.Overwrite {
+		dstInfo, err := destination.Stat(ctx, info.Key)
+		if err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return false, errors.Wrap("stat destination object", err)
+		}
+		if err == nil && dstInfo.Size == info.Size {
+			same, err := sameContent(ctx, source, destination, info, *dstInfo)
+			if err != nil || same {
+				return false, err
+			}
+		}
+	}
+	if opts.DryRun {
+		return true, nil
+	}
+
+	srcObject, err := source.DownloadContext(ctx, info.Key)
+	if err != nil {
+		return false, errors.Wrap("getting source object", err)
+	}
+	defer srcObject.Close()
+
+	srcHash := sha256.New()
+	_, err = destination.UploadObject(ctx, info.Key, io.TeeReader(srcObject, srcHash), media.MediaType_MEDIA_TYPE_UNSPECIFIED,
+		PutObjectOptions{
+			ContentType:        srcObject.Info.ContentType,
+			CacheControl:       srcObject.Info.CacheControl,
+			ContentDisposition: srcObject.Info.ContentDisposition,
+			Metadata:           srcObject.Info.Metadata,
+		})
+	if err != nil {
+		return false, err
+	}
+
+	dstSum, err := objectChecksum(ctx, destination, info.Key)
+	if err != nil {
+		return false, errors.Wrap("reading destination object", err)
+	}
+	if !bytes.Equal(srcHash.Sum(nil), dstSum) {
+		return false, ErrChecksumMismatch
+	}
+
+	return true, nil
+}
+
+// sameContent returns true if the objects of the source and of the
+// destination have the same content. The ETags are only computed the same
+// way by the same kind of backend, so different ETags don't tell that the
+// contents differ.
+func sameContent(ctx context.Context, source, destination *Store, srcInfo, dstInfo ObjectInfo) (bool, error) {
+	if srcInfo.ETag != "" && srcInfo.ETag == dstInfo.ETag {
+		return true, nil
+	}
+	srcSum, err := objectChecksum(ctx, source, srcInfo.Key)
+	if err != nil {
+		return false, errors.Wrap("source checksum", err)
+	}
+	dstSum, err := objectChecksum(ctx, destination, dstInfo.Key)
+	if err != nil {
+		return false, errors.Wrap("destination checksum", err)
+	}
+	return bytes.Equal(srcSum, dstSum), nil
+}
+
+func objectChecksum(ctx context.Context, mediaStore *Store, objectKey string) ([]byte, error) {
+	obj, err := mediaStore.DownloadContext(ctx, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, obj); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// migrateCheckpoint is the content of the checkpoint file. PageToken is
+// the token of the page which contains the object LastKey.
+type migrateCheckpoint struct {
+	Prefix    string `json:"prefix"`
+	PageToken string `json:"page_token,omitempty"`
+	LastKey   string `json:"last_key,omitempty"`
+}
+
+func readMigrateCheckpoint(fileName string) (*migrateCheckpoint, error) {
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap("read checkpoint file", err)
+	}
+	var checkpoint migrateCheckpoint
+	if err = json.Unmarshal(b, &checkpoint); err != nil {
+		return nil, errors.Wrap("decode checkpoint file", err)
+	}
+	return &checkpoint, nil
+}
+
+// writeMigrateCheckpoint replaces the checkpoint file atomically so that
+// an interruption never leaves a partial checkpoint.
+func writeMigrateCheckpoint(fileName string, checkpoint migrateCheckpoint) error {
+	b, err := json.Marshal(checkpoint)
+	if err != nil {
+		return errors.Wrap("encode checkpoint", err)
+	}
+	tempFile := filepath.Join(filepath.Dir(fileName), "."+filepath.Base(fileName)+".tmp")
+	if err = os.WriteFile(tempFile, b, 0644); err != nil {
+		return errors.Wrap("write checkpoint file", err)
+	}
+	if err = os.Rename(tempFile, fileName); err != nil {
+		return errors.Wrap("rename checkpoint file", err)
+	}
+	return nil
+}
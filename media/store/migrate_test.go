@@ -0,0 +1,283 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+	"github.com/timemore/foundation/media/store/memory"
+)
+
+// otherETagService computes the ETags differently, as another kind of
+// backend would.
+type otherETagService struct {
+	mediastore.ServiceV2
+}
+
+func (s otherETagService) StatObject(ctx context.Context, objectKey string) (*mediastore.ObjectInfo, error) {
+	info, err := s.ServiceV2.StatObject(ctx, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	info.ETag = "other-" + info.ETag
+	return info, nil
+}
+
+func TestMigrateObjects(t *testing.T) {
+	testCases := []struct {
+		name        string
+		opts        mediastore.MigrateOptions
+		existing    map[string]string
+		otherETags  bool
+		copied      int
+		skipped     int
+		bytes       int64
+		destination []string
+	}{
+		{
+			name:        "all",
+			copied:      3,
+			bytes:       9,
+			destination: []string{"a/1", "a/2", "b/1"},
+		},
+		{
+			name:        "prefix",
+			opts:        mediastore.MigrateOptions{Prefix: "a/"},
+			copied:      2,
+			bytes:       6,
+			destination: []string{"a/1", "a/2"},
+		},
+		{
+			name:        "existing skipped",
+			existing:    map[string]string{"a/1": "<1>"},
+			copied:      2,
+			skipped:     1,
+			bytes:       6,
+			destination: []string{"a/1", "a/2", "b/1"},
+		},
+		{
+			name:        "existing with other ETags skipped",
+			existing:    map[string]string{"a/1": "<1>"},
+			otherETags:  true,
+			copied:      2,
+			skipped:     1,
+			bytes:       6,
+			destination: []string{"a/1", "a/2", "b/1"},
+		},
+		{
+			name:        "existing with the same size",
+			existing:    map[string]string{"a/1": "xxx"},
+			copied:      3,
+			bytes:       9,
+			destination: []string{"a/1", "a/2", "b/1"},
+		},
+		{
+			name:        "existing with another size",
+			existing:    map[string]string{"a/1": "x"},
+			copied:      3,
+			bytes:       9,
+			destination: []string{"a/1", "a/2", "b/1"},
+		},
+		{
+			name:        "overwrite",
+			opts:        mediastore.MigrateOptions{Overwrite: true},
+			existing:    map[string]string{"a/1": "xxx"},
+			copied:      3,
+			bytes:       9,
+			destination: []string{"a/1", "a/2", "b/1"},
+		},
+		{
+			name:   "dry run",
+			opts:   mediastore.MigrateOptions{DryRun: true},
+			copied: 3,
+			bytes:  9,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			src := newMemoryService(t)
+			for _, key := range []string{"a/1", "a/2", "b/1"} {
+				putObject(t, src, key, "<"+key[2:]+">")
+			}
+			dst := newMemoryService(t)
+			for key, content := range tc.existing {
+				putObject(t, dst, key, content)
+			}
+			var dstService mediastore.ServiceV2 = dst
+			if tc.otherETags {
+				dstService = otherETagService{dst}
+			}
+
+			result, err := mediastore.MigrateObjects(context.Background(),
+				newTestStore(t, mediastore.Config{}, src), newTestStore(t, mediastore.Config{}, dstService), tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Copied != tc.copied || result.Skipped != tc.skipped || result.Bytes != tc.bytes {
+				t.Errorf("got %+v, want copied %d, skipped %d, bytes %d", *result, tc.copied, tc.skipped, tc.bytes)
+			}
+			keys := objectKeys(t, dst, "")
+			if strings.Join(keys, ",") != strings.Join(tc.destination, ",") {
+				t.Errorf("destination keys: got %v, want %v", keys, tc.destination)
+			}
+			for _, key := range keys {
+				if got, want := readObject(t, dst, key), readObject(t, src, key); got != want {
+					t.Errorf("%s: got %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateObjectsResume(t *testing.T) {
+	ctx := context.Background()
+	src := newMemoryService(t)
+	keys := []string{"k1", "k2", "k3", "k4", "k5"}
+	for _, key := range keys {
+		putObject(t, src, key, key)
+	}
+	dst := newMemoryService(t)
+	srcStore := newTestStore(t, mediastore.Config{}, src)
+	dstStore := newTestStore(t, mediastore.Config{}, dst)
+	checkpointFile := filepath.Join(t.TempDir(), "checkpoint")
+
+	errInterrupted := errors.Msg("interrupted")
+	opts := mediastore.MigrateOptions{
+		CheckpointFile: checkpointFile,
+		Overwrite:      true,
+		OnObject: func(info mediastore.ObjectInfo, copied bool) {
+			if info.Key == "k2" {
+				dst.InjectFailure(mediastore.OperationPutObject, errInterrupted)
+			}
+		},
+	}
+	result, err := mediastore.MigrateObjects(ctx, srcStore, dstStore, opts)
+	if !errors.Is(err, errInterrupted) {
+		t.Fatalf("got %v, want the interruption", err)
+	}
+	if result.Copied != 2 {
+		t.Errorf("copied before the interruption: got %d, want 2", result.Copied)
+	}
+	if _, err = os.Stat(checkpointFile); err != nil {
+		t.Fatalf("checkpoint: %v", err)
+	}
+
+	// The checkpoint is bound to the prefix.
+	_, err = mediastore.MigrateObjects(ctx, srcStore, dstStore,
+		mediastore.MigrateOptions{CheckpointFile: checkpointFile, Prefix: "k"})
+	var argErr errors.ArgumentError
+	if !errors.As(err, &argErr) || argErr.ArgumentName() != "opts.Prefix" {
+		t.Fatalf("got %v, want an argument error of opts.Prefix", err)
+	}
+
+	dst.ClearFailures()
+	opts.OnObject = nil
+	result, err = mediastore.MigrateObjects(ctx, srcStore, dstStore, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Even with Overwrite, the objects recorded in the checkpoint are not
+	// copied again.
+	if result.Copied != 3 || result.Skipped != 0 {
+		t.Errorf("resumed: got %+v, want 3 copied", *result)
+	}
+	if _, err = os.Stat(checkpointFile); !os.IsNotExist(err) {
+		t.Errorf("checkpoint not removed: %v", err)
+	}
+	if got := objectKeys(t, dst, ""); strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Errorf("destination keys: got %v, want %v", got, keys)
+	}
+}
+
+// corruptingService returns altered content, as a faulty backend would.
+type corruptingService struct {
+	mediastore.ServiceV2
+}
+
+func (s corruptingService) GetObject(ctx context.Context, objectKey string) (*mediastore.ObjectReader, error) {
+	obj, err := s.ServiceV2.GetObject(ctx, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(obj)
+	_ = obj.Close()
+	if err != nil {
+		return nil, err
+	}
+	obj.ReadCloser = io.NopCloser(bytes.NewReader(append(b[:len(b):len(b)], '!')))
+	return obj, nil
+}
+
+func TestMigrateObjectsChecksumMismatch(t *testing.T) {
+	src := newMemoryService(t)
+	putObject(t, src, "key", "content")
+	dst := corruptingService{newMemoryService(t)}
+
+	_, err := mediastore.MigrateObjects(context.Background(),
+		newTestStore(t, mediastore.Config{}, src), newTestStore(t, mediastore.Config{}, dst),
+		mediastore.MigrateOptions{})
+	if !errors.Is(err, mediastore.ErrChecksumMismatch) {
+		t.Fatalf("got %v, want ErrChecksumMismatch", err)
+	}
+}
+
+// lifecycleRecorder counts the lifecycle configurations provided to the
+// service. The module of recorderServiceName takes the recorder as its
+// config.
+type lifecycleRecorder struct {
+	*memory.Service
+	configured int32
+}
+
+func (s *lifecycleRecorder) SetLifecycle(ctx context.Context, config mediastore.LifecycleConfig) error {
+	atomic.AddInt32(&s.configured, 1)
+	return nil
+}
+
+const recorderServiceName = "lifecycle-recorder"
+
+func init() {
+	mediastore.RegisterModule(recorderServiceName, mediastore.Module{
+		ServiceConfigSkeleton: func() mediastore.ServiceConfig { return &lifecycleRecorder{} },
+		NewServiceV2: func(config mediastore.ServiceConfig) (mediastore.ServiceV2, error) {
+			return config.(*lifecycleRecorder), nil
+		},
+	})
+}
+
+func TestMigrateLifecycle(t *testing.T) {
+	lifecycle := mediastore.LifecycleConfig{Rules: []mediastore.LifecycleRule{{ExpirationDays: 1}}}
+	src := &lifecycleRecorder{Service: newMemoryService(t)}
+	dst := &lifecycleRecorder{Service: newMemoryService(t)}
+	putObject(t, src, "key", "content")
+
+	result, err := mediastore.Migrate(context.Background(), mediastore.Config{
+		StoreService: recorderServiceName,
+		Modules:      map[string]any{recorderServiceName: src},
+		Lifecycle:    lifecycle,
+	}, mediastore.Config{
+		StoreService: recorderServiceName,
+		Modules:      map[string]any{recorderServiceName: dst},
+		Lifecycle:    lifecycle,
+	}, mediastore.MigrateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Copied != 1 {
+		t.Errorf("copied: got %d, want 1", result.Copied)
+	}
+	// The migration must not change the source, e.g., sweep it.
+	if n := atomic.LoadInt32(&src.configured); n != 0 {
+		t.Errorf("lifecycle of the source configured %d times", n)
+	}
+	if n := atomic.LoadInt32(&dst.configured); n != 1 {
+		t.Errorf("lifecycle of the destination configured %d times, want once", n)
+	}
+}
@@ -1,22 +1,24 @@
 package minio
 
 import (
-	"bytes"
 	"context"
 	"io"
-	"net/url"
-	"path"
+	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
 	"github.com/timemore/foundation/errors"
-	"github.com/timemore/foundation/media"
+	"github.com/timemore/foundation/logger"
 	mediastore "github.com/timemore/foundation/media/store"
 	"gopkg.in/yaml.v3"
 )
 
+var log = logger.NewPkgLogger()
+
 type Config struct {
 	Region          string `env:"REGION" yaml:"region" json:"region"`
 	BucketName      string `env:"BUCKET_NAME" yaml:"bucket_name" json:"bucket_name"`
@@ -26,15 +28,26 @@ type Config struct {
 	Endpoint        string `env:"ENDPOINT,required" yaml:"endpoint" json:"endpoint"`
 	UseSSL          bool   `env:"USE_SSL" yaml:"use_ssl" json:"use_ssl"`
 	BucketOperation bool   `env:"BUCKET_OPERATION" yaml:"bucket_operation" json:"bucket_operation"`
+
+	// PartSize is the size, in bytes, of the parts of the multipart
+	// upload. An upload keeps one part in memory at a time. As an upload is
+	// limited to 10000 parts, this also limits the size of the objects.
+	PartSize uint64 `env:"PART_SIZE" yaml:"part_size" json:"part_size"`
 }
 
+const (
+	PartSizeMin     = 5 * 1024 * 1024
+	PartSizeMax     = 5 * 1024 * 1024 * 1024
+	PartSizeDefault = 16 * 1024 * 1024
+)
+
 const ServiceName = "minio"
 
 func init() {
 	mediastore.RegisterModule(
 		ServiceName,
 		mediastore.Module{
-			NewService: NewService,
+			NewServiceV2: NewServiceV2,
 			ServiceConfigSkeleton: func() mediastore.ServiceConfig {
 				cfg := ConfigSkeleton()
 				return &cfg
@@ -42,9 +55,24 @@ func init() {
 		})
 }
 
-func ConfigSkeleton() Config { return Config{} }
+func ConfigSkeleton() Config {
+	return Config{
+		PartSize: PartSizeDefault,
+	}
+}
 
+// NewService creates the service behind the legacy Service interface.
+//
+// Deprecated: use NewServiceV2.
 func NewService(config mediastore.ServiceConfig) (mediastore.Service, error) {
+	svc, err := NewServiceV2(config)
+	if err != nil {
+		return nil, err
+	}
+	return mediastore.LegacyService(svc), nil
+}
+
+func NewServiceV2(config mediastore.ServiceConfig) (mediastore.ServiceV2, error) {
 	ctx := context.Background()
 	if config == nil {
 		return nil, errors.ArgMsg("config", "missing")
@@ -66,6 +94,13 @@ func NewService(config mediastore.ServiceConfig) (mediastore.Service, error) {
 	if conf.AccessKeyID == "" || conf.SecretAccessKey == "" {
 		return nil, errors.ArgMsg("config", "access key required")
 	}
+	partSize := conf.PartSize
+	if partSize == 0 {
+		partSize = PartSizeDefault
+	}
+	if partSize < PartSizeMin || partSize > PartSizeMax {
+		return nil, errors.ArgMsg("config.PartSize", "out of range")
+	}
 
 	// 	Initialize minio client object
 	accessKeyID := conf.AccessKeyID
@@ -75,7 +110,8 @@ func NewService(config mediastore.ServiceConfig) (mediastore.Service, error) {
 
 	minioClient, err := minio.New(endpoint, &minio.Options{
 		Creds:  credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
-		Secure: useSSL})
+		Secure: useSSL,
+		Region: conf.Region})
 
 	if err != nil {
 		return nil, errors.Wrap("minio client initialization", err)
@@ -97,83 +133,474 @@ func NewService(config mediastore.ServiceConfig) (mediastore.Service, error) {
 	}
 
 	return &Service{
-		bucketName:  bucketName,
-		basePath:    basepath,
-		minioClient: minioClient,
+		bucketName:      bucketName,
+		basePath:        mediastore.BasePath(basepath),
+		minioClient:     minioClient,
+		partSize:        partSize,
+		bucketOperation: conf.BucketOperation,
 	}, nil
 }
 
 type Service struct {
-	bucketName  string
-	basePath    string
-	minioClient *minio.Client
+	bucketName      string
+	basePath        mediastore.BasePath
+	minioClient     *minio.Client
+	partSize        uint64
+	bucketOperation bool
 }
 
-func (s *Service) PutObject(targetKey string, contentSource io.Reader) (uploadInfo *mediastore.UploadInfo, err error) {
+func (s *Service) PutObject(
+	ctx context.Context,
+	targetKey string,
+	contentSource io.Reader,
+	opts mediastore.PutObjectOptions,
+) (uploadInfo *mediastore.UploadInfo, err error) {
 	bucketName := s.bucketName
-	if s.basePath != "" {
-		targetKey = path.Join(s.basePath, targetKey)
+	objectKey, err := s.basePath.ObjectKey(targetKey)
+	if err != nil {
+		return nil, err
 	}
 
-	targetKey = path.Clean(targetKey)
-	buff := &bytes.Buffer{}
-	var objectSize int64 = -1
-	if written, err := io.Copy(buff, contentSource); err == nil {
-		if objectSize != 0 {
-			objectSize = written
+	// The content is streamed, only its head is read to detect the
+	// content type if it's not provided.
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType, contentSource, err = mediastore.SniffContentType(contentSource)
+		if err != nil {
+			return nil, errors.Wrap("read content", err)
 		}
 	}
-
-	contentType := media.DetectType(buff.Bytes())
-	opts := minio.PutObjectOptions{
-		ContentType: contentType,
+	putOpts := minio.PutObjectOptions{
+		ContentType:        contentType,
+		CacheControl:       opts.CacheControl,
+		ContentDisposition: opts.ContentDisposition,
+		UserMetadata:       mediastore.NormalizeMetadata(opts.Metadata),
+		PartSize:           s.partSize,
 	}
-	info, err := s.minioClient.PutObject(context.Background(), bucketName, targetKey, buff, objectSize, opts)
+	// With unknown size, the client uploads the content part by part
+	// reusing a single buffer of PartSize.
+	info, err := s.minioClient.PutObject(ctx, bucketName, objectKey, contentSource, -1, putOpts)
 	if err != nil {
 		return nil, errors.Wrap("upload", err)
 	}
 
 	return &mediastore.UploadInfo{
 		Bucket:       bucketName,
-		Key:          info.Key,
+		Key:          s.basePath.RelativeKey(info.Key),
 		ETag:         info.ETag,
 		LastModified: info.LastModified,
+		Size:         int(info.Size),
 	}, nil
 }
 
-func (s *Service) GetPublicObject(sourceKey string) (targetURl string, err error) {
-	ctx := context.Background()
-	object, err := s.minioClient.GetObject(ctx, s.bucketName, sourceKey, minio.GetObjectOptions{})
-	if err != nil {
-		return "", err
-	}
+// PublicURLExpiryDefault is how long the URLs of GetPublicObject stay
+// valid if the expiry is not provided.
+const PublicURLExpiryDefault = 24 * time.Hour
 
-	objectBuf := new(bytes.Buffer)
-	_, _ = objectBuf.ReadFrom(object)
-	objectExt := media.DetectExtension(objectBuf.Bytes())
-	reqParams := make(url.Values)
-	reqParams.Set("response-content-disposition", "attachment;filename="+strconv.Quote(sourceKey+objectExt))
+// GetPublicObject creates a presigned GET URL, which is valid for
+// PublicURLExpiryDefault if opts.Expiry is not positive.
+func (s *Service) GetPublicObject(
+	ctx context.Context,
+	sourceKey string,
+	opts mediastore.PublicURLOptions,
+) (targetURl string, err error) {
+	expiry := opts.Expiry
+	if expiry <= 0 {
+		expiry = PublicURLExpiryDefault
+	}
 
-	// Generates a presigned url which expires in a day.
-	preSignedURL, err := s.minioClient.PresignedGetObject(ctx, s.bucketName, sourceKey, time.Second*24*60*60, reqParams)
+	objectKey, err := s.basePath.ObjectKey(sourceKey)
 	if err != nil {
 		return "", err
 	}
+	preSignedURL, err := s.minioClient.PresignedGetObject(ctx, s.bucketName, objectKey, expiry, opts.ResponseQuery())
+	if err != nil {
+		return "", errors.Wrap("presign get object", err)
+	}
 	targetURl = preSignedURL.String()
 	return
 }
 
-func (s *Service) GetObject(sourceKey string) (stream *bytes.Buffer, err error) {
-	ctx, cancel := context.WithCancel(context.Background())
+func (s *Service) GetObject(ctx context.Context, sourceKey string) (object *mediastore.ObjectReader, err error) {
+	objectKey, err := s.basePath.ObjectKey(sourceKey)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := s.minioClient.GetObject(ctx, s.bucketName, objectKey, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// The object is lazily requested, stat it so that errors like a
+	// missing object are reported here instead of on the first read.
+	info, err := obj.Stat()
+	if err != nil {
+		_ = obj.Close()
+		return nil, translateError(err)
+	}
+	return &mediastore.ObjectReader{
+		ReadCloser: obj,
+		Info:       objectInfo(sourceKey, info),
+	}, nil
+}
+
+func (s *Service) GetObjectRange(
+	ctx context.Context,
+	sourceKey string,
+	offset, length int64,
+) (object *mediastore.ObjectReader, err error) {
+	objectKey, err := s.basePath.ObjectKey(sourceKey)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.minioClient.StatObject(ctx, s.bucketName, objectKey, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, translateError(err)
+	}
+	length, err = mediastore.ResolveRange(info.Size, offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the same version of the object which has been stat-ed.
+	opts := minio.GetObjectOptions{}
+	if err = opts.SetMatchETag(info.ETag); err != nil {
+		return nil, errors.Wrap("set match etag", err)
+	}
+	if length > 0 {
+		if err = opts.SetRange(offset, offset+length-1); err != nil {
+			return nil, errors.Wrap("set range", err)
+		}
+	}
+	obj, err := s.minioClient.GetObject(ctx, s.bucketName, objectKey, opts)
+	if err != nil {
+		return nil, err
+	}
+	var rc io.ReadCloser = obj
+	if length == 0 {
+		// An empty range could not be requested.
+		_ = obj.Close()
+		rc = io.NopCloser(strings.NewReader(""))
+	}
+	return &mediastore.ObjectReader{
+		ReadCloser: rc,
+		Info:       objectInfo(sourceKey, info),
+	}, nil
+}
+
+// ListObjects lists the objects recursively. The page token is the key of
+// the last object of the previous page.
+func (s *Service) ListObjects(
+	ctx context.Context,
+	prefix string,
+	pageToken string,
+	limit int,
+) (*mediastore.ObjectList, error) {
+	if limit <= 0 {
+		limit = mediastore.ListObjectsLimitDefault
+	}
+
+	// The listing is done in the background, cancel it once we have
+	// enough objects.
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	object, err := s.minioClient.GetObject(ctx, s.bucketName, sourceKey, minio.GetObjectOptions{})
+	prefixKey, err := s.basePath.PrefixKey(prefix)
 	if err != nil {
 		return nil, err
 	}
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(object)
-	return buf, nil
+	opts := minio.ListObjectsOptions{
+		Prefix:    prefixKey,
+		Recursive: true,
+		MaxKeys:   limit + 1,
+	}
+	if pageToken != "" {
+		if opts.StartAfter, err = s.basePath.ObjectKey(pageToken); err != nil {
+			return nil, errors.ArgMsg("pageToken", "invalid")
+		}
+	}
+
+	result := &mediastore.ObjectList{}
+	for objInfo := range s.minioClient.ListObjects(ctx, s.bucketName, opts) {
+		if objInfo.Err != nil {
+			return nil, errors.Wrap("list objects", objInfo.Err)
+		}
+		if len(result.Objects) == limit {
+			result.NextPageToken = result.Objects[limit-1].Key
+			break
+		}
+		result.Objects = append(result.Objects, mediastore.ObjectInfo{
+			Key:          s.basePath.RelativeKey(objInfo.Key),
+			Size:         objInfo.Size,
+			ETag:         objInfo.ETag,
+			LastModified: objInfo.LastModified,
+		})
+	}
+
+	return result, nil
 }
 
-var _ mediastore.Service = &Service{}
+func (s *Service) DeleteObject(ctx context.Context, sourceKey string) error {
+	// Removing an object which does not exist is not an error for minio.
+	objectKey, err := s.basePath.ObjectKey(sourceKey)
+	if err != nil {
+		return err
+	}
+	err = s.minioClient.RemoveObject(ctx, s.bucketName, objectKey, minio.RemoveObjectOptions{})
+	if err != nil {
+		return errors.Wrap("remove object", err)
+	}
+	return nil
+}
+
+func (s *Service) StatObject(ctx context.Context, sourceKey string) (*mediastore.ObjectInfo, error) {
+	objectKey, err := s.basePath.ObjectKey(sourceKey)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.minioClient.StatObject(ctx, s.bucketName, objectKey, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, errors.Wrap("stat object", translateError(err))
+	}
+
+	objInfo := objectInfo(sourceKey, info)
+	return &objInfo, nil
+}
+
+func objectInfo(objectKey string, info minio.ObjectInfo) mediastore.ObjectInfo {
+	return mediastore.ObjectInfo{
+		Key:                objectKey,
+		Size:               info.Size,
+		ContentType:        info.ContentType,
+		CacheControl:       info.Metadata.Get("Cache-Control"),
+		ContentDisposition: info.Metadata.Get("Content-Disposition"),
+		ETag:               info.ETag,
+		LastModified:       info.LastModified,
+		Metadata:           mediastore.NormalizeMetadata(info.UserMetadata),
+	}
+}
+
+// PresignPutObject creates a presigned POST policy for uploading the
+// object. A policy is used instead of a presigned PUT because it is able
+// to limit the size of the content.
+func (s *Service) PresignPutObject(
+	ctx context.Context,
+	targetKey string,
+	opts mediastore.PresignPutOptions,
+) (*mediastore.PresignedRequest, error) {
+	expiry := opts.Expiry
+	if expiry <= 0 {
+		expiry = mediastore.PresignExpiryDefault
+	}
+	expires := time.Now().UTC().Add(expiry)
+	objectKey, err := s.basePath.ObjectKey(targetKey)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := minio.NewPostPolicy()
+	if err := policy.SetBucket(s.bucketName); err != nil {
+		return nil, errors.Wrap("policy bucket", err)
+	}
+	if err := policy.SetKey(objectKey); err != nil {
+		return nil, errors.ArgWrap("targetKey", "policy key", err)
+	}
+	if err := policy.SetExpires(expires); err != nil {
+		return nil, errors.ArgWrap("opts.Expiry", "policy expiry", err)
+	}
+	if opts.ContentType != "" {
+		if err := policy.SetContentType(opts.ContentType); err != nil {
+			return nil, errors.ArgWrap("opts.ContentType", "policy content type", err)
+		}
+	}
+	if opts.MaxSize > 0 {
+		if err := policy.SetContentLengthRange(0, opts.MaxSize); err != nil {
+			return nil, errors.ArgWrap("opts.MaxSize", "policy content length", err)
+		}
+	}
+
+	postURL, formData, err := s.minioClient.PresignedPostPolicy(ctx, policy)
+	if err != nil {
+		return nil, errors.Wrap("presign post policy", err)
+	}
+
+	return &mediastore.PresignedRequest{
+		Method:   http.MethodPost,
+		URL:      postURL.String(),
+		Header:   http.Header{},
+		FormData: formData,
+		Expires:  expires,
+	}, nil
+}
+
+// copyObjectSizeMax is the size of the largest object which is copied with
+// a single request.
+const copyObjectSizeMax = 5 * 1024 * 1024 * 1024 // 5GiB
+
+// CopyObject copies the object on the server, with a single request up to
+// 5GiB, the limit of the S3 API, and part by part above.
+func (s *Service) CopyObject(ctx context.Context, srcKey, dstKey string) error {
+	srcObjectKey, err := s.basePath.ObjectKey(srcKey)
+	if err != nil {
+		return err
+	}
+	dstObjectKey, err := s.basePath.ObjectKey(dstKey)
+	if err != nil {
+		return err
+	}
+	info, err := s.minioClient.StatObject(ctx, s.bucketName, srcObjectKey, minio.StatObjectOptions{})
+	if err != nil {
+		return errors.Wrap("stat object", translateError(err))
+	}
+	dst := minio.CopyDestOptions{Bucket: s.bucketName, Object: dstObjectKey}
+	src := minio.CopySrcOptions{Bucket: s.bucketName, Object: srcObjectKey, MatchETag: info.ETag}
+	if info.Size <= copyObjectSizeMax {
+		// The metadata of the source object is copied unless replaced.
+		_, err = s.minioClient.CopyObject(ctx, dst, src)
+	} else {
+		// ComposeObject copies the source part by part, but it only
+		// keeps the user metadata of the source, the attributes are
+		// set explicitly.
+		dst.ReplaceMetadata = true
+		dst.UserMetadata = copyMetadata(info)
+		_, err = s.minioClient.ComposeObject(ctx, dst, src)
+	}
+	if err != nil {
+		return errors.Wrap("copy object", translateError(err))
+	}
+	return nil
+}
+
+// copyMetadata returns the attributes and the user metadata of the object
+// as the metadata of a copy.
+func copyMetadata(info minio.ObjectInfo) map[string]string {
+	metadata := make(map[string]string, len(info.UserMetadata)+3)
+	for k, v := range info.UserMetadata {
+		metadata[k] = v
+	}
+	metadata["Content-Type"] = info.ContentType
+	for _, name := range []string{"Cache-Control", "Content-Disposition"} {
+		if v := info.Metadata.Get(name); v != "" {
+			metadata[name] = v
+		}
+	}
+	return metadata
+}
+
+// MoveObject copies the object and then removes the source, S3-compatible
+// storages don't provide a rename.
+func (s *Service) MoveObject(ctx context.Context, srcKey, dstKey string) error {
+	if err := s.CopyObject(ctx, srcKey, dstKey); err != nil {
+		return err
+	}
+	return s.DeleteObject(ctx, srcKey)
+}
+
+// HealthCheck checks that the bucket exists, which also checks the
+// credentials, and that the objects could be written.
+func (s *Service) HealthCheck(ctx context.Context) error {
+	exists, err := s.minioClient.BucketExists(ctx, s.bucketName)
+	if err != nil {
+		return errors.Wrap("bucket exists", err)
+	}
+	if !exists {
+		return errors.Msg("bucket " + s.bucketName + " does not exist")
+	}
+	return mediastore.CheckWritable(ctx, s)
+}
+
+// SetLifecycle replaces the lifecycle configuration of the bucket with
+// the expirations and the transitions of the rules. As a rule of the
+// bucket holds a single transition, the other transitions of a rule are
+// configured as additional rules. The bucket is left as it is if
+// BucketOperation is not enabled.
+func (s *Service) SetLifecycle(ctx context.Context, config mediastore.LifecycleConfig) error {
+	if !s.bucketOperation {
+		log.Warn().Str("bucket", s.bucketName).
+			Msg("Bucket operation disabled, the lifecycle rules must be configured on the bucket")
+		return nil
+	}
+
+	lifecycleConfig := lifecycle.NewConfiguration()
+	for i, rule := range config.Rules {
+		if rule.ExpirationDays == 0 && len(rule.Transitions) == 0 {
+			continue
+		}
+		prefixKey, err := s.basePath.PrefixKey(rule.Prefix)
+		if err != nil {
+			return errors.Wrap("rule prefix", err)
+		}
+		ruleID := rule.RuleID(i)
+		lifecycleRule := lifecycle.Rule{
+			ID:         ruleID,
+			RuleFilter: lifecycle.Filter{Prefix: prefixKey},
+			Status:     "Enabled",
+		}
+		if rule.ExpirationDays > 0 {
+			lifecycleRule.Expiration = lifecycle.Expiration{Days: lifecycle.ExpirationDays(rule.ExpirationDays)}
+		}
+		for j, transition := range rule.Transitions {
+			if j > 0 {
+				lifecycleConfig.Rules = append(lifecycleConfig.Rules, lifecycleRule)
+				lifecycleRule = lifecycle.Rule{
+					ID:         ruleID + "-" + strconv.Itoa(j),
+					RuleFilter: lifecycleRule.RuleFilter,
+					Status:     "Enabled",
+				}
+			}
+			lifecycleRule.Transition = lifecycle.Transition{
+				Days:         lifecycle.ExpirationDays(transition.Days),
+				StorageClass: transition.StorageClass,
+			}
+		}
+		lifecycleConfig.Rules = append(lifecycleConfig.Rules, lifecycleRule)
+	}
+	if lifecycleConfig.Empty() {
+		return nil
+	}
+
+	if err := s.minioClient.SetBucketLifecycle(ctx, s.bucketName, lifecycleConfig); err != nil {
+		return errors.Wrap("set bucket lifecycle", err)
+	}
+	return nil
+}
+
+var _ mediastore.ServiceV2 = &Service{}
+var _ mediastore.Copier = &Service{}
+var _ mediastore.Presigner = &Service{}
+var _ mediastore.MultipartUploader = &Service{}
+var _ mediastore.HealthChecker = &Service{}
+var _ mediastore.LifecycleConfigurer = &Service{}
+
+// ClassifyError classifies the error responses by their status code and
+// the throttling errors as retryable.
+func (s *Service) ClassifyError(err error) mediastore.ErrorClass {
+	var resp minio.ErrorResponse
+	if !errors.As(err, &resp) {
+		return mediastore.ErrorClassUnknown
+	}
+	switch resp.Code {
+	case "SlowDown", "SlowDownRead", "SlowDownWrite", "RequestTimeout", "InternalError", "ServiceUnavailable":
+		return mediastore.ErrorClassRetryable
+	}
+	switch code := resp.StatusCode; {
+	case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests, code >= 500:
+		return mediastore.ErrorClassRetryable
+	case code >= 400:
+		return mediastore.ErrorClassPermanent
+	}
+	return mediastore.ErrorClassUnknown
+}
+
+var _ mediastore.ErrorClassifier = &Service{}
+
+// translateError maps the errors of the client library into the errors
+// defined by mediastore.
+func translateError(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return mediastore.ErrObjectNotFound
+	case "NoSuchUpload":
+		return mediastore.ErrUploadNotFound
+	}
+	return err
+}
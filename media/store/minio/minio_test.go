@@ -1 +1,437 @@
 package minio
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+// BenchmarkPutObject uploads objects of growing sizes to a fake endpoint
+// and reports the peak heap in use, which should stay around the part
+// size regardless of the object size.
+func BenchmarkPutObject(b *testing.B) {
+	srv := httptest.NewServer(fakeMultipartHandler())
+	defer srv.Close()
+
+	svc, err := NewServiceV2(&Config{
+		Region:          "us-east-1",
+		BucketName:      "bench",
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+		Endpoint:        strings.TrimPrefix(srv.URL, "http://"),
+		PartSize:        PartSizeMin,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, sizeMiB := range []int64{64, 256, 1024} {
+		b.Run(fmt.Sprintf("%dMiB", sizeMiB), func(b *testing.B) {
+			size := sizeMiB * 1024 * 1024
+			b.SetBytes(size)
+
+			var peak uint64
+			stop := sampleHeapInUse(&peak)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := svc.PutObject(context.Background(), "object",
+					io.LimitReader(zeroReader{}, size), mediastore.PutObjectOptions{})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			stop()
+			b.ReportMetric(float64(peak)/(1024*1024), "peak-heap-MiB")
+		})
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// sampleHeapInUse records the highest HeapInuse into peak until the
+// returned function is called.
+func sampleHeapInUse(peak *uint64) (stop func()) {
+	runtime.GC()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapInuse > atomic.LoadUint64(peak) {
+				atomic.StoreUint64(peak, stats.HeapInuse)
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// fakeMultipartHandler implements just enough of the S3 multipart upload
+// API for the client to upload an object. The content is discarded.
+func fakeMultipartHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		query := r.URL.Query()
+		switch {
+		case r.Method == http.MethodPost && query.Has("uploads"):
+			w.Header().Set("Content-Type", "application/xml")
+			_, _ = io.WriteString(w, `<InitiateMultipartUploadResult>`+
+				`<Bucket>bench</Bucket><Key>object</Key><UploadId>upload</UploadId>`+
+				`</InitiateMultipartUploadResult>`)
+		case r.Method == http.MethodPut && query.Has("partNumber"):
+			w.Header().Set("ETag", `"part"`)
+		case r.Method == http.MethodPost && query.Has("uploadId"):
+			w.Header().Set("Content-Type", "application/xml")
+			_, _ = io.WriteString(w, `<CompleteMultipartUploadResult>`+
+				`<Bucket>bench</Bucket><Key>object</Key><ETag>"object"</ETag>`+
+				`</CompleteMultipartUploadResult>`)
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	})
+}
+
+func TestBasePathEscape(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNotImplemented)
+	}))
+	defer srv.Close()
+	svc, err := NewServiceV2(&Config{
+		Region:          "us-east-1",
+		BucketName:      "bucket",
+		BasePath:        "tenant",
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+		Endpoint:        strings.TrimPrefix(srv.URL, "http://"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := svc.(*Service)
+	ctx := context.Background()
+
+	testCases := []struct {
+		name string
+		call func() error
+	}{
+		{"put", func() error {
+			_, err := s.PutObject(ctx, "../other/x", strings.NewReader("x"), mediastore.PutObjectOptions{})
+			return err
+		}},
+		{"get", func() error {
+			_, err := s.GetObject(ctx, "../other/x")
+			return err
+		}},
+		{"get range", func() error {
+			_, err := s.GetObjectRange(ctx, "a/../../other/x", 0, 1)
+			return err
+		}},
+		{"public URL", func() error {
+			_, err := s.GetPublicObject(ctx, "../other/x", mediastore.PublicURLOptions{})
+			return err
+		}},
+		{"list", func() error {
+			_, err := s.ListObjects(ctx, "../other/", "", 10)
+			return err
+		}},
+		{"delete", func() error { return s.DeleteObject(ctx, "../other/x") }},
+		{"stat", func() error {
+			_, err := s.StatObject(ctx, "..")
+			return err
+		}},
+		{"presign", func() error {
+			_, err := s.PresignPutObject(ctx, "../other/x", mediastore.PresignPutOptions{})
+			return err
+		}},
+		{"copy from", func() error { return s.CopyObject(ctx, "../other/x", "x") }},
+		{"copy to", func() error { return s.CopyObject(ctx, "x", "../other/x") }},
+		{"initiate upload", func() error {
+			_, err := s.InitiateUpload(ctx, "../other/x", mediastore.PutObjectOptions{})
+			return err
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var argErr errors.ArgumentError
+			if err := tc.call(); !errors.As(err, &argErr) {
+				t.Errorf("got %v, want an argument error", err)
+			}
+		})
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("%d requests sent to the backend", n)
+	}
+}
+
+func TestGetPublicObject(t *testing.T) {
+	svc, err := NewServiceV2(&Config{
+		Region:          "us-east-1",
+		BucketName:      "bucket",
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+		Endpoint:        "media.example",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name    string
+		opts    mediastore.PublicURLOptions
+		expires string
+		query   map[string]string
+	}{
+		{name: "default", expires: "86400"},
+		{name: "expiry", opts: mediastore.PublicURLOptions{Expiry: time.Hour}, expires: "3600"},
+		{name: "response overrides", opts: mediastore.PublicURLOptions{ContentType: "text/plain"},
+			expires: "86400", query: map[string]string{"response-content-type": "text/plain"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			publicURL, err := svc.GetPublicObject(context.Background(), "key", tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(publicURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query := u.Query()
+			if got := query.Get("X-Amz-Expires"); got != tc.expires {
+				t.Errorf("expires: got %q, want %q", got, tc.expires)
+			}
+			for name, value := range tc.query {
+				if got := query.Get(name); got != value {
+					t.Errorf("%s: got %q, want %q", name, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestObjectAttributes(t *testing.T) {
+	// The content of unknown size is uploaded part by part, the
+	// attributes are sent when the upload is initiated.
+	var putHeader http.Header
+	upload := fakeMultipartHandler()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			if r.URL.Query().Has("uploads") {
+				putHeader = r.Header.Clone()
+			}
+			upload.ServeHTTP(w, r)
+		case http.MethodPut:
+			upload.ServeHTTP(w, r)
+		case http.MethodHead:
+			header := w.Header()
+			header.Set("Content-Length", "7")
+			header.Set("Content-Type", "text/csv")
+			header.Set("Cache-Control", "no-cache")
+			header.Set("Content-Disposition", "inline")
+			header.Set("ETag", `"etag"`)
+			header.Set("Last-Modified", "Wed, 05 Apr 2023 10:00:00 GMT")
+			header.Set("X-Amz-Meta-Owner", "acme")
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	defer srv.Close()
+	svc, err := NewServiceV2(&Config{
+		Region:          "us-east-1",
+		BucketName:      "bucket",
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+		Endpoint:        strings.TrimPrefix(srv.URL, "http://"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	_, err = svc.PutObject(ctx, "key", strings.NewReader("content"), mediastore.PutObjectOptions{
+		CacheControl:       "no-cache",
+		ContentDisposition: "inline",
+		Metadata:           map[string]string{"Owner": "acme"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The content type is detected from the head of the content.
+	for name, value := range map[string]string{
+		"Content-Type":        "text/plain; charset=utf-8",
+		"Cache-Control":       "no-cache",
+		"Content-Disposition": "inline",
+		"X-Amz-Meta-Owner":    "acme",
+	} {
+		if got := putHeader.Get(name); got != value {
+			t.Errorf("put %s: got %q, want %q", name, got, value)
+		}
+	}
+
+	info, err := svc.StatObject(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mediastore.ObjectInfo{
+		Key:                "key",
+		Size:               7,
+		ContentType:        "text/csv",
+		CacheControl:       "no-cache",
+		ContentDisposition: "inline",
+		ETag:               "etag",
+		LastModified:       time.Date(2023, 4, 5, 10, 0, 0, 0, time.UTC),
+		Metadata:           map[string]string{"owner": "acme"},
+	}
+	if !reflect.DeepEqual(*info, want) {
+		t.Errorf("stat: got %+v, want %+v", *info, want)
+	}
+}
+
+// copyRecorder is a fake S3 endpoint for the copies of an object of the
+// given size, which records the ranges of the copied parts.
+type copyRecorder struct {
+	size int64
+
+	mu           sync.Mutex
+	singleCopies int
+	uploadHeader http.Header
+	ranges       []string
+	completed    bool
+}
+
+func (c *copyRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, _ = io.Copy(io.Discard, r.Body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	query := r.URL.Query()
+	w.Header().Set("Content-Type", "application/xml")
+	switch {
+	case r.Method == http.MethodHead:
+		header := w.Header()
+		header.Set("Content-Length", strconv.FormatInt(c.size, 10))
+		header.Set("Content-Type", "video/mp4")
+		header.Set("Cache-Control", "no-cache")
+		header.Set("ETag", `"source"`)
+		header.Set("Last-Modified", "Wed, 05 Apr 2023 10:00:00 GMT")
+		header.Set("X-Amz-Meta-Owner", "acme")
+	case r.Method == http.MethodPut && strings.Trim(r.Header.Get("X-Amz-Copy-Source-If-Match"), `"`) != "source":
+		w.WriteHeader(http.StatusPreconditionFailed)
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		c.ranges = append(c.ranges, r.Header.Get("X-Amz-Copy-Source-Range"))
+		_, _ = io.WriteString(w, `<CopyPartResult><ETag>"part"</ETag>`+
+			`<LastModified>2023-04-05T10:00:00.000Z</LastModified></CopyPartResult>`)
+	case r.Method == http.MethodPut:
+		c.singleCopies++
+		_, _ = io.WriteString(w, `<CopyObjectResult><ETag>"copy"</ETag>`+
+			`<LastModified>2023-04-05T10:00:00.000Z</LastModified></CopyObjectResult>`)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		c.uploadHeader = r.Header.Clone()
+		_, _ = io.WriteString(w, `<InitiateMultipartUploadResult><Bucket>bucket</Bucket>`+
+			`<Key>copy</Key><UploadId>upload</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		c.completed = true
+		_, _ = io.WriteString(w, `<CompleteMultipartUploadResult><Bucket>bucket</Bucket>`+
+			`<Key>copy</Key><ETag>"copy"</ETag></CompleteMultipartUploadResult>`)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// checkRanges checks that the ranges are contiguous and cover the object.
+func (c *copyRecorder) checkRanges(t *testing.T) {
+	t.Helper()
+	var next int64
+	for _, r := range c.ranges {
+		var start, end int64
+		if _, err := fmt.Sscanf(r, "bytes=%d-%d", &start, &end); err != nil || start != next || end < start {
+			t.Fatalf("ranges: got %v", c.ranges)
+		}
+		next = end + 1
+	}
+	if next != c.size {
+		t.Errorf("copied %d bytes of %d", next, c.size)
+	}
+}
+
+func TestCopyObject(t *testing.T) {
+	for _, size := range []int64{1024, copyObjectSizeMax + 1} {
+		t.Run(strconv.FormatInt(size, 10), func(t *testing.T) {
+			recorder := &copyRecorder{size: size}
+			srv := httptest.NewServer(recorder)
+			defer srv.Close()
+			svc, err := NewServiceV2(&Config{
+				Region:          "us-east-1",
+				BucketName:      "bucket",
+				AccessKeyID:     "access",
+				SecretAccessKey: "secret",
+				Endpoint:        strings.TrimPrefix(srv.URL, "http://"),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = svc.(*Service).CopyObject(context.Background(), "source", "copy"); err != nil {
+				t.Fatal(err)
+			}
+
+			if size <= copyObjectSizeMax {
+				if recorder.singleCopies != 1 || recorder.ranges != nil {
+					t.Errorf("got %d copies and %d parts, want a single copy",
+						recorder.singleCopies, len(recorder.ranges))
+				}
+				return
+			}
+			if recorder.singleCopies != 0 || !recorder.completed {
+				t.Fatalf("got %d single copies, completed: %v", recorder.singleCopies, recorder.completed)
+			}
+			recorder.checkRanges(t)
+			for name, value := range map[string]string{
+				"Content-Type":     "video/mp4",
+				"Cache-Control":    "no-cache",
+				"X-Amz-Meta-Owner": "acme",
+			} {
+				if got := recorder.uploadHeader.Get(name); got != value {
+					t.Errorf("upload %s: got %q, want %q", name, got, value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package minio
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+// The upload sessions are mapped to the multipart uploads, through the
+// low level API of the client.
+
+func (s *Service) core() minio.Core {
+	return minio.Core{Client: s.minioClient}
+}
+
+func (s *Service) InitiateUpload(
+	ctx context.Context,
+	targetKey string,
+	opts mediastore.PutObjectOptions,
+) (string, error) {
+	objectKey, err := s.basePath.ObjectKey(targetKey)
+	if err != nil {
+		return "", err
+	}
+	uploadID, err := s.core().NewMultipartUpload(ctx, s.bucketName, objectKey,
+		minio.PutObjectOptions{
+			ContentType:        opts.ContentType,
+			CacheControl:       opts.CacheControl,
+			ContentDisposition: opts.ContentDisposition,
+			UserMetadata:       mediastore.NormalizeMetadata(opts.Metadata),
+		})
+	if err != nil {
+		return "", errors.Wrap("new multipart upload", err)
+	}
+	return uploadID, nil
+}
+
+// UploadPart buffers the part in memory if its size is not known.
+func (s *Service) UploadPart(
+	ctx context.Context,
+	targetKey, uploadID string,
+	partNumber int,
+	contentSource io.Reader,
+	size int64,
+) (*mediastore.UploadPart, error) {
+	objectKey, err := s.basePath.ObjectKey(targetKey)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		buf := &bytes.Buffer{}
+		if _, err := buf.ReadFrom(contentSource); err != nil {
+			return nil, errors.Wrap("read content", err)
+		}
+		contentSource, size = buf, int64(buf.Len())
+	}
+	part, err := s.core().PutObjectPart(ctx, s.bucketName, objectKey, uploadID,
+		partNumber, contentSource, size, minio.PutObjectPartOptions{})
+	if err != nil {
+		return nil, errors.Wrap("put object part", translateError(err))
+	}
+	return &mediastore.UploadPart{
+		PartNumber:   part.PartNumber,
+		Size:         part.Size,
+		ETag:         strings.Trim(part.ETag, `"`),
+		LastModified: part.LastModified,
+	}, nil
+}
+
+func (s *Service) ListUploadParts(ctx context.Context, targetKey, uploadID string) ([]mediastore.UploadPart, error) {
+	objectKey, err := s.basePath.ObjectKey(targetKey)
+	if err != nil {
+		return nil, err
+	}
+	var parts []mediastore.UploadPart
+	partNumberMarker := 0
+	for {
+		result, err := s.core().ListObjectParts(ctx, s.bucketName, objectKey, uploadID,
+			partNumberMarker, mediastore.ListObjectsLimitDefault)
+		if err != nil {
+			return nil, errors.Wrap("list object parts", translateError(err))
+		}
+		for _, part := range result.ObjectParts {
+			parts = append(parts, mediastore.UploadPart{
+				PartNumber:   part.PartNumber,
+				Size:         part.Size,
+				ETag:         strings.Trim(part.ETag, `"`),
+				LastModified: part.LastModified,
+			})
+		}
+		if !result.IsTruncated {
+			break
+		}
+		partNumberMarker = result.NextPartNumberMarker
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	return parts, nil
+}
+
+func (s *Service) CompleteUpload(ctx context.Context, targetKey, uploadID string) (*mediastore.UploadInfo, error) {
+	parts, err := s.ListUploadParts(ctx, targetKey, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		return nil, errors.ArgMsg("uploadID", "no parts uploaded")
+	}
+	completeParts := make([]minio.CompletePart, 0, len(parts))
+	var size int64
+	for _, part := range parts {
+		completeParts = append(completeParts, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+		size += part.Size
+	}
+
+	objectKey, err := s.basePath.ObjectKey(targetKey)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.core().CompleteMultipartUpload(ctx, s.bucketName, objectKey, uploadID,
+		completeParts, minio.PutObjectOptions{})
+	if err != nil {
+		return nil, errors.Wrap("complete multipart upload", translateError(err))
+	}
+	return &mediastore.UploadInfo{
+		Bucket:       s.bucketName,
+		Key:          targetKey,
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+		Location:     info.Location,
+		Size:         int(size),
+		UploadID:     uploadID,
+	}, nil
+}
+
+func (s *Service) AbortUpload(ctx context.Context, targetKey, uploadID string) error {
+	objectKey, err := s.basePath.ObjectKey(targetKey)
+	if err != nil {
+		return err
+	}
+	err = s.core().AbortMultipartUpload(ctx, s.bucketName, objectKey, uploadID)
+	if err != nil {
+		return errors.Wrap("abort multipart upload", translateError(err))
+	}
+	return nil
+}
+
+func (s *Service) ListUploads(ctx context.Context, prefix string) ([]mediastore.UploadSession, error) {
+	var sessions []mediastore.UploadSession
+	prefixKey, err := s.basePath.PrefixKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var keyMarker, uploadIDMarker string
+	for {
+		result, err := s.core().ListMultipartUploads(ctx, s.bucketName, prefixKey,
+			keyMarker, uploadIDMarker, "", mediastore.ListObjectsLimitDefault)
+		if err != nil {
+			return nil, errors.Wrap("list multipart uploads", err)
+		}
+		for _, upload := range result.Uploads {
+			sessions = append(sessions, mediastore.UploadSession{
+				Key:       s.basePath.RelativeKey(upload.Key),
+				UploadID:  upload.UploadID,
+				Initiated: upload.Initiated,
+			})
+		}
+		if !result.IsTruncated {
+			break
+		}
+		keyMarker, uploadIDMarker = result.NextKeyMarker, result.NextUploadIDMarker
+	}
+	return sessions, nil
+}
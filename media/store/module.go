@@ -3,6 +3,7 @@ package store
 import (
 	"sync"
 
+	"github.com/timemore/foundation/errors"
 	"gopkg.in/yaml.v3"
 )
 
@@ -14,7 +15,13 @@ type Module struct {
 
 	// NewService create a storage service backend connection. This is
 	// usually initialize the client of the object storage.
+	//
+	// Deprecated: provide NewServiceV2 instead.
 	NewService func(config ServiceConfig) (Service, error)
+
+	// NewServiceV2 create a context-aware storage service backend
+	// connection. It takes precedence over NewService.
+	NewServiceV2 func(config ServiceConfig) (ServiceV2, error)
 }
 
 var (
@@ -34,12 +41,31 @@ func ModuleNames() []string {
 	return names
 }
 
+// AvailableModules returns a copy of the registered modules.
 func AvailableModules() map[string]Module {
-	modulesMu.Lock()
-	defer modulesMu.Unlock()
-	return modules
+	modulesMu.RLock()
+	defer modulesMu.RUnlock()
+	available := make(map[string]Module, len(modules))
+	for serviceName, mod := range modules {
+		available[serviceName] = mod
+	}
+	return available
 }
 
+func lookupModule(serviceName string) (Module, error) {
+	modulesMu.RLock()
+	module, ok := modules[serviceName]
+	modulesMu.RUnlock()
+	if !ok || (module.NewService == nil && module.NewServiceV2 == nil) {
+		return Module{}, errors.ArgMsg("serviceName", serviceName+" not registered")
+	}
+	return module, nil
+}
+
+// NewServiceClient instantiates the service of the module registered
+// as serviceName.
+//
+// Deprecated: use NewServiceClientV2.
 func NewServiceClient(
 	serviceName string,
 	config any,
@@ -48,12 +74,45 @@ func NewServiceClient(
 		return nil, nil
 	}
 
-	var module Module
-	modulesMu.RLock()
-	module, _ = modules[serviceName]
-	modulesMu.RUnlock()
+	module, err := lookupModule(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	if module.NewService != nil {
+		return module.NewService(config)
+	}
 
-	return module.NewService(config)
+	svc, err := module.NewServiceV2(config)
+	if err != nil {
+		return nil, err
+	}
+	return LegacyService(svc), nil
+}
+
+// NewServiceClientV2 instantiates the context-aware service of the module
+// registered as serviceName. Modules which only provide the legacy
+// NewService are adapted with AdaptLegacyService.
+func NewServiceClientV2(
+	serviceName string,
+	config any,
+) (ServiceV2, error) {
+	if serviceName == "" {
+		return nil, nil
+	}
+
+	module, err := lookupModule(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	if module.NewServiceV2 != nil {
+		return module.NewServiceV2(config)
+	}
+
+	svc, err := module.NewService(config)
+	if err != nil {
+		return nil, err
+	}
+	return AdaptLegacyService(svc), nil
 }
 
 func RegisterModule(
@@ -71,11 +130,11 @@ func RegisterModule(
 }
 
 func ModuleConfigSkeletons() map[string]any {
-	modulesMu.RLock()
-	defer modulesMu.RUnlock()
-
+	// The skeletons are created without holding the lock, as a skeleton
+	// may look up the other modules, e.g., the one of the replicated
+	// module.
 	configs := map[string]any{}
-	for serviceName, mod := range modules {
+	for serviceName, mod := range AvailableModules() {
 		if mod.ServiceConfigSkeleton != nil {
 			configs[serviceName] = mod.ServiceConfigSkeleton()
 		}
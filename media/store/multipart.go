@@ -0,0 +1,244 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/media"
+)
+
+// ErrUploadNotFound is returned, usually wrapped, by the services when
+// the upload session does not exist, e.g., it has been completed or
+// aborted.
+var ErrUploadNotFound = errors.Msg("upload not found")
+
+const (
+	// UploadPartNumberMax is the highest part number of an upload.
+	UploadPartNumberMax = 10000
+
+	// UploadPartSizeMin is the minimum size of the parts, except the last
+	// one, required by S3 and S3-compatible storages.
+	UploadPartSizeMin = 5 * 1024 * 1024
+)
+
+// UploadSession is an upload in progress.
+type UploadSession struct {
+	Key       string
+	UploadID  string
+	Initiated time.Time
+}
+
+// UploadPart is a part which has been uploaded to an upload session.
+type UploadPart struct {
+	PartNumber   int
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+// NewUploadID generates a random upload ID, for the services which
+// manage the upload sessions themselves.
+func NewUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// IsUploadID returns true if the string could have been generated by
+// NewUploadID. The services which keep the sessions under a path derived
+// from the upload ID must check it.
+func IsUploadID(uploadID string) bool {
+	b, err := hex.DecodeString(uploadID)
+	return err == nil && len(b) == 16
+}
+
+// InitiateUpload starts a session to upload the object in parts, which
+// could be uploaded in any order and uploaded again if they failed. The
+// attributes in opts are applied to the object when the upload completes.
+// Unlike UploadContext, the content type is not detected if it's not provided.
+//
+// If the media type has a media.MediaTypeInfo, the UploadPolicy of the
+// media type applies to the upload, and opts.ContentType is required. The
+// same media type must be passed to UploadPart and CompleteUpload, which
+// check the content.
+func (mediaStore *Store) InitiateUpload(
+	ctx context.Context,
+	targetKey string,
+	mediaType media.MediaType,
+	opts PutObjectOptions,
+) (uploadID string, err error) {
+	if targetKey == "" {
+		return "", errors.ArgMsg("targetKey", "empty")
+	}
+	if typeInfo := media.GetMediaTypeInfo(mediaType); typeInfo != nil {
+		policy := mediaStore.config.UploadPolicy.Policy(mediaType)
+		if err = policy.checkDeclaredContentType(typeInfo, mediaType, "opts.ContentType", opts.ContentType); err != nil {
+			return "", err
+		}
+	}
+	uploader, err := GetMultipartUploader(mediaStore.serviceClient)
+	if err != nil {
+		return "", err
+	}
+	opts.Metadata = NormalizeMetadata(opts.Metadata)
+	uploadID, err = uploader.InitiateUpload(ctx, targetKey, opts)
+	if err != nil {
+		return "", errors.Wrap("initiating upload", err)
+	}
+	return uploadID, nil
+}
+
+// UploadPart stores the content as the part partNumber of the upload. The
+// size is the size of the content, or -1 if it's not known in which case
+// some backends buffer the part in memory. All the parts but the last must
+// be at least UploadPartSizeMin bytes. A part larger than the maximum size
+// of the UploadPolicy of the media type is rejected.
+func (mediaStore *Store) UploadPart(
+	ctx context.Context,
+	targetKey string,
+	uploadID string,
+	mediaType media.MediaType,
+	partNumber int,
+	contentSource io.Reader,
+	size int64,
+) (*UploadPart, error) {
+	if uploadID == "" {
+		return nil, errors.ArgMsg("uploadID", "empty")
+	}
+	if partNumber < 1 || partNumber > UploadPartNumberMax {
+		return nil, errors.ArgMsg("partNumber", "out of range 1-"+strconv.Itoa(UploadPartNumberMax))
+	}
+	var limiter *sizeLimitReader
+	if typeInfo := media.GetMediaTypeInfo(mediaType); typeInfo != nil {
+		policy := mediaStore.config.UploadPolicy.Policy(mediaType)
+		if policy.MaxSizeBytes > 0 {
+			limiter = &sizeLimitReader{r: contentSource, limit: policy.MaxSizeBytes, remaining: policy.MaxSizeBytes}
+			if size > policy.MaxSizeBytes {
+				return nil, limiter.policyError()
+			}
+			contentSource = limiter
+		}
+	}
+	uploader, err := GetMultipartUploader(mediaStore.serviceClient)
+	if err != nil {
+		return nil, err
+	}
+	part, err := uploader.UploadPart(ctx, targetKey, uploadID, partNumber, contentSource, size)
+	if err != nil {
+		if limiter != nil && limiter.exceeded {
+			return nil, limiter.policyError()
+		}
+		return nil, errors.Wrap("uploading part", err)
+	}
+	return part, nil
+}
+
+// ListUploadParts returns the parts which have been uploaded, ordered by
+// part number. It allows a client to resume an upload with the parts
+// which are missing.
+func (mediaStore *Store) ListUploadParts(ctx context.Context, targetKey, uploadID string) ([]UploadPart, error) {
+	if uploadID == "" {
+		return nil, errors.ArgMsg("uploadID", "empty")
+	}
+	uploader, err := GetMultipartUploader(mediaStore.serviceClient)
+	if err != nil {
+		return nil, err
+	}
+	return uploader.ListUploadParts(ctx, targetKey, uploadID)
+}
+
+// CompleteUpload assembles all the uploaded parts, in order of part
+// number, into the object and ends the session.
+//
+// If the media type has a media.MediaTypeInfo, the session is aborted if
+// the parts exceed the maximum size of the UploadPolicy of the media type.
+// The content of the assembled object must then comply with the policy,
+// and have the content type declared to InitiateUpload, otherwise the
+// object is deleted. The returned error is then an UploadPolicyError.
+func (mediaStore *Store) CompleteUpload(
+	ctx context.Context,
+	targetKey string,
+	uploadID string,
+	mediaType media.MediaType,
+) (*UploadInfo, error) {
+	if uploadID == "" {
+		return nil, errors.ArgMsg("uploadID", "empty")
+	}
+	uploader, err := GetMultipartUploader(mediaStore.serviceClient)
+	if err != nil {
+		return nil, err
+	}
+	typeInfo := media.GetMediaTypeInfo(mediaType)
+	if policy := mediaStore.config.UploadPolicy.Policy(mediaType); typeInfo != nil && policy.MaxSizeBytes > 0 {
+		parts, err := uploader.ListUploadParts(ctx, targetKey, uploadID)
+		if err != nil {
+			return nil, errors.Wrap("listing parts", err)
+		}
+		var size int64
+		for _, part := range parts {
+			size += part.Size
+		}
+		if size > policy.MaxSizeBytes {
+			if err = uploader.AbortUpload(ctx, targetKey, uploadID); err != nil {
+				log.Warn().Err(err).Str("key", targetKey).Str("upload_id", uploadID).
+					Msg("Unable to abort the upload which exceeds the maximum size")
+			}
+			return nil, &UploadPolicyError{
+				ArgName: "uploadID",
+				Err:     ErrContentTooLarge,
+				Detail:  "exceeds " + strconv.FormatInt(policy.MaxSizeBytes, 10) + " bytes",
+			}
+		}
+	}
+	uploadInfo, err := uploader.CompleteUpload(ctx, targetKey, uploadID)
+	if err != nil {
+		return nil, errors.Wrap("completing upload", err)
+	}
+	if typeInfo != nil {
+		if err = mediaStore.enforceObjectPolicy(ctx, targetKey, mediaType); err != nil {
+			// The object is not deleted along with the context.
+			if delErr := mediaStore.serviceClient.DeleteObject(context.Background(), targetKey); delErr != nil {
+				log.Warn().Err(delErr).Str("key", targetKey).
+					Msg("Unable to delete the uploaded object which violates the upload policy")
+			}
+			return nil, err
+		}
+	}
+	if uploadInfo.LastModified.IsZero() {
+		uploadInfo.LastModified = time.Now().UTC()
+	}
+	uploadInfo.UploadID = uploadID
+	return uploadInfo, nil
+}
+
+// AbortUpload ends the session and discards the uploaded parts.
+func (mediaStore *Store) AbortUpload(ctx context.Context, targetKey, uploadID string) error {
+	if uploadID == "" {
+		return errors.ArgMsg("uploadID", "empty")
+	}
+	uploader, err := GetMultipartUploader(mediaStore.serviceClient)
+	if err != nil {
+		return err
+	}
+	if err = uploader.AbortUpload(ctx, targetKey, uploadID); err != nil {
+		return errors.Wrap("aborting upload", err)
+	}
+	return nil
+}
+
+// ListUploads returns the sessions in progress for the objects whose key
+// starts with prefix.
+func (mediaStore *Store) ListUploads(ctx context.Context, prefix string) ([]UploadSession, error) {
+	uploader, err := GetMultipartUploader(mediaStore.serviceClient)
+	if err != nil {
+		return nil, err
+	}
+	return uploader.ListUploads(ctx, prefix)
+}
@@ -0,0 +1,165 @@
+package store_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/media"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+var multipartBackends = map[string]func(t *testing.T) mediastore.ServiceV2{
+	"memory": func(t *testing.T) mediastore.ServiceV2 { return newMemoryService(t) },
+	"local":  newLocalService,
+}
+
+func TestUploadSession(t *testing.T) {
+	for backendName, newService := range multipartBackends {
+		t.Run(backendName, func(t *testing.T) {
+			ctx := context.Background()
+			svc := newService(t)
+			mediaStore := newTestStore(t, mediastore.Config{}, svc)
+
+			uploadID, err := mediaStore.InitiateUpload(ctx, "dir/key", media.MediaType_MEDIA_TYPE_UNSPECIFIED, mediastore.PutObjectOptions{
+				ContentType: "text/plain",
+				Metadata:    map[string]string{"Origin": "test"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The parts are uploaded out of order, and the second one is
+			// uploaded again.
+			for _, part := range []struct {
+				number  int
+				content string
+			}{{3, "ccc"}, {1, "aaa"}, {2, "xx"}, {2, "bbb"}} {
+				_, err = mediaStore.UploadPart(ctx, "dir/key", uploadID, media.MediaType_MEDIA_TYPE_UNSPECIFIED, part.number,
+					strings.NewReader(part.content), int64(len(part.content)))
+				if err != nil {
+					t.Fatalf("part %d: %v", part.number, err)
+				}
+			}
+
+			parts, err := mediaStore.ListUploadParts(ctx, "dir/key", uploadID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(parts) != 3 {
+				t.Fatalf("parts: got %+v, want 3", parts)
+			}
+			for i, part := range parts {
+				if part.PartNumber != i+1 || part.Size != 3 {
+					t.Errorf("part %d: got %+v", i+1, part)
+				}
+			}
+			sessions, err := mediaStore.ListUploads(ctx, "dir/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != 1 || sessions[0].UploadID != uploadID || sessions[0].Key != "dir/key" {
+				t.Errorf("sessions: got %+v", sessions)
+			}
+
+			info, err := mediaStore.CompleteUpload(ctx, "dir/key", uploadID, media.MediaType_MEDIA_TYPE_UNSPECIFIED)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size != 9 || info.UploadID != uploadID {
+				t.Errorf("upload info: got %+v", info)
+			}
+			if got := readObject(t, svc, "dir/key"); got != "aaabbbccc" {
+				t.Errorf("content: got %q", got)
+			}
+			stat, err := mediaStore.Stat(ctx, "dir/key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stat.ContentType != "text/plain" || stat.Metadata["origin"] != "test" {
+				t.Errorf("attributes: got %q, %v", stat.ContentType, stat.Metadata)
+			}
+
+			if _, err = mediaStore.ListUploadParts(ctx, "dir/key", uploadID); !errors.Is(err, mediastore.ErrUploadNotFound) {
+				t.Errorf("completed session: got %v, want ErrUploadNotFound", err)
+			}
+			if sessions, _ = mediaStore.ListUploads(ctx, ""); len(sessions) != 0 {
+				t.Errorf("sessions after completion: got %+v", sessions)
+			}
+		})
+	}
+}
+
+func TestUploadSessionErrors(t *testing.T) {
+	for backendName, newService := range multipartBackends {
+		t.Run(backendName, func(t *testing.T) {
+			ctx := context.Background()
+			mediaStore := newTestStore(t, mediastore.Config{}, newService(t))
+			uploadID, err := mediaStore.InitiateUpload(ctx, "key", media.MediaType_MEDIA_TYPE_UNSPECIFIED, mediastore.PutObjectOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			testCases := []struct {
+				name     string
+				call     func() error
+				argName  string
+				notFound bool
+			}{
+				{name: "part number zero", argName: "partNumber", call: func() error {
+					_, err := mediaStore.UploadPart(ctx, "key", uploadID, media.MediaType_MEDIA_TYPE_UNSPECIFIED, 0, strings.NewReader("a"), 1)
+					return err
+				}},
+				{name: "part number too high", argName: "partNumber", call: func() error {
+					_, err := mediaStore.UploadPart(ctx, "key", uploadID, media.MediaType_MEDIA_TYPE_UNSPECIFIED, mediastore.UploadPartNumberMax+1, strings.NewReader("a"), 1)
+					return err
+				}},
+				{name: "size mismatch", argName: "size", call: func() error {
+					_, err := mediaStore.UploadPart(ctx, "key", uploadID, media.MediaType_MEDIA_TYPE_UNSPECIFIED, 1, strings.NewReader("abc"), 2)
+					return err
+				}},
+				{name: "no parts", argName: "uploadID", call: func() error {
+					_, err := mediaStore.CompleteUpload(ctx, "key", uploadID, media.MediaType_MEDIA_TYPE_UNSPECIFIED)
+					return err
+				}},
+				{name: "other key", notFound: true, call: func() error {
+					_, err := mediaStore.UploadPart(ctx, "other", uploadID, media.MediaType_MEDIA_TYPE_UNSPECIFIED, 1, strings.NewReader("a"), 1)
+					return err
+				}},
+				{name: "unknown upload", notFound: true, call: func() error {
+					_, err := mediaStore.ListUploadParts(ctx, "key", strings.Repeat("0", 32))
+					return err
+				}},
+				{name: "malformed upload ID", notFound: true, call: func() error {
+					_, err := mediaStore.ListUploadParts(ctx, "key", "../../key")
+					return err
+				}},
+			}
+			for _, tc := range testCases {
+				t.Run(tc.name, func(t *testing.T) {
+					err := tc.call()
+					if tc.notFound {
+						if !errors.Is(err, mediastore.ErrUploadNotFound) {
+							t.Fatalf("got %v, want ErrUploadNotFound", err)
+						}
+						return
+					}
+					var argErr errors.ArgumentError
+					if !errors.As(err, &argErr) || argErr.ArgumentName() != tc.argName {
+						t.Fatalf("got %v, want an argument error of %s", err, tc.argName)
+					}
+				})
+			}
+
+			if err = mediaStore.AbortUpload(ctx, "key", uploadID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = mediaStore.ListUploadParts(ctx, "key", uploadID); !errors.Is(err, mediastore.ErrUploadNotFound) {
+				t.Errorf("aborted session: got %v, want ErrUploadNotFound", err)
+			}
+			if exists, _ := mediaStore.Exists(ctx, "key"); exists {
+				t.Error("aborted upload created the object")
+			}
+		})
+	}
+}
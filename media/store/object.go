@@ -0,0 +1,124 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/media"
+)
+
+// ErrObjectNotFound is returned, usually wrapped, by the services when the
+// requested object does not exist.
+var ErrObjectNotFound = errors.Msg("object not found")
+
+// ObjectInfo describes an object kept in the storage.
+type ObjectInfo struct {
+	// Key is the object key relative to the service base path.
+	Key                string
+	Size               int64
+	ContentType        string
+	CacheControl       string
+	ContentDisposition string
+	ETag               string
+	LastModified       time.Time
+
+	// Metadata contains the custom metadata of the object. The keys are
+	// in lower case. This is not populated by ListObjects.
+	Metadata map[string]string
+}
+
+// ErrRangeNotSatisfiable is returned, usually wrapped, by GetObjectRange
+// when the offset is not within the object.
+var ErrRangeNotSatisfiable = errors.Msg("range not satisfiable")
+
+// ResolveRange checks the range against the size of the object and
+// returns the number of bytes in the range. A negative length means up to
+// the end of the object. The offset must be within the object, except for
+// an empty object where it could only be 0.
+func ResolveRange(size, offset, length int64) (int64, error) {
+	if offset < 0 {
+		return 0, errors.ArgMsg("offset", "negative")
+	}
+	if offset > size || (offset == size && size > 0) {
+		return 0, ErrRangeNotSatisfiable
+	}
+	if remaining := size - offset; length < 0 || length > remaining {
+		length = remaining
+	}
+	return length, nil
+}
+
+// LimitReadCloser is like io.LimitReader but keeps the Closer of rc.
+func LimitReadCloser(rc io.ReadCloser, n int64) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, n), rc}
+}
+
+// ObjectReader is a stream of the content of an object along with the
+// information of the object. For a range of the object, the stream only
+// contains the range while Info.Size is the size of the whole object.
+type ObjectReader struct {
+	io.ReadCloser
+	Info ObjectInfo
+}
+
+// PutObjectOptions contains the attributes which are stored along with
+// the content of the object.
+type PutObjectOptions struct {
+	ContentType        string
+	CacheControl       string
+	ContentDisposition string
+
+	// Metadata contains custom key-value pairs. The keys are stored in
+	// lower case.
+	Metadata map[string]string
+}
+
+// NormalizeMetadata returns a copy of the metadata with lower-cased
+// keys. It returns nil if the metadata is empty.
+func NormalizeMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	normalized := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		normalized[strings.ToLower(k)] = v
+	}
+	return normalized
+}
+
+// ObjectList is a page of objects returned by ListObjects.
+type ObjectList struct {
+	Objects []ObjectInfo
+
+	// NextPageToken is used to retrieve the next page. It's empty
+	// when there are no more objects to list.
+	NextPageToken string
+}
+
+// ListObjectsLimitDefault is the page size used when the requested
+// limit is not positive.
+const ListObjectsLimitDefault = 1000
+
+// ContentTypeSniffLength is the size of the head of the content which
+// SniffContentType reads.
+const ContentTypeSniffLength = 3072
+
+// SniffContentType detects the content type from the head of the content
+// and returns a reader which yields the whole content, including the head
+// which has been read.
+func SniffContentType(content io.Reader) (contentType string, fullContent io.Reader, err error) {
+	head := make([]byte, ContentTypeSniffLength)
+	n, err := io.ReadFull(content, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	head = head[:n]
+
+	return media.DetectType(head), io.MultiReader(bytes.NewReader(head), content), nil
+}
@@ -0,0 +1,74 @@
+package store_test
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/timemore/foundation/media"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+func TestUploadAttributes(t *testing.T) {
+	svc := newMemoryService(t)
+	mediaStore := newTestStore(t, mediastore.Config{}, svc)
+	ctx := context.Background()
+
+	testCases := []struct {
+		name        string
+		content     string
+		opts        mediastore.PutObjectOptions
+		contentType string
+		metadata    map[string]string
+	}{
+		{name: "provided", content: "content", opts: mediastore.PutObjectOptions{
+			ContentType:        "application/octet-stream",
+			CacheControl:       "max-age=60",
+			ContentDisposition: `attachment; filename="a.txt"`,
+			Metadata:           map[string]string{"Owner": "acme", "x-Source": "upload"},
+		}, contentType: "application/octet-stream", metadata: map[string]string{"owner": "acme", "x-source": "upload"}},
+		{name: "detected", content: "%PDF-1.7\n", contentType: "application/pdf"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			info, err := mediaStore.UploadContext(ctx, tc.name, strings.NewReader(tc.content),
+				media.MediaType_MEDIA_TYPE_UNSPECIFIED, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := mediastore.ObjectInfo{
+				Key:                info.Key,
+				Size:               int64(len(tc.content)),
+				ContentType:        tc.contentType,
+				CacheControl:       tc.opts.CacheControl,
+				ContentDisposition: tc.opts.ContentDisposition,
+				Metadata:           tc.metadata,
+			}
+			check := func(op string, got mediastore.ObjectInfo) {
+				t.Helper()
+				got.ETag, got.LastModified = "", got.LastModified.UTC()
+				want.LastModified = got.LastModified
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: got %+v, want %+v", op, got, want)
+				}
+			}
+
+			stat, err := mediaStore.Stat(ctx, info.Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check("stat", *stat)
+			obj, err := mediaStore.DownloadContext(ctx, info.Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer obj.Close()
+			check("download", obj.Info)
+			if b, _ := io.ReadAll(obj); string(b) != tc.content {
+				t.Errorf("content: got %q", b)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package store
+
+// Operation identifies a call of ServiceV2. It's used by the modules and
+// the decorators which need to tell the calls apart, e.g., to inject
+// failures or to label measurements.
+type Operation string
+
+const (
+	OperationPutObject        Operation = "PutObject"
+	OperationGetObject        Operation = "GetObject"
+	OperationGetObjectRange   Operation = "GetObjectRange"
+	OperationGetPublicObject  Operation = "GetPublicObject"
+	OperationListObjects      Operation = "ListObjects"
+	OperationDeleteObject     Operation = "DeleteObject"
+	OperationStatObject       Operation = "StatObject"
+	OperationPresignPutObject Operation = "PresignPutObject"
+	OperationCopyObject       Operation = "CopyObject"
+	OperationMoveObject       Operation = "MoveObject"
+	OperationInitiateUpload   Operation = "InitiateUpload"
+	OperationUploadPart       Operation = "UploadPart"
+	OperationListUploadParts  Operation = "ListUploadParts"
+	OperationCompleteUpload   Operation = "CompleteUpload"
+	OperationAbortUpload      Operation = "AbortUpload"
+	OperationListUploads      Operation = "ListUploads"
+	OperationHealthCheck      Operation = "HealthCheck"
+)
+
+func (op Operation) String() string { return string(op) }
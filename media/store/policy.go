@@ -0,0 +1,353 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/media"
+)
+
+// The causes of the UploadPolicyError.
+var (
+	ErrContentTypeNotAllowed   = errors.Msg("content type not allowed")
+	ErrContentTypeMismatch     = errors.Msg("content type mismatch")
+	ErrContentTooLarge         = errors.Msg("content too large")
+	ErrImageDimensionsExceeded = errors.Msg("image dimensions exceeded")
+	ErrImageInvalid            = errors.Msg("image invalid")
+)
+
+// UploadPolicyError is returned by Store.Upload when the content violates
+// the UploadPolicy of its media type. It's an argument error whose cause is
+// one of ErrContentTypeNotAllowed, ErrContentTypeMismatch,
+// ErrContentTooLarge, ErrImageDimensionsExceeded or ErrImageInvalid.
+type UploadPolicyError struct {
+	ArgName string
+	Err     error
+	Detail  string
+}
+
+var (
+	_ errors.ArgumentError = &UploadPolicyError{}
+	_ errors.CallError     = &UploadPolicyError{}
+	_ errors.Unwrappable   = &UploadPolicyError{}
+)
+
+func (e *UploadPolicyError) ArgumentName() string { return e.ArgName }
+
+func (*UploadPolicyError) CallError() {}
+
+func (e *UploadPolicyError) Unwrap() error { return e.Err }
+
+func (e *UploadPolicyError) Error() string {
+	msg := "arg " + e.ArgName + ": " + e.Err.Error()
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+// RESTStatusCode returns the HTTP status code of the violation, e.g.,
+// 413 for ErrContentTooLarge.
+func (e *UploadPolicyError) RESTStatusCode() int {
+	switch e.Err {
+	case ErrContentTypeNotAllowed, ErrContentTypeMismatch:
+		return http.StatusUnsupportedMediaType
+	case ErrContentTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ErrImageDimensionsExceeded, ErrImageInvalid:
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadRequest
+}
+
+// UploadPolicy restricts the content which could be uploaded with a media
+// type. The content type is always checked against the content types
+// allowed by the media.MediaTypeInfo, the other limits are disabled if
+// they are zero.
+type UploadPolicy struct {
+	// AllowedContentTypes replaces the content types allowed by the
+	// media.MediaTypeInfo if it's not empty.
+	AllowedContentTypes []string `env:"-" yaml:"allowed_content_types" json:"allowed_content_types"`
+
+	// SniffLength is the size of the head of the content from which the
+	// content type is detected. ContentTypeSniffLength is used if it's
+	// not positive. Some formats, e.g., the Office documents, might need
+	// a larger head to be told apart from a plain archive.
+	SniffLength int32 `env:"SNIFF_LENGTH" yaml:"sniff_length" json:"sniff_length"`
+
+	MaxSizeBytes int64 `env:"MAX_SIZE_BYTES" yaml:"max_size_bytes" json:"max_size_bytes"`
+
+	// The dimension limits only apply to the images. The images whose
+	// dimensions could not be decoded are rejected if any of them is set.
+	MaxImageWidth  int32 `env:"MAX_IMAGE_WIDTH" yaml:"max_image_width" json:"max_image_width"`
+	MaxImageHeight int32 `env:"MAX_IMAGE_HEIGHT" yaml:"max_image_height" json:"max_image_height"`
+	MaxImagePixels int64 `env:"MAX_IMAGE_PIXELS" yaml:"max_image_pixels" json:"max_image_pixels"`
+}
+
+// UploadPolicyConfig holds the UploadPolicy of each media type.
+type UploadPolicyConfig struct {
+	Image UploadPolicy `env:"IMAGE" yaml:"image" json:"image"`
+	File  UploadPolicy `env:"FILE" yaml:"file" json:"file"`
+}
+
+// Policy returns the policy of the media type.
+func (cfg UploadPolicyConfig) Policy(mediaType media.MediaType) UploadPolicy {
+	switch mediaType {
+	case media.MediaType_IMAGE:
+		return cfg.Image
+	case media.MediaType_FILE:
+		return cfg.File
+	}
+	return UploadPolicy{}
+}
+
+func (policy UploadPolicy) isContentTypeAllowed(typeInfo media.MediaTypeInfo, contentType string) bool {
+	if len(policy.AllowedContentTypes) > 0 {
+		return ContentTypeInList(contentType, policy.AllowedContentTypes)
+	}
+	return typeInfo.IsContentTypeAllowed(contentType)
+}
+
+func (policy UploadPolicy) checksDimensions() bool {
+	return policy.MaxImageWidth > 0 || policy.MaxImageHeight > 0 || policy.MaxImagePixels > 0
+}
+
+// baseContentType returns the content type without its parameters, e.g.,
+// the charset.
+func baseContentType(contentType string) string {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// contentTypeAliases maps the content types which are accepted for
+// another one, e.g., in the allowed content types, to the detected one.
+var contentTypeAliases = map[string]string{
+	"image/jpg": "image/jpeg",
+}
+
+// sameContentType returns true if the base content types are the same, or
+// aliases of each other.
+func sameContentType(a, b string) bool {
+	if alias, ok := contentTypeAliases[a]; ok {
+		a = alias
+	}
+	if alias, ok := contentTypeAliases[b]; ok {
+		b = alias
+	}
+	return a == b
+}
+
+// checkDeclaredContentType checks the content type declared for an upload
+// whose content is not available yet, e.g., a presigned upload. The
+// content type is required as it could not be detected.
+func (policy UploadPolicy) checkDeclaredContentType(
+	typeInfo media.MediaTypeInfo,
+	mediaType media.MediaType,
+	argName string,
+	contentType string,
+) error {
+	if contentType == "" {
+		return &UploadPolicyError{
+			ArgName: argName,
+			Err:     ErrContentTypeNotAllowed,
+			Detail:  "unspecified for " + mediaType.String(),
+		}
+	}
+	if declaredType := baseContentType(contentType); !policy.isContentTypeAllowed(typeInfo, declaredType) {
+		return &UploadPolicyError{
+			ArgName: argName,
+			Err:     ErrContentTypeNotAllowed,
+			Detail:  declaredType + " for " + mediaType.String(),
+		}
+	}
+	return nil
+}
+
+// enforceUploadPolicy checks the content type, and the dimensions of an
+// image, from the head of the content. The returned reader yields the whole
+// content and fails with an UploadPolicyError once the content exceeds the
+// maximum size, which the returned limiter tells afterwards. The content
+// type detected from the content is set into opts if it's empty, otherwise
+// it must be the same as the declared one.
+func (mediaStore *Store) enforceUploadPolicy(
+	contentSource io.Reader,
+	mediaType media.MediaType,
+	opts *PutObjectOptions,
+) (io.Reader, *sizeLimitReader, error) {
+	typeInfo := media.GetMediaTypeInfo(mediaType)
+	if typeInfo == nil {
+		return contentSource, nil, nil
+	}
+	policy := mediaStore.config.UploadPolicy.Policy(mediaType)
+
+	var limiter *sizeLimitReader
+	if policy.MaxSizeBytes > 0 {
+		limiter = &sizeLimitReader{r: contentSource, limit: policy.MaxSizeBytes, remaining: policy.MaxSizeBytes}
+		contentSource = limiter
+	}
+
+	sniffLength := int(policy.SniffLength)
+	if sniffLength <= 0 {
+		sniffLength = ContentTypeSniffLength
+	}
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(contentSource, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		if limiter != nil && limiter.exceeded {
+			return nil, nil, limiter.policyError()
+		}
+		return nil, nil, errors.Wrap("detecting content type", err)
+	}
+	head = head[:n]
+	contentSource = io.MultiReader(bytes.NewReader(head), contentSource)
+
+	detectedType := baseContentType(media.DetectType(head))
+	if !policy.isContentTypeAllowed(typeInfo, detectedType) {
+		return nil, nil, &UploadPolicyError{
+			ArgName: "contentSource",
+			Err:     ErrContentTypeNotAllowed,
+			Detail:  detectedType + " for " + mediaType.String(),
+		}
+	}
+	if opts.ContentType == "" {
+		opts.ContentType = detectedType
+	} else {
+		declaredType := baseContentType(opts.ContentType)
+		if !policy.isContentTypeAllowed(typeInfo, declaredType) {
+			return nil, nil, &UploadPolicyError{
+				ArgName: "opts.ContentType",
+				Err:     ErrContentTypeNotAllowed,
+				Detail:  declaredType + " for " + mediaType.String(),
+			}
+		}
+		if !sameContentType(declaredType, detectedType) {
+			return nil, nil, &UploadPolicyError{
+				ArgName: "opts.ContentType",
+				Err:     ErrContentTypeMismatch,
+				Detail:  declaredType + " declared for " + detectedType + " content",
+			}
+		}
+	}
+
+	if policy.checksDimensions() && strings.HasPrefix(detectedType, "image/") {
+		// DecodeConfig only reads the header of the image, which is
+		// replayed along with the rest of the content.
+		header := new(bytes.Buffer)
+		imgConfig, _, err := image.DecodeConfig(io.TeeReader(contentSource, header))
+		contentSource = io.MultiReader(header, contentSource)
+		if err != nil {
+			if limiter != nil && limiter.exceeded {
+				return nil, nil, limiter.policyError()
+			}
+			return nil, nil, &UploadPolicyError{
+				ArgName: "contentSource",
+				Err:     ErrImageInvalid,
+				Detail:  err.Error(),
+			}
+		}
+		if err = policy.checkDimensions(imgConfig.Width, imgConfig.Height); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return contentSource, limiter, nil
+}
+
+// enforceObjectPolicy checks the stored object against the policy of the
+// media type, like enforceUploadPolicy with the content type of the object
+// as the declared one. Only the head of the content is read.
+func (mediaStore *Store) enforceObjectPolicy(ctx context.Context, objectKey string, mediaType media.MediaType) error {
+	object, err := mediaStore.serviceClient.GetObject(ctx, objectKey)
+	if err != nil {
+		return errors.Wrap("getting object", err)
+	}
+	defer object.Close()
+	policy := mediaStore.config.UploadPolicy.Policy(mediaType)
+	if policy.MaxSizeBytes > 0 && object.Info.Size > policy.MaxSizeBytes {
+		limiter := sizeLimitReader{limit: policy.MaxSizeBytes}
+		return limiter.policyError()
+	}
+	_, _, err = mediaStore.enforceUploadPolicy(object, mediaType, &PutObjectOptions{
+		ContentType: object.Info.ContentType,
+	})
+	return err
+}
+
+func (policy UploadPolicy) checkDimensions(width, height int) error {
+	dimensions := strconv.Itoa(width) + "x" + strconv.Itoa(height)
+	if (policy.MaxImageWidth > 0 && width > int(policy.MaxImageWidth)) ||
+		(policy.MaxImageHeight > 0 && height > int(policy.MaxImageHeight)) {
+		return &UploadPolicyError{
+			ArgName: "contentSource",
+			Err:     ErrImageDimensionsExceeded,
+			Detail: dimensions + " exceeds " +
+				strconv.Itoa(int(policy.MaxImageWidth)) + "x" + strconv.Itoa(int(policy.MaxImageHeight)),
+		}
+	}
+	if policy.MaxImagePixels > 0 && int64(width)*int64(height) > policy.MaxImagePixels {
+		return &UploadPolicyError{
+			ArgName: "contentSource",
+			Err:     ErrImageDimensionsExceeded,
+			Detail:  dimensions + " exceeds " + strconv.FormatInt(policy.MaxImagePixels, 10) + " pixels",
+		}
+	}
+	return nil
+}
+
+// sizeLimitReader fails with an UploadPolicyError once more than limit
+// bytes are read.
+type sizeLimitReader struct {
+	r         io.Reader
+	limit     int64
+	remaining int64
+	exceeded  bool
+}
+
+func (lr *sizeLimitReader) Read(p []byte) (int, error) {
+	if lr.exceeded {
+		return 0, lr.policyError()
+	}
+	// Read one more byte than allowed to tell apart the content which
+	// is exactly at the limit.
+	if int64(len(p)) > lr.remaining+1 {
+		p = p[:lr.remaining+1]
+	}
+	n, err := lr.r.Read(p)
+	if int64(n) > lr.remaining {
+		lr.exceeded = true
+		return int(lr.remaining), lr.policyError()
+	}
+	lr.remaining -= int64(n)
+	return n, err
+}
+
+func (lr *sizeLimitReader) policyError() error {
+	return &UploadPolicyError{
+		ArgName: "contentSource",
+		Err:     ErrContentTooLarge,
+		Detail:  "exceeds " + strconv.FormatInt(lr.limit, 10) + " bytes",
+	}
+}
+
+// seekableSizeLimitReader is a sizeLimitReader of an io.ReadSeeker, which
+// starts at the offset start. The bytes left to read follow the seeks.
+type seekableSizeLimitReader struct {
+	*sizeLimitReader
+	start int64
+}
+
+func (lr seekableSizeLimitReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := lr.r.(io.Seeker).Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	lr.remaining = lr.limit - (pos - lr.start)
+	lr.exceeded = lr.remaining < 0
+	return pos, nil
+}
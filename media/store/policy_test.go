@@ -0,0 +1,247 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/media"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+func pngContent(t *testing.T, width, height int) string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestUploadPolicy(t *testing.T) {
+	policyConfig := mediastore.UploadPolicyConfig{
+		Image: mediastore.UploadPolicy{MaxImageWidth: 100, MaxImageHeight: 50, MaxImagePixels: 4000},
+		File:  mediastore.UploadPolicy{MaxSizeBytes: 1000},
+	}
+	testCases := []struct {
+		name        string
+		policy      *mediastore.UploadPolicyConfig
+		mediaType   media.MediaType
+		content     string
+		contentType string
+		argName     string
+		wantErr     error
+		status      int
+	}{
+		{name: "image", mediaType: media.MediaType_IMAGE, content: pngContent(t, 100, 40)},
+		{name: "image type not allowed", mediaType: media.MediaType_IMAGE, content: "plain text",
+			argName: "contentSource", wantErr: mediastore.ErrContentTypeNotAllowed, status: http.StatusUnsupportedMediaType},
+		{name: "allowed types replaced", mediaType: media.MediaType_IMAGE, content: pngContent(t, 10, 10),
+			policy:  &mediastore.UploadPolicyConfig{Image: mediastore.UploadPolicy{AllowedContentTypes: []string{"image/gif"}}},
+			argName: "contentSource", wantErr: mediastore.ErrContentTypeNotAllowed, status: http.StatusUnsupportedMediaType},
+		{name: "image too wide", mediaType: media.MediaType_IMAGE, content: pngContent(t, 101, 10),
+			argName: "contentSource", wantErr: mediastore.ErrImageDimensionsExceeded, status: http.StatusUnprocessableEntity},
+		{name: "image too high", mediaType: media.MediaType_IMAGE, content: pngContent(t, 10, 51),
+			argName: "contentSource", wantErr: mediastore.ErrImageDimensionsExceeded, status: http.StatusUnprocessableEntity},
+		{name: "too many pixels", mediaType: media.MediaType_IMAGE, content: pngContent(t, 100, 41),
+			argName: "contentSource", wantErr: mediastore.ErrImageDimensionsExceeded, status: http.StatusUnprocessableEntity},
+		{name: "image invalid", mediaType: media.MediaType_IMAGE, content: "\x89PNG\r\n\x1a\n" + strings.Repeat("x", 100),
+			argName: "contentSource", wantErr: mediastore.ErrImageInvalid, status: http.StatusUnprocessableEntity},
+		{name: "file at the maximum size", mediaType: media.MediaType_FILE, content: strings.Repeat("a", 1000)},
+		{name: "file too large", mediaType: media.MediaType_FILE, content: strings.Repeat("a", 1001),
+			argName: "contentSource", wantErr: mediastore.ErrContentTooLarge, status: http.StatusRequestEntityTooLarge},
+		{name: "file too large in its head", mediaType: media.MediaType_FILE, content: strings.Repeat("a", 1001),
+			policy:  &mediastore.UploadPolicyConfig{File: mediastore.UploadPolicy{MaxSizeBytes: 100}},
+			argName: "contentSource", wantErr: mediastore.ErrContentTooLarge, status: http.StatusRequestEntityTooLarge},
+		{name: "declared type", mediaType: media.MediaType_FILE, content: "plain text",
+			contentType: "text/plain; charset=utf-8"},
+		{name: "declared type not allowed", mediaType: media.MediaType_FILE, content: "plain text",
+			contentType: "text/html", argName: "opts.ContentType",
+			wantErr: mediastore.ErrContentTypeNotAllowed, status: http.StatusUnsupportedMediaType},
+		{name: "declared type mismatch", mediaType: media.MediaType_IMAGE, content: pngContent(t, 10, 10),
+			contentType: "image/gif", argName: "opts.ContentType",
+			wantErr: mediastore.ErrContentTypeMismatch, status: http.StatusUnsupportedMediaType},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := mediastore.Config{UploadPolicy: policyConfig}
+			if tc.policy != nil {
+				config.UploadPolicy = *tc.policy
+			}
+			svc := newMemoryService(t)
+			mediaStore := newTestStore(t, config, svc)
+
+			_, err := mediaStore.UploadContext(context.Background(), "key", strings.NewReader(tc.content), tc.mediaType,
+				mediastore.PutObjectOptions{ContentType: tc.contentType})
+			if tc.wantErr == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := readObject(t, svc, "key"); got != tc.content {
+					t.Errorf("got %d bytes, want %d", len(got), len(tc.content))
+				}
+				return
+			}
+			var policyErr *mediastore.UploadPolicyError
+			if !errors.As(err, &policyErr) || !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got %v, want %v", err, tc.wantErr)
+			}
+			if policyErr.ArgumentName() != tc.argName {
+				t.Errorf("argument: got %q, want %q", policyErr.ArgumentName(), tc.argName)
+			}
+			if policyErr.RESTStatusCode() != tc.status {
+				t.Errorf("status: got %d, want %d", policyErr.RESTStatusCode(), tc.status)
+			}
+			if exists, _ := mediaStore.Exists(context.Background(), "key"); exists {
+				t.Error("rejected content stored")
+			}
+		})
+	}
+}
+
+// presignRecorder records the options of the presigned uploads.
+type presignRecorder struct {
+	mediastore.ServiceV2
+	opts mediastore.PresignPutOptions
+}
+
+func (s *presignRecorder) PresignPutObject(
+	ctx context.Context,
+	objectKey string,
+	opts mediastore.PresignPutOptions,
+) (*mediastore.PresignedRequest, error) {
+	s.opts = opts
+	return mediastore.PresignPutObject(ctx, s.ServiceV2, objectKey, opts)
+}
+
+func TestPresignPutPolicy(t *testing.T) {
+	testCases := []struct {
+		name        string
+		mediaType   media.MediaType
+		contentType string
+		maxSize     int64
+		wantMaxSize int64
+		wantErr     error
+	}{
+		{name: "policy maximum size", mediaType: media.MediaType_FILE, contentType: "text/plain", wantMaxSize: 1000},
+		{name: "larger than the policy", mediaType: media.MediaType_FILE, contentType: "text/plain",
+			maxSize: 2000, wantMaxSize: 1000},
+		{name: "smaller than the policy", mediaType: media.MediaType_FILE, contentType: "text/plain",
+			maxSize: 10, wantMaxSize: 10},
+		{name: "content type unspecified", mediaType: media.MediaType_FILE,
+			wantErr: mediastore.ErrContentTypeNotAllowed},
+		{name: "content type not allowed", mediaType: media.MediaType_IMAGE, contentType: "text/plain",
+			wantErr: mediastore.ErrContentTypeNotAllowed},
+		{name: "no policy", mediaType: media.MediaType_MEDIA_TYPE_UNSPECIFIED, maxSize: 2000, wantMaxSize: 2000},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := &presignRecorder{ServiceV2: newMemoryService(t)}
+			mediaStore := newTestStore(t, mediastore.Config{UploadPolicy: mediastore.UploadPolicyConfig{
+				File: mediastore.UploadPolicy{MaxSizeBytes: 1000},
+			}}, svc)
+
+			_, err := mediaStore.PresignPut(context.Background(), "key", tc.mediaType, tc.contentType, tc.maxSize, 0)
+			if tc.wantErr != nil {
+				var policyErr *mediastore.UploadPolicyError
+				if !errors.As(err, &policyErr) || !errors.Is(err, tc.wantErr) || policyErr.ArgumentName() != "contentType" {
+					t.Fatalf("got %v, want %v", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if svc.opts.MaxSize != tc.wantMaxSize || svc.opts.ContentType != tc.contentType {
+				t.Errorf("got %+v, want the maximum size %d", svc.opts, tc.wantMaxSize)
+			}
+		})
+	}
+}
+
+func TestUploadSessionPolicy(t *testing.T) {
+	type part struct {
+		content string
+		size    int64
+	}
+	testCases := []struct {
+		name        string
+		mediaType   media.MediaType
+		contentType string
+		parts       []part
+		// step is the call which fails: initiate, part or complete.
+		step    string
+		wantErr error
+	}{
+		{name: "allowed", mediaType: media.MediaType_FILE, contentType: "text/plain",
+			parts: []part{{"plain text", 10}}},
+		{name: "content type unspecified", mediaType: media.MediaType_FILE,
+			step: "initiate", wantErr: mediastore.ErrContentTypeNotAllowed},
+		{name: "content type not allowed", mediaType: media.MediaType_FILE, contentType: "text/html",
+			step: "initiate", wantErr: mediastore.ErrContentTypeNotAllowed},
+		{name: "part larger than declared", mediaType: media.MediaType_FILE, contentType: "text/plain",
+			parts: []part{{strings.Repeat("a", 1001), 1001}}, step: "part", wantErr: mediastore.ErrContentTooLarge},
+		{name: "part of unknown size", mediaType: media.MediaType_FILE, contentType: "text/plain",
+			parts: []part{{strings.Repeat("a", 1001), -1}}, step: "part", wantErr: mediastore.ErrContentTooLarge},
+		{name: "parts too large", mediaType: media.MediaType_FILE, contentType: "text/plain",
+			parts: []part{{strings.Repeat("a", 600), 600}, {strings.Repeat("a", 600), 600}},
+			step:  "complete", wantErr: mediastore.ErrContentTooLarge},
+		{name: "content type mismatch", mediaType: media.MediaType_IMAGE, contentType: "image/gif",
+			parts: []part{{pngContent(t, 10, 10), -1}}, step: "complete", wantErr: mediastore.ErrContentTypeMismatch},
+		{name: "content not allowed", mediaType: media.MediaType_IMAGE, contentType: "image/png",
+			parts: []part{{"plain text", 10}}, step: "complete", wantErr: mediastore.ErrContentTypeNotAllowed},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := newMemoryService(t)
+			mediaStore := newTestStore(t, mediastore.Config{UploadPolicy: mediastore.UploadPolicyConfig{
+				File: mediastore.UploadPolicy{MaxSizeBytes: 1000},
+			}}, svc)
+			ctx := context.Background()
+			check := func(step string, err error) bool {
+				t.Helper()
+				if tc.step != step {
+					if err != nil {
+						t.Fatalf("%s: %v", step, err)
+					}
+					return false
+				}
+				var policyErr *mediastore.UploadPolicyError
+				if !errors.As(err, &policyErr) || !errors.Is(err, tc.wantErr) {
+					t.Fatalf("%s: got %v, want %v", step, err, tc.wantErr)
+				}
+				return true
+			}
+
+			uploadID, err := mediaStore.InitiateUpload(ctx, "key", tc.mediaType,
+				mediastore.PutObjectOptions{ContentType: tc.contentType})
+			if check("initiate", err) {
+				return
+			}
+			for i, p := range tc.parts {
+				_, err = mediaStore.UploadPart(ctx, "key", uploadID, tc.mediaType, i+1, strings.NewReader(p.content), p.size)
+				if check("part", err) {
+					return
+				}
+			}
+			_, err = mediaStore.CompleteUpload(ctx, "key", uploadID, tc.mediaType)
+			if check("complete", err) {
+				if exists, _ := mediaStore.Exists(ctx, "key"); exists {
+					t.Error("rejected content stored")
+				}
+				if sessions, _ := mediaStore.ListUploads(ctx, ""); len(sessions) != 0 {
+					t.Errorf("sessions: got %+v", sessions)
+				}
+				return
+			}
+			if got := readObject(t, svc, "key"); got != tc.parts[0].content {
+				t.Errorf("got %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package store
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/timemore/foundation/errors"
+)
+
+// NewPrefixedService wraps the service so that the keys of its callers are
+// relative to prefix, like the BasePath of a service. The keys which would
+// resolve outside of the prefix, e.g., with "..", are rejected so that the
+// callers could never reach the other objects of the backend.
+func NewPrefixedService(svc ServiceV2, prefix string) (ServiceV2, error) {
+	if svc == nil {
+		return nil, errors.ArgMsg("svc", "missing")
+	}
+	basePath := BasePath(prefix)
+	if basePath.isRoot() {
+		return nil, errors.ArgMsg("prefix", "empty")
+	}
+	return &prefixedService{
+		ServiceV2: svc,
+		basePath:  basePath,
+		root:      basePath.join("") + "/",
+	}, nil
+}
+
+type prefixedService struct {
+	ServiceV2
+
+	basePath BasePath
+	root     string
+}
+
+var (
+	_ ServiceV2         = &prefixedService{}
+	_ Copier            = &prefixedService{}
+	_ Presigner         = &prefixedService{}
+	_ MultipartUploader = &prefixedService{}
+	_ HealthChecker     = &prefixedService{}
+)
+
+func (s *prefixedService) objectKey(argName, key string) (string, error) {
+	objectKey, err := s.basePath.ObjectKey(key)
+	if err != nil || !strings.HasPrefix(objectKey, s.root) {
+		return "", errors.ArgMsg(argName, "outside of the prefix")
+	}
+	return objectKey, nil
+}
+
+func (s *prefixedService) prefixKey(prefix string) (string, error) {
+	prefixKey, err := s.basePath.PrefixKey(prefix)
+	if err != nil || !strings.HasPrefix(prefixKey, s.root) {
+		return "", errors.ArgMsg("prefix", "outside of the prefix")
+	}
+	return prefixKey, nil
+}
+
+func (s *prefixedService) PutObject(
+	ctx context.Context,
+	objectKey string,
+	content io.Reader,
+	opts PutObjectOptions,
+) (*UploadInfo, error) {
+	key, err := s.objectKey("objectKey", objectKey)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.ServiceV2.PutObject(ctx, key, content, opts)
+	if err != nil {
+		return nil, err
+	}
+	info.Key = s.basePath.RelativeKey(info.Key)
+	return info, nil
+}
+
+func (s *prefixedService) GetObject(ctx context.Context, objectKey string) (*ObjectReader, error) {
+	key, err := s.objectKey("objectKey", objectKey)
+	if err != nil {
+		return nil, err
+	}
+	object, err := s.ServiceV2.GetObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	object.Info.Key = s.basePath.RelativeKey(object.Info.Key)
+	return object, nil
+}
+
+func (s *prefixedService) GetObjectRange(
+	ctx context.Context,
+	objectKey string,
+	offset, length int64,
+) (*ObjectReader, error) {
+	key, err := s.objectKey("objectKey", objectKey)
+	if err != nil {
+		return nil, err
+	}
+	object, err := s.ServiceV2.GetObjectRange(ctx, key, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	object.Info.Key = s.basePath.RelativeKey(object.Info.Key)
+	return object, nil
+}
+
+func (s *prefixedService) GetPublicObject(
+	ctx context.Context,
+	objectKey string,
+	opts PublicURLOptions,
+) (string, error) {
+	key, err := s.objectKey("objectKey", objectKey)
+	if err != nil {
+		return "", err
+	}
+	return s.ServiceV2.GetPublicObject(ctx, key, opts)
+}
+
+// ListObjects passes the page token through, the services either use an
+// opaque token or the key of the last object, which is already prefixed.
+func (s *prefixedService) ListObjects(
+	ctx context.Context,
+	prefix string,
+	pageToken string,
+	limit int,
+) (*ObjectList, error) {
+	prefixKey, err := s.prefixKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+	list, err := s.ServiceV2.ListObjects(ctx, prefixKey, pageToken, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list.Objects {
+		list.Objects[i].Key = s.basePath.RelativeKey(list.Objects[i].Key)
+	}
+	return list, nil
+}
+
+func (s *prefixedService) DeleteObject(ctx context.Context, objectKey string) error {
+	key, err := s.objectKey("objectKey", objectKey)
+	if err != nil {
+		return err
+	}
+	return s.ServiceV2.DeleteObject(ctx, key)
+}
+
+func (s *prefixedService) StatObject(ctx context.Context, objectKey string) (*ObjectInfo, error) {
+	key, err := s.objectKey("objectKey", objectKey)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.ServiceV2.StatObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	info.Key = s.basePath.RelativeKey(info.Key)
+	return info, nil
+}
+
+func (s *prefixedService) PresignPutObject(
+	ctx context.Context,
+	objectKey string,
+	opts PresignPutOptions,
+) (*PresignedRequest, error) {
+	key, err := s.objectKey("objectKey", objectKey)
+	if err != nil {
+		return nil, err
+	}
+	return PresignPutObject(ctx, s.ServiceV2, key, opts)
+}
+
+func (s *prefixedService) CopyObject(ctx context.Context, srcKey, dstKey string) error {
+	src, err := s.objectKey("srcKey", srcKey)
+	if err != nil {
+		return err
+	}
+	dst, err := s.objectKey("dstKey", dstKey)
+	if err != nil {
+		return err
+	}
+	return CopyObject(ctx, s.ServiceV2, src, dst)
+}
+
+func (s *prefixedService) MoveObject(ctx context.Context, srcKey, dstKey string) error {
+	src, err := s.objectKey("srcKey", srcKey)
+	if err != nil {
+		return err
+	}
+	dst, err := s.objectKey("dstKey", dstKey)
+	if err != nil {
+		return err
+	}
+	return MoveObject(ctx, s.ServiceV2, src, dst)
+}
+
+func (s *prefixedService) InitiateUpload(ctx context.Context, objectKey string, opts PutObjectOptions) (string, error) {
+	key, err := s.objectKey("objectKey", objectKey)
+	if err != nil {
+		return "", err
+	}
+	uploader, err := GetMultipartUploader(s.ServiceV2)
+	if err != nil {
+		return "", err
+	}
+	return uploader.InitiateUpload(ctx, key, opts)
+}
+
+func (s *prefixedService) UploadPart(
+	ctx context.Context,
+	objectKey, uploadID string,
+	partNumber int,
+	content io.Reader,
+	size int64,
+) (*UploadPart, error) {
+	key, err := s.objectKey("objectKey", objectKey)
+	if err != nil {
+		return nil, err
+	}
+	uploader, err := GetMultipartUploader(s.ServiceV2)
+	if err != nil {
+		return nil, err
+	}
+	return uploader.UploadPart(ctx, key, uploadID, partNumber, content, size)
+}
+
+func (s *prefixedService) ListUploadParts(ctx context.Context, objectKey, uploadID string) ([]UploadPart, error) {
+	key, err := s.objectKey("objectKey", objectKey)
+	if err != nil {
+		return nil, err
+	}
+	uploader, err := GetMultipartUploader(s.ServiceV2)
+	if err != nil {
+		return nil, err
+	}
+	return uploader.ListUploadParts(ctx, key, uploadID)
+}
+
+func (s *prefixedService) CompleteUpload(ctx context.Context, objectKey, uploadID string) (*UploadInfo, error) {
+	key, err := s.objectKey("objectKey", objectKey)
+	if err != nil {
+		return nil, err
+	}
+	uploader, err := GetMultipartUploader(s.ServiceV2)
+	if err != nil {
+		return nil, err
+	}
+	info, err := uploader.CompleteUpload(ctx, key, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	info.Key = s.basePath.RelativeKey(info.Key)
+	return info, nil
+}
+
+func (s *prefixedService) AbortUpload(ctx context.Context, objectKey, uploadID string) error {
+	key, err := s.objectKey("objectKey", objectKey)
+	if err != nil {
+		return err
+	}
+	uploader, err := GetMultipartUploader(s.ServiceV2)
+	if err != nil {
+		return err
+	}
+	return uploader.AbortUpload(ctx, key, uploadID)
+}
+
+func (s *prefixedService) ListUploads(ctx context.Context, prefix string) ([]UploadSession, error) {
+	prefixKey, err := s.prefixKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+	uploader, err := GetMultipartUploader(s.ServiceV2)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := uploader.ListUploads(ctx, prefixKey)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		sessions[i].Key = s.basePath.RelativeKey(sessions[i].Key)
+	}
+	return sessions, nil
+}
+
+func (s *prefixedService) HealthCheck(ctx context.Context) error {
+	return HealthCheck(ctx, s.ServiceV2)
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// PresignExpiryDefault is used when the requested expiry is not
+	// positive.
+	PresignExpiryDefault = 15 * time.Minute
+
+	// PresignExpiryMax is the longest expiry supported by all the
+	// backends.
+	PresignExpiryMax = 7 * 24 * time.Hour
+)
+
+// PresignPutOptions describes the upload which a presigned request
+// allows.
+type PresignPutOptions struct {
+	// ContentType, if not empty, is the only content type accepted.
+	ContentType string
+
+	// MaxSize, if positive, is the maximum size in bytes of the content.
+	MaxSize int64
+
+	// Expiry is how long the request stays valid.
+	Expiry time.Duration
+}
+
+// PresignedRequest describes an HTTP request which the client could make,
+// without any other credentials, to upload an object directly to the
+// storage backend.
+type PresignedRequest struct {
+	// Method is either PUT, where the content is the body of the request,
+	// or POST, where the content is sent as the "file" field of a
+	// multipart/form-data body along with FormData.
+	Method string
+
+	URL string
+
+	// Header contains the headers which must be sent with the request.
+	Header http.Header
+
+	// FormData contains the form fields which must be sent, before the
+	// file, when Method is POST.
+	FormData map[string]string
+
+	Expires time.Time
+}
+
+// ContentDisposition tells how the client should present the content
+// retrieved through a public URL.
+type ContentDisposition string
+
+const (
+	// ContentDispositionUnspecified leaves the disposition to the backend
+	// and the metadata of the object.
+	ContentDispositionUnspecified ContentDisposition = ""
+	ContentDispositionInline      ContentDisposition = "inline"
+	ContentDispositionAttachment  ContentDisposition = "attachment"
+)
+
+// PublicURLOptions controls the URL created by GetPublicObject. Backends
+// which sign their URLs apply the options as response overrides.
+type PublicURLOptions struct {
+	// Expiry is how long the URL stays valid. The default of the backend
+	// is used if it's not positive, see Config.PublicURLExpiry.
+	Expiry time.Duration
+
+	Disposition ContentDisposition
+
+	// Filename is the name suggested to the client. It's only used when
+	// Disposition is specified.
+	Filename string
+
+	// ContentType, if not empty, overrides the content type of the object.
+	ContentType string
+}
+
+// ContentDispositionHeader returns the value for the Content-Disposition
+// header of the response, or an empty string if the disposition is not
+// specified.
+func (opts PublicURLOptions) ContentDispositionHeader() string {
+	if opts.Disposition == ContentDispositionUnspecified {
+		return ""
+	}
+	if opts.Filename == "" {
+		return string(opts.Disposition)
+	}
+	return mime.FormatMediaType(string(opts.Disposition), map[string]string{
+		"filename": opts.Filename,
+	})
+}
+
+// ResponseQuery returns the query parameters, as defined by S3 and
+// supported by S3-compatible storages and GCS, which override the headers
+// of the response to a signed URL.
+func (opts PublicURLOptions) ResponseQuery() url.Values {
+	query := url.Values{}
+	if contentDisposition := opts.ContentDispositionHeader(); contentDisposition != "" {
+		query.Set("response-content-disposition", contentDisposition)
+	}
+	if opts.ContentType != "" {
+		query.Set("response-content-type", opts.ContentType)
+	}
+	return query
+}
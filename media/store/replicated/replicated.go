@@ -0,0 +1,685 @@
+package replicated
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/logger"
+	mediastore "github.com/timemore/foundation/media/store"
+	"gopkg.in/yaml.v3"
+)
+
+var log = logger.NewPkgLogger()
+
+// Config for the replicated storage. The objects are written to all the
+// replicas, and read from the first replica which is able to serve them.
+type Config struct {
+	// Replicas configures the replicas. As a list could not be loaded
+	// from the environment, ReplicaServices and ReplicaModules configure
+	// the replicas there instead.
+	Replicas []ReplicaConfig `env:"-" yaml:"replicas" json:"replicas"`
+
+	// ReplicaServices is the comma-separated list of the modules of the
+	// replicas, e.g., "s3,gcs". Each replica is named after its module
+	// and configured by the config of the module in ReplicaModules, so
+	// the replicas of the same module must be configured with Replicas.
+	// It's ignored if Replicas is not empty.
+	ReplicaServices string `env:"REPLICA_SERVICES" yaml:"replica_services" json:"replica_services"`
+
+	// ReplicaModules contains the configs of the modules of
+	// ReplicaServices, keyed by module, e.g., the bucket of the s3
+	// replica is loaded from REPLICA_MODULES_S3_BUCKET_NAME.
+	ReplicaModules map[string]any `env:"REPLICA_MODULES,map" yaml:"replica_modules,omitempty" json:"replica_modules,omitempty"`
+
+	// WriteQuorum is the number of replicas which must succeed for a
+	// write to succeed. It defaults to the number of replicas.
+	WriteQuorum int32 `env:"WRITE_QUORUM" yaml:"write_quorum" json:"write_quorum"`
+}
+
+// ReplicaConfig configures a replica with the config of a registered
+// module, the same way Config.Modules of media/store does.
+type ReplicaConfig struct {
+	// Name identifies the replica in the logs and in the divergence
+	// reports. It defaults to StoreService.
+	Name         string `yaml:"name" json:"name"`
+	StoreService string `yaml:"store_service" json:"store_service"`
+	Config       any    `yaml:"config" json:"config"`
+}
+
+const ServiceName = "replicated"
+
+func init() {
+	mediastore.RegisterModule(
+		ServiceName,
+		mediastore.Module{
+			NewServiceV2: NewServiceV2,
+			ServiceConfigSkeleton: func() mediastore.ServiceConfig {
+				cfg := ConfigSkeleton()
+				return &cfg
+			},
+		})
+}
+
+// ConfigSkeleton returns a config whose ReplicaModules contains the config
+// skeletons of all the other registered modules.
+func ConfigSkeleton() Config {
+	replicaModules := map[string]any{}
+	for serviceName, module := range mediastore.AvailableModules() {
+		if serviceName != ServiceName && module.ServiceConfigSkeleton != nil {
+			replicaModules[serviceName] = module.ServiceConfigSkeleton()
+		}
+	}
+	return Config{ReplicaModules: replicaModules}
+}
+
+// NewService creates the service behind the legacy Service interface.
+//
+// Deprecated: use NewServiceV2.
+func NewService(config mediastore.ServiceConfig) (mediastore.Service, error) {
+	svc, err := NewServiceV2(config)
+	if err != nil {
+		return nil, err
+	}
+	return mediastore.LegacyService(svc), nil
+}
+
+func NewServiceV2(config mediastore.ServiceConfig) (mediastore.ServiceV2, error) {
+	if config == nil {
+		return nil, errors.ArgMsg("config", "missing")
+	}
+
+	conf, ok := config.(*Config)
+	if !ok {
+		b, _ := yaml.Marshal(config)
+		var cfg Config
+		err := yaml.Unmarshal(b, &cfg)
+		if err != nil {
+			return nil, errors.ArgMsg("config", "type invalid")
+		}
+		conf = &cfg
+	}
+
+	replicaConfs := conf.Replicas
+	if len(replicaConfs) == 0 {
+		replicaConfs = conf.serviceReplicas()
+	}
+	if len(replicaConfs) == 0 {
+		return nil, errors.ArgMsg("config.Replicas", "empty")
+	}
+	writeQuorum := int(conf.WriteQuorum)
+	if writeQuorum == 0 {
+		writeQuorum = len(replicaConfs)
+	}
+	if writeQuorum < 0 || writeQuorum > len(replicaConfs) {
+		return nil, errors.ArgMsg("config.WriteQuorum", "out of range")
+	}
+
+	replicas := make([]Replica, 0, len(replicaConfs))
+	names := map[string]bool{}
+	for _, replicaConf := range replicaConfs {
+		name := replicaConf.Name
+		if name == "" {
+			name = replicaConf.StoreService
+		}
+		if names[name] {
+			return nil, errors.ArgMsg("config.Replicas", "duplicate name "+name)
+		}
+		names[name] = true
+
+		if replicaConf.StoreService == "" {
+			return nil, errors.ArgMsg("config.Replicas", name+" StoreService empty")
+		}
+		svc, err := mediastore.NewServiceClientV2(replicaConf.StoreService, replicaConf.Config)
+		if err != nil {
+			return nil, errors.ArgWrap("config.Replicas", name+" initialization failed", err)
+		}
+		replicas = append(replicas, Replica{Name: name, Service: svc})
+	}
+
+	svc, err := NewServiceWithReplicas(replicas, writeQuorum)
+	if err != nil {
+		return nil, err
+	}
+	return svc, nil
+}
+
+// serviceReplicas returns the configs of the replicas of ReplicaServices.
+func (conf Config) serviceReplicas() []ReplicaConfig {
+	var replicaConfs []ReplicaConfig
+	for _, serviceName := range strings.Split(conf.ReplicaServices, ",") {
+		serviceName = strings.TrimSpace(serviceName)
+		if serviceName == "" {
+			continue
+		}
+		replicaConfs = append(replicaConfs, ReplicaConfig{
+			StoreService: serviceName,
+			Config:       conf.ReplicaModules[serviceName],
+		})
+	}
+	return replicaConfs
+}
+
+// NewServiceWithReplicas creates a service of the provided replicas. The
+// replicas are tried in order for the reads.
+func NewServiceWithReplicas(replicas []Replica, writeQuorum int) (*Service, error) {
+	if len(replicas) == 0 {
+		return nil, errors.ArgMsg("replicas", "empty")
+	}
+	if writeQuorum <= 0 || writeQuorum > len(replicas) {
+		return nil, errors.ArgMsg("writeQuorum", "out of range")
+	}
+	for _, r := range replicas {
+		if r.Service == nil {
+			return nil, errors.ArgMsg("replicas", r.Name+" service missing")
+		}
+	}
+
+	return &Service{
+		replicas:     replicas,
+		writeQuorum:  writeQuorum,
+		onDivergence: logDivergence,
+	}, nil
+}
+
+// Replica is a named child service of the replicated service.
+type Replica struct {
+	Name    string
+	Service mediastore.ServiceV2
+}
+
+// Divergence describes an object which is not the same on all the
+// replicas, e.g., because a write succeeded on the quorum but failed on
+// the other replicas.
+type Divergence struct {
+	Key       string
+	Operation mediastore.Operation
+
+	// Replicas contains the names of the replicas which diverged, along
+	// with the error they returned, if any.
+	Replicas map[string]error
+}
+
+// DivergenceHandler is called by the service when it detects a
+// divergence.
+type DivergenceHandler func(Divergence)
+
+func logDivergence(d Divergence) {
+	replicaNames := make([]string, 0, len(d.Replicas))
+	for name := range d.Replicas {
+		replicaNames = append(replicaNames, name)
+	}
+	log.Warn().Str("key", d.Key).Str("operation", d.Operation.String()).
+		Strs("replicas", replicaNames).Msg("Replicas diverged")
+}
+
+// Service writes to all the replicas and reads from the first one which
+// is able to serve the request.
+type Service struct {
+	replicas    []Replica
+	writeQuorum int
+
+	mu           sync.RWMutex
+	onDivergence DivergenceHandler
+}
+
+// The presigned uploads and the upload sessions are not supported because
+// they would reach only one of the replicas, and the sessions of the
+// replicas could not be tied to a single upload ID.
+var (
+	_ mediastore.ServiceV2           = &Service{}
+	_ mediastore.Copier              = &Service{}
+	_ mediastore.HealthChecker       = &Service{}
+	_ mediastore.LifecycleConfigurer = &Service{}
+)
+
+// SetDivergenceHandler replaces the handler of the divergences, which by
+// default logs them. Pass nil to restore the default.
+func (s *Service) SetDivergenceHandler(handler DivergenceHandler) {
+	if handler == nil {
+		handler = logDivergence
+	}
+	s.mu.Lock()
+	s.onDivergence = handler
+	s.mu.Unlock()
+}
+
+func (s *Service) reportDivergence(d Divergence) {
+	s.mu.RLock()
+	handler := s.onDivergence
+	s.mu.RUnlock()
+	handler(d)
+}
+
+// errReplicaDone is the error seen by the writer of a replica which
+// returned before consuming the whole content.
+var errReplicaDone = errors.Msg("replica done")
+
+// PutObject streams the content to all the replicas concurrently. The
+// slowest replica sets the pace, the content is not buffered. The calls of
+// the replicas are cancelled once the quorum could not be reached.
+//
+// The write is not atomic. If the quorum is not reached, the object is
+// deleted from the replicas which succeeded, see rollback, but the
+// previous content of an overwritten object is not restored.
+func (s *Service) PutObject(
+	ctx context.Context,
+	objectKey string,
+	contentSource io.Reader,
+	opts mediastore.PutObjectOptions,
+) (*mediastore.UploadInfo, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	writers := make([]*io.PipeWriter, len(s.replicas))
+	uploadInfos := make([]*mediastore.UploadInfo, len(s.replicas))
+	errs := make([]error, len(s.replicas))
+	var failures int32
+	var wg sync.WaitGroup
+	for i, r := range s.replicas {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		wg.Add(1)
+		go func(i int, r Replica) {
+			defer wg.Done()
+			uploadInfos[i], errs[i] = r.Service.PutObject(ctx, objectKey, pr, opts)
+			_ = pr.CloseWithError(errReplicaDone)
+			if errs[i] != nil && int(atomic.AddInt32(&failures, 1)) > len(s.replicas)-s.writeQuorum {
+				cancel()
+			}
+		}(i, r)
+	}
+
+	source := &sourceReader{r: contentSource}
+	_, copyErr := io.Copy(&fanOutWriter{writers: writers}, source)
+	for _, pw := range writers {
+		if copyErr != nil {
+			_ = pw.CloseWithError(copyErr)
+		} else {
+			_ = pw.Close()
+		}
+	}
+	wg.Wait()
+
+	// All the replicas failed because of the content, they have not
+	// diverged.
+	if source.err != nil {
+		return nil, source.err
+	}
+	if err := s.checkQuorum(objectKey, mediastore.OperationPutObject, errs); err != nil {
+		s.rollback(objectKey, errs)
+		return nil, err
+	}
+	for i := range uploadInfos {
+		if errs[i] == nil {
+			return uploadInfos[i], nil
+		}
+	}
+	return nil, errors.Msg("no replica succeeded")
+}
+
+// sourceReader keeps the error of the content to tell it apart from the
+// errors of the replicas.
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (sr *sourceReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	if err != nil && err != io.EOF {
+		sr.err = err
+	}
+	return n, err
+}
+
+// fanOutWriter writes to all the writers which have not failed. It fails
+// only when all of them have failed.
+type fanOutWriter struct {
+	writers []*io.PipeWriter
+	failed  []bool
+}
+
+func (w *fanOutWriter) Write(p []byte) (int, error) {
+	if w.failed == nil {
+		w.failed = make([]bool, len(w.writers))
+	}
+	var lastErr error
+	alive := 0
+	for i, pw := range w.writers {
+		if w.failed[i] {
+			continue
+		}
+		if _, err := pw.Write(p); err != nil {
+			w.failed[i] = true
+			lastErr = err
+			continue
+		}
+		alive++
+	}
+	if alive == 0 {
+		if lastErr == nil {
+			lastErr = errReplicaDone
+		}
+		return 0, lastErr
+	}
+	return len(p), nil
+}
+
+// checkQuorum returns an error if fewer replicas than the quorum have
+// succeeded. If some replicas failed, the divergence is reported. The
+// returned error wraps the error of the first replica which failed by
+// itself rather than by being cancelled.
+func (s *Service) checkQuorum(objectKey string, op mediastore.Operation, errs []error) error {
+	failed := map[string]error{}
+	var firstErr error
+	for i, err := range errs {
+		if err != nil {
+			failed[s.replicas[i].Name] = err
+			if firstErr == nil || (errors.Is(firstErr, context.Canceled) && !errors.Is(err, context.Canceled)) {
+				firstErr = errors.Wrap(s.replicas[i].Name, err)
+			}
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	s.reportDivergence(Divergence{Key: objectKey, Operation: op, Replicas: failed})
+
+	succeeded := len(errs) - len(failed)
+	if succeeded < s.writeQuorum {
+		return errors.Wrap("write quorum not reached, "+strconv.Itoa(succeeded)+
+			" of "+strconv.Itoa(len(errs))+" replicas succeeded", firstErr)
+	}
+	return nil
+}
+
+// rollback deletes the object from the replicas whose write succeeded,
+// i.e., whose error is nil, after the quorum of the write was not reached.
+// The context of the write may have been cancelled, the deletions have
+// their own. The failures are logged, the object is left as diverged.
+func (s *Service) rollback(objectKey string, errs []error) {
+	for i, err := range errs {
+		if err != nil {
+			continue
+		}
+		if err = s.replicas[i].Service.DeleteObject(context.Background(), objectKey); err != nil {
+			log.Warn().Err(err).Str("key", objectKey).Str("replica", s.replicas[i].Name).
+				Msg("Unable to roll back the write")
+		}
+	}
+}
+
+// writeAll calls fn for all the replicas concurrently, and checks the
+// quorum of the results. If the quorum is not reached and rollback is
+// true, the object is deleted from the replicas which succeeded.
+func (s *Service) writeAll(
+	objectKey string,
+	op mediastore.Operation,
+	rollback bool,
+	fn func(svc mediastore.ServiceV2) error,
+) error {
+	errs := make([]error, len(s.replicas))
+	var wg sync.WaitGroup
+	for i, r := range s.replicas {
+		wg.Add(1)
+		go func(i int, svc mediastore.ServiceV2) {
+			defer wg.Done()
+			errs[i] = fn(svc)
+		}(i, r.Service)
+	}
+	wg.Wait()
+	if err := s.checkQuorum(objectKey, op, errs); err != nil {
+		if rollback {
+			s.rollback(objectKey, errs)
+		}
+		return err
+	}
+	return nil
+}
+
+// readFirst calls fn for the replicas in order until one succeeds. If
+// the object is found after some replicas didn't find it, the divergence
+// is reported. If all the replicas fail, the error of the first replica
+// is returned.
+func (s *Service) readFirst(
+	ctx context.Context,
+	objectKey string,
+	op mediastore.Operation,
+	fn func(svc mediastore.ServiceV2) error,
+) error {
+	var firstErr error
+	notFound := map[string]error{}
+	for _, r := range s.replicas {
+		err := fn(r.Service)
+		if err == nil {
+			if len(notFound) > 0 {
+				s.reportDivergence(Divergence{Key: objectKey, Operation: op, Replicas: notFound})
+			}
+			return nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if errors.Is(err, mediastore.ErrObjectNotFound) {
+			notFound[r.Name] = err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *Service) GetObject(ctx context.Context, objectKey string) (obj *mediastore.ObjectReader, err error) {
+	err = s.readFirst(ctx, objectKey, mediastore.OperationGetObject, func(svc mediastore.ServiceV2) (err error) {
+		obj, err = svc.GetObject(ctx, objectKey)
+		return err
+	})
+	return obj, err
+}
+
+func (s *Service) GetObjectRange(
+	ctx context.Context,
+	objectKey string,
+	offset, length int64,
+) (obj *mediastore.ObjectReader, err error) {
+	err = s.readFirst(ctx, objectKey, mediastore.OperationGetObjectRange, func(svc mediastore.ServiceV2) (err error) {
+		obj, err = svc.GetObjectRange(ctx, objectKey, offset, length)
+		return err
+	})
+	return obj, err
+}
+
+func (s *Service) GetPublicObject(
+	ctx context.Context,
+	objectKey string,
+	opts mediastore.PublicURLOptions,
+) (publicURL string, err error) {
+	err = s.readFirst(ctx, objectKey, mediastore.OperationGetPublicObject, func(svc mediastore.ServiceV2) (err error) {
+		publicURL, err = svc.GetPublicObject(ctx, objectKey, opts)
+		return err
+	})
+	return publicURL, err
+}
+
+func (s *Service) StatObject(ctx context.Context, objectKey string) (info *mediastore.ObjectInfo, err error) {
+	err = s.readFirst(ctx, objectKey, mediastore.OperationStatObject, func(svc mediastore.ServiceV2) (err error) {
+		info, err = svc.StatObject(ctx, objectKey)
+		return err
+	})
+	return info, err
+}
+
+// ListObjects lists the objects of the first healthy replica. The page
+// token is bound to the replica which produced it so that the following
+// pages come from the same replica.
+func (s *Service) ListObjects(
+	ctx context.Context,
+	prefix string,
+	pageToken string,
+	limit int,
+) (*mediastore.ObjectList, error) {
+	if pageToken != "" {
+		indexStr, replicaToken, _ := strings.Cut(pageToken, ":")
+		i, err := strconv.Atoi(indexStr)
+		if err != nil || i < 0 || i >= len(s.replicas) {
+			return nil, errors.ArgMsg("pageToken", "invalid")
+		}
+		return s.listReplica(ctx, i, prefix, replicaToken, limit)
+	}
+
+	var firstErr error
+	for i := range s.replicas {
+		list, err := s.listReplica(ctx, i, prefix, "", limit)
+		if err == nil {
+			return list, nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+func (s *Service) listReplica(
+	ctx context.Context,
+	i int,
+	prefix string,
+	pageToken string,
+	limit int,
+) (*mediastore.ObjectList, error) {
+	list, err := s.replicas[i].Service.ListObjects(ctx, prefix, pageToken, limit)
+	if err != nil {
+		return nil, errors.Wrap(s.replicas[i].Name, err)
+	}
+	if list.NextPageToken != "" {
+		list.NextPageToken = strconv.Itoa(i) + ":" + list.NextPageToken
+	}
+	return list, nil
+}
+
+func (s *Service) DeleteObject(ctx context.Context, objectKey string) error {
+	return s.writeAll(objectKey, mediastore.OperationDeleteObject, false, func(svc mediastore.ServiceV2) error {
+		return svc.DeleteObject(ctx, objectKey)
+	})
+}
+
+// CopyObject copies the object on every replica. Like PutObject, the copy
+// is deleted from the replicas which succeeded if the quorum is not
+// reached.
+func (s *Service) CopyObject(ctx context.Context, srcKey, dstKey string) error {
+	return s.writeAll(dstKey, mediastore.OperationCopyObject, true, func(svc mediastore.ServiceV2) error {
+		return mediastore.CopyObject(ctx, svc, srcKey, dstKey)
+	})
+}
+
+// MoveObject moves the object on every replica. A move which does not
+// reach the quorum is not rolled back, the replicas which succeeded only
+// have the object under dstKey.
+func (s *Service) MoveObject(ctx context.Context, srcKey, dstKey string) error {
+	return s.writeAll(dstKey, mediastore.OperationMoveObject, false, func(svc mediastore.ServiceV2) error {
+		return mediastore.MoveObject(ctx, svc, srcKey, dstKey)
+	})
+}
+
+// HealthCheck checks all the replicas. The service is healthy as long as
+// the write quorum of the replicas are healthy, the unhealthy replicas are
+// logged.
+func (s *Service) HealthCheck(ctx context.Context) error {
+	errs := make([]error, len(s.replicas))
+	var wg sync.WaitGroup
+	for i, r := range s.replicas {
+		wg.Add(1)
+		go func(i int, svc mediastore.ServiceV2) {
+			defer wg.Done()
+			errs[i] = mediastore.HealthCheck(ctx, svc)
+		}(i, r.Service)
+	}
+	wg.Wait()
+
+	healthy := 0
+	var firstErr error
+	for i, err := range errs {
+		if err == nil {
+			healthy++
+			continue
+		}
+		log.Warn().Err(err).Str("replica", s.replicas[i].Name).Msg("Replica unhealthy")
+		if firstErr == nil {
+			firstErr = errors.Wrap(s.replicas[i].Name, err)
+		}
+	}
+	if healthy < s.writeQuorum {
+		return errors.Wrap(strconv.Itoa(healthy)+" of "+strconv.Itoa(len(errs))+
+			" replicas healthy, below the write quorum", firstErr)
+	}
+	return nil
+}
+
+// SetLifecycle configures the lifecycle of every replica. All the
+// replicas must support it.
+func (s *Service) SetLifecycle(ctx context.Context, config mediastore.LifecycleConfig) error {
+	for _, replica := range s.replicas {
+		configurer, ok := replica.Service.(mediastore.LifecycleConfigurer)
+		if !ok {
+			return errors.Msg("lifecycle not supported by replica " + replica.Name)
+		}
+		if err := configurer.SetLifecycle(ctx, config); err != nil {
+			return errors.Wrap(replica.Name, err)
+		}
+	}
+	return nil
+}
+
+// CheckObject compares the object on all the replicas. It returns nil if
+// the object has the same size on all of them, or if none has it.
+func (s *Service) CheckObject(ctx context.Context, objectKey string) (*Divergence, error) {
+	infos := make([]*mediastore.ObjectInfo, len(s.replicas))
+	errs := make([]error, len(s.replicas))
+	var wg sync.WaitGroup
+	for i, r := range s.replicas {
+		wg.Add(1)
+		go func(i int, svc mediastore.ServiceV2) {
+			defer wg.Done()
+			infos[i], errs[i] = svc.StatObject(ctx, objectKey)
+		}(i, r.Service)
+	}
+	wg.Wait()
+
+	// The first replica which has the object is the reference.
+	var reference *mediastore.ObjectInfo
+	for i, err := range errs {
+		if err != nil && !errors.Is(err, mediastore.ErrObjectNotFound) {
+			return nil, errors.Wrap(s.replicas[i].Name, err)
+		}
+		if err == nil && reference == nil {
+			reference = infos[i]
+		}
+	}
+	if reference == nil {
+		return nil, nil
+	}
+
+	diverged := map[string]error{}
+	for i, err := range errs {
+		switch {
+		case err != nil:
+			diverged[s.replicas[i].Name] = err
+		case infos[i].Size != reference.Size:
+			diverged[s.replicas[i].Name] = errors.Msg("size " + strconv.FormatInt(infos[i].Size, 10) +
+				" differs from " + strconv.FormatInt(reference.Size, 10))
+		}
+	}
+	if len(diverged) == 0 {
+		return nil, nil
+	}
+	return &Divergence{Key: objectKey, Operation: mediastore.OperationStatObject, Replicas: diverged}, nil
+}
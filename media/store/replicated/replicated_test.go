@@ -0,0 +1,300 @@
+package replicated
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/media"
+	mediastore "github.com/timemore/foundation/media/store"
+	_ "github.com/timemore/foundation/media/store/local"
+	"github.com/timemore/foundation/media/store/memory"
+)
+
+var errInjected = errors.Msg("injected")
+
+func newTestService(t *testing.T, n, writeQuorum int) (*Service, []*memory.Service, *[]Divergence) {
+	t.Helper()
+	var replicas []Replica
+	var backends []*memory.Service
+	for i := 0; i < n; i++ {
+		svc, err := memory.NewServiceV2(&memory.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends = append(backends, svc.(*memory.Service))
+		replicas = append(replicas, Replica{Name: replicaName(i), Service: svc})
+	}
+	svc, err := NewServiceWithReplicas(replicas, writeQuorum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	divergences := &[]Divergence{}
+	svc.SetDivergenceHandler(func(d Divergence) {
+		mu.Lock()
+		*divergences = append(*divergences, d)
+		mu.Unlock()
+	})
+	return svc, backends, divergences
+}
+
+func replicaName(i int) string { return "r" + strconv.Itoa(i) }
+
+func divergedReplicas(d Divergence) string {
+	var names []string
+	for name := range d.Replicas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestPutObjectQuorum(t *testing.T) {
+	testCases := []struct {
+		name        string
+		writeQuorum int
+		failing     []int
+		wantErr     bool
+		diverged    string
+	}{
+		{name: "all succeed", writeQuorum: 3},
+		{name: "quorum reached", writeQuorum: 2, failing: []int{1}, diverged: "r1"},
+		{name: "quorum not reached", writeQuorum: 3, failing: []int{2}, wantErr: true, diverged: "r2"},
+		{name: "all fail", writeQuorum: 1, failing: []int{0, 1, 2}, wantErr: true, diverged: "r0,r1,r2"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, backends, divergences := newTestService(t, 3, tc.writeQuorum)
+			for _, i := range tc.failing {
+				backends[i].InjectFailure(mediastore.OperationPutObject, errInjected)
+			}
+
+			_, err := svc.PutObject(context.Background(), "key", strings.NewReader("content"),
+				mediastore.PutObjectOptions{})
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if tc.wantErr && !errors.Is(err, errInjected) {
+				t.Errorf("got %v, want the error of a replica", err)
+			}
+			if tc.diverged == "" && len(*divergences) != 0 {
+				t.Errorf("unexpected divergences %v", *divergences)
+			}
+			if tc.diverged != "" && len(*divergences) != 1 {
+				t.Fatalf("divergences: got %v, want one", *divergences)
+			}
+			// The replicas which are still writing once the quorum could
+			// not be reached are cancelled, they diverge as well. The
+			// write is rolled back on the replicas which succeeded.
+			for i, backend := range backends {
+				_, err := backend.StatObject(context.Background(), "key")
+				diverged := false
+				if len(*divergences) == 1 {
+					_, diverged = (*divergences)[0].Replicas[replicaName(i)]
+				}
+				if stored := !tc.wantErr && !diverged; stored == errors.Is(err, mediastore.ErrObjectNotFound) {
+					t.Errorf("replica %d: diverged %v, stat %v", i, diverged, err)
+				}
+				if strings.Contains(tc.diverged, replicaName(i)) && !diverged {
+					t.Errorf("replica %d: failure not reported", i)
+				}
+			}
+		})
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errInjected }
+
+func TestPutObjectContentError(t *testing.T) {
+	svc, _, divergences := newTestService(t, 3, 2)
+
+	_, err := svc.PutObject(context.Background(), "key",
+		io.MultiReader(strings.NewReader("partial"), failingReader{}), mediastore.PutObjectOptions{})
+	if err != errInjected {
+		t.Fatalf("got %v, want the error of the content", err)
+	}
+	if len(*divergences) != 0 {
+		t.Errorf("the error of the content reported as a divergence: %v", *divergences)
+	}
+}
+
+func TestPutObjectCancelsOnceQuorumUnreachable(t *testing.T) {
+	svc, backends, _ := newTestService(t, 3, 3)
+	backends[0].InjectFailure(mediastore.OperationPutObject, errInjected)
+	backends[1].SetLatency(time.Minute)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := svc.PutObject(context.Background(), "key", strings.NewReader("content"),
+			mediastore.PutObjectOptions{})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errInjected) {
+			t.Errorf("got %v, want the error of the failed replica", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the slow replica was not cancelled")
+	}
+}
+
+func TestReadFallback(t *testing.T) {
+	svc, backends, divergences := newTestService(t, 2, 2)
+	putObject := func(backend *memory.Service) {
+		_, err := backend.PutObject(context.Background(), "key", strings.NewReader("content"),
+			mediastore.PutObjectOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	putObject(backends[1])
+
+	obj, err := svc.GetObject(context.Background(), "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(obj)
+	obj.Close()
+	if string(b) != "content" {
+		t.Errorf("got %q", b)
+	}
+	if len(*divergences) != 1 || divergedReplicas((*divergences)[0]) != "r0" {
+		t.Errorf("divergences: got %v, want r0", *divergences)
+	}
+
+	d, err := svc.CheckObject(context.Background(), "key")
+	if err != nil || d == nil || divergedReplicas(*d) != "r0" {
+		t.Errorf("CheckObject: got %v, %v, want r0", d, err)
+	}
+	putObject(backends[0])
+	if d, err = svc.CheckObject(context.Background(), "key"); d != nil || err != nil {
+		t.Errorf("CheckObject: got %v, %v, want no divergence", d, err)
+	}
+}
+
+func TestNewService(t *testing.T) {
+	config := &Config{Replicas: []ReplicaConfig{
+		{Name: "a", StoreService: memory.ServiceName, Config: &memory.Config{}},
+		{Name: "b", StoreService: memory.ServiceName, Config: &memory.Config{}},
+	}}
+	svc, err := NewService(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = svc.PutObject("key", strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := svc.GetObject("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "content" {
+		t.Errorf("content: got %q", buf.String())
+	}
+
+	config.WriteQuorum = 3
+	svcV2, err := NewServiceV2(config)
+	var argErr errors.ArgumentError
+	if !errors.As(err, &argErr) || argErr.ArgumentName() != "config.WriteQuorum" {
+		t.Errorf("got %v, want an argument error of config.WriteQuorum", err)
+	}
+	if svcV2 != nil {
+		t.Error("service returned with the error")
+	}
+}
+
+// lateFailingService fails the writes once the other replicas have
+// completed theirs.
+type lateFailingService struct {
+	mediastore.ServiceV2
+}
+
+func (s lateFailingService) PutObject(
+	ctx context.Context,
+	objectKey string,
+	contentSource io.Reader,
+	opts mediastore.PutObjectOptions,
+) (*mediastore.UploadInfo, error) {
+	_, _ = io.Copy(io.Discard, contentSource)
+	time.Sleep(50 * time.Millisecond)
+	return nil, errInjected
+}
+
+func (s lateFailingService) CopyObject(ctx context.Context, srcKey, dstKey string) error {
+	time.Sleep(50 * time.Millisecond)
+	return errInjected
+}
+
+func TestWriteRollback(t *testing.T) {
+	ctx := context.Background()
+	testCases := []struct {
+		name string
+		call func(svc *Service) error
+	}{
+		{"put", func(svc *Service) error {
+			_, err := svc.PutObject(ctx, "key", strings.NewReader("content"), mediastore.PutObjectOptions{})
+			return err
+		}},
+		{"copy", func(svc *Service) error {
+			return svc.CopyObject(ctx, "source", "key")
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, backends, _ := newTestService(t, 3, 3)
+			for _, backend := range backends {
+				if _, err := backend.PutObject(ctx, "source", strings.NewReader("content"),
+					mediastore.PutObjectOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			svc.replicas[2].Service = lateFailingService{backends[2]}
+
+			if err := tc.call(svc); !errors.Is(err, errInjected) {
+				t.Fatalf("got %v, want the error of the replica", err)
+			}
+			for i, backend := range backends {
+				if _, err := backend.StatObject(ctx, "key"); !errors.Is(err, mediastore.ErrObjectNotFound) {
+					t.Errorf("replica %d: got %v, want the write rolled back", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("MEDIA_STORE_SERVICE", ServiceName)
+	t.Setenv("MEDIA_REPLICATED_REPLICA_SERVICES", "memory, local")
+	t.Setenv("MEDIA_REPLICATED_REPLICA_MODULES_LOCAL_FOLDER_PATH", dir)
+	t.Setenv("MEDIA_REPLICATED_WRITE_QUORUM", "1")
+
+	config, err := mediastore.ParseConfigFromEnv("MEDIA_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaStore, err := mediastore.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mediaStore.UploadObject(context.Background(), "key", strings.NewReader("content"),
+		media.MediaType_MEDIA_TYPE_UNSPECIFIED, mediastore.PutObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// The object is written to the directory of the local replica.
+	if b, err := os.ReadFile(filepath.Join(dir, "key")); err != nil || string(b) != "content" {
+		t.Errorf("local replica: got %q, %v", b, err)
+	}
+}
@@ -0,0 +1,512 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/eapache/go-resiliency/breaker"
+	"github.com/eapache/go-resiliency/retrier"
+	"github.com/timemore/foundation/errors"
+)
+
+// ErrCircuitOpen is returned, wrapped, when a call is rejected because
+// the circuit breaker of the service is open.
+var ErrCircuitOpen = errors.Msg("circuit breaker open")
+
+// ResilienceConfig configures the retries and the circuit breaker of the
+// calls to the service. Both are disabled by default.
+type ResilienceConfig struct {
+	// Retries is the number of times a call failing with a retryable
+	// error is retried. Only the idempotent calls are retried.
+	Retries int32 `env:"RETRIES" yaml:"retries" json:"retries"`
+	// RetryBackoff is the delay before the first retry, which doubles at
+	// every retry up to RetryBackoffMax. The defaults are
+	// ResilienceRetryBackoffDefault and ResilienceRetryBackoffMaxDefault.
+	RetryBackoff    time.Duration `env:"RETRY_BACKOFF" yaml:"retry_backoff" json:"retry_backoff"`
+	RetryBackoffMax time.Duration `env:"RETRY_BACKOFF_MAX" yaml:"retry_backoff_max" json:"retry_backoff_max"`
+	// RetryBufferBytes is the size of the largest content which is kept
+	// in memory so that an upload could be retried. Each upload whose
+	// content is not an io.Seeker could hold up to this many bytes in
+	// memory, so the memory cost grows with the concurrent uploads. The
+	// content is not buffered if it's not positive, which is the default,
+	// and the uploads of content which is not an io.Seeker, or which is
+	// larger than the buffer, are then not retried.
+	RetryBufferBytes int64 `env:"RETRY_BUFFER_BYTES" yaml:"retry_buffer_bytes" json:"retry_buffer_bytes"`
+
+	// BreakerErrorThreshold is the number of retryable errors, each
+	// within BreakerTimeout of the previous one, which opens the circuit.
+	// The circuit breaker is disabled if it's zero.
+	BreakerErrorThreshold int32 `env:"BREAKER_ERROR_THRESHOLD" yaml:"breaker_error_threshold" json:"breaker_error_threshold"`
+	// BreakerSuccessThreshold is the number of consecutive successes
+	// which closes the circuit after BreakerTimeout. It defaults to 1.
+	BreakerSuccessThreshold int32 `env:"BREAKER_SUCCESS_THRESHOLD" yaml:"breaker_success_threshold" json:"breaker_success_threshold"`
+	// BreakerTimeout is how long the circuit stays open before a call is
+	// let through. ResilienceBreakerTimeoutDefault is used if it's not
+	// positive.
+	BreakerTimeout time.Duration `env:"BREAKER_TIMEOUT" yaml:"breaker_timeout" json:"breaker_timeout"`
+}
+
+// Enabled returns true if the config enables the retries or the circuit
+// breaker.
+func (cfg ResilienceConfig) Enabled() bool {
+	return cfg.Retries > 0 || cfg.BreakerErrorThreshold > 0
+}
+
+const (
+	ResilienceRetryBackoffDefault    = 100 * time.Millisecond
+	ResilienceRetryBackoffMaxDefault = 5 * time.Second
+	ResilienceBreakerTimeoutDefault  = 30 * time.Second
+)
+
+// resilienceRetryJitter spreads the retries of the concurrent calls.
+const resilienceRetryJitter = 0.25
+
+// ErrorClass tells whether a failed call could be retried.
+type ErrorClass int
+
+const (
+	// ErrorClassUnknown is returned by an ErrorClassifier which does not
+	// recognize the error.
+	ErrorClassUnknown ErrorClass = iota
+	ErrorClassRetryable
+	ErrorClassPermanent
+)
+
+// ErrorClassifier is implemented by the services which are able to tell
+// apart the transient errors of their backend, e.g., a throttling or a
+// 503 response. The errors it does not recognize are classified by
+// ClassifyError.
+type ErrorClassifier interface {
+	ClassifyError(err error) ErrorClass
+}
+
+// ClassifyError classifies the errors which are not specific to a
+// backend. The errors defined by this package, the argument errors and the
+// cancellations are permanent, the network errors and the responses with a
+// 408, 429 or 5xx status code are retryable. The other errors are
+// considered permanent.
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ErrorClassUnknown
+	}
+	for _, permanentErr := range []error{
+		ErrObjectNotFound, ErrUploadNotFound, ErrRangeNotSatisfiable,
+		ErrChecksumMismatch, ErrDecryptionFailed, ErrEncryptionKeyNotFound, ErrObjectNotEncrypted,
+		ErrObjectRetained, ErrCircuitOpen, errors.ErrUnimplemented,
+		context.Canceled, context.DeadlineExceeded,
+	} {
+		if errors.Is(err, permanentErr) {
+			return ErrorClassPermanent
+		}
+	}
+	var callErr errors.CallError
+	if errors.As(err, &callErr) {
+		return ErrorClassPermanent
+	}
+
+	var statusErr interface{ StatusCode() int }
+	if errors.As(err, &statusErr) {
+		switch code := statusErr.StatusCode(); {
+		case code == 408, code == 429, code >= 500:
+			return ErrorClassRetryable
+		case code >= 400:
+			return ErrorClassPermanent
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorClassRetryable
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return ErrorClassRetryable
+	}
+	return ErrorClassPermanent
+}
+
+// NewResilientService wraps the service so that the idempotent calls
+// failing with a retryable error are retried with an exponential backoff,
+// and so that the calls are rejected with ErrCircuitOpen while the service
+// keeps failing. Only the retryable errors count toward opening the
+// circuit, e.g., ErrObjectNotFound does not. Each wrapped service has its
+// own circuit breaker.
+//
+// The retries only cover establishing the downloads, an error while
+// reading the content is returned to the caller.
+func NewResilientService(svc ServiceV2, config ResilienceConfig) (ServiceV2, error) {
+	if svc == nil {
+		return nil, errors.ArgMsg("svc", "missing")
+	}
+	if config.Retries < 0 {
+		return nil, errors.ArgMsg("config.Retries", "negative")
+	}
+	if config.BreakerErrorThreshold < 0 || config.BreakerSuccessThreshold < 0 {
+		return nil, errors.ArgMsg("config", "breaker threshold negative")
+	}
+	backoff := config.RetryBackoff
+	if backoff <= 0 {
+		backoff = ResilienceRetryBackoffDefault
+	}
+	backoffMax := config.RetryBackoffMax
+	if backoffMax <= 0 {
+		backoffMax = ResilienceRetryBackoffMaxDefault
+	}
+
+	s := &resilientService{
+		ServiceV2:        svc,
+		retryBufferBytes: config.RetryBufferBytes,
+	}
+	s.classifier, _ = svc.(ErrorClassifier)
+	if config.Retries > 0 {
+		s.retrier = retrier.New(
+			retrier.LimitedExponentialBackoff(int(config.Retries), backoff, backoffMax),
+			retryClassifier{s})
+		s.retrier.SetJitter(resilienceRetryJitter)
+	}
+	if config.BreakerErrorThreshold > 0 {
+		successThreshold := config.BreakerSuccessThreshold
+		if successThreshold == 0 {
+			successThreshold = 1
+		}
+		timeout := config.BreakerTimeout
+		if timeout <= 0 {
+			timeout = ResilienceBreakerTimeoutDefault
+		}
+		s.breaker = breaker.New(int(config.BreakerErrorThreshold), int(successThreshold), timeout)
+	}
+	return s, nil
+}
+
+// resilientService embeds the service so that HealthCheck is forwarded
+// as it is, bypassing the circuit breaker so that it reports the actual
+// health of the backend.
+type resilientService struct {
+	ServiceV2
+
+	classifier       ErrorClassifier
+	retrier          *retrier.Retrier
+	breaker          *breaker.Breaker
+	retryBufferBytes int64
+}
+
+var (
+	_ ServiceV2         = &resilientService{}
+	_ Copier            = &resilientService{}
+	_ Presigner         = &resilientService{}
+	_ MultipartUploader = &resilientService{}
+	_ HealthChecker     = &resilientService{}
+)
+
+func (s *resilientService) classify(err error) ErrorClass {
+	if s.classifier != nil {
+		if class := s.classifier.ClassifyError(err); class != ErrorClassUnknown {
+			return class
+		}
+	}
+	return ClassifyError(err)
+}
+
+type retryClassifier struct {
+	s *resilientService
+}
+
+func (c retryClassifier) Classify(err error) retrier.Action {
+	if err == nil {
+		return retrier.Succeed
+	}
+	if c.s.classify(err) == ErrorClassRetryable {
+		return retrier.Retry
+	}
+	return retrier.Fail
+}
+
+// call runs fn through the circuit breaker, and the retrier if retry is
+// true and the retries are enabled.
+func (s *resilientService) call(ctx context.Context, op Operation, retry bool, fn func(ctx context.Context) error) error {
+	attempt := func(ctx context.Context) error {
+		if s.breaker == nil {
+			return fn(ctx)
+		}
+		var callErr error
+		err := s.breaker.Run(func() error {
+			callErr = fn(ctx)
+			if callErr != nil && s.classify(callErr) == ErrorClassRetryable {
+				return callErr
+			}
+			return nil
+		})
+		if err == breaker.ErrBreakerOpen {
+			return errors.Wrap(op.String(), ErrCircuitOpen)
+		}
+		return callErr
+	}
+	if !retry || s.retrier == nil {
+		return attempt(ctx)
+	}
+	return s.retrier.RunCtx(ctx, attempt)
+}
+
+// replayableContent returns a function which returns the content from
+// its start at every call, if the content could be read again.
+func (s *resilientService) replayableContent(content io.Reader) (replay func() (io.Reader, error), ok bool) {
+	if seeker, isSeeker := content.(io.ReadSeeker); isSeeker {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			return func() (io.Reader, error) {
+				if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+					return nil, errors.Wrap("seek content", err)
+				}
+				return seeker, nil
+			}, true
+		}
+	}
+	return nil, false
+}
+
+// bufferContent reads the content up to the buffer limit. If the content
+// is larger, the returned reader provides the whole content but could
+// only be read once.
+func (s *resilientService) bufferContent(content io.Reader) (io.Reader, bool, error) {
+	buf := &bytes.Buffer{}
+	n, err := io.CopyN(buf, content, s.retryBufferBytes+1)
+	if err != nil && err != io.EOF {
+		return nil, false, errors.Wrap("read content", err)
+	}
+	if n > s.retryBufferBytes {
+		return io.MultiReader(buf, content), false, nil
+	}
+	return bytes.NewReader(buf.Bytes()), true, nil
+}
+
+// putContent calls fn with the content, retrying if the content could be
+// read again, either because it's an io.Seeker or because it fits in the
+// retry buffer.
+func (s *resilientService) putContent(
+	ctx context.Context,
+	op Operation,
+	content io.Reader,
+	fn func(ctx context.Context, content io.Reader) error,
+) error {
+	if s.retrier == nil {
+		return s.call(ctx, op, false, func(ctx context.Context) error {
+			return fn(ctx, content)
+		})
+	}
+	replay, ok := s.replayableContent(content)
+	if !ok && s.retryBufferBytes <= 0 {
+		return s.call(ctx, op, false, func(ctx context.Context) error {
+			return fn(ctx, content)
+		})
+	}
+	if !ok {
+		buffered, replayable, err := s.bufferContent(content)
+		if err != nil {
+			return err
+		}
+		if !replayable {
+			return s.call(ctx, op, false, func(ctx context.Context) error {
+				return fn(ctx, buffered)
+			})
+		}
+		replay, _ = s.replayableContent(buffered)
+	}
+	return s.call(ctx, op, true, func(ctx context.Context) error {
+		content, err := replay()
+		if err != nil {
+			return err
+		}
+		return fn(ctx, content)
+	})
+}
+
+func (s *resilientService) PutObject(
+	ctx context.Context,
+	objectKey string,
+	content io.Reader,
+	opts PutObjectOptions,
+) (uploadInfo *UploadInfo, err error) {
+	err = s.putContent(ctx, OperationPutObject, content, func(ctx context.Context, content io.Reader) error {
+		uploadInfo, err = s.ServiceV2.PutObject(ctx, objectKey, content, opts)
+		return err
+	})
+	return uploadInfo, err
+}
+
+func (s *resilientService) GetObject(ctx context.Context, objectKey string) (object *ObjectReader, err error) {
+	err = s.call(ctx, OperationGetObject, true, func(ctx context.Context) error {
+		object, err = s.ServiceV2.GetObject(ctx, objectKey)
+		return err
+	})
+	return object, err
+}
+
+func (s *resilientService) GetObjectRange(
+	ctx context.Context,
+	objectKey string,
+	offset, length int64,
+) (object *ObjectReader, err error) {
+	err = s.call(ctx, OperationGetObjectRange, true, func(ctx context.Context) error {
+		object, err = s.ServiceV2.GetObjectRange(ctx, objectKey, offset, length)
+		return err
+	})
+	return object, err
+}
+
+func (s *resilientService) GetPublicObject(
+	ctx context.Context,
+	objectKey string,
+	opts PublicURLOptions,
+) (publicURL string, err error) {
+	err = s.call(ctx, OperationGetPublicObject, true, func(ctx context.Context) error {
+		publicURL, err = s.ServiceV2.GetPublicObject(ctx, objectKey, opts)
+		return err
+	})
+	return publicURL, err
+}
+
+func (s *resilientService) ListObjects(
+	ctx context.Context,
+	prefix string,
+	pageToken string,
+	limit int,
+) (list *ObjectList, err error) {
+	err = s.call(ctx, OperationListObjects, true, func(ctx context.Context) error {
+		list, err = s.ServiceV2.ListObjects(ctx, prefix, pageToken, limit)
+		return err
+	})
+	return list, err
+}
+
+func (s *resilientService) DeleteObject(ctx context.Context, objectKey string) error {
+	return s.call(ctx, OperationDeleteObject, true, func(ctx context.Context) error {
+		return s.ServiceV2.DeleteObject(ctx, objectKey)
+	})
+}
+
+func (s *resilientService) StatObject(ctx context.Context, objectKey string) (info *ObjectInfo, err error) {
+	err = s.call(ctx, OperationStatObject, true, func(ctx context.Context) error {
+		info, err = s.ServiceV2.StatObject(ctx, objectKey)
+		return err
+	})
+	return info, err
+}
+
+func (s *resilientService) PresignPutObject(
+	ctx context.Context,
+	objectKey string,
+	opts PresignPutOptions,
+) (req *PresignedRequest, err error) {
+	err = s.call(ctx, OperationPresignPutObject, true, func(ctx context.Context) error {
+		req, err = PresignPutObject(ctx, s.ServiceV2, objectKey, opts)
+		return err
+	})
+	return req, err
+}
+
+func (s *resilientService) CopyObject(ctx context.Context, srcKey, dstKey string) error {
+	return s.call(ctx, OperationCopyObject, true, func(ctx context.Context) error {
+		return CopyObject(ctx, s.ServiceV2, srcKey, dstKey)
+	})
+}
+
+// MoveObject is not retried, a retry after the source has been deleted
+// would fail with ErrObjectNotFound.
+func (s *resilientService) MoveObject(ctx context.Context, srcKey, dstKey string) error {
+	return s.call(ctx, OperationMoveObject, false, func(ctx context.Context) error {
+		return MoveObject(ctx, s.ServiceV2, srcKey, dstKey)
+	})
+}
+
+// InitiateUpload is not retried, a retry could leave a session behind.
+func (s *resilientService) InitiateUpload(
+	ctx context.Context,
+	objectKey string,
+	opts PutObjectOptions,
+) (uploadID string, err error) {
+	uploader, err := GetMultipartUploader(s.ServiceV2)
+	if err != nil {
+		return "", err
+	}
+	err = s.call(ctx, OperationInitiateUpload, false, func(ctx context.Context) error {
+		uploadID, err = uploader.InitiateUpload(ctx, objectKey, opts)
+		return err
+	})
+	return uploadID, err
+}
+
+func (s *resilientService) UploadPart(
+	ctx context.Context,
+	objectKey, uploadID string,
+	partNumber int,
+	content io.Reader,
+	size int64,
+) (part *UploadPart, err error) {
+	uploader, err := GetMultipartUploader(s.ServiceV2)
+	if err != nil {
+		return nil, err
+	}
+	err = s.putContent(ctx, OperationUploadPart, content, func(ctx context.Context, content io.Reader) error {
+		part, err = uploader.UploadPart(ctx, objectKey, uploadID, partNumber, content, size)
+		return err
+	})
+	return part, err
+}
+
+func (s *resilientService) ListUploadParts(ctx context.Context, objectKey, uploadID string) (parts []UploadPart, err error) {
+	uploader, err := GetMultipartUploader(s.ServiceV2)
+	if err != nil {
+		return nil, err
+	}
+	err = s.call(ctx, OperationListUploadParts, true, func(ctx context.Context) error {
+		parts, err = uploader.ListUploadParts(ctx, objectKey, uploadID)
+		return err
+	})
+	return parts, err
+}
+
+// CompleteUpload is not retried, a retry after the upload has completed
+// would fail with ErrUploadNotFound.
+func (s *resilientService) CompleteUpload(ctx context.Context, objectKey, uploadID string) (uploadInfo *UploadInfo, err error) {
+	uploader, err := GetMultipartUploader(s.ServiceV2)
+	if err != nil {
+		return nil, err
+	}
+	err = s.call(ctx, OperationCompleteUpload, false, func(ctx context.Context) error {
+		uploadInfo, err = uploader.CompleteUpload(ctx, objectKey, uploadID)
+		return err
+	})
+	return uploadInfo, err
+}
+
+// AbortUpload is not retried for the same reason as CompleteUpload.
+func (s *resilientService) AbortUpload(ctx context.Context, objectKey, uploadID string) error {
+	uploader, err := GetMultipartUploader(s.ServiceV2)
+	if err != nil {
+		return err
+	}
+	return s.call(ctx, OperationAbortUpload, false, func(ctx context.Context) error {
+		return uploader.AbortUpload(ctx, objectKey, uploadID)
+	})
+}
+
+func (s *resilientService) ListUploads(ctx context.Context, prefix string) (sessions []UploadSession, err error) {
+	uploader, err := GetMultipartUploader(s.ServiceV2)
+	if err != nil {
+		return nil, err
+	}
+	err = s.call(ctx, OperationListUploads, true, func(ctx context.Context) error {
+		sessions, err = uploader.ListUploads(ctx, prefix)
+		return err
+	})
+	return sessions, err
+}
+
+func (s *resilientService) HealthCheck(ctx context.Context) error {
+	return HealthCheck(ctx, s.ServiceV2)
+}
@@ -0,0 +1,173 @@
+package store_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/media"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+// flakyService reads the content of the first failures uploads, then fails
+// them with a retryable error.
+type flakyService struct {
+	mediastore.ServiceV2
+	failures int
+	attempts int
+}
+
+func (s *flakyService) PutObject(
+	ctx context.Context,
+	objectKey string,
+	content io.Reader,
+	opts mediastore.PutObjectOptions,
+) (*mediastore.UploadInfo, error) {
+	s.attempts++
+	if s.attempts <= s.failures {
+		if _, err := io.Copy(io.Discard, content); err != nil {
+			return nil, err
+		}
+		return nil, io.ErrUnexpectedEOF
+	}
+	return s.ServiceV2.PutObject(ctx, objectKey, content, opts)
+}
+
+func TestResilientServicePutObject(t *testing.T) {
+	testCases := []struct {
+		name             string
+		seekable         bool
+		retryBufferBytes int64
+		attempts         int
+		retried          bool
+	}{
+		{name: "seekable", seekable: true, attempts: 2, retried: true},
+		{name: "not buffered by default", attempts: 1},
+		{name: "buffered", retryBufferBytes: 100, attempts: 2, retried: true},
+		{name: "buffered at the limit", retryBufferBytes: 7, attempts: 2, retried: true},
+		{name: "larger than the buffer", retryBufferBytes: 6, attempts: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := &flakyService{ServiceV2: newMemoryService(t), failures: 1}
+			svc, err := mediastore.NewResilientService(backend, mediastore.ResilienceConfig{
+				Retries:          2,
+				RetryBackoff:     time.Millisecond,
+				RetryBufferBytes: tc.retryBufferBytes,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var content io.Reader = strings.NewReader("content")
+			if !tc.seekable {
+				content = io.MultiReader(content)
+			}
+
+			_, err = svc.PutObject(context.Background(), "key", content, mediastore.PutObjectOptions{})
+			if backend.attempts != tc.attempts {
+				t.Errorf("attempts: got %d, want %d", backend.attempts, tc.attempts)
+			}
+			if !tc.retried {
+				if !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Fatalf("got %v, want the error of the first attempt", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readObject(t, backend, "key"); got != "content" {
+				t.Errorf("content: got %q", got)
+			}
+		})
+	}
+}
+
+// The content passed to Store.Upload is still seekable, once it's checked,
+// so that the resilient service retries its upload.
+func TestResilientServiceStoreUpload(t *testing.T) {
+	testCases := []struct {
+		name      string
+		mediaType media.MediaType
+		content   string
+		attempts  int
+		wantErr   error
+	}{
+		{name: "unchecked", mediaType: media.MediaType_MEDIA_TYPE_UNSPECIFIED, content: "content", attempts: 2},
+		{name: "size limited", mediaType: media.MediaType_FILE, content: "plain text", attempts: 2},
+		{name: "at the maximum size", mediaType: media.MediaType_FILE, content: strings.Repeat("a", 4000), attempts: 2},
+		// The content is too large past the head read by the checks.
+		{name: "too large", mediaType: media.MediaType_FILE, content: strings.Repeat("a", 4001),
+			attempts: 1, wantErr: mediastore.ErrContentTooLarge},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := &flakyService{ServiceV2: newMemoryService(t), failures: 1}
+			svc, err := mediastore.NewResilientService(backend, mediastore.ResilienceConfig{
+				Retries:      2,
+				RetryBackoff: time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			mediaStore := newTestStore(t, mediastore.Config{UploadPolicy: mediastore.UploadPolicyConfig{
+				File: mediastore.UploadPolicy{MaxSizeBytes: 4000},
+			}}, svc)
+
+			_, err = mediaStore.UploadContext(context.Background(), "key", strings.NewReader(tc.content),
+				tc.mediaType, mediastore.PutObjectOptions{})
+			if backend.attempts != tc.attempts {
+				t.Errorf("attempts: got %d, want %d", backend.attempts, tc.attempts)
+			}
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("got %v, want %v", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readObject(t, backend, "key"); got != tc.content {
+				t.Errorf("content: got %q", got)
+			}
+		})
+	}
+}
+
+func TestResilientServiceBreaker(t *testing.T) {
+	backend := newMemoryService(t)
+	putObject(t, backend, "key", "content")
+	svc, err := mediastore.NewResilientService(backend, mediastore.ResilienceConfig{
+		BreakerErrorThreshold: 2,
+		BreakerTimeout:        time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// The permanent errors don't open the circuit.
+	for i := 0; i < 3; i++ {
+		if _, err = svc.StatObject(ctx, "missing"); !errors.Is(err, mediastore.ErrObjectNotFound) {
+			t.Fatalf("got %v, want ErrObjectNotFound", err)
+		}
+	}
+	if _, err = svc.StatObject(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	backend.InjectFailure(mediastore.OperationStatObject, io.ErrUnexpectedEOF)
+	for i := 0; i < 2; i++ {
+		if _, err = svc.StatObject(ctx, "key"); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("got %v, want the injected failure", err)
+		}
+	}
+	backend.ClearFailures()
+	if _, err = svc.StatObject(ctx, "key"); !errors.Is(err, mediastore.ErrCircuitOpen) {
+		t.Errorf("got %v, want ErrCircuitOpen", err)
+	}
+}
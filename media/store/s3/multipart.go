@@ -0,0 +1,290 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+// The upload sessions are mapped to the S3 multipart uploads.
+
+func (s *Service) InitiateUpload(
+	ctx context.Context,
+	targetKey string,
+	opts mediastore.PutObjectOptions,
+) (string, error) {
+	objectKey, err := s.basePath.ObjectKey(targetKey)
+	if err != nil {
+		return "", err
+	}
+	input := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(objectKey),
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	if opts.CacheControl != "" {
+		input.CacheControl = aws.String(opts.CacheControl)
+	}
+	if opts.ContentDisposition != "" {
+		input.ContentDisposition = aws.String(opts.ContentDisposition)
+	}
+	if metadata := mediastore.NormalizeMetadata(opts.Metadata); metadata != nil {
+		input.Metadata = aws.StringMap(metadata)
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId, input.StorageClass = s.objectStorageInput()
+	result, err := s.svc.CreateMultipartUploadWithContext(ctx, input)
+	if err != nil {
+		return "", errors.Wrap("create multipart upload", err)
+	}
+	return aws.StringValue(result.UploadId), nil
+}
+
+// UploadPart buffers the part in memory unless the content is seekable,
+// which the SDK requires to sign the request, and its size is known.
+func (s *Service) UploadPart(
+	ctx context.Context,
+	targetKey, uploadID string,
+	partNumber int,
+	contentSource io.Reader,
+	size int64,
+) (*mediastore.UploadPart, error) {
+	objectKey, err := s.basePath.ObjectKey(targetKey)
+	if err != nil {
+		return nil, err
+	}
+	body, ok := contentSource.(io.ReadSeeker)
+	if !ok || size < 0 {
+		buf := &bytes.Buffer{}
+		if _, err := buf.ReadFrom(contentSource); err != nil {
+			return nil, errors.Wrap("read content", err)
+		}
+		body = bytes.NewReader(buf.Bytes())
+		size = int64(buf.Len())
+	}
+	input := &s3.UploadPartInput{
+		Bucket:        aws.String(s.bucketName),
+		Key:           aws.String(objectKey),
+		UploadId:      aws.String(uploadID),
+		PartNumber:    aws.Int64(int64(partNumber)),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+	}
+	result, err := s.svc.UploadPartWithContext(ctx, input)
+	if err != nil {
+		return nil, errors.Wrap("upload part", translateError(err))
+	}
+	return &mediastore.UploadPart{
+		PartNumber: partNumber,
+		Size:       size,
+		ETag:       strings.Trim(aws.StringValue(result.ETag), `"`),
+	}, nil
+}
+
+func (s *Service) ListUploadParts(ctx context.Context, targetKey, uploadID string) ([]mediastore.UploadPart, error) {
+	objectKey, err := s.basePath.ObjectKey(targetKey)
+	if err != nil {
+		return nil, err
+	}
+	var parts []mediastore.UploadPart
+	err = s.svc.ListPartsPagesWithContext(ctx,
+		&s3.ListPartsInput{
+			Bucket:   aws.String(s.bucketName),
+			Key:      aws.String(objectKey),
+			UploadId: aws.String(uploadID),
+		},
+		func(page *s3.ListPartsOutput, lastPage bool) bool {
+			for _, part := range page.Parts {
+				parts = append(parts, mediastore.UploadPart{
+					PartNumber:   int(aws.Int64Value(part.PartNumber)),
+					Size:         aws.Int64Value(part.Size),
+					ETag:         strings.Trim(aws.StringValue(part.ETag), `"`),
+					LastModified: aws.TimeValue(part.LastModified),
+				})
+			}
+			return true
+		})
+	if err != nil {
+		return nil, errors.Wrap("list parts", translateError(err))
+	}
+	return parts, nil
+}
+
+func (s *Service) CompleteUpload(ctx context.Context, targetKey, uploadID string) (*mediastore.UploadInfo, error) {
+	parts, err := s.ListUploadParts(ctx, targetKey, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		return nil, errors.ArgMsg("uploadID", "no parts uploaded")
+	}
+	completedParts := make([]*s3.CompletedPart, 0, len(parts))
+	var size int64
+	for _, part := range parts {
+		completedParts = append(completedParts, &s3.CompletedPart{
+			PartNumber: aws.Int64(int64(part.PartNumber)),
+			ETag:       aws.String(`"` + part.ETag + `"`),
+		})
+		size += part.Size
+	}
+
+	objectKey, err := s.basePath.ObjectKey(targetKey)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucketName),
+		Key:             aws.String(objectKey),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completedParts},
+	})
+	if err != nil {
+		return nil, errors.Wrap("complete multipart upload", translateError(err))
+	}
+	return &mediastore.UploadInfo{
+		Bucket:   s.bucketName,
+		Key:      targetKey,
+		ETag:     strings.Trim(aws.StringValue(result.ETag), `"`),
+		Location: aws.StringValue(result.Location),
+		Size:     int(size),
+		UploadID: uploadID,
+	}, nil
+}
+
+func (s *Service) AbortUpload(ctx context.Context, targetKey, uploadID string) error {
+	objectKey, err := s.basePath.ObjectKey(targetKey)
+	if err != nil {
+		return err
+	}
+	_, err = s.svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucketName),
+		Key:      aws.String(objectKey),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		return errors.Wrap("abort multipart upload", translateError(err))
+	}
+	return nil
+}
+
+func (s *Service) ListUploads(ctx context.Context, prefix string) ([]mediastore.UploadSession, error) {
+	prefixKey, err := s.basePath.PrefixKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []mediastore.UploadSession
+	err = s.svc.ListMultipartUploadsPagesWithContext(ctx,
+		&s3.ListMultipartUploadsInput{
+			Bucket: aws.String(s.bucketName),
+			Prefix: aws.String(prefixKey),
+		},
+		func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+			for _, upload := range page.Uploads {
+				sessions = append(sessions, mediastore.UploadSession{
+					Key:       s.basePath.RelativeKey(aws.StringValue(upload.Key)),
+					UploadID:  aws.StringValue(upload.UploadId),
+					Initiated: aws.TimeValue(upload.Initiated),
+				})
+			}
+			return true
+		})
+	if err != nil {
+		return nil, errors.Wrap("list multipart uploads", err)
+	}
+	return sessions, nil
+}
+
+const (
+	copyPartSizeMin = 512 * 1024 * 1024 // 512MiB
+	copyPartsMax    = 10000
+)
+
+// copyObjectMultipart copies the object with a multipart upload whose
+// parts are copied from ranges of the source, which S3 requires for the
+// objects larger than copyObjectSizeMax. A multipart upload doesn't copy
+// the attributes of the source, they are set from the head of the source.
+func (s *Service) copyObjectMultipart(
+	ctx context.Context,
+	copySource, dstObjectKey string,
+	head *s3.HeadObjectOutput,
+) error {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:             aws.String(s.bucketName),
+		Key:                aws.String(dstObjectKey),
+		ContentType:        head.ContentType,
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		Metadata:           head.Metadata,
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId, input.StorageClass = s.objectStorageInput()
+	created, err := s.svc.CreateMultipartUploadWithContext(ctx, input)
+	if err != nil {
+		return errors.Wrap("create multipart upload", err)
+	}
+	uploadID := created.UploadId
+
+	size := aws.Int64Value(head.ContentLength)
+	partSize := int64(copyPartSizeMin)
+	if minSize := (size + copyPartsMax - 1) / copyPartsMax; minSize > partSize {
+		partSize = minSize
+	}
+	var parts []*s3.CompletedPart
+	for offset := int64(0); offset < size; offset += partSize {
+		end := offset + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		partNumber := aws.Int64(int64(len(parts) + 1))
+		result, err := s.svc.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.bucketName),
+			Key:             aws.String(dstObjectKey),
+			UploadId:        uploadID,
+			PartNumber:      partNumber,
+			CopySource:      aws.String(copySource),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+			// Fail if the source is replaced during the copy.
+			CopySourceIfMatch: head.ETag,
+		})
+		if err != nil {
+			s.abortCopy(dstObjectKey, uploadID)
+			return errors.Wrap("upload part copy", translateError(err))
+		}
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       result.CopyPartResult.ETag,
+			PartNumber: partNumber,
+		})
+	}
+
+	_, err = s.svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucketName),
+		Key:             aws.String(dstObjectKey),
+		UploadId:        uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		s.abortCopy(dstObjectKey, uploadID)
+		return errors.Wrap("complete multipart upload", translateError(err))
+	}
+	return nil
+}
+
+// abortCopy aborts the multipart upload of a failed copy so that its
+// parts are not kept. The context of the copy may have been cancelled.
+func (s *Service) abortCopy(objectKey string, uploadID *string) {
+	_, err := s.svc.AbortMultipartUploadWithContext(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucketName),
+		Key:      aws.String(objectKey),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("key", objectKey).Msg("Unable to abort the upload of a copy")
+	}
+}
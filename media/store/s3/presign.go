@@ -0,0 +1,147 @@
+package s3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+const (
+	signAlgorithm     = "AWS4-HMAC-SHA256"
+	signDateFormat    = "20060102"
+	signTimeFormat    = "20060102T150405Z"
+	policyTimeFormat  = "2006-01-02T15:04:05.000Z"
+	signServiceName   = "s3"
+	signRequestSuffix = "aws4_request"
+)
+
+// PresignPutObject creates a presigned POST policy for uploading the
+// object. The SDK doesn't provide POST policies, which are the only way
+// to limit the size of the content, so the policy is signed here using
+// Signature Version 4.
+func (s *Service) PresignPutObject(
+	ctx context.Context,
+	targetKey string,
+	opts mediastore.PresignPutOptions,
+) (*mediastore.PresignedRequest, error) {
+	expiry := opts.Expiry
+	if expiry <= 0 {
+		expiry = mediastore.PresignExpiryDefault
+	}
+	now := time.Now().UTC()
+	expires := now.Add(expiry)
+
+	creds, err := s.svc.Config.Credentials.GetWithContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap("credentials", err)
+	}
+	objectKey, err := s.basePath.ObjectKey(targetKey)
+	if err != nil {
+		return nil, err
+	}
+	postURL, err := s.bucketURL(objectKey)
+	if err != nil {
+		return nil, err
+	}
+
+	region := aws.StringValue(s.svc.Config.Region)
+	signDate := now.Format(signDateFormat)
+	credential := strings.Join([]string{
+		creds.AccessKeyID, signDate, region, signServiceName, signRequestSuffix,
+	}, "/")
+
+	formData := map[string]string{
+		"key":              objectKey,
+		"x-amz-algorithm":  signAlgorithm,
+		"x-amz-credential": credential,
+		"x-amz-date":       now.Format(signTimeFormat),
+	}
+	if opts.ContentType != "" {
+		formData["Content-Type"] = opts.ContentType
+	}
+	if creds.SessionToken != "" {
+		formData["x-amz-security-token"] = creds.SessionToken
+	}
+	serverSideEncryption, sseKMSKeyID, storageClass := s.objectStorageInput()
+	if serverSideEncryption != nil {
+		formData["x-amz-server-side-encryption"] = *serverSideEncryption
+	}
+	if sseKMSKeyID != nil {
+		formData["x-amz-server-side-encryption-aws-kms-key-id"] = *sseKMSKeyID
+	}
+	if storageClass != nil {
+		formData["x-amz-storage-class"] = *storageClass
+	}
+
+	conditions := []any{
+		map[string]string{"bucket": s.bucketName},
+	}
+	for field, value := range formData {
+		conditions = append(conditions, map[string]string{field: value})
+	}
+	if opts.MaxSize > 0 {
+		conditions = append(conditions, []any{"content-length-range", 0, opts.MaxSize})
+	}
+	policyJSON, err := json.Marshal(map[string]any{
+		"expiration": expires.Format(policyTimeFormat),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return nil, errors.Wrap("policy encoding", err)
+	}
+	policy := base64.StdEncoding.EncodeToString(policyJSON)
+
+	signingKey := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), signDate)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, signServiceName)
+	signingKey = hmacSHA256(signingKey, signRequestSuffix)
+
+	formData["policy"] = policy
+	formData["x-amz-signature"] = hex.EncodeToString(hmacSHA256(signingKey, policy))
+
+	return &mediastore.PresignedRequest{
+		Method:   http.MethodPost,
+		URL:      postURL,
+		Header:   http.Header{},
+		FormData: formData,
+		Expires:  expires,
+	}, nil
+}
+
+// bucketURL resolves the URL of the bucket, in the addressing style the
+// client is configured with, by building an object request.
+func (s *Service) bucketURL(objectKey string) (string, error) {
+	req, _ := s.svc.PutObjectRequest(&s3.PutObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(objectKey),
+	})
+	if err := req.Build(); err != nil {
+		return "", errors.Wrap("resolve bucket URL", err)
+	}
+
+	u := *req.HTTPRequest.URL
+	u.Path = strings.TrimSuffix(u.Path, "/"+objectKey)
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawPath = ""
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
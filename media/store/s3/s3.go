@@ -1,25 +1,72 @@
 package s3
 
 import (
-	"bytes"
+	"context"
+	"fmt"
 	"io"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/logger"
 	mediastore "github.com/timemore/foundation/media/store"
 	"gopkg.in/yaml.v3"
 )
 
+var log = logger.NewPkgLogger()
+
 type Config struct {
 	Region          string `env:"REGION,required" yaml:"region" json:"region"`
 	BucketName      string `env:"BUCKET_NAME,required" yaml:"bucket_name" json:"bucket_name"`
+	BasePath        string `env:"BASE_PATH" yaml:"base_path" json:"base_path"`
 	AccessKeyID     string `env:"ACCESS_KEY_ID" yaml:"access_key_id" json:"access_key_id"`
 	SecretAccessKey string `env:"SECRET_ACCESS_KEY" yaml:"secret_access_key" json:"secret_access_key"`
+
+	// Endpoint is the URL of an S3-compatible service, e.g., LocalStack,
+	// Ceph or R2. The AWS endpoint of the region is used if it's empty.
+	Endpoint string `env:"ENDPOINT" yaml:"endpoint" json:"endpoint"`
+	// ForcePathStyle addresses the bucket in the path of the URL instead
+	// of the host name, which most S3-compatible services require.
+	ForcePathStyle bool `env:"FORCE_PATH_STYLE" yaml:"force_path_style" json:"force_path_style"`
+
+	// Profile is the profile of the shared configuration and credentials
+	// files. The credentials are looked up in the standard chain, i.e.,
+	// the environment, the shared files, the web identity token and the
+	// instance role, if AccessKeyID is empty.
+	Profile string `env:"PROFILE" yaml:"profile" json:"profile"`
+	// RoleARN is the role assumed with the credentials. With
+	// WebIdentityTokenFile, the role is assumed with the web identity
+	// token instead.
+	RoleARN              string `env:"ROLE_ARN" yaml:"role_arn" json:"role_arn"`
+	RoleSessionName      string `env:"ROLE_SESSION_NAME" yaml:"role_session_name" json:"role_session_name"`
+	RoleExternalID       string `env:"ROLE_EXTERNAL_ID" yaml:"role_external_id" json:"role_external_id"`
+	WebIdentityTokenFile string `env:"WEB_IDENTITY_TOKEN_FILE" yaml:"web_identity_token_file" json:"web_identity_token_file"`
+
+	// ServerSideEncryption is either "AES256", for SSE-S3, or "aws:kms",
+	// for SSE-KMS with the key SSEKMSKeyID, or the default key of the
+	// account if it's empty. The objects are stored with the default
+	// encryption of the bucket if it's empty.
+	ServerSideEncryption string `env:"SERVER_SIDE_ENCRYPTION" yaml:"server_side_encryption" json:"server_side_encryption"`
+	SSEKMSKeyID          string `env:"SSE_KMS_KEY_ID" yaml:"sse_kms_key_id" json:"sse_kms_key_id"`
+
+	// StorageClass is the storage class of the stored objects, e.g.,
+	// "STANDARD_IA". The default class of the service is used if it's
+	// empty.
+	StorageClass string `env:"STORAGE_CLASS" yaml:"storage_class" json:"storage_class"`
+
+	// BucketOperation allows the service to modify the configuration of
+	// the bucket, e.g., its lifecycle rules.
+	BucketOperation bool `env:"BUCKET_OPERATION" yaml:"bucket_operation" json:"bucket_operation"`
 }
 
 const ServiceName = "s3"
@@ -28,7 +75,7 @@ func init() {
 	mediastore.RegisterModule(
 		ServiceName,
 		mediastore.Module{
-			NewService: NewService,
+			NewServiceV2: NewServiceV2,
 			ServiceConfigSkeleton: func() mediastore.ServiceConfig {
 				cfg := ConfigSkeleton()
 				return &cfg
@@ -38,7 +85,18 @@ func init() {
 
 func ConfigSkeleton() Config { return Config{} }
 
+// NewService creates the service behind the legacy Service interface.
+//
+// Deprecated: use NewServiceV2.
 func NewService(config mediastore.ServiceConfig) (mediastore.Service, error) {
+	svc, err := NewServiceV2(config)
+	if err != nil {
+		return nil, err
+	}
+	return mediastore.LegacyService(svc), nil
+}
+
+func NewServiceV2(config mediastore.ServiceConfig) (mediastore.ServiceV2, error) {
 	if config == nil {
 		return nil, errors.ArgMsg("config", "missing")
 	}
@@ -56,20 +114,17 @@ func NewService(config mediastore.ServiceConfig) (mediastore.Service, error) {
 	if conf == nil || conf.Region == "" || conf.BucketName == "" {
 		return nil, errors.ArgMsg("config", "fields invalid")
 	}
-
-	var creds *credentials.Credentials
-	if conf.AccessKeyID != "" {
-		creds = credentials.NewStaticCredentials(
-			conf.AccessKeyID,
-			conf.SecretAccessKey,
-			"",
-		)
+	switch conf.ServerSideEncryption {
+	case "", s3.ServerSideEncryptionAes256:
+		if conf.SSEKMSKeyID != "" {
+			return nil, errors.ArgMsg("config.SSEKMSKeyID", "requires "+s3.ServerSideEncryptionAwsKms)
+		}
+	case s3.ServerSideEncryptionAwsKms:
+	default:
+		return nil, errors.ArgMsg("config.ServerSideEncryption", "unsupported")
 	}
 
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(conf.Region),
-		Credentials: creds,
-	})
+	sess, err := newSession(conf)
 	if err != nil {
 		return nil, errors.Wrap("AWS Session", err)
 	}
@@ -77,46 +132,197 @@ func NewService(config mediastore.ServiceConfig) (mediastore.Service, error) {
 	const uploadPartSize = 10 * 1024 * 1024 // 10MiB
 
 	return &Service{
-		bucketName: conf.BucketName,
+		bucketName:           conf.BucketName,
+		basePath:             mediastore.BasePath(conf.BasePath),
+		serverSideEncryption: conf.ServerSideEncryption,
+		sseKMSKeyID:          conf.SSEKMSKeyID,
+		storageClass:         conf.StorageClass,
+		bucketOperation:      conf.BucketOperation,
 		uploader: s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
 			u.PartSize = uploadPartSize
 		}),
-		downloader: s3manager.NewDownloader(sess),
-		svc:        s3.New(sess),
+		svc: s3.New(sess),
 	}, nil
 }
 
+// newSession creates the session with the static credentials of the
+// config, or with the standard chain, and then assumes the role if any.
+func newSession(conf *Config) (*session.Session, error) {
+	awsConfig := aws.Config{
+		Region:           aws.String(conf.Region),
+		S3ForcePathStyle: aws.Bool(conf.ForcePathStyle),
+	}
+	if conf.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(conf.Endpoint)
+	}
+	if conf.AccessKeyID != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(
+			conf.AccessKeyID,
+			conf.SecretAccessKey,
+			"",
+		)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            awsConfig,
+		Profile:           conf.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if conf.RoleARN == "" {
+		if conf.WebIdentityTokenFile != "" {
+			return nil, errors.ArgMsg("config.RoleARN", "required with WebIdentityTokenFile")
+		}
+		return sess, nil
+	}
+
+	roleSessionName := conf.RoleSessionName
+	if roleSessionName == "" {
+		roleSessionName = "mediastore-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	// The STS requests are made to AWS, not to the custom endpoint.
+	stsConfig := sess.Copy(&aws.Config{Endpoint: aws.String("")})
+	if conf.WebIdentityTokenFile != "" {
+		awsConfig.Credentials = stscreds.NewWebIdentityCredentials(
+			stsConfig, conf.RoleARN, roleSessionName, conf.WebIdentityTokenFile)
+	} else {
+		awsConfig.Credentials = stscreds.NewCredentials(stsConfig, conf.RoleARN,
+			func(p *stscreds.AssumeRoleProvider) {
+				p.RoleSessionName = roleSessionName
+				if conf.RoleExternalID != "" {
+					p.ExternalID = aws.String(conf.RoleExternalID)
+				}
+			})
+	}
+	return sess.Copy(&awsConfig), nil
+}
+
 type Service struct {
-	bucketName string
-	uploader   *s3manager.Uploader
-	svc        *s3.S3
-	downloader *s3manager.Downloader
+	bucketName           string
+	basePath             mediastore.BasePath
+	serverSideEncryption string
+	sseKMSKeyID          string
+	storageClass         string
+	bucketOperation      bool
+	uploader             *s3manager.Uploader
+	svc                  *s3.S3
 }
 
-func (s *Service) PutObject(targetKey string, contentSource io.Reader) (uploadInfo *mediastore.UploadInfo, err error) {
-	result, err := s.uploader.Upload(&s3manager.UploadInput{
+func (s *Service) PutObject(
+	ctx context.Context,
+	targetKey string,
+	contentSource io.Reader,
+	opts mediastore.PutObjectOptions,
+) (uploadInfo *mediastore.UploadInfo, err error) {
+	objectKey, err := s.basePath.ObjectKey(targetKey)
+	if err != nil {
+		return nil, err
+	}
+	// The seekable content is passed as it is as the uploader relies on
+	// seeking to upload the parts without buffering them.
+	var size int64 = -1
+	counter := &byteCounter{}
+	if seeker, ok := contentSource.(io.Seeker); ok {
+		size = seekableSize(seeker)
+	}
+	if size < 0 {
+		contentSource = io.TeeReader(contentSource, counter)
+	}
+	input := &s3manager.UploadInput{
 		Body:   contentSource,
 		Bucket: aws.String(s.bucketName),
-		Key:    aws.String(targetKey),
-	})
+		Key:    aws.String(objectKey),
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	if opts.CacheControl != "" {
+		input.CacheControl = aws.String(opts.CacheControl)
+	}
+	if opts.ContentDisposition != "" {
+		input.ContentDisposition = aws.String(opts.ContentDisposition)
+	}
+	if metadata := mediastore.NormalizeMetadata(opts.Metadata); metadata != nil {
+		input.Metadata = aws.StringMap(metadata)
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId, input.StorageClass = s.objectStorageInput()
+	result, err := s.uploader.UploadWithContext(ctx, input)
 	if err != nil {
 		return nil, errors.Wrap("upload", err)
 	}
+	if size < 0 {
+		size = counter.n
+	}
 
+	// S3 doesn't return the modification time of the uploaded object, the
+	// completion of the upload is close to it.
 	return &mediastore.UploadInfo{
-		Bucket:   *aws.String(s.bucketName),
-		Key:      *aws.String(targetKey),
-		UploadID: result.UploadID,
-		Location: result.Location,
+		Bucket:       s.bucketName,
+		Key:          targetKey,
+		ETag:         strings.Trim(aws.StringValue(result.ETag), `"`),
+		Size:         int(size),
+		LastModified: time.Now().UTC(),
+		UploadID:     result.UploadID,
+		Location:     result.Location,
 	}, nil
 }
 
-func (s *Service) GetPublicObject(sourceKey string) (targetURL string, err error) {
-	req, _ := s.svc.GetObjectRequest(&s3.GetObjectInput{
+// seekableSize returns the number of bytes from the current position to
+// the end, or -1 if it could not be determined.
+func seekableSize(seeker io.Seeker) int64 {
+	current, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return -1
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return -1
+	}
+	if _, err = seeker.Seek(current, io.SeekStart); err != nil {
+		return -1
+	}
+	return end - current
+}
+
+// byteCounter is a writer which only counts the bytes written to it.
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+func (s *Service) GetPublicObject(
+	ctx context.Context,
+	sourceKey string,
+	opts mediastore.PublicURLOptions,
+) (targetURL string, err error) {
+	expiry := opts.Expiry
+	if expiry <= 0 {
+		expiry = mediastore.PresignExpiryDefault
+	}
+
+	objectKey, err := s.basePath.ObjectKey(sourceKey)
+	if err != nil {
+		return "", err
+	}
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(s.bucketName),
-		Key:    aws.String(sourceKey),
-	})
-	targetURL, err = req.Presign(15 * time.Minute)
+		Key:    aws.String(objectKey),
+	}
+	if contentDisposition := opts.ContentDispositionHeader(); contentDisposition != "" {
+		input.ResponseContentDisposition = aws.String(contentDisposition)
+	}
+	if opts.ContentType != "" {
+		input.ResponseContentType = aws.String(opts.ContentType)
+	}
+	req, _ := s.svc.GetObjectRequest(input)
+	req.SetContext(ctx)
+	targetURL, err = req.Presign(expiry)
 
 	if err != nil {
 		return "", err
@@ -125,19 +331,323 @@ func (s *Service) GetPublicObject(sourceKey string) (targetURL string, err error
 	return targetURL, nil
 }
 
-func (s *Service) GetObject(sourceKey string) (stream *bytes.Buffer, err error) {
-	buff := &aws.WriteAtBuffer{}
-	_, err = s.downloader.Download(buff,
+func (s *Service) GetObject(ctx context.Context, sourceKey string) (object *mediastore.ObjectReader, err error) {
+	objectKey, err := s.basePath.ObjectKey(sourceKey)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.svc.GetObjectWithContext(ctx,
 		&s3.GetObjectInput{
 			Bucket: aws.String(s.bucketName),
-			Key:    aws.String(sourceKey),
+			Key:    aws.String(objectKey),
 		})
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return &mediastore.ObjectReader{
+		ReadCloser: result.Body,
+		Info: mediastore.ObjectInfo{
+			Key:                sourceKey,
+			Size:               aws.Int64Value(result.ContentLength),
+			ContentType:        aws.StringValue(result.ContentType),
+			CacheControl:       aws.StringValue(result.CacheControl),
+			ContentDisposition: aws.StringValue(result.ContentDisposition),
+			ETag:               strings.Trim(aws.StringValue(result.ETag), `"`),
+			LastModified:       aws.TimeValue(result.LastModified),
+			Metadata:           mediastore.NormalizeMetadata(aws.StringValueMap(result.Metadata)),
+		},
+	}, nil
+}
+
+func (s *Service) GetObjectRange(
+	ctx context.Context,
+	sourceKey string,
+	offset, length int64,
+) (object *mediastore.ObjectReader, err error) {
+	objectKey, err := s.basePath.ObjectKey(sourceKey)
 	if err != nil {
 		return nil, err
 	}
-	buf := new(bytes.Buffer)
-	buf.Read(buff.Bytes())
-	return buf, nil
+	head, err := s.StatObject(ctx, sourceKey)
+	if err != nil {
+		return nil, err
+	}
+	length, err = mediastore.ResolveRange(head.Size, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		// An empty range could not be requested.
+		return &mediastore.ObjectReader{
+			ReadCloser: io.NopCloser(strings.NewReader("")),
+			Info:       *head,
+		}, nil
+	}
+
+	// Read the same version of the object which has been stat-ed.
+	result, err := s.svc.GetObjectWithContext(ctx,
+		&s3.GetObjectInput{
+			Bucket:  aws.String(s.bucketName),
+			Key:     aws.String(objectKey),
+			Range:   aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+			IfMatch: aws.String(`"` + head.ETag + `"`),
+		})
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return &mediastore.ObjectReader{
+		ReadCloser: result.Body,
+		Info:       *head,
+	}, nil
 }
 
-var _ mediastore.Service = &Service{}
+func (s *Service) ListObjects(
+	ctx context.Context,
+	prefix string,
+	pageToken string,
+	limit int,
+) (*mediastore.ObjectList, error) {
+	if limit <= 0 {
+		limit = mediastore.ListObjectsLimitDefault
+	}
+
+	prefixKey, err := s.basePath.PrefixKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucketName),
+		Prefix:  aws.String(prefixKey),
+		MaxKeys: aws.Int64(int64(limit)),
+	}
+	if pageToken != "" {
+		input.ContinuationToken = aws.String(pageToken)
+	}
+	output, err := s.svc.ListObjectsV2WithContext(ctx, input)
+	if err != nil {
+		return nil, errors.Wrap("list objects", err)
+	}
+
+	objects := make([]mediastore.ObjectInfo, 0, len(output.Contents))
+	for _, obj := range output.Contents {
+		objects = append(objects, mediastore.ObjectInfo{
+			Key:          s.basePath.RelativeKey(aws.StringValue(obj.Key)),
+			Size:         aws.Int64Value(obj.Size),
+			ETag:         strings.Trim(aws.StringValue(obj.ETag), `"`),
+			LastModified: aws.TimeValue(obj.LastModified),
+		})
+	}
+
+	result := &mediastore.ObjectList{Objects: objects}
+	if aws.BoolValue(output.IsTruncated) {
+		result.NextPageToken = aws.StringValue(output.NextContinuationToken)
+	}
+
+	return result, nil
+}
+
+func (s *Service) DeleteObject(ctx context.Context, sourceKey string) error {
+	objectKey, err := s.basePath.ObjectKey(sourceKey)
+	if err != nil {
+		return err
+	}
+	// Deleting an object which does not exist is not an error for S3.
+	_, err = s.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		return errors.Wrap("delete object", err)
+	}
+	return nil
+}
+
+func (s *Service) StatObject(ctx context.Context, sourceKey string) (*mediastore.ObjectInfo, error) {
+	objectKey, err := s.basePath.ObjectKey(sourceKey)
+	if err != nil {
+		return nil, err
+	}
+	output, err := s.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		return nil, errors.Wrap("head object", translateError(err))
+	}
+
+	return &mediastore.ObjectInfo{
+		Key:                sourceKey,
+		Size:               aws.Int64Value(output.ContentLength),
+		ContentType:        aws.StringValue(output.ContentType),
+		CacheControl:       aws.StringValue(output.CacheControl),
+		ContentDisposition: aws.StringValue(output.ContentDisposition),
+		ETag:               strings.Trim(aws.StringValue(output.ETag), `"`),
+		LastModified:       aws.TimeValue(output.LastModified),
+		Metadata:           mediastore.NormalizeMetadata(aws.StringValueMap(output.Metadata)),
+	}, nil
+}
+
+// copyObjectSizeMax is the size of the largest object S3 copies with a
+// single request.
+const copyObjectSizeMax = 5 * 1024 * 1024 * 1024 // 5GiB
+
+// CopyObject copies the object with a single request up to 5GiB, the
+// limit of S3, and part by part above, see copyObjectMultipart.
+func (s *Service) CopyObject(ctx context.Context, srcKey, dstKey string) error {
+	srcObjectKey, err := s.basePath.ObjectKey(srcKey)
+	if err != nil {
+		return err
+	}
+	dstObjectKey, err := s.basePath.ObjectKey(dstKey)
+	if err != nil {
+		return err
+	}
+	head, err := s.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(srcObjectKey),
+	})
+	if err != nil {
+		return errors.Wrap("head object", translateError(err))
+	}
+	copySource := url.URL{Path: s.bucketName + "/" + srcObjectKey}
+	if aws.Int64Value(head.ContentLength) > copyObjectSizeMax {
+		return s.copyObjectMultipart(ctx, copySource.EscapedPath(), dstObjectKey, head)
+	}
+
+	// The metadata of the source object is copied by default, but not
+	// its encryption nor its storage class.
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucketName),
+		Key:               aws.String(dstObjectKey),
+		CopySource:        aws.String(copySource.EscapedPath()),
+		CopySourceIfMatch: head.ETag,
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId, input.StorageClass = s.objectStorageInput()
+	_, err = s.svc.CopyObjectWithContext(ctx, input)
+	if err != nil {
+		return errors.Wrap("copy object", translateError(err))
+	}
+	return nil
+}
+
+// MoveObject copies the object and then deletes the source, S3 doesn't
+// provide a rename.
+func (s *Service) MoveObject(ctx context.Context, srcKey, dstKey string) error {
+	if err := s.CopyObject(ctx, srcKey, dstKey); err != nil {
+		return err
+	}
+	return s.DeleteObject(ctx, srcKey)
+}
+
+// HealthCheck checks that the bucket is reachable with the credentials
+// and that the objects could be written.
+func (s *Service) HealthCheck(ctx context.Context) error {
+	_, err := s.svc.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s.bucketName),
+	})
+	if err != nil {
+		return errors.Wrap("head bucket", err)
+	}
+	return mediastore.CheckWritable(ctx, s)
+}
+
+// SetLifecycle replaces the lifecycle configuration of the bucket with
+// the expirations and the transitions of the rules. The bucket is left as
+// it is if BucketOperation is not enabled.
+func (s *Service) SetLifecycle(ctx context.Context, config mediastore.LifecycleConfig) error {
+	if !s.bucketOperation {
+		log.Warn().Str("bucket", s.bucketName).
+			Msg("Bucket operation disabled, the lifecycle rules must be configured on the bucket")
+		return nil
+	}
+
+	var rules []*s3.LifecycleRule
+	for i, rule := range config.Rules {
+		if rule.ExpirationDays == 0 && len(rule.Transitions) == 0 {
+			continue
+		}
+		prefixKey, err := s.basePath.PrefixKey(rule.Prefix)
+		if err != nil {
+			return errors.Wrap("rule prefix", err)
+		}
+		lifecycleRule := &s3.LifecycleRule{
+			ID:     aws.String(rule.RuleID(i)),
+			Filter: &s3.LifecycleRuleFilter{Prefix: aws.String(prefixKey)},
+			Status: aws.String(s3.ExpirationStatusEnabled),
+		}
+		if rule.ExpirationDays > 0 {
+			lifecycleRule.Expiration = &s3.LifecycleExpiration{Days: aws.Int64(int64(rule.ExpirationDays))}
+		}
+		for _, transition := range rule.Transitions {
+			lifecycleRule.Transitions = append(lifecycleRule.Transitions, &s3.Transition{
+				Days:         aws.Int64(int64(transition.Days)),
+				StorageClass: aws.String(transition.StorageClass),
+			})
+		}
+		rules = append(rules, lifecycleRule)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	_, err := s.svc.PutBucketLifecycleConfigurationWithContext(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(s.bucketName),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: rules},
+	})
+	if err != nil {
+		return errors.Wrap("put bucket lifecycle", err)
+	}
+	return nil
+}
+
+// objectStorageInput returns the encryption and the storage class of the
+// objects to set into the requests which store them. They are nil if they
+// are not configured.
+func (s *Service) objectStorageInput() (serverSideEncryption, sseKMSKeyID, storageClass *string) {
+	if s.serverSideEncryption != "" {
+		serverSideEncryption = aws.String(s.serverSideEncryption)
+	}
+	if s.sseKMSKeyID != "" {
+		sseKMSKeyID = aws.String(s.sseKMSKeyID)
+	}
+	if s.storageClass != "" {
+		storageClass = aws.String(s.storageClass)
+	}
+	return serverSideEncryption, sseKMSKeyID, storageClass
+}
+
+var _ mediastore.ServiceV2 = &Service{}
+var _ mediastore.Copier = &Service{}
+var _ mediastore.Presigner = &Service{}
+var _ mediastore.MultipartUploader = &Service{}
+var _ mediastore.HealthChecker = &Service{}
+var _ mediastore.LifecycleConfigurer = &Service{}
+
+// ClassifyError relies on the SDK, which retries the transient errors
+// itself, to tell the retryable errors apart.
+func (s *Service) ClassifyError(err error) mediastore.ErrorClass {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return mediastore.ErrorClassUnknown
+	}
+	if request.IsErrorRetryable(aerr) || request.IsErrorThrottle(aerr) {
+		return mediastore.ErrorClassRetryable
+	}
+	return mediastore.ErrorClassUnknown
+}
+
+var _ mediastore.ErrorClassifier = &Service{}
+
+// translateError maps the errors of the SDK into the errors defined by
+// mediastore.
+func translateError(err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return mediastore.ErrObjectNotFound
+		case s3.ErrCodeNoSuchUpload:
+			return mediastore.ErrUploadNotFound
+		}
+	}
+	return err
+}
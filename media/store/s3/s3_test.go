@@ -1 +1,589 @@
 package s3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+func TestBasePathEscape(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNotImplemented)
+	}))
+	defer srv.Close()
+	svc, err := NewServiceV2(&Config{
+		Region:          "us-east-1",
+		BucketName:      "bucket",
+		BasePath:        "tenant",
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+		Endpoint:        srv.URL,
+		ForcePathStyle:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := svc.(*Service)
+	ctx := context.Background()
+
+	testCases := []struct {
+		name string
+		call func() error
+	}{
+		{"put", func() error {
+			_, err := s.PutObject(ctx, "../other/x", strings.NewReader("x"), mediastore.PutObjectOptions{})
+			return err
+		}},
+		{"get", func() error {
+			_, err := s.GetObject(ctx, "../other/x")
+			return err
+		}},
+		{"get range", func() error {
+			_, err := s.GetObjectRange(ctx, "a/../../other/x", 0, 1)
+			return err
+		}},
+		{"public URL", func() error {
+			_, err := s.GetPublicObject(ctx, "../other/x", mediastore.PublicURLOptions{})
+			return err
+		}},
+		{"list", func() error {
+			_, err := s.ListObjects(ctx, "../other/", "", 10)
+			return err
+		}},
+		{"delete", func() error { return s.DeleteObject(ctx, "../other/x") }},
+		{"stat", func() error {
+			_, err := s.StatObject(ctx, "..")
+			return err
+		}},
+		{"presign", func() error {
+			_, err := s.PresignPutObject(ctx, "../other/x", mediastore.PresignPutOptions{})
+			return err
+		}},
+		{"copy from", func() error { return s.CopyObject(ctx, "../other/x", "x") }},
+		{"copy to", func() error { return s.CopyObject(ctx, "x", "../other/x") }},
+		{"initiate upload", func() error {
+			_, err := s.InitiateUpload(ctx, "../other/x", mediastore.PutObjectOptions{})
+			return err
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var argErr errors.ArgumentError
+			if err := tc.call(); !errors.As(err, &argErr) {
+				t.Errorf("got %v, want an argument error", err)
+			}
+		})
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("%d requests sent to the backend", n)
+	}
+}
+
+func TestGetPublicObject(t *testing.T) {
+	svc, err := NewServiceV2(&Config{
+		Region:          "us-east-1",
+		BucketName:      "bucket",
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name    string
+		opts    mediastore.PublicURLOptions
+		expires string
+		query   map[string]string
+	}{
+		{name: "default", expires: "900"},
+		{name: "expiry", opts: mediastore.PublicURLOptions{Expiry: time.Hour}, expires: "3600"},
+		{name: "response overrides", opts: mediastore.PublicURLOptions{ContentType: "text/plain"},
+			expires: "900", query: map[string]string{"response-content-type": "text/plain"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			publicURL, err := svc.GetPublicObject(context.Background(), "key", tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(publicURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query := u.Query()
+			if got := query.Get("X-Amz-Expires"); got != tc.expires {
+				t.Errorf("expires: got %q, want %q", got, tc.expires)
+			}
+			for name, value := range tc.query {
+				if got := query.Get(name); got != value {
+					t.Errorf("%s: got %q, want %q", name, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestObjectAttributes(t *testing.T) {
+	var putHeader http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		switch r.Method {
+		case http.MethodPut:
+			putHeader = r.Header.Clone()
+			w.Header().Set("ETag", `"etag"`)
+		case http.MethodHead:
+			header := w.Header()
+			header.Set("Content-Length", "7")
+			header.Set("Content-Type", "text/csv")
+			header.Set("Cache-Control", "no-cache")
+			header.Set("Content-Disposition", "inline")
+			header.Set("ETag", `"etag"`)
+			header.Set("Last-Modified", "Wed, 05 Apr 2023 10:00:00 GMT")
+			header.Set("X-Amz-Meta-Owner", "acme")
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	defer srv.Close()
+	svc, err := NewServiceV2(&Config{
+		Region:          "us-east-1",
+		BucketName:      "bucket",
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+		Endpoint:        srv.URL,
+		ForcePathStyle:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	_, err = svc.PutObject(ctx, "key", strings.NewReader("content"), mediastore.PutObjectOptions{
+		ContentType:        "text/csv",
+		CacheControl:       "no-cache",
+		ContentDisposition: "inline",
+		Metadata:           map[string]string{"Owner": "acme"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range map[string]string{
+		"Content-Type":        "text/csv",
+		"Cache-Control":       "no-cache",
+		"Content-Disposition": "inline",
+		"X-Amz-Meta-Owner":    "acme",
+	} {
+		if got := putHeader.Get(name); got != value {
+			t.Errorf("put %s: got %q, want %q", name, got, value)
+		}
+	}
+
+	info, err := svc.StatObject(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mediastore.ObjectInfo{
+		Key:                "key",
+		Size:               7,
+		ContentType:        "text/csv",
+		CacheControl:       "no-cache",
+		ContentDisposition: "inline",
+		ETag:               "etag",
+		LastModified:       time.Date(2023, 4, 5, 10, 0, 0, 0, time.UTC),
+		Metadata:           map[string]string{"owner": "acme"},
+	}
+	if !reflect.DeepEqual(*info, want) {
+		t.Errorf("stat: got %+v, want %+v", *info, want)
+	}
+}
+
+// copyRecorder is a fake S3 endpoint for the copies of an object of the
+// given size, which records the ranges of the copied parts.
+type copyRecorder struct {
+	size int64
+
+	mu           sync.Mutex
+	singleCopies int
+	uploadHeader http.Header
+	ranges       []string
+	completed    bool
+}
+
+func (c *copyRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, _ = io.Copy(io.Discard, r.Body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	query := r.URL.Query()
+	w.Header().Set("Content-Type", "application/xml")
+	switch {
+	case r.Method == http.MethodHead:
+		header := w.Header()
+		header.Set("Content-Length", strconv.FormatInt(c.size, 10))
+		header.Set("Content-Type", "video/mp4")
+		header.Set("Cache-Control", "no-cache")
+		header.Set("ETag", `"source"`)
+		header.Set("Last-Modified", "Wed, 05 Apr 2023 10:00:00 GMT")
+		header.Set("X-Amz-Meta-Owner", "acme")
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source-If-Match") != `"source"`:
+		w.WriteHeader(http.StatusPreconditionFailed)
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		c.ranges = append(c.ranges, r.Header.Get("X-Amz-Copy-Source-Range"))
+		_, _ = io.WriteString(w, `<CopyPartResult><ETag>"part"</ETag>`+
+			`<LastModified>2023-04-05T10:00:00.000Z</LastModified></CopyPartResult>`)
+	case r.Method == http.MethodPut:
+		c.singleCopies++
+		_, _ = io.WriteString(w, `<CopyObjectResult><ETag>"copy"</ETag>`+
+			`<LastModified>2023-04-05T10:00:00.000Z</LastModified></CopyObjectResult>`)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		c.uploadHeader = r.Header.Clone()
+		_, _ = io.WriteString(w, `<InitiateMultipartUploadResult><Bucket>bucket</Bucket>`+
+			`<Key>copy</Key><UploadId>upload</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		c.completed = true
+		_, _ = io.WriteString(w, `<CompleteMultipartUploadResult><Bucket>bucket</Bucket>`+
+			`<Key>copy</Key><ETag>"copy"</ETag></CompleteMultipartUploadResult>`)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// checkRanges checks that the ranges are contiguous and cover the object.
+func (c *copyRecorder) checkRanges(t *testing.T) {
+	t.Helper()
+	var next int64
+	for _, r := range c.ranges {
+		var start, end int64
+		if _, err := fmt.Sscanf(r, "bytes=%d-%d", &start, &end); err != nil || start != next || end < start {
+			t.Fatalf("ranges: got %v", c.ranges)
+		}
+		next = end + 1
+	}
+	if next != c.size {
+		t.Errorf("copied %d bytes of %d", next, c.size)
+	}
+}
+
+func TestCopyObject(t *testing.T) {
+	for _, size := range []int64{1024, copyObjectSizeMax + 1, 6000 * copyPartSizeMin} {
+		t.Run(strconv.FormatInt(size, 10), func(t *testing.T) {
+			recorder := &copyRecorder{size: size}
+			srv := httptest.NewServer(recorder)
+			defer srv.Close()
+			svc, err := NewServiceV2(&Config{
+				Region:          "us-east-1",
+				BucketName:      "bucket",
+				AccessKeyID:     "access",
+				SecretAccessKey: "secret",
+				Endpoint:        srv.URL,
+				ForcePathStyle:  true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = svc.(*Service).CopyObject(context.Background(), "source", "copy"); err != nil {
+				t.Fatal(err)
+			}
+
+			if size <= copyObjectSizeMax {
+				if recorder.singleCopies != 1 || recorder.ranges != nil {
+					t.Errorf("got %d copies and %d parts, want a single copy",
+						recorder.singleCopies, len(recorder.ranges))
+				}
+				return
+			}
+			if recorder.singleCopies != 0 || !recorder.completed {
+				t.Fatalf("got %d single copies, completed: %v", recorder.singleCopies, recorder.completed)
+			}
+			recorder.checkRanges(t)
+			if n := len(recorder.ranges); n > copyPartsMax {
+				t.Errorf("%d parts", n)
+			}
+			for name, value := range map[string]string{
+				"Content-Type":     "video/mp4",
+				"Cache-Control":    "no-cache",
+				"X-Amz-Meta-Owner": "acme",
+			} {
+				if got := recorder.uploadHeader.Get(name); got != value {
+					t.Errorf("upload %s: got %q, want %q", name, got, value)
+				}
+			}
+		})
+	}
+}
+
+// requestRecorder is a fake S3 endpoint which accepts the uploads and
+// records their requests.
+type requestRecorder struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []int
+}
+
+func (rr *requestRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n, _ := io.Copy(io.Discard, r.Body)
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.requests = append(rr.requests, r.Clone(context.Background()))
+	rr.bodies = append(rr.bodies, int(n))
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("ETag", `"etag"`)
+}
+
+func TestServiceConfig(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config Config
+		path   string
+		header map[string]string
+	}{
+		{name: "default", path: "/bucket/key",
+			header: map[string]string{
+				"X-Amz-Server-Side-Encryption": "",
+				"X-Amz-Storage-Class":          "",
+			}},
+		{name: "base path", config: Config{BasePath: "tenant/media"}, path: "/bucket/tenant/media/key"},
+		{name: "SSE-S3", config: Config{ServerSideEncryption: "AES256"}, path: "/bucket/key",
+			header: map[string]string{
+				"X-Amz-Server-Side-Encryption":                "AES256",
+				"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "",
+			}},
+		{name: "SSE-KMS", config: Config{ServerSideEncryption: "aws:kms", SSEKMSKeyID: "key-id"}, path: "/bucket/key",
+			header: map[string]string{
+				"X-Amz-Server-Side-Encryption":                "aws:kms",
+				"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "key-id",
+			}},
+		{name: "storage class", config: Config{StorageClass: "STANDARD_IA"}, path: "/bucket/key",
+			header: map[string]string{"X-Amz-Storage-Class": "STANDARD_IA"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := &requestRecorder{}
+			srv := httptest.NewServer(recorder)
+			defer srv.Close()
+			config := tc.config
+			config.Region = "us-east-1"
+			config.BucketName = "bucket"
+			config.AccessKeyID = "access"
+			config.SecretAccessKey = "secret"
+			config.Endpoint = srv.URL
+			config.ForcePathStyle = true
+			svc, err := NewServiceV2(&config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now().UTC()
+			info, err := svc.PutObject(context.Background(), "key", strings.NewReader("content"),
+				mediastore.PutObjectOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Key != "key" || info.Bucket != "bucket" || info.ETag != "etag" {
+				t.Errorf("upload info: got %+v", *info)
+			}
+			if len(recorder.requests) != 1 {
+				t.Fatalf("got %d requests", len(recorder.requests))
+			}
+			r := recorder.requests[0]
+			if r.URL.Path != tc.path {
+				t.Errorf("path: got %q, want %q", r.URL.Path, tc.path)
+			}
+			if r.Host != strings.TrimPrefix(srv.URL, "http://") {
+				t.Errorf("host: got %q, want the endpoint", r.Host)
+			}
+			for name, value := range tc.header {
+				if got := r.Header.Get(name); got != value {
+					t.Errorf("%s: got %q, want %q", name, got, value)
+				}
+			}
+			if auth := r.Header.Get("Authorization"); !strings.Contains(auth, "Credential=access/") {
+				t.Errorf("authorization: got %q", auth)
+			}
+			if info.LastModified.Before(start) {
+				t.Errorf("last modified: got %v, before %v", info.LastModified, start)
+			}
+		})
+	}
+}
+
+func TestServiceConfigInvalid(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config Config
+	}{
+		{"region missing", Config{BucketName: "bucket"}},
+		{"bucket missing", Config{Region: "us-east-1"}},
+		{"SSE unsupported", Config{Region: "us-east-1", BucketName: "bucket", ServerSideEncryption: "aws:kms:dsse"}},
+		{"KMS key without SSE-KMS", Config{Region: "us-east-1", BucketName: "bucket", SSEKMSKeyID: "key-id"}},
+		{"KMS key with SSE-S3", Config{Region: "us-east-1", BucketName: "bucket",
+			ServerSideEncryption: "AES256", SSEKMSKeyID: "key-id"}},
+		{"web identity without role", Config{Region: "us-east-1", BucketName: "bucket",
+			WebIdentityTokenFile: "/var/run/secrets/token"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := tc.config
+			if _, err := NewServiceV2(&config); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+// The bucket is in the host name, which isn't resolved for the presigned
+// URLs, unless ForcePathStyle is set.
+func TestServiceConfigAddressing(t *testing.T) {
+	testCases := []struct {
+		name           string
+		forcePathStyle bool
+		host, path     string
+	}{
+		{"virtual-hosted", false, "bucket.storage.example.com", "/key"},
+		{"path-style", true, "storage.example.com", "/bucket/key"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, err := NewServiceV2(&Config{
+				Region:          "us-east-1",
+				BucketName:      "bucket",
+				AccessKeyID:     "access",
+				SecretAccessKey: "secret",
+				Endpoint:        "https://storage.example.com",
+				ForcePathStyle:  tc.forcePathStyle,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			publicURL, err := svc.GetPublicObject(context.Background(), "key", mediastore.PublicURLOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(publicURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Host != tc.host || u.Path != tc.path {
+				t.Errorf("got %s%s, want %s%s", u.Host, u.Path, tc.host, tc.path)
+			}
+		})
+	}
+}
+
+func TestServiceConfigCredentials(t *testing.T) {
+	credentialsFile := filepath.Join(t.TempDir(), "credentials")
+	err := os.WriteFile(credentialsFile, []byte("[media]\n"+
+		"aws_access_key_id = profile-access\n"+
+		"aws_secret_access_key = profile-secret\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_ROLE_ARN", "")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "env-access")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+
+	testCases := []struct {
+		name   string
+		config Config
+		access string
+	}{
+		{"static", Config{AccessKeyID: "access", SecretAccessKey: "secret"}, "access"},
+		{"environment", Config{}, "env-access"},
+		{"profile", Config{Profile: "media"}, "profile-access"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := tc.config
+			config.Region = "us-east-1"
+			config.BucketName = "bucket"
+			svc, err := NewServiceV2(&config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			publicURL, err := svc.GetPublicObject(context.Background(), "key", mediastore.PublicURLOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(publicURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := u.Query().Get("X-Amz-Credential"); !strings.HasPrefix(got, tc.access+"/") {
+				t.Errorf("credential: got %q, want %s", got, tc.access)
+			}
+		})
+	}
+}
+
+func TestPutObjectSize(t *testing.T) {
+	recorder := &requestRecorder{}
+	srv := httptest.NewServer(recorder)
+	defer srv.Close()
+	svc, err := NewServiceV2(&Config{
+		Region:          "us-east-1",
+		BucketName:      "bucket",
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+		Endpoint:        srv.URL,
+		ForcePathStyle:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seekable := strings.NewReader("skipped content")
+	if _, err = seekable.Seek(8, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name    string
+		content io.Reader
+		size    int
+	}{
+		{"seekable", strings.NewReader("content"), 7},
+		{"seeked", seekable, 7},
+		{"stream", io.MultiReader(strings.NewReader("stream "), strings.NewReader("content")), 14},
+		{"empty", io.MultiReader(), 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			info, err := svc.PutObject(context.Background(), "key", tc.content, mediastore.PutObjectOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size != tc.size {
+				t.Errorf("size: got %d, want %d", info.Size, tc.size)
+			}
+			if uploaded := recorder.bodies[len(recorder.bodies)-1]; uploaded != tc.size {
+				t.Errorf("uploaded %d bytes, want %d", uploaded, tc.size)
+			}
+			if info.LastModified.IsZero() {
+				t.Error("last modified: got zero")
+			}
+		})
+	}
+}
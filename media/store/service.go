@@ -2,13 +2,193 @@ package store
 
 import (
 	"bytes"
+	"context"
 	"io"
+
+	"github.com/timemore/foundation/errors"
 )
 
 type ServiceConfig any
 
+// Service is the original storage backend contract. It does not accept a
+// context and buffers the whole object in memory on download.
+//
+// Deprecated: implement ServiceV2 instead. Modules which still provide a
+// Service are adapted with AdaptLegacyService.
 type Service interface {
 	PutObject(objectKey string, content io.Reader) (uploadInfo *UploadInfo, err error)
 	GetObject(objectKey string) (stream *bytes.Buffer, err error)
 	GetPublicObject(objectKey string) (string, error)
 }
+
+// ServiceV2 is the context-aware storage backend contract. Every call
+// accepts a context so that callers are able to cancel or bound the
+// operation, and objects are streamed instead of buffered.
+//
+// The other operations are optional, a service provides them by
+// implementing Copier, Presigner, MultipartUploader or HealthChecker. They
+// are called through CopyObject, MoveObject, PresignPutObject,
+// GetMultipartUploader and HealthCheck.
+type ServiceV2 interface {
+	// PutObject stores the content and the attributes in opts as the
+	// object.
+	PutObject(ctx context.Context, objectKey string, content io.Reader, opts PutObjectOptions) (uploadInfo *UploadInfo, err error)
+
+	// GetObject returns a stream of the object content along with the
+	// object information. The caller is responsible to close the stream.
+	GetObject(ctx context.Context, objectKey string) (object *ObjectReader, err error)
+
+	// GetObjectRange is like GetObject but the stream only contains
+	// length bytes starting at offset. A negative length means up to
+	// the end of the object. See ResolveRange for the valid ranges.
+	GetObjectRange(ctx context.Context, objectKey string, offset, length int64) (object *ObjectReader, err error)
+
+	// GetPublicObject returns a URL which allows anyone to download the
+	// object until it expires.
+	GetPublicObject(ctx context.Context, objectKey string, opts PublicURLOptions) (string, error)
+
+	// ListObjects returns a page of objects whose key starts with prefix,
+	// ordered by key. The pageToken is the NextPageToken of the previous
+	// page, or empty for the first page. Implementations should use
+	// ListObjectsLimitDefault if limit is not positive.
+	ListObjects(ctx context.Context, prefix string, pageToken string, limit int) (*ObjectList, error)
+
+	// DeleteObject removes the object. Deleting an object which does not
+	// exist is not an error.
+	DeleteObject(ctx context.Context, objectKey string) error
+
+	// StatObject returns the information of the object. It returns an
+	// error which wraps ErrObjectNotFound if the object does not exist.
+	StatObject(ctx context.Context, objectKey string) (*ObjectInfo, error)
+}
+
+// Copier is implemented by the services which copy the objects within the
+// backend, without downloading them.
+type Copier interface {
+	// CopyObject copies the object, including its attributes, within the
+	// backend. An existing object at dstKey is replaced.
+	CopyObject(ctx context.Context, srcKey, dstKey string) error
+
+	// MoveObject is like CopyObject but the source object is removed. The
+	// operation is not atomic on backends without a native rename.
+	MoveObject(ctx context.Context, srcKey, dstKey string) error
+}
+
+// Presigner is implemented by the services which allow the clients to
+// upload the objects directly.
+type Presigner interface {
+	// PresignPutObject creates a request which allows a client to upload
+	// the object directly to the backend, constrained by opts.
+	PresignPutObject(ctx context.Context, objectKey string, opts PresignPutOptions) (*PresignedRequest, error)
+}
+
+// MultipartUploader is implemented by the services which are able to
+// upload an object in parts.
+type MultipartUploader interface {
+	// InitiateUpload starts a session to upload the object in parts. The
+	// attributes in opts are applied when the upload completes.
+	InitiateUpload(ctx context.Context, objectKey string, opts PutObjectOptions) (uploadID string, err error)
+
+	// UploadPart stores the part partNumber of the upload. The size is
+	// -1 if it's not known. Uploading a part again replaces it.
+	UploadPart(ctx context.Context, objectKey, uploadID string, partNumber int, content io.Reader, size int64) (*UploadPart, error)
+
+	// ListUploadParts returns the uploaded parts ordered by part number.
+	ListUploadParts(ctx context.Context, objectKey, uploadID string) ([]UploadPart, error)
+
+	// CompleteUpload assembles the uploaded parts, in order of part
+	// number, into the object and ends the session.
+	CompleteUpload(ctx context.Context, objectKey, uploadID string) (*UploadInfo, error)
+
+	// AbortUpload ends the session and discards the uploaded parts.
+	AbortUpload(ctx context.Context, objectKey, uploadID string) error
+
+	// ListUploads returns the sessions in progress for the objects whose
+	// key starts with prefix.
+	ListUploads(ctx context.Context, prefix string) ([]UploadSession, error)
+}
+
+// HealthChecker is implemented by the services which are able to tell
+// whether their backend is usable.
+type HealthChecker interface {
+	// HealthCheck returns an error if the backend is not usable, e.g.,
+	// the bucket does not exist, the credentials are not valid anymore or
+	// the objects could not be written. See CheckWritable.
+	HealthCheck(ctx context.Context) error
+}
+
+// CopyObject copies the object with the Copier of the service. If the
+// service is not a Copier, the object is downloaded and uploaded again
+// along with its attributes.
+func CopyObject(ctx context.Context, svc ServiceV2, srcKey, dstKey string) error {
+	if copier, ok := svc.(Copier); ok {
+		return copier.CopyObject(ctx, srcKey, dstKey)
+	}
+	object, err := svc.GetObject(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+	_, err = svc.PutObject(ctx, dstKey, object, PutObjectOptions{
+		ContentType:        object.Info.ContentType,
+		CacheControl:       object.Info.CacheControl,
+		ContentDisposition: object.Info.ContentDisposition,
+		Metadata:           object.Info.Metadata,
+	})
+	return err
+}
+
+// MoveObject moves the object with the Copier of the service. If the
+// service is not a Copier, the object is copied with CopyObject then
+// deleted.
+func MoveObject(ctx context.Context, svc ServiceV2, srcKey, dstKey string) error {
+	if copier, ok := svc.(Copier); ok {
+		return copier.MoveObject(ctx, srcKey, dstKey)
+	}
+	if err := CopyObject(ctx, svc, srcKey, dstKey); err != nil {
+		return err
+	}
+	return svc.DeleteObject(ctx, srcKey)
+}
+
+// PresignPutObject calls the Presigner of the service. It returns
+// errors.ErrUnimplemented if the service is not a Presigner.
+func PresignPutObject(
+	ctx context.Context,
+	svc ServiceV2,
+	objectKey string,
+	opts PresignPutOptions,
+) (*PresignedRequest, error) {
+	presigner, ok := svc.(Presigner)
+	if !ok {
+		return nil, errors.ErrUnimplemented
+	}
+	return presigner.PresignPutObject(ctx, objectKey, opts)
+}
+
+// GetMultipartUploader returns the service as a MultipartUploader. It
+// returns errors.ErrUnimplemented if the service is not one.
+func GetMultipartUploader(svc ServiceV2) (MultipartUploader, error) {
+	uploader, ok := svc.(MultipartUploader)
+	if !ok {
+		return nil, errors.ErrUnimplemented
+	}
+	return uploader, nil
+}
+
+// HealthCheck calls the HealthChecker of the service. It returns
+// errors.ErrUnimplemented if the service is not a HealthChecker.
+func HealthCheck(ctx context.Context, svc ServiceV2) error {
+	checker, ok := svc.(HealthChecker)
+	if !ok {
+		return errors.ErrUnimplemented
+	}
+	return checker.HealthCheck(ctx)
+}
+
+// PublicBaseURLSetter is implemented by the services which serve the
+// objects themselves, e.g., the local module, to be provided the URL where
+// they are reachable. Store.New provides Config.ImagesBaseURL to them.
+type PublicBaseURLSetter interface {
+	SetPublicBaseURL(baseURL string) error
+}
@@ -0,0 +1,144 @@
+package store_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/media"
+	mediastore "github.com/timemore/foundation/media/store"
+)
+
+// bareService only provides the operations of ServiceV2.
+type bareService struct {
+	mediastore.ServiceV2
+}
+
+func TestOptionalOperations(t *testing.T) {
+	backend := newMemoryService(t)
+	svc := bareService{backend}
+	ctx := context.Background()
+	_, err := backend.PutObject(ctx, "src", strings.NewReader("content"), mediastore.PutObjectOptions{
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"owner": "acme"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = mediastore.CopyObject(ctx, svc, "src", "copy"); err != nil {
+		t.Fatal(err)
+	}
+	if err = mediastore.MoveObject(ctx, svc, "copy", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, backend, "moved"); got != "content" {
+		t.Errorf("content: got %q", got)
+	}
+	info, err := backend.StatObject(ctx, "moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentType != "text/plain" || info.Metadata["owner"] != "acme" {
+		t.Errorf("attributes not copied: %+v", info)
+	}
+	if _, err = backend.StatObject(ctx, "copy"); !errors.Is(err, mediastore.ErrObjectNotFound) {
+		t.Errorf("source of the move: got %v, want ErrObjectNotFound", err)
+	}
+
+	if _, err = mediastore.PresignPutObject(ctx, svc, "key", mediastore.PresignPutOptions{}); !errors.Is(err, errors.ErrUnimplemented) {
+		t.Errorf("presign: got %v, want ErrUnimplemented", err)
+	}
+	if _, err = mediastore.GetMultipartUploader(svc); !errors.Is(err, errors.ErrUnimplemented) {
+		t.Errorf("multipart: got %v, want ErrUnimplemented", err)
+	}
+	if err = mediastore.HealthCheck(ctx, svc); !errors.Is(err, errors.ErrUnimplemented) {
+		t.Errorf("health check: got %v, want ErrUnimplemented", err)
+	}
+	// The capabilities of the backend are detected.
+	if _, err = mediastore.GetMultipartUploader(backend); err != nil {
+		t.Errorf("multipart of the backend: %v", err)
+	}
+}
+
+func TestStoreLegacyMethods(t *testing.T) {
+	svc := newMemoryService(t)
+	mediaStore := newTestStore(t, mediastore.Config{}, svc)
+
+	info, err := mediaStore.Upload("abcdef", strings.NewReader("content"), media.MediaType_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a key layout, the name is the key.
+	if info.Key != "abcdef" {
+		t.Errorf("key: got %q", info.Key)
+	}
+	buf, err := mediaStore.Download(info.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "content" {
+		t.Errorf("content: got %q", buf.String())
+	}
+	if _, err = mediaStore.Download("files/missing"); !errors.Is(err, mediastore.ErrObjectNotFound) {
+		t.Errorf("missing: got %v, want ErrObjectNotFound", err)
+	}
+	publicURL, err := mediaStore.GetPublicURL(info.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if publicURL == "" {
+		t.Error("empty URL")
+	}
+}
+
+// expiryService records the expiry of the public URLs it creates.
+type expiryService struct {
+	mediastore.ServiceV2
+	expiry time.Duration
+}
+
+func (s *expiryService) GetPublicObject(ctx context.Context, key string, opts mediastore.PublicURLOptions) (string, error) {
+	s.expiry = opts.Expiry
+	return s.ServiceV2.GetPublicObject(ctx, key, opts)
+}
+
+func TestPublicURLExpiry(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config time.Duration
+		opts   time.Duration
+		expiry time.Duration
+	}{
+		// The backend applies its own default.
+		{name: "default"},
+		{name: "configured", config: 2 * time.Hour, expiry: 2 * time.Hour},
+		{name: "requested", config: 2 * time.Hour, opts: time.Minute, expiry: time.Minute},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := newMemoryService(t)
+			putObject(t, backend, "key", "content")
+			svc := &expiryService{ServiceV2: backend}
+			mediaStore := newTestStore(t, mediastore.Config{PublicURLExpiry: tc.config}, svc)
+			_, err := mediaStore.GetPublicURLContext(context.Background(), "key",
+				mediastore.PublicURLOptions{Expiry: tc.opts})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if svc.expiry != tc.expiry {
+				t.Errorf("expiry: got %v, want %v", svc.expiry, tc.expiry)
+			}
+		})
+	}
+
+	for _, expiry := range []time.Duration{-time.Second, mediastore.PresignExpiryMax + time.Second} {
+		_, err := mediastore.NewWithService(mediastore.Config{PublicURLExpiry: expiry}, newMemoryService(t))
+		var argErr errors.ArgumentError
+		if !errors.As(err, &argErr) || argErr.ArgumentName() != "config.PublicURLExpiry" {
+			t.Errorf("%v: got %v, want an argument error of config.PublicURLExpiry", expiry, err)
+		}
+	}
+}
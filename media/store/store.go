@@ -2,6 +2,8 @@ package store
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/hex"
 	"io"
 	"strconv"
@@ -15,7 +17,8 @@ import (
 
 type Store struct {
 	config        Config
-	serviceClient Service
+	serviceClient ServiceV2
+	keyLayout     KeyLayout
 }
 
 type Object interface {
@@ -31,32 +34,216 @@ func New(config Config) (*Store, error) {
 	if config.StoreService == "" {
 		return nil, errors.ArgMsg("config.StoreService", "empty")
 	}
+	keyLayout, err := config.KeyLayout.KeyLayout()
+	if err != nil {
+		return nil, errors.ArgWrap("config.KeyLayout", "invalid", err)
+	}
+	if config.PublicURLExpiry < 0 || config.PublicURLExpiry > PresignExpiryMax {
+		return nil, errors.ArgMsg("config.PublicURLExpiry", "out of range")
+	}
 
 	modsAvailable := ModuleNames()
 	modCfg := config.Modules[config.StoreService]
 	if modCfg == nil {
 		return nil, errors.ArgMsg("config.StoreService", config.StoreService+" not configured, availbale StoreService name : "+strings.Join(modsAvailable, ","))
 	}
-	serviceClient, err := NewServiceClient(config.StoreService, modCfg)
+	serviceClient, err := NewServiceClientV2(config.StoreService, modCfg)
 	if err != nil {
 		return nil, errors.ArgWrap("config.StoreService", config.StoreService+" initialization failed", err)
 	}
+	if err = configureService(config, serviceClient); err != nil {
+		return nil, err
+	}
+	if len(config.Lifecycle.Rules) > 0 {
+		if err = config.Lifecycle.Validate(); err != nil {
+			return nil, errors.ArgWrap("config.Lifecycle", "invalid", err)
+		}
+		lifecycleConfigurer, ok := serviceClient.(LifecycleConfigurer)
+		if !ok {
+			return nil, errors.ArgMsg("config.Lifecycle", "not supported by "+config.StoreService)
+		}
+		if err = lifecycleConfigurer.SetLifecycle(context.Background(), config.Lifecycle); err != nil {
+			return nil, errors.ArgWrap("config.Lifecycle", "configuration failed", err)
+		}
+	}
+	if serviceClient, err = decorateService(config, config.StoreService, serviceClient); err != nil {
+		return nil, err
+	}
+
+	return &Store{
+		config:        config,
+		serviceClient: serviceClient,
+		keyLayout:     keyLayout,
+	}, nil
+}
+
+// configureService provides the optional settings of the config to the
+// service.
+func configureService(config Config, serviceClient ServiceV2) error {
+	if baseURLSetter, ok := serviceClient.(PublicBaseURLSetter); ok && config.ImagesBaseURL != "" {
+		if err := baseURLSetter.SetPublicBaseURL(config.ImagesBaseURL); err != nil {
+			return errors.ArgWrap("config.ImagesBaseURL", "invalid", err)
+		}
+	}
+	return nil
+}
+
+// decorateService wraps the service of the backend with the decorators
+// enabled by the config. The instrumentation is the outermost so that it
+// measures the calls as the Store makes them, including the cache hits and
+// the retries.
+func decorateService(config Config, backend string, serviceClient ServiceV2) (ServiceV2, error) {
+	var err error
+	if config.Resilience.Enabled() {
+		serviceClient, err = NewResilientService(serviceClient, config.Resilience)
+		if err != nil {
+			return nil, errors.ArgWrap("config.Resilience", "initialization failed", err)
+		}
+	}
+	if config.Cache.Enabled() {
+		serviceClient, err = NewCachingService(serviceClient, config.Cache)
+		if err != nil {
+			return nil, errors.ArgWrap("config.Cache", "initialization failed", err)
+		}
+	}
+	if config.Instrumentation.Enabled {
+		serviceClient, err = NewInstrumentedService(serviceClient, backend, DefaultMetrics)
+		if err != nil {
+			return nil, errors.ArgWrap("config.Instrumentation", "initialization failed", err)
+		}
+	}
+	return serviceClient, nil
+}
+
+// NewWithService creates a Store which uses the provided service instead
+// of instantiating one from the modules. This is useful for wrapping the
+// service, or to provide a service in tests. The service is used as is,
+// config.Resilience, config.Cache, config.Instrumentation and
+// config.Lifecycle are not applied, but the retention of the lifecycle
+// rules is. See NewInstrumentedService to instrument the service.
+func NewWithService(config Config, serviceClient ServiceV2) (*Store, error) {
+	if serviceClient == nil {
+		return nil, errors.ArgMsg("serviceClient", "missing")
+	}
+	keyLayout, err := config.KeyLayout.KeyLayout()
+	if err != nil {
+		return nil, errors.ArgWrap("config.KeyLayout", "invalid", err)
+	}
+	if config.PublicURLExpiry < 0 || config.PublicURLExpiry > PresignExpiryMax {
+		return nil, errors.ArgMsg("config.PublicURLExpiry", "out of range")
+	}
 
 	return &Store{
 		config:        config,
 		serviceClient: serviceClient,
+		keyLayout:     keyLayout,
 	}, nil
 }
 
+// Upload stores the content as the object named mediaName. See
+// UploadContext.
 func (mediaStore *Store) Upload(
 	mediaName string,
 	contentSource io.Reader,
 	mediaType media.MediaType,
 ) (uploadInfo *UploadInfo, err error) {
-	uploadInfo, err = mediaStore.serviceClient.PutObject(mediaName, contentSource)
+	return mediaStore.UploadContext(context.Background(), mediaName, contentSource, mediaType, PutObjectOptions{})
+}
+
+// UploadContext stores the content as the object named mediaName along
+// with the attributes in opts. If opts.ContentType is empty, it's detected
+// from the head of the content. If the store has a key layout, the key of the
+// object is built from mediaName by the layout, see MediaKey, otherwise
+// mediaName is the key. The key is returned in the UploadInfo.
+//
+// The content of a media type with a media.MediaTypeInfo must comply with
+// the UploadPolicy of the media type, otherwise the returned error is an
+// UploadPolicyError.
+//
+// The upload could be retried by config.Resilience if the content is an
+// io.ReadSeeker, or if it fits in ResilienceConfig.RetryBufferBytes.
+func (mediaStore *Store) UploadContext(
+	ctx context.Context,
+	mediaName string,
+	contentSource io.Reader,
+	mediaType media.MediaType,
+	opts PutObjectOptions,
+) (uploadInfo *UploadInfo, err error) {
+	objectKey, err := mediaStore.MediaKey(ctx, mediaName, mediaType)
 	if err != nil {
+		return nil, err
+	}
+	return mediaStore.upload(ctx, objectKey, contentSource, mediaType, opts)
+}
+
+// UploadObject is like UploadContext but stores the content as the object
+// with the key objectKey, whatever the key layout of the store is, e.g., to
+// copy an object whose key was already built by a layout.
+func (mediaStore *Store) UploadObject(
+	ctx context.Context,
+	objectKey string,
+	contentSource io.Reader,
+	mediaType media.MediaType,
+	opts PutObjectOptions,
+) (uploadInfo *UploadInfo, err error) {
+	if objectKey == "" {
+		return nil, errors.ArgMsg("objectKey", "empty")
+	}
+	return mediaStore.upload(ctx, objectKey, contentSource, mediaType, opts)
+}
+
+func (mediaStore *Store) upload(
+	ctx context.Context,
+	objectKey string,
+	contentSource io.Reader,
+	mediaType media.MediaType,
+	opts PutObjectOptions,
+) (uploadInfo *UploadInfo, err error) {
+	// The checks below read the start of the content and replay it, which
+	// makes the content a plain io.Reader. A seekable content is rewound
+	// instead, so that it stays seekable and its upload could be retried,
+	// see NewResilientService.
+	seeker, isSeeker := contentSource.(io.ReadSeeker)
+	var contentStart int64
+	if isSeeker {
+		if contentStart, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			isSeeker = false
+		}
+	}
+
+	contentSource, limiter, err := mediaStore.enforceUploadPolicy(contentSource, mediaType, &opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ContentType == "" {
+		opts.ContentType, contentSource, err = SniffContentType(contentSource)
+		if err != nil {
+			return nil, errors.Wrap("detecting content type", err)
+		}
+	}
+	if isSeeker {
+		if _, err = seeker.Seek(contentStart, io.SeekStart); err != nil {
+			return nil, errors.Wrap("rewinding content", err)
+		}
+		contentSource = seeker
+		if limiter != nil {
+			limiter = &sizeLimitReader{r: seeker, limit: limiter.limit, remaining: limiter.limit}
+			contentSource = seekableSizeLimitReader{limiter, contentStart}
+		}
+	}
+	opts.Metadata = NormalizeMetadata(opts.Metadata)
+
+	uploadInfo, err = mediaStore.serviceClient.PutObject(ctx, objectKey, contentSource, opts)
+	if err != nil {
+		// The backends don't necessarily keep the error of the content.
+		if limiter != nil && limiter.exceeded {
+			return nil, limiter.policyError()
+		}
 		return nil, errors.Wrap("putting object", err)
 	}
+	if uploadInfo.Key == "" {
+		uploadInfo.Key = objectKey
+	}
 	tNow := time.Now().UTC()
 	if uploadInfo.LastModified.IsZero() {
 		uploadInfo.LastModified = tNow
@@ -65,12 +252,184 @@ func (mediaStore *Store) Upload(
 	return uploadInfo, nil
 }
 
+// GetPublicURL returns a URL which allows anyone to download the object.
+// See GetPublicURLContext.
 func (mediaStore *Store) GetPublicURL(sourceKey string) (publicURL string, err error) {
-	return mediaStore.serviceClient.GetPublicObject(sourceKey)
+	return mediaStore.GetPublicURLContext(context.Background(), sourceKey, PublicURLOptions{})
+}
+
+// GetPublicURLContext returns a URL which allows anyone to download the
+// object until it expires. Config.PublicURLExpiry is used if opts.Expiry
+// is not positive, then the default of the backend.
+func (mediaStore *Store) GetPublicURLContext(
+	ctx context.Context,
+	sourceKey string,
+	opts PublicURLOptions,
+) (publicURL string, err error) {
+	if opts.Expiry <= 0 {
+		opts.Expiry = mediaStore.config.PublicURLExpiry
+	}
+	if opts.Expiry > PresignExpiryMax {
+		return "", errors.ArgMsg("opts.Expiry", "exceeds "+PresignExpiryMax.String())
+	}
+	switch opts.Disposition {
+	case ContentDispositionUnspecified, ContentDispositionInline, ContentDispositionAttachment:
+	default:
+		return "", errors.ArgMsg("opts.Disposition", "unsupported")
+	}
+
+	return mediaStore.serviceClient.GetPublicObject(ctx, sourceKey, opts)
 }
 
+// Download returns the content of the object, which is buffered in
+// memory. See DownloadContext to stream the content instead.
 func (mediaStore *Store) Download(sourceKey string) (buffer *bytes.Buffer, err error) {
-	return mediaStore.serviceClient.GetObject(sourceKey)
+	object, err := mediaStore.DownloadContext(context.Background(), sourceKey)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	buffer = &bytes.Buffer{}
+	if _, err = buffer.ReadFrom(object); err != nil {
+		return nil, errors.Wrap("reading object", err)
+	}
+	return buffer, nil
+}
+
+// DownloadContext returns a stream of the object content along with the
+// object information. The caller is responsible to close the stream.
+func (mediaStore *Store) DownloadContext(ctx context.Context, sourceKey string) (object *ObjectReader, err error) {
+	return mediaStore.serviceClient.GetObject(ctx, sourceKey)
+}
+
+// DownloadRange is like DownloadContext but the stream only contains length
+// bytes starting at offset. A negative length means up to the end of the
+// object. The returned error wraps ErrRangeNotSatisfiable if the offset is
+// not within the object.
+func (mediaStore *Store) DownloadRange(
+	ctx context.Context,
+	sourceKey string,
+	offset, length int64,
+) (object *ObjectReader, err error) {
+	return mediaStore.serviceClient.GetObjectRange(ctx, sourceKey, offset, length)
+}
+
+// ListObjects returns a page of the objects whose key starts with prefix.
+// Pass the NextPageToken of the returned list to retrieve the next page.
+func (mediaStore *Store) ListObjects(
+	ctx context.Context,
+	prefix string,
+	pageToken string,
+	limit int,
+) (*ObjectList, error) {
+	if limit <= 0 {
+		limit = ListObjectsLimitDefault
+	}
+	return mediaStore.serviceClient.ListObjects(ctx, prefix, pageToken, limit)
+}
+
+// Delete removes the object. Deleting an object which does not exist is
+// not an error. The returned error wraps ErrObjectRetained if a lifecycle
+// rule retains the object.
+func (mediaStore *Store) Delete(ctx context.Context, sourceKey string) error {
+	if err := mediaStore.checkRetention(ctx, sourceKey); err != nil {
+		return err
+	}
+	if err := mediaStore.serviceClient.DeleteObject(ctx, sourceKey); err != nil {
+		return errors.Wrap("deleting object", err)
+	}
+	return nil
+}
+
+// Stat returns the information of the object. The returned error wraps
+// ErrObjectNotFound if there's no object with the key.
+func (mediaStore *Store) Stat(ctx context.Context, sourceKey string) (*ObjectInfo, error) {
+	return mediaStore.serviceClient.StatObject(ctx, sourceKey)
+}
+
+// Exists returns true if there's an object with the key.
+func (mediaStore *Store) Exists(ctx context.Context, sourceKey string) (bool, error) {
+	_, err := mediaStore.serviceClient.StatObject(ctx, sourceKey)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// PresignPut creates a request which allows a client to upload the object
+// directly to the storage backend. If contentType is not empty, the
+// upload must have that content type. If maxSize is positive, the content
+// must not be larger than maxSize bytes. PresignExpiryDefault is used if
+// expiry is not positive.
+//
+// If the media type has a media.MediaTypeInfo, contentType is required
+// and must be allowed by the UploadPolicy of the media type, whose
+// maximum size applies if maxSize is larger or not positive. The content
+// itself only reaches the backend, it's not checked against the declared
+// content type nor the image dimension limits.
+func (mediaStore *Store) PresignPut(
+	ctx context.Context,
+	targetKey string,
+	mediaType media.MediaType,
+	contentType string,
+	maxSize int64,
+	expiry time.Duration,
+) (*PresignedRequest, error) {
+	if targetKey == "" {
+		return nil, errors.ArgMsg("targetKey", "empty")
+	}
+	if typeInfo := media.GetMediaTypeInfo(mediaType); typeInfo != nil {
+		policy := mediaStore.config.UploadPolicy.Policy(mediaType)
+		if err := policy.checkDeclaredContentType(typeInfo, mediaType, "contentType", contentType); err != nil {
+			return nil, err
+		}
+		if policy.MaxSizeBytes > 0 && (maxSize <= 0 || maxSize > policy.MaxSizeBytes) {
+			maxSize = policy.MaxSizeBytes
+		}
+	}
+	if expiry <= 0 {
+		expiry = PresignExpiryDefault
+	}
+	if expiry > PresignExpiryMax {
+		return nil, errors.ArgMsg("expiry", "exceeds "+PresignExpiryMax.String())
+	}
+
+	return PresignPutObject(ctx, mediaStore.serviceClient, targetKey, PresignPutOptions{
+		ContentType: contentType,
+		MaxSize:     maxSize,
+		Expiry:      expiry,
+	})
+}
+
+// Copy copies the object, including its attributes, to dstKey without
+// transferring the content through this process.
+func (mediaStore *Store) Copy(ctx context.Context, srcKey, dstKey string) error {
+	if srcKey == dstKey {
+		return errors.ArgMsg("dstKey", "same as srcKey")
+	}
+	if err := CopyObject(ctx, mediaStore.serviceClient, srcKey, dstKey); err != nil {
+		return errors.Wrap("copying object", err)
+	}
+	return nil
+}
+
+// Move moves the object, including its attributes, to dstKey without
+// transferring the content through this process. Like Delete, it fails if
+// a lifecycle rule retains the source object.
+func (mediaStore *Store) Move(ctx context.Context, srcKey, dstKey string) error {
+	if srcKey == dstKey {
+		return errors.ArgMsg("dstKey", "same as srcKey")
+	}
+	if err := mediaStore.checkRetention(ctx, srcKey); err != nil {
+		return err
+	}
+	if err := MoveObject(ctx, mediaStore.serviceClient, srcKey, dstKey); err != nil {
+		return errors.Wrap("moving object", err)
+	}
+	return nil
 }
 
 const nameGenHashLength = 16
@@ -81,10 +440,7 @@ const nameGenKeyDefault = "N0k3y"
 // based on the content. It utilized hash so the result could be used to
 // prevent duplicates when storing the media object
 func (mediaStore *Store) GenerateName(stream io.Reader) string {
-	keyBytes := []byte(mediaStore.config.NameGenerationKey)
-	if len(keyBytes) == 0 {
-		keyBytes = []byte(nameGenKeyDefault)
-	}
+	keyBytes := mediaStore.nameGenKey()
 	hasher, err := blake2b.New(nameGenHashLength, keyBytes)
 	if err != nil {
 		panic(err)
@@ -105,11 +461,157 @@ func (mediaStore *Store) GenerateName(stream io.Reader) string {
 		}
 	}
 
-	hashBytes := hasher.Sum(nil)
+	return encodeGeneratedName(hasher.Sum(nil), keyBytes, int64(dataSize))
+}
+
+func (mediaStore *Store) nameGenKey() []byte {
+	keyBytes := []byte(mediaStore.config.NameGenerationKey)
+	if len(keyBytes) == 0 {
+		keyBytes = []byte(nameGenKeyDefault)
+	}
+	return keyBytes
+}
 
-	encodedHash := hex.EncodeToString(hashBytes) + "K" + hex.EncodeToString(keyBytes[:4]) + "N" + strconv.FormatInt(int64(dataSize), 16)
+func encodeGeneratedName(hashBytes, keyBytes []byte, dataSize int64) string {
+	return hex.EncodeToString(hashBytes) + "K" + hex.EncodeToString(keyBytes[:4]) + "N" + strconv.FormatInt(dataSize, 16)
+}
+
+// ContentName returns the name under which UploadDeduplicated stores the
+// content. Unlike GenerateName, which hashes its whole read buffer
+// whatever the size of the content, it hashes exactly the bytes of the
+// content. Its names mark the size with "S" instead of "N" so that the
+// two formats never collide.
+//
+// The objects stored under a name from GenerateName are not recognized as
+// duplicates by UploadDeduplicated. To have them deduplicated, copy them to
+// their ContentName, and update the references to them.
+func (mediaStore *Store) ContentName(stream io.Reader) (string, error) {
+	keyBytes := mediaStore.nameGenKey()
+	hasher, err := blake2b.New(nameGenHashLength, keyBytes)
+	if err != nil {
+		return "", errors.Wrap("creating hasher", err)
+	}
+	dataSize, err := io.Copy(hasher, stream)
+	if err != nil {
+		return "", errors.Wrap("reading content", err)
+	}
+	return encodeContentName(hasher.Sum(nil), keyBytes, dataSize), nil
+}
+
+func encodeContentName(hashBytes, keyBytes []byte, dataSize int64) string {
+	return hex.EncodeToString(hashBytes) + "K" + hex.EncodeToString(keyBytes[:4]) + "S" + strconv.FormatInt(dataSize, 16)
+}
+
+// dedupTempKeyPrefix is the prefix of the name of the objects which
+// UploadDeduplicated uploads before their content-derived name is known.
+const dedupTempKeyPrefix = ".upload-"
+
+// UploadDeduplicated stores the content under a name derived from the
+// content, the one returned by ContentName, prefixed with keyPrefix.
+// The content is hashed while it's uploaded to a temporary key, which is
+// then moved to the content-derived key. If an object already exists
+// under that key, the upload is discarded and duplicate is true.
+//
+// If the store has a key layout, the content-derived name is laid out like
+// the names passed to Upload, and keyPrefix must be empty. With a layout
+// which includes the upload date, the duplicates are only detected within
+// the same day.
+func (mediaStore *Store) UploadDeduplicated(
+	ctx context.Context,
+	keyPrefix string,
+	contentSource io.Reader,
+	mediaType media.MediaType,
+	opts PutObjectOptions,
+) (uploadInfo *UploadInfo, duplicate bool, err error) {
+	keyBytes := mediaStore.nameGenKey()
+	hasher, err := blake2b.New(nameGenHashLength, keyBytes)
+	if err != nil {
+		return nil, false, errors.Wrap("creating hasher", err)
+	}
+	tempKeyPrefix := keyPrefix
+	if mediaStore.keyLayout != nil {
+		if keyPrefix != "" {
+			return nil, false, errors.ArgMsg("keyPrefix", "not supported with a key layout")
+		}
+		if _, err = mediaDirectoryName(mediaType); err != nil {
+			return nil, false, errors.ArgWrap("mediaType", "not supported with a key layout", err)
+		}
+		// The temporary object is kept along with the target so that
+		// it's isolated the same way, e.g., by tenant.
+		tempKeyPrefix, err = mediaStore.keyLayout.ListPrefix(KeyParams{
+			MediaType: mediaType,
+			Tenant:    TenantFromContext(ctx),
+		})
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	suffix := make([]byte, 16)
+	if _, err = rand.Read(suffix); err != nil {
+		return nil, false, errors.Wrap("generating temporary key", err)
+	}
+	tempKey := tempKeyPrefix + dedupTempKeyPrefix + hex.EncodeToString(suffix)
+
+	counter := &byteCounter{}
+	_, err = mediaStore.upload(ctx, tempKey,
+		io.TeeReader(contentSource, io.MultiWriter(hasher, counter)), mediaType, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	// The temporary object must not outlive the call, whatever happens.
+	defer func() {
+		if err != nil {
+			_ = mediaStore.serviceClient.DeleteObject(context.Background(), tempKey)
+		}
+	}()
+
+	targetKey, err := mediaStore.MediaKey(ctx,
+		keyPrefix+encodeContentName(hasher.Sum(nil), keyBytes, counter.n), mediaType)
+	if err != nil {
+		return nil, false, err
+	}
+	info, err := mediaStore.serviceClient.StatObject(ctx, targetKey)
+	if err == nil {
+		// The temporary object is not subject to the retention.
+		if err = mediaStore.serviceClient.DeleteObject(ctx, tempKey); err != nil {
+			return nil, false, errors.Wrap("deleting object", err)
+		}
+		return &UploadInfo{
+			Key:          targetKey,
+			ETag:         info.ETag,
+			LastModified: info.LastModified,
+			Size:         int(info.Size),
+		}, true, nil
+	}
+	if !errors.Is(err, ErrObjectNotFound) {
+		return nil, false, errors.Wrap("checking duplicate", err)
+	}
+
+	// Concurrent uploads of the same content might both get here, which
+	// is harmless as they move the same content.
+	if err = MoveObject(ctx, mediaStore.serviceClient, tempKey, targetKey); err != nil {
+		return nil, false, errors.Wrap("moving object", err)
+	}
+	info, err = mediaStore.serviceClient.StatObject(ctx, targetKey)
+	if err != nil {
+		return nil, false, errors.Wrap("getting object info", err)
+	}
+	return &UploadInfo{
+		Key:          targetKey,
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+		Size:         int(info.Size),
+	}, false, nil
+}
+
+// byteCounter is a writer which only counts the bytes written to it.
+type byteCounter struct {
+	n int64
+}
 
-	return encodedHash
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
 }
 
 func ContentTypeInList(contentType string, contentTypeList []string) bool {
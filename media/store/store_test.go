@@ -1 +1,65 @@
-package store
+package store_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	mediastore "github.com/timemore/foundation/media/store"
+	"github.com/timemore/foundation/media/store/memory"
+)
+
+func newMemoryService(t *testing.T) *memory.Service {
+	t.Helper()
+	svc, err := memory.NewServiceV2(&memory.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc.(*memory.Service)
+}
+
+func newTestStore(t *testing.T, config mediastore.Config, svc mediastore.ServiceV2) *mediastore.Store {
+	t.Helper()
+	mediaStore, err := mediastore.NewWithService(config, svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mediaStore
+}
+
+func putObject(t *testing.T, svc mediastore.ServiceV2, key, content string) {
+	t.Helper()
+	_, err := svc.PutObject(context.Background(), key, strings.NewReader(content), mediastore.PutObjectOptions{})
+	if err != nil {
+		t.Fatalf("PutObject(%q): %v", key, err)
+	}
+}
+
+// readObject returns the content of the object, or fails the test.
+func readObject(t *testing.T, svc mediastore.ServiceV2, key string) string {
+	t.Helper()
+	obj, err := svc.GetObject(context.Background(), key)
+	if err != nil {
+		t.Fatalf("GetObject(%q): %v", key, err)
+	}
+	defer obj.Close()
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		t.Fatalf("reading %q: %v", key, err)
+	}
+	return string(b)
+}
+
+func objectKeys(t *testing.T, svc mediastore.ServiceV2, prefix string) []string {
+	t.Helper()
+	list, err := svc.ListObjects(context.Background(), prefix, "", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, obj := range list.Objects {
+		keys = append(keys, obj.Key)
+	}
+	return keys
+}
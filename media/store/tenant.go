@@ -0,0 +1,204 @@
+package store
+
+import (
+	"context"
+	"sync"
+
+	"github.com/timemore/foundation/errors"
+)
+
+// ErrTenantNotFound should be returned, wrapped, by a TenantResolver when
+// the tenant does not exist.
+var ErrTenantNotFound = errors.Msg("tenant not found")
+
+// TenantBackend describes where the objects of a tenant are stored.
+type TenantBackend struct {
+	// StoreService is the name of the module of a backend dedicated to
+	// the tenant, e.g., with its own bucket and credentials, which is
+	// configured with ModuleConfig. The tenant shares the backend of the
+	// TenantStore if it's empty.
+	StoreService string
+	ModuleConfig ServiceConfig
+
+	// KeyPrefix is the prefix under which the objects of the tenant are
+	// kept. On the shared backend, it defaults to the tenant ID. On a
+	// dedicated backend, the keys are not prefixed if it's empty.
+	KeyPrefix string
+}
+
+// TenantResolver resolves the backend of a tenant.
+type TenantResolver interface {
+	ResolveTenant(ctx context.Context, tenantID string) (*TenantBackend, error)
+}
+
+// TenantResolverFunc adapts a function to a TenantResolver.
+type TenantResolverFunc func(ctx context.Context, tenantID string) (*TenantBackend, error)
+
+func (fn TenantResolverFunc) ResolveTenant(ctx context.Context, tenantID string) (*TenantBackend, error) {
+	return fn(ctx, tenantID)
+}
+
+// TenantStore provides a Store for each tenant. The backend of a tenant is
+// resolved, and its service created, on the first use and then cached
+// until Evict is called. The keys of a tenant are relative to its prefix,
+// which they could not escape, so that a tenant is never able to reach the
+// objects of another one.
+type TenantStore struct {
+	config    Config
+	resolver  TenantResolver
+	keyLayout KeyLayout
+
+	// shared is the backend of the tenants without a dedicated one. It's
+	// nil if the config has no StoreService.
+	shared ServiceV2
+
+	mu     sync.Mutex
+	stores map[string]*tenantStoreEntry
+}
+
+type tenantStoreEntry struct {
+	ready chan struct{}
+	store *Store
+	err   error
+}
+
+// NewTenantStore creates a TenantStore. The shared backend is the one
+// selected by config.StoreService, if any. The decorators of the config,
+// e.g., the cache, are applied once to the shared backend and to each
+// dedicated backend. The lifecycle rules are not supported as they would
+// apply to the buckets of the tenants rather than to their keys.
+func NewTenantStore(config Config, resolver TenantResolver) (*TenantStore, error) {
+	if resolver == nil {
+		return nil, errors.ArgMsg("resolver", "missing")
+	}
+	if len(config.Lifecycle.Rules) > 0 {
+		return nil, errors.ArgMsg("config.Lifecycle", "not supported by the tenant store")
+	}
+	keyLayout, err := config.KeyLayout.KeyLayout()
+	if err != nil {
+		return nil, errors.ArgWrap("config.KeyLayout", "invalid", err)
+	}
+
+	ts := &TenantStore{
+		config:    config,
+		resolver:  resolver,
+		keyLayout: keyLayout,
+		stores:    map[string]*tenantStoreEntry{},
+	}
+	if config.StoreService != "" {
+		modCfg := config.Modules[config.StoreService]
+		if modCfg == nil {
+			return nil, errors.ArgMsg("config.StoreService", config.StoreService+" not configured")
+		}
+		ts.shared, err = ts.newService(config.StoreService, modCfg)
+		if err != nil {
+			return nil, errors.ArgWrap("config.StoreService", config.StoreService+" initialization failed", err)
+		}
+	}
+	return ts, nil
+}
+
+// StoreFromContext is like Store for the tenant of the context. See
+// ContextWithTenant.
+func (ts *TenantStore) StoreFromContext(ctx context.Context) (*Store, error) {
+	return ts.Store(ctx, TenantFromContext(ctx))
+}
+
+// Store returns the Store of the tenant. The returned error wraps the
+// error of the resolver, e.g., ErrTenantNotFound, if the tenant could not
+// be resolved. The failures are not cached.
+func (ts *TenantStore) Store(ctx context.Context, tenantID string) (*Store, error) {
+	if err := checkKeySegment("tenantID", tenantID); err != nil {
+		return nil, err
+	}
+
+	ts.mu.Lock()
+	entry, ok := ts.stores[tenantID]
+	if !ok {
+		entry = &tenantStoreEntry{ready: make(chan struct{})}
+		ts.stores[tenantID] = entry
+	}
+	ts.mu.Unlock()
+
+	if ok {
+		select {
+		case <-entry.ready:
+			if entry.err == nil {
+				return entry.store, nil
+			}
+			// The failed entry has been removed, try again.
+			return ts.Store(ctx, tenantID)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	entry.store, entry.err = ts.newStore(ctx, tenantID)
+	if entry.err != nil {
+		ts.mu.Lock()
+		if ts.stores[tenantID] == entry {
+			delete(ts.stores, tenantID)
+		}
+		ts.mu.Unlock()
+	}
+	close(entry.ready)
+	return entry.store, entry.err
+}
+
+// Evict discards the cached Store of the tenant so that its backend is
+// resolved again on the next use, e.g., after its credentials changed.
+func (ts *TenantStore) Evict(tenantID string) {
+	ts.mu.Lock()
+	delete(ts.stores, tenantID)
+	ts.mu.Unlock()
+}
+
+func (ts *TenantStore) newStore(ctx context.Context, tenantID string) (*Store, error) {
+	backend, err := ts.resolver.ResolveTenant(ctx, tenantID)
+	if err != nil {
+		return nil, errors.Wrap("resolving tenant "+tenantID, err)
+	}
+	if backend == nil {
+		return nil, errors.Wrap(tenantID, ErrTenantNotFound)
+	}
+
+	var serviceClient ServiceV2
+	keyPrefix := backend.KeyPrefix
+	if backend.StoreService == "" {
+		if ts.shared == nil {
+			return nil, errors.ArgMsg("StoreService", "empty without a shared backend")
+		}
+		serviceClient = ts.shared
+		if keyPrefix == "" {
+			keyPrefix = tenantID
+		}
+	} else {
+		serviceClient, err = ts.newService(backend.StoreService, backend.ModuleConfig)
+		if err != nil {
+			return nil, errors.ArgWrap("StoreService", backend.StoreService+" initialization failed", err)
+		}
+	}
+	if keyPrefix != "" {
+		serviceClient, err = NewPrefixedService(serviceClient, keyPrefix)
+		if err != nil {
+			return nil, errors.ArgWrap("KeyPrefix", "invalid", err)
+		}
+	}
+
+	return &Store{
+		config:        ts.config,
+		serviceClient: serviceClient,
+		keyLayout:     ts.keyLayout,
+	}, nil
+}
+
+func (ts *TenantStore) newService(serviceName string, modCfg ServiceConfig) (ServiceV2, error) {
+	serviceClient, err := NewServiceClientV2(serviceName, modCfg)
+	if err != nil {
+		return nil, err
+	}
+	if err = configureService(ts.config, serviceClient); err != nil {
+		return nil, err
+	}
+	return decorateService(ts.config, serviceName, serviceClient)
+}
@@ -0,0 +1,230 @@
+package store_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/timemore/foundation/errors"
+	"github.com/timemore/foundation/media"
+	mediastore "github.com/timemore/foundation/media/store"
+	"github.com/timemore/foundation/media/store/memory"
+)
+
+// countingResolver resolves the tenants of backends, and counts the calls
+// for each tenant.
+type countingResolver struct {
+	backends map[string]*mediastore.TenantBackend
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (r *countingResolver) ResolveTenant(ctx context.Context, tenantID string) (*mediastore.TenantBackend, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.calls == nil {
+		r.calls = map[string]int{}
+	}
+	r.calls[tenantID]++
+	backend, ok := r.backends[tenantID]
+	if !ok {
+		return nil, errors.Wrap(tenantID, mediastore.ErrTenantNotFound)
+	}
+	return backend, nil
+}
+
+func (r *countingResolver) callCount(tenantID string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls[tenantID]
+}
+
+func newTestTenantStore(t *testing.T) (*mediastore.TenantStore, *countingResolver) {
+	t.Helper()
+	resolver := &countingResolver{backends: map[string]*mediastore.TenantBackend{
+		"acme":    {},
+		"globex":  {},
+		"initech": {StoreService: memory.ServiceName, ModuleConfig: &memory.Config{}},
+	}}
+	ts, err := mediastore.NewTenantStore(mediastore.Config{
+		StoreService: memory.ServiceName,
+		Modules:      map[string]any{memory.ServiceName: &memory.Config{}},
+	}, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts, resolver
+}
+
+func tenantStore(t *testing.T, ts *mediastore.TenantStore, tenantID string) *mediastore.Store {
+	t.Helper()
+	mediaStore, err := ts.Store(context.Background(), tenantID)
+	if err != nil {
+		t.Fatalf("Store(%q): %v", tenantID, err)
+	}
+	return mediaStore
+}
+
+func TestTenantStoreIsolation(t *testing.T) {
+	ts, _ := newTestTenantStore(t)
+	ctx := context.Background()
+	for _, tenantID := range []string{"acme", "initech"} {
+		_, err := tenantStore(t, ts, tenantID).UploadObject(ctx, "dir/key", strings.NewReader(tenantID),
+			media.MediaType_MEDIA_TYPE_UNSPECIFIED, mediastore.PutObjectOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		tenantID string
+		content  string
+	}{
+		{"acme", "acme"},
+		{"globex", ""},
+		{"initech", "initech"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.tenantID, func(t *testing.T) {
+			mediaStore := tenantStore(t, ts, tc.tenantID)
+			list, err := mediaStore.ListObjects(ctx, "", "", 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.content == "" {
+				if len(list.Objects) != 0 {
+					t.Errorf("got the objects of another tenant: %+v", list.Objects)
+				}
+				return
+			}
+			if len(list.Objects) != 1 || list.Objects[0].Key != "dir/key" {
+				t.Fatalf("listed: got %+v", list.Objects)
+			}
+			obj, err := mediaStore.DownloadContext(ctx, "dir/key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer obj.Close()
+			if obj.Info.Key != "dir/key" {
+				t.Errorf("key: got %q", obj.Info.Key)
+			}
+			b, err := io.ReadAll(obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.content {
+				t.Errorf("content: got %q, want %q", b, tc.content)
+			}
+		})
+	}
+}
+
+func TestTenantStoreEscape(t *testing.T) {
+	ts, _ := newTestTenantStore(t)
+	ctx := context.Background()
+	_, err := tenantStore(t, ts, "acme").UploadObject(ctx, "key", strings.NewReader("acme"),
+		media.MediaType_MEDIA_TYPE_UNSPECIFIED, mediastore.PutObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	globex := tenantStore(t, ts, "globex")
+
+	testCases := []struct {
+		name string
+		call func() error
+	}{
+		{"download", func() error {
+			obj, err := globex.DownloadContext(ctx, "../acme/key")
+			if err == nil {
+				obj.Close()
+			}
+			return err
+		}},
+		{"stat", func() error {
+			_, err := globex.Stat(ctx, "../acme/key")
+			return err
+		}},
+		{"delete", func() error { return globex.Delete(ctx, "../acme/key") }},
+		{"copy", func() error { return globex.Copy(ctx, "../acme/key", "stolen") }},
+		{"upload", func() error {
+			_, err := globex.UploadObject(ctx, "../acme/key", strings.NewReader("globex"),
+				media.MediaType_MEDIA_TYPE_UNSPECIFIED, mediastore.PutObjectOptions{})
+			return err
+		}},
+		{"list", func() error {
+			_, err := globex.ListObjects(ctx, "../acme/", "", 100)
+			return err
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.call()
+			var argErr errors.ArgumentError
+			if !errors.As(err, &argErr) || !strings.Contains(err.Error(), "outside of the prefix") {
+				t.Errorf("got %v, want an argument error outside of the prefix", err)
+			}
+		})
+	}
+
+	obj, err := tenantStore(t, ts, "acme").DownloadContext(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	if b, err := io.ReadAll(obj); err != nil || string(b) != "acme" {
+		t.Errorf("object of the other tenant changed: %q, %v", b, err)
+	}
+}
+
+func TestTenantStoreResolution(t *testing.T) {
+	ts, resolver := newTestTenantStore(t)
+	ctx := context.Background()
+
+	// The store is cached until it's evicted.
+	first := tenantStore(t, ts, "acme")
+	if second := tenantStore(t, ts, "acme"); second != first {
+		t.Error("store not cached")
+	}
+	if got := resolver.callCount("acme"); got != 1 {
+		t.Errorf("resolved %d times, want once", got)
+	}
+	ts.Evict("acme")
+	if third := tenantStore(t, ts, "acme"); third == first {
+		t.Error("store not evicted")
+	}
+	if got := resolver.callCount("acme"); got != 2 {
+		t.Errorf("resolved %d times after the eviction, want twice", got)
+	}
+
+	// The tenant of the context is used.
+	fromCtx, err := ts.StoreFromContext(mediastore.ContextWithTenant(ctx, "acme"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromCtx != tenantStore(t, ts, "acme") {
+		t.Error("store of the context differs")
+	}
+
+	// The failures are not cached.
+	for i := 1; i <= 2; i++ {
+		if _, err = ts.Store(ctx, "unknown"); !errors.Is(err, mediastore.ErrTenantNotFound) {
+			t.Fatalf("got %v, want ErrTenantNotFound", err)
+		}
+		if got := resolver.callCount("unknown"); got != i {
+			t.Errorf("resolved %d times, want %d", got, i)
+		}
+	}
+
+	for _, tenantID := range []string{"", "..", "a/b", ".hidden"} {
+		var argErr errors.ArgumentError
+		if _, err = ts.Store(ctx, tenantID); !errors.As(err, &argErr) || argErr.ArgumentName() != "tenantID" {
+			t.Errorf("%q: got %v, want an argument error of tenantID", tenantID, err)
+		}
+	}
+	if _, err = ts.StoreFromContext(ctx); err == nil {
+		t.Error("no error without a tenant in the context")
+	}
+}